@@ -0,0 +1,65 @@
+package admin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"ljightningparking/clock"
+	"sync"
+	"time"
+)
+
+const SessionCookie = "admin_session"
+
+const sessionLifetime = 12 * time.Hour
+
+type session struct {
+	name    string
+	expires time.Time
+}
+
+var sessions = struct {
+	byToken map[string]session
+	sync.Mutex
+}{byToken: make(map[string]session)}
+
+// NewSession starts a dashboard session for a logged in admin user.
+func NewSession(name string) (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	now := clock.Now()
+	for t, s := range sessions.byToken {
+		if now.After(s.expires) {
+			delete(sessions.byToken, t)
+		}
+	}
+	sessions.byToken[token] = session{name, now.Add(sessionLifetime)}
+
+	return token, nil
+}
+
+// SessionUser returns the admin user a session token belongs to.
+func SessionUser(token string) (string, bool) {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	s, ok := sessions.byToken[token]
+	if !ok || clock.Now().After(s.expires) {
+		return "", false
+	}
+	return s.name, true
+}
+
+func EndSession(token string) {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	delete(sessions.byToken, token)
+}
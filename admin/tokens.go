@@ -0,0 +1,170 @@
+package admin
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"ljightningparking/clock"
+	"ljightningparking/store"
+	"log"
+	"strings"
+	"time"
+)
+
+// Scopes of API tokens, each allowing reading one group of endpoints for
+// someone who should not have the whole admin, like an accountant.
+const (
+	ScopeExport      = "export:read"
+	ScopeEnforcement = "enforcement:lookup"
+	ScopeStats       = "stats:read"
+)
+
+var Scopes = []string{ScopeExport, ScopeEnforcement, ScopeStats}
+
+const tokenPrefix = "ljp_"
+
+// APIToken is a scoped token as listed to admins, the token itself is only
+// shown when it is issued.
+type APIToken struct {
+	ID         int64        `json:"id"`
+	Name       string       `json:"name"`
+	Scopes     []string     `json:"scopes"`
+	CreatedBy  string       `json:"created_by"`
+	CreatedAt  time.Time    `json:"created_at"`
+	ExpiresAt  time.Time    `json:"expires_at"`
+	RevokedAt  sql.NullTime `json:"-"`
+	LastUsedAt sql.NullTime `json:"-"`
+}
+
+// Valid reports whether the token is neither revoked nor expired at now.
+func (t APIToken) Valid(now time.Time) bool {
+	return !t.RevokedAt.Valid && now.Before(t.ExpiresAt)
+}
+
+// Allows reports whether the token has scope.
+func (t APIToken) Allows(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IssueToken creates a token for name with scopes, valid until expires. Only
+// a hash of it is stored.
+func IssueToken(name string, scopes []string, expires time.Time, by string) (string, error) {
+	name = strings.TrimSpace(name)
+	if len(name) == 0 || len(scopes) == 0 {
+		return "", errors.New("a token needs a name and at least one scope")
+	}
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			return "", errors.New("unknown scope " + scope)
+		}
+	}
+	if !expires.After(clock.Now()) {
+		return "", errors.New("a token must expire in the future")
+	}
+
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	token := tokenPrefix + hex.EncodeToString(b)
+
+	_, err = store.Exec("INSERT INTO api_tokens (name, token_hash, scopes, created_by, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		name, hashToken(token), strings.Join(scopes, " "), by, clock.Now(), expires)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// lastUsedResolution is how precisely a token's last use is recorded, so
+// reads by a busy token don't each write.
+const lastUsedResolution = time.Hour
+
+// LookupToken returns the valid token a request presented, recording to the
+// hour when it was last used.
+func LookupToken(token string) (APIToken, bool) {
+	if store.DB == nil || !strings.HasPrefix(token, tokenPrefix) {
+		return APIToken{}, false
+	}
+
+	t, err := scanToken(store.QueryRow("SELECT "+tokenColumns+" FROM api_tokens WHERE token_hash = ?", hashToken(token)))
+	if err != nil || !t.Valid(clock.Now()) {
+		return APIToken{}, false
+	}
+
+	now := clock.Now()
+	if t.LastUsedAt.Valid && now.Sub(t.LastUsedAt.Time) < lastUsedResolution {
+		return t, true
+	}
+	_, err = store.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", now, t.ID)
+	if err != nil {
+		log.Printf("Error recording use of api token %d: %s", t.ID, err)
+	}
+	return t, true
+}
+
+// ListTokens returns all tokens, newest first.
+func ListTokens() ([]APIToken, error) {
+	rows, err := store.Query("SELECT " + tokenColumns + " FROM api_tokens ORDER BY id DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeToken stops a token from working, reporting whether it still did.
+func RevokeToken(id int64) (bool, error) {
+	result, err := store.Exec("UPDATE api_tokens SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", clock.Now(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+const tokenColumns = "id, name, scopes, created_by, created_at, expires_at, revoked_at, last_used_at"
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanToken(row scanner) (APIToken, error) {
+	var t APIToken
+	var scopes string
+	err := row.Scan(&t.ID, &t.Name, &scopes, &t.CreatedBy, &t.CreatedAt, &t.ExpiresAt, &t.RevokedAt, &t.LastUsedAt)
+	t.Scopes = strings.Fields(scopes)
+	return t, err
+}
+
+func validScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// hashToken is enough for tokens, unlike passwords they are random and long.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,123 @@
+package admin
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"ljightningparking/clock"
+	"ljightningparking/pbkdf2"
+	"ljightningparking/store"
+	"strconv"
+	"strings"
+)
+
+const (
+	hashIterations = 600000
+	hashLength     = 32
+)
+
+var ErrInvalidLogin = errors.New("invalid name, password or code")
+
+// AddUser creates an admin user and returns the TOTP secret to enroll in an
+// authenticator app.
+func AddUser(name, password string) (string, error) {
+	if len(name) == 0 || len(password) < 12 {
+		return "", errors.New("name is required and password must have at least 12 characters")
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		return "", err
+	}
+
+	secret, err := newTotpSecret()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = store.Exec("INSERT INTO admin_users (name, password_hash, totp_secret, created_at) VALUES (?, ?, ?, ?)",
+		name, hash, secret, clock.Now())
+	if err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+// Authenticate checks the password and the current TOTP code of an admin user.
+func Authenticate(name, password, code string) error {
+	var hash, secret string
+	err := store.QueryRow("SELECT password_hash, totp_secret FROM admin_users WHERE name = ?", name).Scan(&hash, &secret)
+	if err == sql.ErrNoRows {
+		return ErrInvalidLogin
+	}
+	if err != nil {
+		return err
+	}
+
+	if !checkPassword(hash, password) {
+		return ErrInvalidLogin
+	}
+	step, ok := validTotp(secret, code, clock.Now())
+	if !ok {
+		return ErrInvalidLogin
+	}
+
+	// a code is only good once, nor is an older one after it
+	result, err := store.Exec("UPDATE admin_users SET totp_step = ? WHERE name = ? AND totp_step < ?", step, name, step)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return ErrInvalidLogin
+	}
+	return nil
+}
+
+// hashPassword returns pbkdf2-sha256$iterations$salt$hash.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, hashIterations, hashLength)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", hashIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func checkPassword(encoded, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(expected))
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
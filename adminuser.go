@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"ljightningparking/admin"
+	"ljightningparking/store"
+	"log"
+	"os"
+	"strings"
+)
+
+// runAddAdmin creates a dashboard admin user and prints the TOTP secret to
+// enroll in an authenticator app.
+func runAddAdmin(args []string) {
+	fs := flag.NewFlagSet("add-admin", flag.ExitOnError)
+	dbPath := fs.String("db", "ljightningparking.db", "sqlite database path")
+	name := fs.String("name", "", "admin user name")
+	fs.Parse(args)
+
+	err := store.Open(*dbPath, store.DefaultOptions)
+	if err != nil {
+		log.Fatalf("error opening database: %s", err)
+	}
+	defer store.DB.Close()
+
+	fmt.Print("Password: ")
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		log.Fatalf("error reading password: %s", err)
+	}
+
+	secret, err := admin.AddUser(*name, strings.TrimRight(password, "\r\n"))
+	if err != nil {
+		log.Fatalf("error adding admin user: %s", err)
+	}
+
+	fmt.Printf("TOTP secret: %s\n%s\n", secret, admin.TotpURI(*name, secret))
+}
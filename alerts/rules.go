@@ -0,0 +1,94 @@
+package alerts
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+)
+
+// Thresholds are the operator tunable limits the recommended alerting rules
+// are generated from.
+type Thresholds struct {
+	BalanceEur           float64
+	GatewayDown          time.Duration
+	SettlementLatency    time.Duration
+	ParseFailuresPerHour int64
+	// SettleLag is how many settled invoices processing may be behind lnd
+	// for SettleLagFor.
+	SettleLag    int64
+	SettleLagFor time.Duration
+}
+
+var Config = Thresholds{
+	BalanceEur:           5,
+	GatewayDown:          5 * time.Minute,
+	SettlementLatency:    time.Minute,
+	ParseFailuresPerHour: 3,
+	SettleLag:            0,
+	SettleLagFor:         5 * time.Minute,
+}
+
+var rulesTemplate = template.Must(template.New("rules").Funcs(template.FuncMap{
+	"duration": promDuration,
+	"seconds":  func(d time.Duration) string { return fmt.Sprintf("%g", d.Seconds()) },
+}).Parse(`groups:
+  - name: ljightningparking
+    rules:
+      - alert: OperatorBalanceLow
+        expr: ljp_operator_balance_eur < {{.BalanceEur}}
+        for: 10m
+        labels:
+          severity: warning
+        annotations:
+          summary: "SMS parking operator balance is below {{.BalanceEur}} EUR"
+      - alert: SmsGatewayOffline
+        expr: ljp_sms_gateway_up == 0
+        for: {{duration .GatewayDown}}
+        labels:
+          severity: critical
+        annotations:
+          summary: "SMS gateway has been unreachable for {{duration .GatewayDown}}"
+      - alert: SettlementLatencyHigh
+        expr: histogram_quantile(0.95, sum(rate(ljp_settlement_sms_seconds_bucket[15m])) by (le)) > {{seconds .SettlementLatency}}
+        for: 15m
+        labels:
+          severity: warning
+        annotations:
+          summary: "95th percentile time from settlement to parking SMS is above {{duration .SettlementLatency}}"
+      - alert: SmsParseFailures
+        expr: increase(ljp_sms_parse_failures_total[1h]) > {{.ParseFailuresPerHour}}
+        labels:
+          severity: warning
+        annotations:
+          summary: "More than {{.ParseFailuresPerHour}} operator SMS replies could not be parsed in the last hour"
+      - alert: InvoiceConsumerLag
+        expr: ljp_invoice_settle_lag > {{.SettleLag}}
+        for: {{duration .SettleLagFor}}
+        labels:
+          severity: critical
+        annotations:
+          summary: "Settled invoices have not been processed for {{duration .SettleLagFor}}, check the invoice subscription and SMS queue"
+`))
+
+// Rules renders the recommended Prometheus alerting rules for the given thresholds.
+func Rules(t Thresholds) ([]byte, error) {
+	var buf bytes.Buffer
+	err := rulesTemplate.Execute(&buf, t)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// promDuration formats d the way prometheus expects durations, e.g. 90s or 5m.
+func promDuration(d time.Duration) string {
+	switch {
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+}
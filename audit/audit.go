@@ -0,0 +1,99 @@
+package audit
+
+import (
+	"ljightningparking/clock"
+	"ljightningparking/money"
+	"log"
+	"time"
+)
+
+type Kind string
+
+const (
+	// Audit entries record what happened, ledger entries record money moving.
+	Audit  Kind = "audit"
+	Ledger Kind = "ledger"
+)
+
+type Entry struct {
+	Time        time.Time   `json:"time"`
+	Kind        Kind        `json:"kind"`
+	Action      string      `json:"action"`
+	PaymentHash string      `json:"payment_hash,omitempty"`
+	Zone        string      `json:"zone,omitempty"`
+	Plate       string      `json:"plate,omitempty"`
+	Sats        int64       `json:"sats,omitempty"`
+	Eur         money.Cents `json:"eur,omitempty"`
+	Detail      string      `json:"detail,omitempty"`
+}
+
+// Sink is an external append-only destination entries are streamed to.
+type Sink interface {
+	Write(e Entry) error
+}
+
+const (
+	queueSize   = 1024
+	maxAttempts = 5
+)
+
+var (
+	sinks []Sink
+	queue = make(chan Entry, queueSize)
+)
+
+// AddSink registers a sink. It must be called before Start.
+func AddSink(s Sink) {
+	sinks = append(sinks, s)
+}
+
+// Start streams recorded entries to the registered sinks in the background.
+func Start() {
+	if len(sinks) == 0 {
+		return
+	}
+	go run()
+}
+
+// Record queues an entry for the external sinks without blocking the caller.
+func Record(e Entry) {
+	if e.Time.IsZero() {
+		e.Time = clock.Now()
+	}
+	e.Time = e.Time.UTC()
+
+	if len(sinks) == 0 {
+		return
+	}
+
+	select {
+	case queue <- e:
+	default:
+		log.Printf("audit queue full, dropping %s entry %s %s", e.Kind, e.Action, e.PaymentHash)
+	}
+}
+
+func run() {
+	for e := range queue {
+		for _, s := range sinks {
+			write(s, e)
+		}
+	}
+}
+
+func write(s Sink, e Entry) {
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err := s.Write(e)
+		if err == nil {
+			return
+		}
+		if attempt == maxAttempts {
+			log.Printf("giving up writing audit entry %s %s: %s", e.Action, e.PaymentHash, err)
+			return
+		}
+		log.Printf("error writing audit entry, retrying: %s", err)
+		<-clock.After(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,199 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"ljightningparking/clock"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3Sink spools the entries of the current UTC day to a local file and uploads
+// it as one object per day once the day is over. Combined with object lock on
+// the bucket the uploaded days can not be altered anymore.
+type S3Sink struct {
+	Endpoint  string // e.g. https://s3.eu-central-1.amazonaws.com/bucket/prefix
+	Region    string
+	AccessKey string
+	SecretKey string
+	SpoolDir  string
+	Client    http.Client
+
+	day       string
+	uploading bool
+	failed    bool
+	failedAt  time.Time
+	sync.Mutex
+}
+
+// uploadRetry is how long after a failed upload it is tried again.
+const uploadRetry = 5 * time.Minute
+
+func NewS3Sink(endpoint, region, spoolDir string) *S3Sink {
+	return &S3Sink{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Region:    region,
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SpoolDir:  spoolDir,
+		Client:    http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Write spools the entry, then starts uploading the days before today in
+// the background. Failed uploads stay spooled and are retried on a later
+// write, they don't fail the entry.
+func (s *S3Sink) Write(e Entry) error {
+	s.Lock()
+	defer s.Unlock()
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	today := clock.Now().UTC().Format("2006-01-02")
+	day := e.Time.UTC().Format("2006-01-02")
+	if day < today {
+		// recorded before midnight, the earlier days may be uploading
+		day = today
+	}
+	f, err := os.OpenFile(s.spoolPath(day), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if !s.uploading && (s.day != today || s.failed && clock.Since(s.failedAt) >= uploadRetry) {
+		s.day = today
+		s.uploading = true
+		go s.uploadInBackground(today)
+	}
+	return nil
+}
+
+// uploadInBackground uploads the days before today without holding up the
+// writes, nothing is spooled to them anymore.
+func (s *S3Sink) uploadInBackground(today string) {
+	err := s.uploadSpooled(today)
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.uploading = false
+	s.failed = err != nil
+	if s.failed {
+		s.failedAt = clock.Now()
+		log.Printf("error uploading audit log to s3, retrying later: %s", err)
+	}
+}
+
+func (s *S3Sink) spoolPath(day string) string {
+	return filepath.Join(s.SpoolDir, "audit-"+day+".jsonl")
+}
+
+// uploadSpooled uploads the days spooled before today, returning the first
+// error.
+func (s *S3Sink) uploadSpooled(today string) error {
+	files, err := filepath.Glob(filepath.Join(s.SpoolDir, "audit-*.jsonl"))
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		day := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(f), "audit-"), ".jsonl")
+		if day >= today {
+			continue
+		}
+		uploadErr := s.upload(day)
+		if err == nil {
+			err = uploadErr
+		}
+	}
+	return err
+}
+
+func (s *S3Sink) upload(day string) error {
+	body, err := ioutil.ReadFile(s.spoolPath(day))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", s.Endpoint+"/"+day+".jsonl", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	s.sign(req, body, clock.Now().UTC())
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("s3 upload of %s returned %d", day, resp.StatusCode)
+	}
+
+	return os.Remove(s.spoolPath(day))
+}
+
+// sign adds an AWS signature version 4 authorization header to req.
+func (s *S3Sink) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		(&url.URL{Path: req.URL.Path}).EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\n" + "x-amz-content-sha256:" + payloadHash + "\n" + "x-amz-date:" + amzDate + "\n",
+		"host;x-amz-content-sha256;x-amz-date",
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSha256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSha256(key, s.Region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=%s",
+		s.AccessKey, scope, hex.EncodeToString(hmacSha256(key, stringToSign))))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,59 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"time"
+)
+
+// HTTPSink posts every entry as json to a remote collector.
+type HTTPSink struct {
+	URL    string
+	Client http.Client
+}
+
+func NewHTTPSink(url string) *HTTPSink {
+	return &HTTPSink{URL: url, Client: http.Client{Timeout: 10 * time.Second}}
+}
+
+func (s *HTTPSink) Write(e Entry) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.Client.Post(s.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SyslogSink sends every entry as a json line to a remote syslog server.
+type SyslogSink struct {
+	writer *syslog.Writer
+}
+
+func NewSyslogSink(network, address string) (*SyslogSink, error) {
+	w, err := syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_LOCAL0, "ljightningparking")
+	if err != nil {
+		return nil, err
+	}
+	return &SyslogSink{w}, nil
+}
+
+func (s *SyslogSink) Write(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.writer.Info(string(line))
+}
@@ -0,0 +1,86 @@
+package balance
+
+import (
+	"database/sql"
+	"fmt"
+	"ljightningparking/alerts"
+	"ljightningparking/clock"
+	"ljightningparking/metrics"
+	"ljightningparking/sms"
+	"ljightningparking/store"
+	"time"
+)
+
+// Inquiry is the SMS asking SMS parking for the account balance, answered by
+// a "Stanje" reply.
+const Inquiry = "Stanje"
+
+// MaxAge is how old the last known balance may get. Older balances are
+// refreshed with an inquiry and alerted on as stale.
+var MaxAge = 6 * time.Hour
+
+func init() {
+	metrics.GaugeFunc("ljp_operator_balance_eur", "Last SMS parking account balance the operator reported.", func() (float64, bool) {
+		if store.DB == nil {
+			return 0, false
+		}
+		balanceEur, _, err := Latest()
+		return balanceEur, err == nil
+	})
+}
+
+// Latest returns the last balance the operator reported and when.
+func Latest() (float64, time.Time, error) {
+	var balanceEur float64
+	var at time.Time
+	err := store.QueryRow("SELECT balance_eur, created_at FROM balance_log ORDER BY created_at DESC LIMIT 1").Scan(&balanceEur, &at)
+	return balanceEur, at, err
+}
+
+// IsBalanceStale reports whether the last balance is older than maxAge, or
+// there is none.
+func IsBalanceStale(maxAge time.Duration) bool {
+	if store.DB == nil {
+		return true
+	}
+	_, at, err := Latest()
+	return err != nil || clock.Since(at) > maxAge
+}
+
+// Check is the balance monitoring job. Replies to parking SMS carry the
+// balance too, so the inquiry is only sent when none came in for half of
+// MaxAge. The reply arrives through the SMS webhook, and is checked on the
+// next run.
+func Check() error {
+	if store.DB == nil {
+		return nil
+	}
+
+	balanceEur, at, err := Latest()
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if err == sql.ErrNoRows || clock.Since(at) > MaxAge/2 {
+		smsErr := sms.Send(Inquiry)
+		if smsErr != nil {
+			return fmt.Errorf("error sending balance inquiry: %w", smsErr)
+		}
+	}
+
+	if err == sql.ErrNoRows || clock.Since(at) > MaxAge {
+		alerts.Fire("OperatorBalanceStale", fmt.Sprintf("no SMS parking balance reported for more than %s", MaxAge))
+	} else {
+		alerts.Resolve("OperatorBalanceStale", fmt.Sprintf("SMS parking balance reported at %s", at.Format(time.RFC3339)))
+	}
+
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if balanceEur < alerts.Config.BalanceEur {
+		alerts.Fire("OperatorBalanceLow", fmt.Sprintf("SMS parking balance is %.2f EUR, below %.2f EUR, top it up before payments are rejected", balanceEur, alerts.Config.BalanceEur))
+	} else {
+		alerts.Resolve("OperatorBalanceLow", fmt.Sprintf("SMS parking balance is %.2f EUR", balanceEur))
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package balance
+
+import (
+	"fmt"
+	"ljightningparking/alerts"
+	"ljightningparking/audit"
+	"ljightningparking/clock"
+	"ljightningparking/events"
+	"ljightningparking/links"
+	"ljightningparking/sms"
+	"ljightningparking/store"
+	"log"
+	"time"
+)
+
+// ReplyWindow is how long the operator may take to reply to a parking SMS.
+// Past it a balance inquiry is sent and the user is told the confirmation is
+// pending, past twice of it the admins are alerted. 0 disables following up.
+var ReplyWindow = 10 * time.Minute
+
+// lookback is how long orders stay followed up past each step being due, so
+// a job that was held up catches up. It is the time a late reply is still
+// matched to its order, however long ReplyWindow is.
+const lookback = store.ReplyMatchWindow
+
+// OverdueAlert names the alert about an order the operator never replied to.
+func OverdueAlert(o store.Order) string {
+	return "OperatorReplyOverdue " + o.Reference()
+}
+
+// PendingEvent is the event telling the user on the pay page that the
+// confirmation is overdue, with the reference to quote to support.
+func PendingEvent(o store.Order) events.Event {
+	return events.Event{Name: events.Pending, Reference: o.Reference(), Link: links.Payment(o.PaymentHash)}
+}
+
+// FollowUp is the job chasing operator replies that don't arrive. A reply to
+// the balance inquiry shows the operator's number is answering at all, so
+// the alert tells admins whether the parking SMS itself is likely lost.
+func FollowUp() error {
+	if store.DB == nil || ReplyWindow <= 0 {
+		return nil
+	}
+
+	now := clock.Now()
+	inquireBefore := now.Add(-ReplyWindow)
+	overdue, err := store.UnansweredOrders(inquireBefore.Add(-lookback), inquireBefore, store.FollowupInquired)
+	if err != nil {
+		return err
+	}
+	if len(overdue) > 0 {
+		smsErr := sms.Send(Inquiry)
+		if smsErr != nil {
+			log.Printf("Error sending balance inquiry for overdue operator replies: %s", smsErr)
+		}
+	}
+	for _, o := range overdue {
+		err = store.SetOrderFollowup(o.PaymentHash, store.FollowupInquired)
+		if err != nil {
+			return err
+		}
+		events.Publish(o.PaymentRequest, PendingEvent(o))
+		audit.Record(audit.Entry{
+			Kind:        audit.Audit,
+			Action:      "operator_reply_overdue",
+			PaymentHash: o.PaymentHash,
+			Zone:        o.Zone,
+			Plate:       o.Plate,
+		})
+	}
+
+	escalateBefore := now.Add(-2 * ReplyWindow)
+	escalate, err := store.UnansweredOrders(escalateBefore.Add(-lookback), escalateBefore, store.FollowupEscalated)
+	if err != nil {
+		return err
+	}
+	for _, o := range escalate {
+		err = store.SetOrderFollowup(o.PaymentHash, store.FollowupEscalated)
+		if err != nil {
+			return err
+		}
+
+		answered := "the operator did not answer the balance inquiry either"
+		if _, at, err := Latest(); err == nil && at.After(o.SmsSentAt.Time) {
+			answered = "the operator answered since, so the parking SMS may have been lost"
+		}
+		alerts.FireFor(o.PaymentHash, OverdueAlert(o), fmt.Sprintf("no operator reply to the parking SMS for %s in zone %s (payment %s) for %s, %s",
+			o.Plate, o.Zone, o.PaymentHash, now.Sub(o.SmsSentAt.Time).Round(time.Minute), answered))
+	}
+	return nil
+}
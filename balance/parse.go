@@ -0,0 +1,97 @@
+package balance
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata"
+)
+
+type Kind string
+
+const (
+	Success  Kind = "success"
+	Rejected Kind = "rejected"
+	Balance  Kind = "balance"
+)
+
+var ErrUnknownReply = errors.New("unrecognised operator sms")
+
+// Reply is what we could extract from an SMS the parking operator sent back.
+type Reply struct {
+	Kind       Kind
+	Zone       string
+	Plate      string
+	ValidUntil time.Time
+	PriceEur   float64
+	BalanceEur float64
+	HasBalance bool
+}
+
+var (
+	zoneRe       = regexp.MustCompile(`(?i)\bcona:?\s+([A-Za-z]+[0-9]*)`)
+	plateRe      = regexp.MustCompile(`(?i)\breg(?:\.|istrska)?(?:\s+st\.?)?:?\s+([A-Z0-9-]+)`)
+	validUntilRe = regexp.MustCompile(`(?i)\bdo\s+([0-9]{1,2}:[0-9]{2})\s+([0-9]{1,2}\.[0-9]{1,2}\.[0-9]{4})`)
+	priceRe      = regexp.MustCompile(`(?i)\bcena:?\s+([0-9]+(?:[.,][0-9]+)?)\s*EUR`)
+	balanceRe    = regexp.MustCompile(`(?i)\bstanje(?:\s+na\s+(?:vasem\s+)?racunu)?(?:\s+je)?:?\s+([0-9]+(?:[.,][0-9]+)?)\s*EUR`)
+)
+
+var location, _ = time.LoadLocation("Europe/Ljubljana")
+
+// ParseReply recognises the "uspesno" (parking bought), "zavrnjeno" (parking
+// refused) and "Stanje" (balance inquiry) replies of SMS parking.
+func ParseReply(body string) (Reply, error) {
+	normalized := strings.NewReplacer("š", "s", "Š", "S", "č", "c", "Č", "C", "ž", "z", "Ž", "Z").Replace(body)
+	lower := strings.ToLower(normalized)
+
+	var reply Reply
+	switch {
+	case strings.Contains(lower, "uspesno"):
+		reply.Kind = Success
+	case strings.Contains(lower, "zavrnjeno"):
+		reply.Kind = Rejected
+	case strings.Contains(lower, "stanje"):
+		reply.Kind = Balance
+	default:
+		return reply, ErrUnknownReply
+	}
+
+	if m := zoneRe.FindStringSubmatch(normalized); m != nil {
+		reply.Zone = m[1]
+	}
+	if m := plateRe.FindStringSubmatch(normalized); m != nil {
+		reply.Plate = strings.ToUpper(strings.Replace(m[1], "-", "", -1))
+	}
+	if m := validUntilRe.FindStringSubmatch(normalized); m != nil {
+		validUntil, err := time.ParseInLocation("15:04 2.1.2006", m[1]+" "+m[2], location)
+		if err == nil {
+			reply.ValidUntil = validUntil
+		}
+	}
+	if m := priceRe.FindStringSubmatch(normalized); m != nil {
+		reply.PriceEur = parseEur(m[1])
+	}
+	if m := balanceRe.FindStringSubmatch(normalized); m != nil {
+		reply.BalanceEur = parseEur(m[1])
+		reply.HasBalance = true
+	}
+
+	if reply.Kind == Success && reply.ValidUntil.IsZero() {
+		return reply, errors.New("success reply without validity time")
+	}
+	if reply.Kind == Balance && !reply.HasBalance {
+		return reply, errors.New("balance reply without amount")
+	}
+
+	return reply, nil
+}
+
+func parseEur(amount string) float64 {
+	f, err := strconv.ParseFloat(strings.Replace(amount, ",", ".", 1), 64)
+	if err != nil {
+		return 0
+	}
+	return f
+}
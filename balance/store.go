@@ -0,0 +1,45 @@
+package balance
+
+import (
+	"ljightningparking/clock"
+	"ljightningparking/store"
+	"time"
+)
+
+// InsertBalance logs the SMS parking account balance reported by the operator.
+func InsertBalance(balanceEur float64, source Kind) error {
+	if store.DB == nil {
+		return nil
+	}
+
+	_, err := store.Exec("INSERT INTO balance_log (balance_eur, source, created_at) VALUES (?, ?, ?)",
+		balanceEur, source, clock.Now())
+	return err
+}
+
+// Entry is a balance the operator reported.
+type Entry struct {
+	BalanceEur float64   `json:"balance_eur"`
+	Source     Kind      `json:"source"`
+	At         time.Time `json:"at"`
+}
+
+// History returns the balances reported since a time, oldest first.
+func History(since time.Time) ([]Entry, error) {
+	rows, err := store.Query("SELECT balance_eur, source, created_at FROM balance_log WHERE created_at >= ? ORDER BY created_at", since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []Entry
+	for rows.Next() {
+		var e Entry
+		err = rows.Scan(&e.BalanceEur, &e.Source, &e.At)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, e)
+	}
+	return history, rows.Err()
+}
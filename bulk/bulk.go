@@ -0,0 +1,211 @@
+package bulk
+
+import (
+	"errors"
+	"fmt"
+	"ljightningparking/audit"
+	"ljightningparking/clock"
+	"ljightningparking/lnd"
+	"ljightningparking/money"
+	"ljightningparking/revenue"
+	"ljightningparking/sms"
+	"ljightningparking/store"
+	"log"
+	"sync"
+	"time"
+)
+
+type Action string
+
+const (
+	// Resend sends the parking SMS of each order again.
+	Resend Action = "resend"
+	// Refund returns held payments by cancelling their invoice. Settled ones
+	// are marked owed a refund, which is recorded in the ledger once an
+	// admin paid it back with RecordRefund.
+	Refund Action = "refund"
+)
+
+var ErrRunning = errors.New("a bulk job is already running")
+
+var ErrNoRefundOwed = errors.New("the session is not owed a refund")
+
+// Job is the progress of a bulk action over the orders affected by an incident.
+type Job struct {
+	Action   Action
+	Admin    string
+	Total    int
+	Done     int
+	Failed   int
+	Errors   []string
+	Started  time.Time
+	Finished time.Time
+}
+
+func (j Job) Running() bool {
+	return !j.Started.IsZero() && j.Finished.IsZero()
+}
+
+var current struct {
+	job Job
+	sync.Mutex
+}
+
+// Preview returns the orders a bulk action over [from, to) would touch.
+func Preview(from, to time.Time) ([]store.Order, error) {
+	return store.UnconfirmedOrders(from, to)
+}
+
+// Start runs action in the background over the previewed orders with
+// paymentHashes, skipping those that got their parking SMS through since.
+func Start(action Action, paymentHashes []string, admin string) error {
+	if action != Resend && action != Refund {
+		return fmt.Errorf("unknown action %s", action)
+	}
+
+	var orders []store.Order
+	for _, hash := range paymentHashes {
+		o, err := store.GetOrder(hash)
+		if err != nil {
+			return fmt.Errorf("order %s: %s", hash, err)
+		}
+		if o.State == store.OrderPaid || o.State == store.OrderSmsFailed {
+			orders = append(orders, o)
+		}
+	}
+
+	current.Lock()
+	defer current.Unlock()
+
+	if current.job.Running() {
+		return ErrRunning
+	}
+	current.job = Job{
+		Action:  action,
+		Admin:   admin,
+		Total:   len(orders),
+		Started: clock.Now(),
+	}
+
+	go run(action, orders, admin)
+
+	return nil
+}
+
+func Current() Job {
+	current.Lock()
+	defer current.Unlock()
+
+	job := current.job
+	job.Errors = append([]string(nil), job.Errors...)
+	return job
+}
+
+func run(action Action, orders []store.Order, admin string) {
+	for _, o := range orders {
+		var err error
+		switch action {
+		case Resend:
+			err = resend(o)
+		case Refund:
+			err = refund(o, admin)
+		}
+
+		current.Lock()
+		current.job.Done++
+		if err != nil {
+			current.job.Failed++
+			current.job.Errors = append(current.job.Errors, fmt.Sprintf("%s: %s", o.PaymentHash, err))
+		}
+		current.Unlock()
+	}
+
+	current.Lock()
+	current.job.Finished = clock.Now()
+	log.Printf("bulk %s by %s finished: %d orders, %d failed", action, admin, current.job.Total, current.job.Failed)
+	current.Unlock()
+}
+
+func resend(o store.Order) error {
+	key, err := lnd.OrderKey(o)
+	if err != nil {
+		return err
+	}
+
+	sendErr := sms.Send(key.Message())
+	err = store.RecordSmsAttempt(o.PaymentHash, sendErr)
+	if sendErr != nil {
+		return sendErr
+	}
+
+	audit.Record(audit.Entry{Kind: audit.Audit, Action: "sms_resent", PaymentHash: o.PaymentHash})
+	return err
+}
+
+func refund(o store.Order, admin string) error {
+	if len(o.Preimage) > 0 && !o.Settled {
+		if lnd.InvoiceHandler == nil {
+			return errors.New("lnd is not configured to return the held payment")
+		}
+		err := lnd.InvoiceHandler.CancelHeld(o.PaymentHash)
+		if err != nil {
+			return err
+		}
+		return store.AddOrderNote(o.PaymentHash, admin, "held payment returned in bulk incident recovery")
+	}
+
+	err := store.SetOrderState(o.PaymentHash, store.OrderRefundOwed)
+	if err != nil {
+		return err
+	}
+	audit.Record(audit.Entry{
+		Kind:        audit.Audit,
+		Action:      "refund_owed",
+		PaymentHash: o.PaymentHash,
+		Zone:        o.Zone,
+		Plate:       o.Plate,
+		Detail:      "bulk refund by " + admin,
+	})
+	return store.AddOrderNote(o.PaymentHash, admin, "owed a refund after bulk incident recovery, record it here once the sats are sent back")
+}
+
+// RecordRefund records that an admin sent the sats of an order owed a refund
+// back to the user, in the ledger and on the order.
+func RecordRefund(paymentHash, admin string) error {
+	o, err := store.GetOrder(paymentHash)
+	if err != nil {
+		return err
+	}
+	refunded, err := store.SetOrderRefunded(paymentHash)
+	if err != nil {
+		return err
+	}
+	if !refunded {
+		return ErrNoRefundOwed
+	}
+	err = store.SetOrderTag(paymentHash, store.TagRefunded)
+	if err != nil {
+		return err
+	}
+
+	sats := o.Received()
+	var eur money.Cents
+	if o.Sats > 0 {
+		eur = money.EUR(o.Eur * float64(sats) / float64(o.Sats))
+	}
+	audit.Record(audit.Entry{
+		Kind:        audit.Ledger,
+		Action:      "refund_issued",
+		PaymentHash: paymentHash,
+		Zone:        o.Zone,
+		Plate:       o.Plate,
+		Sats:        -sats,
+		Eur:         -eur,
+		Detail:      "refund sent by " + admin,
+	})
+	err = revenue.Reverse(paymentHash)
+	if err != nil {
+		return err
+	}
+	return store.AddOrderNote(paymentHash, admin, fmt.Sprintf("sent the %d sats back", sats))
+}
@@ -0,0 +1,292 @@
+package catalogue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"ljightningparking/money"
+	"ljightningparking/parking"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kind is a type of product. The pricing, validity and fulfilment of each
+// kind is a Type registered with RegisterType.
+type Kind string
+
+const (
+	Hourly       Kind = "hourly"
+	DayTicket    Kind = "day_ticket"
+	Garage       Kind = "garage"
+	EVCredit     Kind = "ev_credit"
+	Subscription Kind = "subscription"
+)
+
+// Product is something the service sells. Products are compared by value, so
+// they must not hold slices, maps or pointers.
+type Product struct {
+	ID   string `json:"id"`
+	Kind Kind   `json:"kind"`
+	Name string `json:"name"`
+	// Zone is the parking zone the product is for, if any.
+	Zone string `json:"zone,omitempty"`
+	// Unit is what the quantity of a purchase counts, e.g. hour or kWh.
+	Unit string `json:"unit"`
+	// PriceEur is the price of one unit. Hourly products show their zone's
+	// list price but are billed by its charging schedule.
+	PriceEur float64 `json:"price_eur,omitempty"`
+	// MaxQuantity caps a purchase, DefaultMaxQuantity when it is 0.
+	MaxQuantity float64 `json:"max_quantity,omitempty"`
+	// Sms is the message sent to fulfil a paid purchase, with {zone},
+	// {plate} and {quantity} filled in. Nothing is sent when it is empty.
+	Sms string `json:"sms,omitempty"`
+}
+
+// Type prices and fulfils the products of a kind.
+type Type interface {
+	// Quote returns the EUR price of quantity units bought at start and
+	// when what they buy runs out, zero for credit that does not.
+	Quote(p Product, start time.Time, quantity float64) (money.Cents, time.Time, error)
+	// ParseQuantity validates the quantity a user asked for.
+	ParseQuantity(p Product, value string) (float64, error)
+	// Message is the SMS fulfilling a paid purchase, "" when none is sent.
+	Message(p Product, plate string, quantity float64, at time.Time) string
+}
+
+var types = map[Kind]Type{}
+
+// RegisterType plugs a product kind in.
+func RegisterType(kind Kind, t Type) {
+	types[kind] = t
+}
+
+// File is the catalogue file of products besides hourly parking, which is
+// sold in every zone.
+var File string
+
+var products = struct {
+	byID map[string]Product
+	sync.RWMutex
+}{byID: map[string]Product{}}
+
+const hourlyPrefix = "parking-"
+
+// DefaultMaxQuantity caps the purchases of products without a MaxQuantity,
+// so a typo can't quote a fortune.
+const DefaultMaxQuantity = 100
+
+// HourlyProduct is the hourly street parking sold in a zone.
+func HourlyProduct(zone parking.Zone) Product {
+	return Product{
+		ID:          hourlyPrefix + zone.Name,
+		Kind:        Hourly,
+		Name:        "Parking in zone " + zone.Name,
+		Zone:        zone.Name,
+		Unit:        "hour",
+		PriceEur:    zone.Price,
+		MaxQuantity: zone.MaxTime,
+	}
+}
+
+// Get looks up a product by id.
+func Get(id string) (Product, bool) {
+	if strings.HasPrefix(id, hourlyPrefix) {
+		zone, ok := parking.GetZone(strings.TrimPrefix(id, hourlyPrefix))
+		if !ok {
+			return Product{}, false
+		}
+		return HourlyProduct(zone), true
+	}
+
+	products.RLock()
+	defer products.RUnlock()
+
+	p, ok := products.byID[id]
+	return p, ok
+}
+
+// All returns every product, hourly parking first, ordered by id. Zones sold
+// only at parking meters have no hourly parking.
+func All() []Product {
+	var all []Product
+	for _, zone := range parking.AllZones() {
+		if !zone.Informational {
+			all = append(all, HourlyProduct(zone))
+		}
+	}
+
+	products.RLock()
+	var others []Product
+	for _, p := range products.byID {
+		others = append(others, p)
+	}
+	products.RUnlock()
+
+	sort.Slice(others, func(i, j int) bool {
+		return others[i].ID < others[j].ID
+	})
+	return append(all, others...)
+}
+
+// Load reads the products in File, a json list of products.
+func Load() error {
+	data, err := ioutil.ReadFile(File)
+	if err != nil {
+		return err
+	}
+
+	var list []Product
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return fmt.Errorf("%s: %w", File, err)
+	}
+
+	loaded := make(map[string]Product, len(list))
+	for _, p := range list {
+		switch {
+		case len(p.ID) == 0 || strings.HasPrefix(p.ID, hourlyPrefix):
+			return fmt.Errorf("%s: product ids must be set and not start with %s", File, hourlyPrefix)
+		case types[p.Kind] == nil || p.Kind == Hourly:
+			return fmt.Errorf("%s: product %s has unsupported kind %q", File, p.ID, p.Kind)
+		case p.PriceEur <= 0:
+			return fmt.Errorf("%s: product %s needs a positive price_eur", File, p.ID)
+		}
+		if _, ok := loaded[p.ID]; ok {
+			return fmt.Errorf("%s: product %s defined twice", File, p.ID)
+		}
+		loaded[p.ID] = p
+	}
+
+	products.Lock()
+	products.byID = loaded
+	products.Unlock()
+	return nil
+}
+
+func typeOf(p Product) (Type, error) {
+	t, ok := types[p.Kind]
+	if !ok {
+		return nil, fmt.Errorf("unsupported product kind %q", p.Kind)
+	}
+	return t, nil
+}
+
+// Quote returns the price of quantity units of a product bought at start and
+// when they run out.
+func Quote(p Product, start time.Time, quantity float64) (money.Cents, time.Time, error) {
+	t, err := typeOf(p)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return t.Quote(p, start, quantity)
+}
+
+// ParseQuantity validates the quantity of a product a user asked for. Its
+// errors are meant for the user.
+func ParseQuantity(p Product, value string) (float64, error) {
+	t, err := typeOf(p)
+	if err != nil {
+		return 0, err
+	}
+	return t.ParseQuantity(p, value)
+}
+
+// Message returns the SMS fulfilling a paid purchase, "" when there is none.
+func Message(p Product, plate string, quantity float64, at time.Time) string {
+	t, err := typeOf(p)
+	if err != nil {
+		return ""
+	}
+	return t.Message(p, plate, quantity, at)
+}
+
+// hourly is street parking, priced by the zone's tariff and schedule.
+type hourly struct{}
+
+func (hourly) zone(p Product) (parking.Zone, error) {
+	zone, ok := parking.GetZone(p.Zone)
+	if !ok {
+		return zone, fmt.Errorf("zone does not exist: %s", p.Zone)
+	}
+	return zone, nil
+}
+
+func (h hourly) Quote(p Product, start time.Time, hours float64) (money.Cents, time.Time, error) {
+	zone, err := h.zone(p)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return zone.Fee(start, hours), zone.PaidUntil(start, hours), nil
+}
+
+func (h hourly) ParseQuantity(p Product, value string) (float64, error) {
+	zone, err := h.zone(p)
+	if err != nil {
+		return 0, err
+	}
+	return zone.ParseHours(value)
+}
+
+func (h hourly) Message(p Product, plate string, hours float64, at time.Time) string {
+	zone, err := h.zone(p)
+	if err != nil {
+		return ""
+	}
+	return zone.SmsMessage(plate, hours, at)
+}
+
+// flat products cost PriceEur per unit and last as long as validity says.
+type flat struct {
+	validity func(start time.Time, quantity float64) time.Time
+}
+
+func (f flat) Quote(p Product, start time.Time, quantity float64) (money.Cents, time.Time, error) {
+	var until time.Time
+	if f.validity != nil {
+		until = f.validity(start, quantity)
+	}
+	return money.EUR(p.PriceEur).Times(quantity), until, nil
+}
+
+func (flat) ParseQuantity(p Product, value string) (float64, error) {
+	quantity, err := parking.ParseNumber(value)
+	if err != nil || quantity < 1 || quantity != math.Trunc(quantity) {
+		return 0, errors.New("quantity must be a whole number")
+	}
+	max := p.MaxQuantity
+	if max <= 0 {
+		max = DefaultMaxQuantity
+	}
+	if quantity > max {
+		return 0, fmt.Errorf("at most %s %s can be bought at once", parking.FormatHours(max), p.Unit)
+	}
+	return quantity, nil
+}
+
+func (flat) Message(p Product, plate string, quantity float64, at time.Time) string {
+	if len(p.Sms) == 0 {
+		return ""
+	}
+	return strings.NewReplacer("{zone}", p.Zone, "{plate}", plate, "{quantity}", parking.FormatHours(quantity)).Replace(p.Sms)
+}
+
+// endOfDay is the local midnight ending the last of days starting with the
+// one start is in.
+func endOfDay(start time.Time, days float64) time.Time {
+	local := start.In(parking.Location)
+	return time.Date(local.Year(), local.Month(), local.Day()+int(days), 0, 0, 0, 0, parking.Location)
+}
+
+func init() {
+	RegisterType(Hourly, hourly{})
+	RegisterType(DayTicket, flat{endOfDay})
+	RegisterType(Garage, flat{endOfDay})
+	RegisterType(EVCredit, flat{})
+	RegisterType(Subscription, flat{func(start time.Time, months float64) time.Time {
+		return start.AddDate(0, int(months), 0)
+	}})
+}
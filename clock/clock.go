@@ -0,0 +1,102 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for anything that expires or is scheduled, so
+// tests and simulations can move time forward instead of sleeping.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// Default is the clock used throughout the service.
+var Default Clock = Real{}
+
+func Now() time.Time {
+	return Default.Now()
+}
+
+func Since(t time.Time) time.Duration {
+	return Default.Now().Sub(t)
+}
+
+func After(d time.Duration) <-chan time.Time {
+	return Default.After(d)
+}
+
+type Real struct{}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+func (Real) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Fake only moves when Advance or Set is called.
+type Fake struct {
+	now     time.Time
+	waiters []waiter
+	sync.Mutex
+}
+
+type waiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (f *Fake) Now() time.Time {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.now
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.Lock()
+	defer f.Unlock()
+
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- f.now
+		return c
+	}
+	f.waiters = append(f.waiters, waiter{f.now.Add(d), c})
+	return c
+}
+
+// Advance moves the clock forward by d, firing every After that became due
+// in order.
+func (f *Fake) Advance(d time.Duration) {
+	f.Set(f.Now().Add(d))
+}
+
+func (f *Fake) Set(now time.Time) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.now = now
+
+	sort.Slice(f.waiters, func(i, j int) bool {
+		return f.waiters[i].at.Before(f.waiters[j].at)
+	})
+
+	pending := f.waiters[:0]
+	for _, w := range f.waiters {
+		if w.at.After(now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.c <- w.at
+	}
+	f.waiters = pending
+}
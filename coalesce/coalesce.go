@@ -0,0 +1,54 @@
+package coalesce
+
+import (
+	"errors"
+	"ljightningparking/metrics"
+	"sync"
+)
+
+var shared = metrics.NewCounter("ljp_coalesced_calls_total", "Calls that waited for an identical call in progress instead of making their own.", "group")
+
+// Group runs one call at a time per key, callers asking for a key already in
+// progress wait for it and share its result. Nothing is kept once the call
+// returns, caching is up to the caller.
+type Group struct {
+	// Name labels the group in the metrics.
+	Name  string
+	calls map[string]*call
+	sync.Mutex
+}
+
+type call struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// Do runs fn for key unless it is already running, in which case it waits
+// for that call and returns its result instead.
+func (g *Group) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.Unlock()
+		shared.Inc(g.Name)
+		<-c.done
+		return c.value, c.err
+	}
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+	// what the waiters get if fn panics
+	c := &call{done: make(chan struct{}), err: errors.New("coalesced call did not return")}
+	g.calls[key] = c
+	g.Unlock()
+
+	defer func() {
+		g.Lock()
+		delete(g.calls, key)
+		g.Unlock()
+		close(c.done)
+	}()
+
+	c.value, c.err = fn()
+	return c.value, c.err
+}
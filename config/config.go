@@ -0,0 +1,135 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Setting is one line of a config file, a command line flag without its dash
+// and its value. Config files are the flat subset of TOML with double quoted
+// string, number and boolean values: no tables, arrays, dotted keys, literal
+// or multi-line strings. Read rejects anything else rather than guessing.
+type Setting struct {
+	Name  string
+	Value string
+}
+
+// Read parses a config file of name = value lines. Blank lines and lines
+// starting with # are skipped, string values are double quoted and other
+// values must be a number, true or false.
+func Read(path string) ([]Setting, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var settings []Setting
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || !validName(name) {
+			return nil, fmt.Errorf("%s:%d: expected name = value", path, line)
+		}
+		value := strings.TrimSpace(parts[1])
+		switch {
+		case strings.HasPrefix(value, `"`):
+			if strings.HasPrefix(value, `"""`) {
+				return nil, fmt.Errorf("%s:%d: multi-line strings are not supported", path, line)
+			}
+			value, err = strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid string value", path, line)
+			}
+		case value == "true" || value == "false":
+		default:
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				return nil, fmt.Errorf("%s:%d: expected a double quoted string, number or boolean", path, line)
+			}
+		}
+		settings = append(settings, Setting{name, value})
+	}
+	return settings, scanner.Err()
+}
+
+// validName reports whether name is a bare TOML key naming a flag.
+func validName(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// EnvPrefix starts the environment variables overriding settings, e.g.
+// LJP_SMS_GATEWAY for sms-gateway.
+const EnvPrefix = "LJP_"
+
+// EnvName is the environment variable overriding a setting.
+func EnvName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name))
+}
+
+// Env returns the settings of fs overridden in the environment.
+func Env(fs *flag.FlagSet) []Setting {
+	var settings []Setting
+	fs.VisitAll(func(f *flag.Flag) {
+		if value, ok := os.LookupEnv(EnvName(f.Name)); ok {
+			settings = append(settings, Setting{f.Name, value})
+		}
+	})
+	return settings
+}
+
+// Apply sets the flags named by settings, except those given on the command
+// line, which take precedence. Later settings override earlier ones.
+func Apply(fs *flag.FlagSet, settings []Setting) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	for _, s := range settings {
+		if fs.Lookup(s.Name) == nil {
+			return fmt.Errorf("unknown setting %s", s.Name)
+		}
+		if given[s.Name] {
+			continue
+		}
+		err := fs.Set(s.Name, s.Value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %s", s.Name, err)
+		}
+	}
+	return nil
+}
+
+// Write saves settings as a config file readable by Read, only by its owner
+// as it may name secrets.
+func Write(path, comment string, settings []Setting) error {
+	var buf bytes.Buffer
+	for _, line := range strings.Split(comment, "\n") {
+		fmt.Fprintf(&buf, "# %s\n", line)
+	}
+	buf.WriteString("\n")
+	for _, s := range settings {
+		fmt.Fprintf(&buf, "%s = %s\n", s.Name, strconv.Quote(s.Value))
+	}
+
+	return ioutil.WriteFile(path, buf.Bytes(), 0600)
+}
@@ -0,0 +1,113 @@
+package dataset
+
+import (
+	"bytes"
+	"encoding/csv"
+	"ljightningparking/clock"
+	"ljightningparking/parking"
+	"ljightningparking/reports"
+	"ljightningparking/store"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MinPurchases is the fewest purchases an hour of a zone must have to be
+// published, so a single parking session can't be singled out.
+var MinPurchases = 3
+
+// Row is an hour of purchases of a product in a zone. No plates or payment
+// details are kept.
+type Row struct {
+	Hour      time.Time
+	Zone      string
+	Product   string
+	Purchases int
+	Eur       float64
+	Sats      int64
+}
+
+var current struct {
+	csv        []byte
+	rows       int
+	suppressed int
+	generated  time.Time
+	sync.Mutex
+}
+
+// Build aggregates every paid order into hourly rows, oldest first, leaving
+// out those with fewer than MinPurchases purchases. It also returns how many
+// rows were left out. The database does the summing, only the hourly rows
+// are loaded.
+func Build() ([]Row, int, error) {
+	hours, err := store.PurchasesByHour(reports.EarnedStates, parking.TestZoneName)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var rows []Row
+	suppressed := 0
+	for _, h := range hours {
+		if h.Purchases < MinPurchases {
+			suppressed++
+			continue
+		}
+		product := h.Product
+		if len(product) == 0 {
+			product = "hourly"
+		}
+		rows = append(rows, Row{h.Hour, h.Zone, product, h.Purchases, h.Eur, h.Sats})
+	}
+	return rows, suppressed, nil
+}
+
+// Refresh is a job regenerating the published CSV. The dataset is only
+// published as CSV: it is a few columns of small numbers, and Parquet would
+// take a dependency the project doesn't otherwise need.
+func Refresh() error {
+	rows, suppressed, err := Build()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"hour", "zone", "product", "purchases", "eur", "sats"})
+	for _, r := range rows {
+		w.Write([]string{
+			r.Hour.Format(time.RFC3339),
+			r.Zone,
+			r.Product,
+			strconv.Itoa(r.Purchases),
+			strconv.FormatFloat(r.Eur, 'f', 2, 64),
+			strconv.FormatInt(r.Sats, 10),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+
+	current.Lock()
+	current.csv = buf.Bytes()
+	current.rows = len(rows)
+	current.suppressed = suppressed
+	current.generated = clock.Now()
+	current.Unlock()
+	return nil
+}
+
+// Summary describes the published dataset.
+type Summary struct {
+	Rows       int
+	Suppressed int
+	Generated  time.Time
+}
+
+// CSV returns the published dataset, nil until it is first generated.
+func CSV() ([]byte, Summary) {
+	current.Lock()
+	defer current.Unlock()
+
+	return current.csv, Summary{current.rows, current.suppressed, current.generated}
+}
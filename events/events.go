@@ -0,0 +1,82 @@
+package events
+
+import "sync"
+
+// Event is a change of an order pushed to the browser waiting on its pay
+// page. Name is one of the order states the page reacts to.
+type Event struct {
+	Name       string `json:"name"`
+	ValidUntil string `json:"validUntil,omitempty"`
+	// Reference is the order's reference, sent while its confirmation is
+	// pending.
+	Reference string `json:"reference,omitempty"`
+	// Link is the payment's status page, see links.Payment.
+	Link string `json:"link,omitempty"`
+}
+
+const (
+	Paid      = "paid"
+	SmsSent   = "sms_sent"
+	SmsFailed = "sms_failed"
+	Cancelled = "cancelled"
+	Confirmed = "confirmed"
+	Rejected  = "rejected"
+	// RefundOwed means the payment was received but buys no parking, an
+	// admin returns it.
+	RefundOwed = "refund_owed"
+	// Pending means the operator did not confirm the parking SMS in time.
+	Pending = "confirmation_pending"
+)
+
+// MaxSubscribers caps the open event streams.
+const MaxSubscribers = 1000
+
+var subscribers = struct {
+	byKey map[string]map[chan Event]bool
+	count int
+	sync.Mutex
+}{byKey: make(map[string]map[chan Event]bool)}
+
+// Subscribe returns a channel receiving the events published for key, a
+// payment request, and a function to unsubscribe. It returns a nil channel
+// when there are too many subscribers.
+func Subscribe(key string) (chan Event, func()) {
+	subscribers.Lock()
+	defer subscribers.Unlock()
+
+	if subscribers.count >= MaxSubscribers {
+		return nil, func() {}
+	}
+
+	ch := make(chan Event, 8)
+	if subscribers.byKey[key] == nil {
+		subscribers.byKey[key] = make(map[chan Event]bool)
+	}
+	subscribers.byKey[key][ch] = true
+	subscribers.count++
+
+	return ch, func() {
+		subscribers.Lock()
+		defer subscribers.Unlock()
+
+		delete(subscribers.byKey[key], ch)
+		if len(subscribers.byKey[key]) == 0 {
+			delete(subscribers.byKey, key)
+		}
+		subscribers.count--
+	}
+}
+
+// Publish sends an event to the subscribers of key. Subscribers that don't
+// keep up miss it rather than block the publisher.
+func Publish(key string, e Event) {
+	subscribers.Lock()
+	defer subscribers.Unlock()
+
+	for ch := range subscribers.byKey[key] {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
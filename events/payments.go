@@ -0,0 +1,69 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Payment is a paid order as shown on the wall display, without anything
+// identifying the buyer.
+type Payment struct {
+	Zone  string    `json:"zone"`
+	Hours float64   `json:"hours"`
+	Sats  int64     `json:"sats"`
+	Time  time.Time `json:"time"`
+}
+
+const (
+	// MaxPaymentSubscribers caps the open wall display streams.
+	MaxPaymentSubscribers = 50
+	// recentPayments is how many payments a new wall display starts with.
+	recentPayments = 20
+)
+
+var payments = struct {
+	subscribers map[chan Payment]bool
+	recent      []Payment
+	sync.Mutex
+}{subscribers: make(map[chan Payment]bool)}
+
+// SubscribePayments returns the latest payments, oldest first, a channel
+// receiving the ones published from now on and a function to unsubscribe. It
+// returns a nil channel when there are too many subscribers.
+func SubscribePayments() ([]Payment, chan Payment, func()) {
+	payments.Lock()
+	defer payments.Unlock()
+
+	recent := append([]Payment(nil), payments.recent...)
+	if len(payments.subscribers) >= MaxPaymentSubscribers {
+		return recent, nil, func() {}
+	}
+
+	ch := make(chan Payment, 8)
+	payments.subscribers[ch] = true
+
+	return recent, ch, func() {
+		payments.Lock()
+		defer payments.Unlock()
+
+		delete(payments.subscribers, ch)
+	}
+}
+
+// PublishPayment sends a payment to the wall displays, dropping it for those
+// that don't keep up.
+func PublishPayment(p Payment) {
+	payments.Lock()
+	defer payments.Unlock()
+
+	payments.recent = append(payments.recent, p)
+	if len(payments.recent) > recentPayments {
+		payments.recent = payments.recent[len(payments.recent)-recentPayments:]
+	}
+	for ch := range payments.subscribers {
+		select {
+		case ch <- p:
+		default:
+		}
+	}
+}
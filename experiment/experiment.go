@@ -0,0 +1,62 @@
+package experiment
+
+import (
+	"ljightningparking/features"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Experiment splits visitors between template variants. It only runs while
+// the feature flag with the same name is enabled, otherwise everyone gets
+// the first variant.
+type Experiment struct {
+	Name     string
+	Variants []string
+}
+
+var PayPage = Experiment{"pay-page", []string{"qr-first", "button-first"}}
+
+const cookieMaxAge = 30 * 24 * time.Hour
+
+// Assign returns the visitor's variant, picking one at random and remembering
+// it in a cookie on the first visit.
+func (e Experiment) Assign(w http.ResponseWriter, r *http.Request) string {
+	if !features.Enabled(e.Name) {
+		return e.Variants[0]
+	}
+
+	cookieName := "exp-" + e.Name
+
+	cookie, err := r.Cookie(cookieName)
+	if err == nil && e.valid(cookie.Value) {
+		return cookie.Value
+	}
+
+	variant := e.Variants[rand.Intn(len(e.Variants))]
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieName,
+		Value:    variant,
+		Path:     "/",
+		MaxAge:   int(cookieMaxAge.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return variant
+}
+
+// Label identifies a variant of this experiment in the stats store.
+func (e Experiment) Label(variant string) string {
+	return e.Name + "/" + variant
+}
+
+func (e Experiment) valid(variant string) bool {
+	for _, v := range e.Variants {
+		if v == variant {
+			return true
+		}
+	}
+	return false
+}
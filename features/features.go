@@ -0,0 +1,32 @@
+package features
+
+import (
+	"strings"
+	"sync"
+)
+
+var enabled = struct {
+	names map[string]bool
+	sync.RWMutex
+}{names: make(map[string]bool)}
+
+// Set replaces the enabled features with the comma separated list in names.
+func Set(names string) {
+	enabled.Lock()
+	defer enabled.Unlock()
+
+	enabled.names = make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) > 0 {
+			enabled.names[name] = true
+		}
+	}
+}
+
+func Enabled(name string) bool {
+	enabled.RLock()
+	defer enabled.RUnlock()
+
+	return enabled.names[name]
+}
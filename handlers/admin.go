@@ -0,0 +1,897 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"ljightningparking/admin"
+	"ljightningparking/audit"
+	"ljightningparking/bulk"
+	"ljightningparking/clock"
+	"ljightningparking/jobs"
+	"ljightningparking/lnd"
+	"ljightningparking/maintenance"
+	"ljightningparking/parking"
+	"ljightningparking/ratelimit"
+	"ljightningparking/reports"
+	"ljightningparking/revenue"
+	"ljightningparking/sms"
+	"ljightningparking/stats"
+	"ljightningparking/store"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminToken is an api key for automation, accepted as a bearer token or as
+// the basic auth password. People log in to the dashboard as admin users.
+var AdminToken string
+
+func RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if validAdminToken(r) || validAdminSession(r) {
+			next(w, r)
+			return
+		}
+
+		if store.DB != nil && r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+			return
+		}
+
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ljightningparking admin"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}
+}
+
+func validAdminToken(r *http.Request) bool {
+	if len(AdminToken) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(AdminToken)) == 1
+}
+
+// bearerToken is the token a request authenticates with, as a bearer token
+// or as the basic auth password.
+func bearerToken(r *http.Request) string {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if _, password, ok := r.BasicAuth(); ok {
+		token = password
+	}
+	return token
+}
+
+func validAdminSession(r *http.Request) bool {
+	cookie, err := r.Cookie(admin.SessionCookie)
+	if err != nil {
+		return false
+	}
+	_, ok := admin.SessionUser(cookie.Value)
+	return ok
+}
+
+func AdminLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if store.DB == nil {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	data := struct {
+		Error string
+	}{}
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		name := r.FormValue("name")
+		if !ratelimit.AllowLogin(clientIP(r), name) {
+			data.Error = "too many login attempts, please try again in a few minutes"
+			w.WriteHeader(http.StatusTooManyRequests)
+			break
+		}
+		err := admin.Authenticate(name, r.FormValue("password"), r.FormValue("code"))
+		if err == nil {
+			token, err := admin.NewSession(name)
+			if err != nil {
+				http.Error(w, "error starting session", http.StatusInternalServerError)
+				log.Printf("error starting admin session: %s", err)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{
+				Name:     admin.SessionCookie,
+				Value:    token,
+				Path:     "/admin",
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteStrictMode,
+			})
+			log.Printf("admin %s logged in", name)
+			http.Redirect(w, r, "/admin/funnel", http.StatusSeeOther)
+			return
+		}
+		if err != admin.ErrInvalidLogin {
+			log.Printf("error authenticating admin: %s", err)
+		}
+		data.Error = admin.ErrInvalidLogin.Error()
+		w.WriteHeader(http.StatusUnauthorized)
+	default:
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	err := BaseTemplate.ExecuteTemplate(w, "admin_login", data)
+	if err != nil {
+		log.Printf("template execution failed: %s", err)
+	}
+}
+
+func AdminLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	if cookie, err := r.Cookie(admin.SessionCookie); err == nil {
+		admin.EndSession(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: admin.SessionCookie, Path: "/admin", MaxAge: -1})
+	http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+}
+
+func AdminFunnelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	data := struct {
+		Stages   []stats.Stage
+		Zones    []stats.ZoneFunnel
+		Variants []stats.ZoneFunnel
+		Payments int64
+		Sats     int64
+		Daily    []stats.PayerCount
+		Weekly   []stats.PayerCount
+	}{
+		Stages:   stats.Stages,
+		Zones:    stats.Funnel(),
+		Variants: stats.Variants(),
+		Daily:    stats.DailyPayers(),
+		Weekly:   stats.WeeklyPayers(),
+	}
+	data.Payments, data.Sats = stats.Totals()
+
+	if wantsJSON(r) {
+		err := json.NewEncoder(w).Encode(data)
+		if err != nil {
+			log.Printf("error encoding funnel response: %s", err)
+		}
+		return
+	}
+
+	err := BaseTemplate.ExecuteTemplate(w, "admin_funnel", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("template execution failed: %s", err)
+	}
+}
+
+func AdminMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if store.DB == nil {
+		http.Error(w, "no database configured", http.StatusNotFound)
+		return
+	}
+
+	var report maintenance.Report
+	switch r.Method {
+	case "GET":
+		report = maintenance.LastReport()
+	case "POST":
+		report = maintenance.Run()
+	default:
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	err := json.NewEncoder(w).Encode(report)
+	if err != nil {
+		log.Printf("error encoding maintenance report: %s", err)
+	}
+}
+
+// AdminJobsHandler shows the background jobs and runs the one named in the
+// job form value on POST.
+func AdminJobsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		err := jobs.RunNow(r.FormValue("job"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "/admin/jobs", http.StatusSeeOther)
+		return
+	default:
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	statuses := jobs.Statuses()
+	if wantsJSON(r) {
+		err := json.NewEncoder(w).Encode(statuses)
+		if err != nil {
+			log.Printf("error encoding jobs response: %s", err)
+		}
+		return
+	}
+
+	data := struct {
+		Jobs []jobs.Status
+		Lag  *lnd.Lag
+	}{Jobs: statuses}
+	if lnd.InvoiceHandler != nil {
+		lag := lnd.InvoiceHandler.Lag()
+		data.Lag = &lag
+	}
+
+	err := BaseTemplate.ExecuteTemplate(w, "admin_jobs", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("template execution failed: %s", err)
+	}
+}
+
+// AdminDiagnosticsHandler shows how far the latest purchases in the TEST zone
+// got through the invoice, payment, parking SMS and operator reply. Posting a
+// plate starts a new purchase, shown on the usual invoice page.
+func AdminDiagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	if store.DB == nil {
+		http.Error(w, "no database configured", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == "POST" {
+		order, err := parseTestOrderRequest(r.FormValue("plate"), r.FormValue("hours"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		renderInvoice(w, r, order)
+		return
+	}
+
+	runs, err := store.TestRuns(20)
+	if err != nil {
+		http.Error(w, "error loading test runs", http.StatusInternalServerError)
+		log.Printf("error loading test runs: %s", err)
+		return
+	}
+
+	_, enabled := parking.GetZone(parking.TestZoneName)
+	data := struct {
+		Enabled bool
+		Zone    string
+		SmsTo   string
+		Steps   []string
+		Runs    []store.TestRun
+	}{enabled, parking.TestZoneName, lnd.TestSmsTo, store.TestSteps, runs}
+
+	if wantsJSON(r) {
+		err = json.NewEncoder(w).Encode(data)
+		if err != nil {
+			log.Printf("error encoding diagnostics response: %s", err)
+		}
+		return
+	}
+
+	err = BaseTemplate.ExecuteTemplate(w, "admin_diagnostics", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("template execution failed: %s", err)
+	}
+}
+
+// AdminSmsDebugHandler shows the last exchanges with the SMS provider, when
+// they are kept.
+func AdminSmsDebugHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	var exchanges []sms.Exchange
+	if sms.Debug != nil {
+		exchanges = sms.Debug.Exchanges()
+	}
+	data := struct {
+		Enabled   bool
+		Exchanges []sms.Exchange
+	}{sms.Debug != nil, exchanges}
+
+	if wantsJSON(r) {
+		err := json.NewEncoder(w).Encode(data)
+		if err != nil {
+			log.Printf("error encoding sms debug response: %s", err)
+		}
+		return
+	}
+
+	err := BaseTemplate.ExecuteTemplate(w, "admin_sms_debug", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("template execution failed: %s", err)
+	}
+}
+
+// AdminFeedbackHandler lists the feedback users sent, the unresolved unless
+// all is set. POST with an id marks that feedback as resolved.
+func AdminFeedbackHandler(w http.ResponseWriter, r *http.Request) {
+	if store.DB == nil {
+		http.Error(w, "no database configured", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid feedback id", http.StatusBadRequest)
+			return
+		}
+		err = store.ResolveFeedback(id, adminName(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Printf("error resolving feedback %d: %s", id, err)
+			return
+		}
+		http.Redirect(w, r, "/admin/feedback", http.StatusSeeOther)
+		return
+	default:
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	all := len(r.FormValue("all")) > 0
+	feedback, err := store.ListFeedback(all, 200)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("error loading feedback: %s", err)
+		return
+	}
+
+	if wantsJSON(r) {
+		err = json.NewEncoder(w).Encode(feedback)
+		if err != nil {
+			log.Printf("error encoding feedback response: %s", err)
+		}
+		return
+	}
+
+	data := struct {
+		All      bool
+		Feedback []store.Feedback
+	}{all, feedback}
+	err = BaseTemplate.ExecuteTemplate(w, "admin_feedback", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("template execution failed: %s", err)
+	}
+}
+
+// AdminPayoutsHandler shows what each revenue share recipient is owed and
+// the latest payout batches. POST with a recipient puts their unpaid shares
+// in a new batch, to be paid out by the operator.
+func AdminPayoutsHandler(w http.ResponseWriter, r *http.Request) {
+	if store.DB == nil {
+		http.Error(w, "no database configured", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		recipient := r.FormValue("recipient")
+		if _, ok := revenue.Get(recipient); !ok {
+			http.Error(w, "unknown recipient", http.StatusBadRequest)
+			return
+		}
+		batch, err := store.CreatePayoutBatch(recipient, adminName(r))
+		if err == store.ErrNoShares {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			log.Printf("error creating payout batch for %s: %s", recipient, err)
+			return
+		}
+		audit.Record(audit.Entry{
+			Kind:   audit.Ledger,
+			Action: "payout_batch",
+			Sats:   batch.Sats,
+			Eur:    batch.Eur,
+			Detail: fmt.Sprintf("batch %d of %d shares to %s by %s", batch.ID, batch.Shares, recipient, batch.CreatedBy),
+		})
+		if wantsJSON(r) {
+			err = json.NewEncoder(w).Encode(batch)
+			if err != nil {
+				log.Printf("error encoding payout batch: %s", err)
+			}
+			return
+		}
+		http.Redirect(w, r, "/admin/payouts", http.StatusSeeOther)
+		return
+	default:
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	unpaid, err := store.UnpaidShares()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("error loading unpaid shares: %s", err)
+		return
+	}
+	batches, err := store.PayoutBatches(50)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("error loading payout batches: %s", err)
+		return
+	}
+	// recipients are listed without their webhook secrets
+	type recipient struct {
+		ID      string  `json:"id"`
+		Name    string  `json:"name"`
+		Percent float64 `json:"percent"`
+	}
+	data := struct {
+		Recipients []recipient
+		Unpaid     []store.PayoutBatch
+		Batches    []store.PayoutBatch
+	}{Unpaid: unpaid, Batches: batches}
+	for _, rc := range revenue.Recipients {
+		data.Recipients = append(data.Recipients, recipient{rc.ID, rc.Name, rc.Percent})
+	}
+
+	if wantsJSON(r) {
+		err = json.NewEncoder(w).Encode(data)
+		if err != nil {
+			log.Printf("error encoding payouts response: %s", err)
+		}
+		return
+	}
+
+	err = BaseTemplate.ExecuteTemplate(w, "admin_payouts", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("template execution failed: %s", err)
+	}
+}
+
+// AdminReportsHandler reports invoices, revenue, SMS outcomes and the
+// operator balance over the last days, 30 unless the days parameter says
+// otherwise.
+func AdminReportsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	if store.DB == nil {
+		http.Error(w, "no database configured", http.StatusNotFound)
+		return
+	}
+
+	days, err := parking.ParseCount(r.URL.Query().Get("days"))
+	if err != nil || days < 1 || days > 366 {
+		days = 30
+	}
+
+	report, err := reports.Build(days)
+	if err != nil {
+		http.Error(w, "error building report", http.StatusInternalServerError)
+		log.Printf("error building report: %s", err)
+		return
+	}
+
+	if wantsJSON(r) {
+		err = json.NewEncoder(w).Encode(report)
+		if err != nil {
+			log.Printf("error encoding report: %s", err)
+		}
+		return
+	}
+
+	data := struct {
+		reports.Report
+		Period int
+	}{report, days}
+
+	err = BaseTemplate.ExecuteTemplate(w, "admin_reports", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("template execution failed: %s", err)
+	}
+}
+
+// AdminMonthlyReportHandler renders the printable report on a month for the
+// city or parking operator, the last full month unless the month parameter
+// (2006-01) says otherwise. The payments parameter is the operator's count of
+// all parking payments in the month, for the share paid over Lightning.
+func AdminMonthlyReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	if store.DB == nil {
+		http.Error(w, "no database configured", http.StatusNotFound)
+		return
+	}
+
+	month, err := time.ParseInLocation("2006-01", r.URL.Query().Get("month"), parking.Location)
+	if err != nil {
+		now := clock.Now().In(parking.Location)
+		month = time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, parking.Location)
+	}
+	payments, err := parking.ParseCount(r.URL.Query().Get("payments"))
+	if err != nil || payments < 0 {
+		payments = 0
+	}
+
+	report, err := reports.BuildMonthly(month, payments)
+	if err != nil {
+		http.Error(w, "error building report", http.StatusInternalServerError)
+		log.Printf("error building monthly report: %s", err)
+		return
+	}
+
+	if wantsJSON(r) {
+		err = json.NewEncoder(w).Encode(report)
+		if err != nil {
+			log.Printf("error encoding monthly report: %s", err)
+		}
+		return
+	}
+
+	data := struct {
+		reports.Monthly
+		Generated time.Time
+	}{report, clock.Now().In(parking.Location)}
+
+	err = BaseTemplate.ExecuteTemplate(w, "monthly_report", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("template execution failed: %s", err)
+	}
+}
+
+// AdminZonesHandler lists the zones in use and reloads them from the zones
+// file on POST.
+func AdminZonesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		_, err := parking.ReloadZones()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error reloading zones: %s", err), http.StatusBadRequest)
+			log.Printf("error reloading zones: %s", err)
+			return
+		}
+	default:
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(parking.AllZones())
+	if err != nil {
+		log.Printf("error encoding zones: %s", err)
+	}
+}
+
+func AdminSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	if store.DB == nil {
+		http.Error(w, "no database configured", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := store.OrderFilter{
+		Reference: strings.TrimSpace(query.Get("ref")),
+		Plate:     query.Get("plate"),
+		Zone:      query.Get("zone"),
+		State:     store.OrderState(query.Get("state")),
+		Tag:       query.Get("tag"),
+	}
+	filter.Page, _ = strconv.Atoi(query.Get("page"))
+	if filter.Page < 0 {
+		filter.Page = 0
+	}
+	if from, err := time.ParseInLocation("2006-01-02", query.Get("from"), time.Local); err == nil {
+		filter.From = from
+	}
+	if to, err := time.ParseInLocation("2006-01-02", query.Get("to"), time.Local); err == nil {
+		filter.To = to.AddDate(0, 0, 1)
+	}
+
+	orders, more, err := store.SearchOrders(filter)
+	if err != nil {
+		http.Error(w, "error searching sessions", http.StatusInternalServerError)
+		log.Printf("error searching orders: %s", err)
+		return
+	}
+
+	if wantsJSON(r) {
+		err = json.NewEncoder(w).Encode(struct {
+			Orders []store.Order
+			More   bool
+		}{orders, more})
+		if err != nil {
+			log.Printf("error encoding sessions response: %s", err)
+		}
+		return
+	}
+
+	pageLink := func(page int) string {
+		q := r.URL.Query()
+		q.Set("page", strconv.Itoa(page))
+		return "?" + q.Encode()
+	}
+
+	data := struct {
+		Query    url.Values
+		States   []store.OrderState
+		Tags     []string
+		Orders   []store.Order
+		Previous string
+		Next     string
+	}{
+		Query:  query,
+		States: store.OrderStates,
+		Tags:   store.OrderTags,
+		Orders: orders,
+	}
+	if filter.Page > 0 {
+		data.Previous = pageLink(filter.Page - 1)
+	}
+	if more {
+		data.Next = pageLink(filter.Page + 1)
+	}
+
+	err = BaseTemplate.ExecuteTemplate(w, "admin_sessions", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("template execution failed: %s", err)
+	}
+}
+
+// AdminSessionHandler shows one order with its support notes and lets admins
+// tag it, add notes and move it to another plate before its SMS goes out.
+func AdminSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if store.DB == nil {
+		http.Error(w, "no database configured", http.StatusNotFound)
+		return
+	}
+
+	paymentHash := r.FormValue("hash")
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		var err error
+		if tag, ok := r.PostForm["tag"]; ok {
+			if !validTag(tag[0]) {
+				http.Error(w, "unknown tag", http.StatusBadRequest)
+				return
+			}
+			err = store.SetOrderTag(paymentHash, tag[0])
+		}
+		if note := strings.TrimSpace(r.PostFormValue("note")); err == nil && len(note) > 0 {
+			err = store.AddOrderNote(paymentHash, adminName(r), note)
+		}
+		if _, ok := r.PostForm["refund_overpayment"]; err == nil && ok {
+			err = lnd.RecordOverpaymentReturned(paymentHash, adminName(r))
+			if err == lnd.ErrNoOverpayment {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if _, ok := r.PostForm["refund_sent"]; err == nil && ok {
+			err = bulk.RecordRefund(paymentHash, adminName(r))
+			if err == bulk.ErrNoRefundOwed {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if plate, ok := r.PostForm["plate"]; err == nil && ok {
+			err = transferOrder(paymentHash, plate[0], adminName(r))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if err != nil {
+			http.Error(w, "error updating session", http.StatusInternalServerError)
+			log.Printf("error updating order %s: %s", paymentHash, err)
+			return
+		}
+		http.Redirect(w, r, "/admin/session?hash="+url.QueryEscape(paymentHash), http.StatusSeeOther)
+		return
+	default:
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	order, err := store.GetOrder(paymentHash)
+	if err == sql.ErrNoRows {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "error loading session", http.StatusInternalServerError)
+		log.Printf("error loading order %s: %s", paymentHash, err)
+		return
+	}
+
+	notes, err := store.OrderNotes(paymentHash)
+	if err != nil {
+		http.Error(w, "error loading notes", http.StatusInternalServerError)
+		log.Printf("error loading notes of order %s: %s", paymentHash, err)
+		return
+	}
+
+	data := struct {
+		Order        store.Order
+		Notes        []store.OrderNote
+		Tags         []string
+		Transferable bool
+	}{order, notes, store.OrderTags, lnd.InvoiceHandler != nil && lnd.Transferable(order)}
+
+	if wantsJSON(r) {
+		err = json.NewEncoder(w).Encode(data)
+		if err != nil {
+			log.Printf("error encoding session response: %s", err)
+		}
+		return
+	}
+
+	err = BaseTemplate.ExecuteTemplate(w, "admin_session", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("template execution failed: %s", err)
+	}
+}
+
+// transferOrder moves a paid order to the plate it was meant for, noting who
+// did on the order.
+func transferOrder(paymentHash, plate, admin string) error {
+	if lnd.InvoiceHandler == nil {
+		return errUnavailable
+	}
+	plate, err := parking.NormalizePlate(plate)
+	if err != nil {
+		return err
+	}
+	order, err := store.GetOrder(paymentHash)
+	if err != nil {
+		return err
+	}
+
+	err = lnd.InvoiceHandler.Transfer(paymentHash, plate, admin)
+	if err != nil {
+		return err
+	}
+	return store.AddOrderNote(paymentHash, admin, fmt.Sprintf("transferred from %s to %s", order.Plate, plate))
+}
+
+func validTag(tag string) bool {
+	if len(tag) == 0 {
+		return true
+	}
+	for _, t := range store.OrderTags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+const bulkTimeLayout = "2006-01-02T15:04"
+
+// AdminBulkHandler previews the orders hit by an incident in a time range,
+// and resends their parking SMS or refunds them for the previewed orders in
+// the hash parameters.
+func AdminBulkHandler(w http.ResponseWriter, r *http.Request) {
+	if store.DB == nil {
+		http.Error(w, "no database configured", http.StatusNotFound)
+		return
+	}
+
+	from, fromErr := time.ParseInLocation(bulkTimeLayout, r.FormValue("from"), time.Local)
+	to, toErr := time.ParseInLocation(bulkTimeLayout, r.FormValue("to"), time.Local)
+	rangeSet := fromErr == nil && toErr == nil
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if len(r.Form["hash"]) == 0 {
+			http.Error(w, "no sessions selected", http.StatusBadRequest)
+			return
+		}
+		err := bulk.Start(bulk.Action(r.FormValue("action")), r.Form["hash"], adminName(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Redirect(w, r, "/admin/bulk", http.StatusSeeOther)
+		return
+	default:
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	data := struct {
+		From    string
+		To      string
+		Preview []store.Order
+		Job     bulk.Job
+	}{
+		From: r.FormValue("from"),
+		To:   r.FormValue("to"),
+		Job:  bulk.Current(),
+	}
+
+	if rangeSet {
+		var err error
+		data.Preview, err = bulk.Preview(from, to)
+		if err != nil {
+			http.Error(w, "error selecting sessions", http.StatusInternalServerError)
+			log.Printf("error previewing bulk action: %s", err)
+			return
+		}
+	}
+
+	if wantsJSON(r) {
+		err := json.NewEncoder(w).Encode(data)
+		if err != nil {
+			log.Printf("error encoding bulk response: %s", err)
+		}
+		return
+	}
+
+	err := BaseTemplate.ExecuteTemplate(w, "admin_bulk", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("template execution failed: %s", err)
+	}
+}
+
+// adminName is who is making an admin request, for notes and audit entries.
+func adminName(r *http.Request) string {
+	if cookie, err := r.Cookie(admin.SessionCookie); err == nil {
+		if name, ok := admin.SessionUser(cookie.Value); ok {
+			return name
+		}
+	}
+	if name, ok := r.Context().Value(tokenNameKey{}).(string); ok {
+		return "token " + name
+	}
+	return "api"
+}
+
+func wantsJSON(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json")
+}
@@ -0,0 +1,440 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"ljightningparking/catalogue"
+	"ljightningparking/clock"
+	"ljightningparking/features"
+	"ljightningparking/lnd"
+	"ljightningparking/money"
+	"ljightningparking/parking"
+	"ljightningparking/price"
+	"ljightningparking/store"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const feesCacheTime = time.Minute
+
+type zoneFee struct {
+	Zone        string  `json:"zone"`
+	EurPerHour  float64 `json:"eur_per_hour"`
+	MaxHours    float64 `json:"max_hours"`
+	SatsPerHour int64   `json:"sats_per_hour,omitempty"`
+	SatsForMax  int64   `json:"sats_for_max_hours,omitempty"`
+}
+
+type feeTable struct {
+	Zones      []zoneFee  `json:"zones"`
+	BtcEur     float64    `json:"btceur,omitempty"`
+	RateTime   *time.Time `json:"rate_time,omitempty"`
+	RateSource string     `json:"rate_source,omitempty"`
+	StaleRate  bool       `json:"stale_rate"`
+	HourStep   float64    `json:"hour_step"`
+	Generated  time.Time  `json:"generated"`
+}
+
+var fees struct {
+	body      []byte
+	generated time.Time
+	sync.Mutex
+}
+
+// FeesHandler serves the price table of all zones for wallet and app
+// developers. It is regenerated at most once a minute.
+func FeesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	fees.Lock()
+	if clock.Since(fees.generated) > feesCacheTime {
+		body, err := json.Marshal(buildFeeTable())
+		if err != nil {
+			fees.Unlock()
+			http.Error(w, "error encoding fees", http.StatusInternalServerError)
+			log.Printf("error encoding fee table: %s", err)
+			return
+		}
+		fees.body = body
+		fees.generated = clock.Now()
+	}
+	body := fees.body
+	fees.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(feesCacheTime.Seconds())))
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(body)
+}
+
+func buildFeeTable() feeTable {
+	table := feeTable{Generated: clock.Now(), HourStep: parking.HourStep()}
+
+	quote, err := price.GetQuote("btceur")
+	if err == nil {
+		table.BtcEur = quote.Rate
+		table.RateTime = &quote.FetchedAt
+		table.RateSource = quote.Source
+		table.StaleRate = quote.Stale
+	}
+
+	for _, zone := range parking.AllZones() {
+		if zone.Informational {
+			continue
+		}
+		fee := zoneFee{
+			Zone:       zone.Name,
+			EurPerHour: zone.Price,
+			MaxHours:   zone.MaxTime,
+		}
+		if err == nil {
+			rate := quote.Conversion()
+			fee.SatsPerHour = rate.Msat(zone.Tariff()).Sats()
+			fee.SatsForMax = rate.Msat(zone.GetParkingFee(zone.MaxTime)).Sats()
+		}
+		table.Zones = append(table.Zones, fee)
+	}
+
+	return table
+}
+
+// ZoneSuggestHandler orders the zone picker suggestions by the plate's
+// registration region. It only works with the plate-region feature enabled
+// and never logs or stores the plate.
+func ZoneSuggestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" || !features.Enabled("plate-region") {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	err := json.NewEncoder(w).Encode(parking.SuggestZones(r.URL.Query().Get("plate")))
+	if err != nil {
+		log.Printf("error encoding zone suggestions: %s", err)
+	}
+}
+
+// OrderDocumentHandler serves the canonical order json at /order/{hash}, so a
+// payer can check what their invoice's description hash commits to.
+func OrderDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	hash := strings.TrimPrefix(r.URL.Path, "/order/")
+	if r.Method != "GET" || store.DB == nil || len(hash) != 64 {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	document, err := store.GetOrderDocument(strings.ToLower(hash))
+	if err == sql.ErrNoRows {
+		http.Error(w, "order not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "error loading order", http.StatusInternalServerError)
+		log.Printf("error loading order document %s: %s", hash, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Write(document)
+}
+
+type apiZone struct {
+	Name       string            `json:"name"`
+	EurPerHour float64           `json:"eur_per_hour"`
+	MaxHours   float64           `json:"max_hours"`
+	Schedule   *parking.Schedule `json:"schedule,omitempty"`
+	// Purchasable is false for zones sold only at parking meters, Nearest
+	// then names the closest zone that can be bought here.
+	Purchasable bool   `json:"purchasable"`
+	Nearest     string `json:"nearest,omitempty"`
+	// Wayfinding has photos, the entrance and where to pay at a parking
+	// meter instead, when known.
+	Wayfinding *parking.Wayfinding `json:"wayfinding,omitempty"`
+}
+
+// ProductsHandler lists the catalogue, hourly parking in every zone and the
+// products configured besides it.
+func ProductsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, catalogue.All())
+}
+
+// ZonesHandler lists the zones with their prices, maximum parking time and
+// charging windows, in minutes since local midnight by weekday, and whether
+// they can be bought here.
+func ZonesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	var zones []apiZone
+	for _, z := range parking.AllZones() {
+		zones = append(zones, apiZone{z.Name, z.Price, z.MaxTime, z.Schedule, !z.Informational, z.Nearest, z.Wayfinding})
+	}
+	writeJSON(w, zones)
+}
+
+type apiEstimate struct {
+	Zone  string    `json:"zone"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Hours is what to buy, zero when parking is free until End.
+	Hours        float64     `json:"hours"`
+	ChargedHours float64     `json:"charged_hours"`
+	Eur          money.Cents `json:"eur"`
+	AmountSat    int64       `json:"amount_sat,omitempty"`
+	PaidUntil    time.Time   `json:"paid_until"`
+	Free         bool        `json:"free"`
+}
+
+// EstimateHandler works out the parking to buy in a zone to be covered until
+// the until parameter, like 14:30 tomorrow, from now or the start parameter
+// on. Free evenings and weekends are not charged, so what is returned can be
+// less than the time until then, and paid parking can run past it.
+func EstimateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	zone, ok := parking.GetZone(query.Get("zone"))
+	if !ok {
+		apiError(w, http.StatusBadRequest, "zone does not exist: "+query.Get("zone"))
+		return
+	}
+	if zone.Informational {
+		apiError(w, http.StatusBadRequest, notSold(zone).Error())
+		return
+	}
+
+	start := clock.Now()
+	if value := query.Get("start"); len(value) > 0 {
+		var err error
+		start, err = parking.ParseUntil(value, start)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "invalid start: "+err.Error())
+			return
+		}
+	}
+	end, err := parking.ParseUntil(query.Get("until"), start)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	estimate, err := zone.Estimate(start, end)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	response := apiEstimate{
+		Zone:         zone.Name,
+		Start:        estimate.Start,
+		End:          estimate.End,
+		Hours:        estimate.Hours,
+		ChargedHours: estimate.Charged.Hours(),
+		Eur:          estimate.Fee,
+		PaidUntil:    estimate.PaidUntil,
+		Free:         estimate.Free(),
+	}
+	if !estimate.Free() {
+		breakdown, err := price.Break(estimate.Fee)
+		if err == nil {
+			response.Eur = breakdown.Total
+			response.AmountSat = breakdown.Sats
+		}
+	}
+	writeJSON(w, response)
+}
+
+type apiInvoice struct {
+	PaymentHash    string           `json:"payment_hash"`
+	PaymentRequest string           `json:"payment_request,omitempty"`
+	Product        string           `json:"product"`
+	Zone           string           `json:"zone"`
+	Hours          float64          `json:"hours"`
+	AmountSat      int64            `json:"amount_sat"`
+	Expiry         time.Time        `json:"expiry"`
+	State          store.OrderState `json:"state,omitempty"`
+	PaidUntil      time.Time        `json:"paid_until"`
+	ValidUntil     *time.Time       `json:"valid_until,omitempty"`
+	// PaymentLink and ReceiptLink are short urls for sharing in chats and
+	// SMS, the first expiring with the invoice.
+	PaymentLink string `json:"payment_link,omitempty"`
+	ReceiptLink string `json:"receipt_link,omitempty"`
+	// Verify is the invoice's LNURL-verify url, for checking settlement
+	// without credentials.
+	Verify string `json:"verify,omitempty"`
+}
+
+// InvoicesHandler creates invoices on POST /api/v1/invoices, from a json or
+// form body with zone, plate and hours, and reports an invoice's state on GET
+// /api/v1/invoices/{payment hash}.
+func InvoicesHandler(w http.ResponseWriter, r *http.Request) {
+	hash := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/v1/invoices"), "/")
+
+	switch {
+	case r.Method == "POST" && len(hash) == 0:
+		createInvoice(w, r)
+	case r.Method == "GET" && len(hash) == 64:
+		getInvoice(w, strings.ToLower(hash))
+	default:
+		apiError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func createInvoice(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Zone     string      `json:"zone"`
+		Plate    string      `json:"plate"`
+		Hours    json.Number `json:"hours"`
+		Product  string      `json:"product"`
+		Quantity json.Number `json:"quantity"`
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "invalid json body")
+			return
+		}
+	} else {
+		body.Zone, body.Plate, body.Hours = r.FormValue("zone"), r.FormValue("plate"), json.Number(r.FormValue("hours"))
+		body.Product, body.Quantity = r.FormValue("product"), json.Number(r.FormValue("quantity"))
+	}
+
+	var order orderRequest
+	var err error
+	if len(body.Product) > 0 {
+		order, err = parseProductRequest(body.Product, body.Plate, body.Quantity.String())
+	} else {
+		order, err = parseOrderRequest(body.Zone, body.Plate, body.Hours.String())
+	}
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	invoice, err := issueInvoice(clientIP(r), order)
+	if err == errVerificationRequired {
+		apiError(w, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	if err == errUnavailable {
+		apiError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if err == errRateLimited {
+		w.Header().Set("Retry-After", "60")
+		apiError(w, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	if errors.Is(err, lnd.ErrTooManyOutstanding) {
+		apiError(w, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	if errors.Is(err, lnd.ErrBusy) {
+		w.Header().Set("Retry-After", "10")
+		apiError(w, http.StatusServiceUnavailable, "too many invoices are being created, please retry shortly")
+		return
+	}
+	if errors.Is(err, price.ErrNoPrice) {
+		apiError(w, http.StatusServiceUnavailable, "exchange rate is currently unavailable, please try again later")
+		return
+	}
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "error while generating ln invoice")
+		log.Printf("error while generating ln invoice: %s", err)
+		return
+	}
+
+	writeJSONStatus(w, http.StatusCreated, apiInvoice{
+		PaymentHash:    invoice.Receipt.Record.PaymentHash,
+		PaymentRequest: invoice.PaymentRequest,
+		Product:        order.product.ID,
+		Zone:           order.zone.Name,
+		Hours:          order.hours,
+		AmountSat:      invoice.Receipt.Record.Sats,
+		Expiry:         time.Unix(invoice.Expiry, 0),
+		State:          store.OrderPending,
+		PaidUntil:      invoice.PaidUntil,
+		PaymentLink:    shortLink(r, "lightning:"+invoice.PaymentRequest, time.Unix(invoice.Expiry, 0)),
+		ReceiptLink:    shortLink(r, "/order/"+invoice.Receipt.Record.OrderHash, invoice.PaidUntil.Add(receiptLinkTTL)),
+		Verify:         verifyURL(r, invoice.Receipt.Record.PaymentHash),
+	})
+}
+
+func getInvoice(w http.ResponseWriter, paymentHash string) {
+	if store.DB == nil {
+		apiError(w, http.StatusNotFound, "no database configured")
+		return
+	}
+
+	o, err := store.GetOrder(paymentHash)
+	if err == sql.ErrNoRows {
+		apiError(w, http.StatusNotFound, "invoice not found")
+		return
+	}
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "error loading invoice")
+		log.Printf("error loading order %s: %s", paymentHash, err)
+		return
+	}
+
+	invoice := apiInvoice{
+		PaymentHash: o.PaymentHash,
+		Product:     o.Product,
+		Zone:        o.Zone,
+		Hours:       o.Hours,
+		AmountSat:   o.Sats,
+		Expiry:      time.Unix(o.ExpiresAt, 0),
+		State:       o.State,
+	}
+	if len(invoice.Product) == 0 {
+		if zone, ok := parking.GetZone(o.Zone); ok {
+			invoice.Product = catalogue.HourlyProduct(zone).ID
+		}
+	}
+	if product, ok := catalogue.Get(invoice.Product); ok {
+		_, invoice.PaidUntil, _ = catalogue.Quote(product, o.CreatedAt, o.Hours)
+	}
+	if o.ValidUntil.Valid {
+		invoice.ValidUntil = &o.ValidUntil.Time
+	}
+	writeJSON(w, invoice)
+}
+
+func apiError(w http.ResponseWriter, status int, message string) {
+	writeJSONStatus(w, status, struct {
+		Error string `json:"error"`
+	}{message})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+func writeJSONStatus(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("error encoding json response: %s", err)
+	}
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"ljightningparking/dataset"
+	"ljightningparking/theme"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// OpenDataHandler describes the public dataset of Lightning parking
+// purchases at /open-data and serves it as CSV at /open-data/usage.csv.
+func OpenDataHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	body, summary := dataset.CSV()
+
+	switch r.URL.Path {
+	case "/open-data":
+	case "/open-data/usage.csv":
+		if body == nil {
+			http.Error(w, "the dataset is being generated, please try again shortly", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="ljightningparking-usage.csv"`)
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Last-Modified", summary.Generated.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body)
+		return
+	default:
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	data := struct {
+		Theme        theme.Theme
+		Summary      dataset.Summary
+		MinPurchases int
+	}{theme.For(r), summary, dataset.MinPurchases}
+
+	err := BaseTemplate.ExecuteTemplate(w, "open_data", data)
+	if err != nil {
+		log.Printf("template execution failed: %s", err)
+	}
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"ljightningparking/balance"
+	"ljightningparking/clock"
+	"ljightningparking/events"
+	"ljightningparking/links"
+	"ljightningparking/store"
+	"log"
+	"net/http"
+	"time"
+)
+
+const eventsKeepAlive = 25 * time.Second
+
+// EventsHandler streams server-sent events about one order, keyed by its
+// payment request, so the pay page doesn't have to poll /check. The current
+// state is sent first, in case it changed before the page subscribed.
+func EventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	paymentRequest := r.URL.Query().Get("paymentRequest")
+	if len(paymentRequest) == 0 {
+		http.Error(w, "paymentRequest parameter missing", http.StatusNotFound)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ch, unsubscribe := events.Subscribe(paymentRequest)
+	defer unsubscribe()
+	if ch == nil {
+		http.Error(w, "too many event streams, poll /check instead", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	if outdatedClient(r) {
+		fmt.Fprint(w, "event: refresh\ndata: {}\n\n")
+	}
+	if current, ok := currentEvent(paymentRequest); ok {
+		writeEvent(w, current)
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case e := <-ch:
+			writeEvent(w, e)
+		case <-clock.After(eventsKeepAlive):
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// currentEvent derives the latest event of an order from the store.
+func currentEvent(paymentRequest string) (events.Event, bool) {
+	if store.DB == nil {
+		return events.Event{}, false
+	}
+
+	order, err := store.GetOrderByPaymentRequest(paymentRequest)
+	if err != nil {
+		return events.Event{}, false
+	}
+
+	e := events.Event{}
+	switch order.State {
+	case store.OrderAccepted, store.OrderPaid:
+		e.Name = events.Paid
+	case store.OrderSmsFailed:
+		e.Name = events.SmsFailed
+	case store.OrderCancelled:
+		e.Name = events.Cancelled
+	case store.OrderRejected:
+		e.Name = events.Rejected
+	case store.OrderRefundOwed:
+		e.Name = events.RefundOwed
+	case store.OrderConfirmed:
+		e.Name = events.SmsSent
+		if len(order.Reply) > 0 {
+			e.Name = events.Confirmed
+		} else if order.ReplyFollowup > 0 {
+			e = balance.PendingEvent(order)
+		}
+		if order.ValidUntil.Valid {
+			e.ValidUntil = order.ValidUntil.Time.Format(time.RFC3339)
+		}
+	default:
+		return e, false
+	}
+	e.Link = links.Payment(order.PaymentHash)
+	return e, true
+}
+
+func writeEvent(w http.ResponseWriter, e events.Event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("error encoding event: %s", err)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Name, data)
+}
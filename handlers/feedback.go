@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"ljightningparking/ratelimit"
+	"ljightningparking/store"
+	"ljightningparking/theme"
+	"log"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxFeedbackMessage = 2000
+	maxFeedbackContact = 200
+	maxFeedbackPage    = 200
+)
+
+var errFeedbackRateLimited = errors.New("you sent a lot of feedback just now, please try again in a few minutes")
+
+// FeedbackHandler stores what a user reports from the feedback form on the
+// purchase pages. The form posts with fetch so the user stays where they
+// were, without javascript the response links back to the page.
+func FeedbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	if store.DB == nil {
+		http.Error(w, "no database configured", http.StatusNotFound)
+		return
+	}
+
+	f, status, err := parseFeedback(r)
+	if err == nil && status == http.StatusOK {
+		err = store.InsertFeedback(f)
+		if err != nil {
+			log.Printf("error storing feedback: %s", err)
+			status, err = http.StatusInternalServerError, errors.New("your feedback could not be saved, please try again later")
+		}
+	}
+
+	if wantsJSON(r) {
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		err = json.NewEncoder(w).Encode(struct {
+			OK bool `json:"ok"`
+		}{true})
+		if err != nil {
+			log.Printf("error encoding feedback response: %s", err)
+		}
+		return
+	}
+
+	data := struct {
+		Theme theme.Theme
+		Error string
+		Page  string
+	}{Theme: theme.For(r), Page: f.Page}
+	if err != nil {
+		data.Error = err.Error()
+	}
+	// the pay page is only posted to, its purchase form is the way back
+	if len(data.Page) == 0 || data.Page == "/pay" {
+		data.Page = "/"
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err = BaseTemplate.ExecuteTemplate(w, "feedback", data)
+	if err != nil {
+		log.Printf("template execution failed: %s", err)
+	}
+}
+
+// parseFeedback validates the submitted feedback. Submissions filling in the
+// hidden website field are bots, they get an OK status without an error but
+// with nothing to store.
+func parseFeedback(r *http.Request) (store.Feedback, int, error) {
+	f := store.Feedback{
+		Message: strings.TrimSpace(r.FormValue("message")),
+		Contact: strings.TrimSpace(r.FormValue("contact")),
+	}
+	// only paths on this site are linked back to
+	page := r.FormValue("page")
+	if strings.HasPrefix(page, "/") && !strings.HasPrefix(page, "//") && len(page) <= maxFeedbackPage {
+		f.Page = page
+	}
+
+	if len(r.FormValue("website")) > 0 {
+		return f, http.StatusAccepted, nil
+	}
+	if !ratelimit.AllowFeedback(clientIP(r)) {
+		return f, http.StatusTooManyRequests, errFeedbackRateLimited
+	}
+
+	switch {
+	case len(f.Message) == 0:
+		return f, http.StatusBadRequest, errors.New("please tell us what went wrong")
+	case utf8.RuneCountInString(f.Message) > maxFeedbackMessage:
+		return f, http.StatusBadRequest, errors.New("your message is too long, please shorten it")
+	case utf8.RuneCountInString(f.Contact) > maxFeedbackContact:
+		return f, http.StatusBadRequest, errors.New("your contact is too long")
+	}
+	return f, http.StatusOK, nil
+}
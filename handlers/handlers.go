@@ -2,13 +2,22 @@ package handlers
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
 	"html/template"
+	"ljightningparking/alerts"
+	"ljightningparking/events"
+	"ljightningparking/experiment"
+	"ljightningparking/features"
 	"ljightningparking/lnd"
 	"ljightningparking/parking"
+	"ljightningparking/price"
+	"ljightningparking/receipt"
+	"ljightningparking/stats"
+	"ljightningparking/store"
+	"ljightningparking/theme"
 	"log"
 	"net/http"
-	"strconv"
+	"time"
 )
 
 var BaseTemplate *template.Template
@@ -20,10 +29,35 @@ func MainHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := BaseTemplate.ExecuteTemplate(w, "main", nil)
+	stats.Record(stats.AllZones, stats.Viewed)
+
+	renderForm(w, r, http.StatusOK, "")
+}
+
+// renderForm shows the purchase form, filled in with the submitted values and
+// the problem with them when there is one.
+func renderForm(w http.ResponseWriter, r *http.Request, status int, problem string) {
+	data := struct {
+		Theme        theme.Theme
+		SuggestZones bool
+		Error        string
+		Zone         string
+		Plate        string
+		Hours        string
+	}{
+		theme.For(r),
+		features.Enabled("plate-region"),
+		problem,
+		r.FormValue("zone"),
+		r.FormValue("plate"),
+		r.FormValue("hours"),
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err := BaseTemplate.ExecuteTemplate(w, "main", data)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Printf("template execution failed")
+		log.Printf("template execution failed: %s", err)
 	}
 }
 
@@ -34,48 +68,91 @@ func PayHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	zoneName := r.FormValue("zone")
+	zoneName, plate, hours := r.FormValue("zone"), r.FormValue("plate"), r.FormValue("hours")
 
-	payZone, ok := parking.Zones[zoneName]
-
-	if !ok {
-		http.Error(w, fmt.Sprintf("zone does not exit: %s", zoneName), http.StatusInternalServerError)
+	order, err := parseOrderRequest(zoneName, plate, hours)
+	if err != nil {
+		renderForm(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	plate := r.FormValue("plate")
+	renderInvoice(w, r, order)
+}
 
-	if checkPlate(plate) != nil {
-		http.Error(w, fmt.Sprintf("invalid licence plate: %s", plate), http.StatusInternalServerError)
+// renderInvoice shows the invoice paying for a submitted order, or what to do
+// when one can't be created right now.
+func renderInvoice(w http.ResponseWriter, r *http.Request, order orderRequest) {
+	zoneName, plate, hours := r.FormValue("zone"), r.FormValue("plate"), r.FormValue("hours")
+
+	ip := clientIP(r)
+	invoice, err := issueInvoice(ip, order)
+	if err == errVerificationRequired {
+		renderVerify(w, r, ip, zoneName, plate, hours)
+		return
+	}
+	if err == errUnavailable {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err == errRateLimited || errors.Is(err, lnd.ErrBusy) {
+		renderBusy(w, r, zoneName, plate, hours)
+		return
+	}
+	if errors.Is(err, lnd.ErrTooManyOutstanding) {
+		renderForm(w, r, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	if errors.Is(err, price.ErrNoPrice) {
+		http.Error(w, "exchange rate is currently unavailable, please try again later", http.StatusServiceUnavailable)
+		log.Printf("error while generating ln invoice: %s", err)
 		return
 	}
-
-	hours := r.FormValue("hours")
-
-	hoursInt, err := strconv.ParseInt(hours, 10, 64)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("invalid hours to park: %s", err.Error()), http.StatusInternalServerError)
+		http.Error(w, "error while generating ln invoice", http.StatusInternalServerError)
+		log.Printf("error while generating ln invoice: %s", err)
 		return
 	}
 
-	//invoice := lnd.InvoiceHandler.GetInvoice(payZone, plate, hoursInt)
-	//if len(invoice.PaymentRequest) == 0 {
-	//	http.Error(w, fmt.Sprintf("error while generating ln invoice"), http.StatusInternalServerError)
-	//	return
-	//}
+	variant := experiment.PayPage.Assign(w, r)
+	label := experiment.PayPage.Label(variant)
+	lnd.InvoiceHandler.SetVariant(invoice.PaymentRequest, label)
+	stats.RecordVariant(label, stats.Invoiced)
 
 	key := lnd.InvoiceKey{
-		Zone:  payZone,
-		Plate: plate,
-		Hours: hoursInt,
+		Zone:    order.zone,
+		Plate:   order.plate,
+		Hours:   order.hours,
+		Product: order.product,
 	}
 
 	data := struct {
+		Theme          theme.Theme
 		PaymentRequest string
-		SmsData string
+		SmsData        string
+		StaleRate      bool
+		Variant        string
+		WalletLink     template.URL
+		Receipt        receipt.Signed
+		PublicKey      string
+		CreditedSats   int64
+		PaidUntil      time.Time
+		Breakdown      price.Breakdown
+		Address        string
+		Wayfinding     *parking.Wayfinding
 	}{
-		"someLnPaymentRequest",
+		theme.For(r),
+		invoice.PaymentRequest,
 		key.Message(),
+		invoice.StaleRate,
+		variant,
+		template.URL("lightning:" + invoice.PaymentRequest),
+		invoice.Receipt,
+		receipt.PublicKey(),
+		invoice.CreditedSats,
+		invoice.PaidUntil.In(parking.Location),
+		invoice.Breakdown,
+		order.lightningAddress(r.Host),
+		order.zone.Wayfinding,
 	}
 
 	err = BaseTemplate.ExecuteTemplate(w, "pay", data)
@@ -83,7 +160,6 @@ func PayHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		log.Printf("template execution failed: %s", err)
 	}
-
 }
 
 func CheckHandler(w http.ResponseWriter, r *http.Request) {
@@ -99,10 +175,29 @@ func CheckHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if lnd.InvoiceHandler == nil {
+		http.Error(w, "lightning payments are not available", http.StatusServiceUnavailable)
+		return
+	}
+
 	response := make(map[string]interface{})
 	response["paymentRequest"] = data[0]
 	response["isPaid"] = lnd.InvoiceHandler.CheckInvoice(data[0])
 
+	if store.DB != nil {
+		order, err := store.GetOrderByPaymentRequest(data[0])
+		if err == nil {
+			response["state"] = order.State
+			if order.ValidUntil.Valid {
+				response["validUntil"] = order.ValidUntil.Time
+			}
+			if order.State == store.OrderConfirmed && len(order.Reply) == 0 && order.ReplyFollowup > 0 {
+				response["state"] = events.Pending
+				response["reference"] = order.Reference()
+			}
+		}
+	}
+
 	err := json.NewEncoder(w).Encode(response)
 	if err != nil {
 		http.Error(w, "error encoding json response", http.StatusNotFound)
@@ -111,6 +206,83 @@ func CheckHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func checkPlate(plate string) error {
-	return nil
-}
\ No newline at end of file
+func ReceiptKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	err := json.NewEncoder(w).Encode(map[string]string{
+		"algorithm": "ed25519",
+		"publicKey": receipt.PublicKey(),
+	})
+	if err != nil {
+		log.Printf("error encoding receipt key response: %s", err)
+	}
+}
+
+func AlertRulesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	rules, err := alerts.Rules(alerts.Config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("error generating alert rules: %s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(rules)
+}
+
+// renderBusy asks the user to resubmit the same form in a few seconds when lnd
+// is pushing back on invoice creation.
+func renderBusy(w http.ResponseWriter, r *http.Request, zone, plate, hours string) {
+	data := struct {
+		Theme  theme.Theme
+		Action string
+		Zone   string
+		Plate  string
+		Hours  string
+	}{theme.For(r), r.URL.Path, zone, plate, hours}
+
+	w.Header().Set("Retry-After", "5")
+	w.WriteHeader(http.StatusServiceUnavailable)
+
+	err := BaseTemplate.ExecuteTemplate(w, "busy", data)
+	if err != nil {
+		log.Printf("template execution failed: %s", err)
+	}
+}
+
+// renderVerify shows the 1 sat verification invoice to a client creating
+// unusually many invoices. Once paid the page resubmits the original form.
+func renderVerify(w http.ResponseWriter, r *http.Request, ip, zone, plate, hours string) {
+	invoice, err := lnd.InvoiceHandler.GetVerificationInvoice(ip)
+	if errors.Is(err, lnd.ErrBusy) {
+		renderBusy(w, r, zone, plate, hours)
+		return
+	}
+	if err != nil {
+		http.Error(w, "error while generating ln invoice", http.StatusInternalServerError)
+		log.Printf("error while generating verification invoice: %s", err)
+		return
+	}
+
+	data := struct {
+		Theme          theme.Theme
+		PaymentRequest string
+		Action         string
+		Zone           string
+		Plate          string
+		Hours          string
+	}{theme.For(r), invoice.PaymentRequest, r.URL.Path, zone, plate, hours}
+
+	err = BaseTemplate.ExecuteTemplate(w, "verify", data)
+	if err != nil {
+		log.Printf("template execution failed: %s", err)
+	}
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"ljightningparking/clock"
+	"ljightningparking/lnd"
+	"ljightningparking/replication"
+	"ljightningparking/store"
+	"net/http"
+	"time"
+)
+
+// HealthHandler reports whether lnd and the database are reachable, and on a
+// standby whether it keeps up with the primary, with 503 when any is not, for
+// reverse proxies and watchdogs to restart on.
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	checks := make(map[string]string)
+	healthy := true
+
+	if lnd.InvoiceHandler != nil {
+		checks["lnd"] = "ok"
+		if err := lnd.InvoiceHandler.Ping(); err != nil {
+			checks["lnd"], healthy = err.Error(), false
+		}
+	}
+	if store.DB != nil {
+		checks["db"] = "ok"
+		if err := store.Ping(); err != nil {
+			checks["db"], healthy = err.Error(), false
+		}
+	}
+
+	if standby := replication.Current(); len(standby.Primary) > 0 {
+		checks["replication"] = "ok"
+		if clock.Since(standby.LastContact) > time.Minute {
+			checks["replication"], healthy = "no contact with the primary since "+standby.LastContact.Format(time.RFC3339), false
+			if len(standby.LastError) > 0 {
+				checks["replication"] += ": " + standby.LastError
+			}
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	status := http.StatusOK
+	if !healthy {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSONStatus(w, status, checks)
+}
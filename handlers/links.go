@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"database/sql"
+	"ljightningparking/links"
+	"ljightningparking/parking"
+	"ljightningparking/store"
+	"ljightningparking/theme"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ShortLinkHandler redirects /l/{code} to the url it was created for, for
+// payment and receipt links in messages where the full url is unwieldy.
+func ShortLinkHandler(w http.ResponseWriter, r *http.Request) {
+	code := strings.TrimPrefix(r.URL.Path, "/l/")
+	if r.Method != "GET" || store.DB == nil || len(code) == 0 {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	link, err := store.GetShortLink(code)
+	if err == sql.ErrNoRows {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "error loading link", http.StatusInternalServerError)
+		log.Printf("error loading short link %s: %s", code, err)
+		return
+	}
+	if link.Expired() {
+		http.Error(w, "this link has expired", http.StatusGone)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, link.Target, http.StatusFound)
+}
+
+// receiptLinkTTL is how long after the parking runs out a receipt link still
+// opens, long enough for a fine to be disputed with it.
+const receiptLinkTTL = 90 * 24 * time.Hour
+
+// shortLink returns a short url for target where clients reach the service,
+// or "" when there is no database to keep it in.
+func shortLink(r *http.Request, target string, expiresAt time.Time) string {
+	if store.DB == nil {
+		return ""
+	}
+
+	link, err := store.CreateShortLink(target, expiresAt)
+	if err != nil {
+		log.Printf("error creating short link: %s", err)
+		return ""
+	}
+	return baseURL(r) + "/l/" + link.Code
+}
+
+// PaymentLinkHandler resolves /p/{prefix}, the start of a payment hash, to
+// the payment's status: the admin session page for admins, and for everyone
+// else a status page leaving out the plate, as lot owners get these links
+// too. When several payments share the prefix it lists longer links telling
+// them apart.
+func PaymentLinkHandler(w http.ResponseWriter, r *http.Request) {
+	prefix := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/p/"))
+	if r.Method != "GET" || store.DB == nil || len(prefix) < links.MinPrefixLength || len(prefix) > 64 || strings.Trim(prefix, "0123456789abcdef") != "" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	orders, err := store.OrdersByHashPrefix(prefix, 10)
+	if err != nil {
+		http.Error(w, "error loading payment", http.StatusInternalServerError)
+		log.Printf("error resolving payment link %s: %s", prefix, err)
+		return
+	}
+	if len(orders) == 0 {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if len(orders) == 1 && (validAdminToken(r) || validAdminSession(r)) {
+		http.Redirect(w, r, "/admin/session?hash="+orders[0].PaymentHash, http.StatusFound)
+		return
+	}
+
+	type choice struct {
+		Link      string
+		Zone      string
+		CreatedAt time.Time
+	}
+	data := struct {
+		Theme     theme.Theme
+		Reference string
+		Zone      string
+		Hours     float64
+		Status    string
+		PaidUntil time.Time
+		CreatedAt time.Time
+		Choices   []choice
+	}{Theme: theme.For(r)}
+
+	status := http.StatusOK
+	if len(orders) > 1 {
+		status = http.StatusMultipleChoices
+		for _, o := range orders {
+			data.Choices = append(data.Choices, choice{"/p/" + distinctPrefix(o.PaymentHash, orders), o.Zone, o.CreatedAt.In(parking.Location)})
+		}
+	} else {
+		o := orders[0]
+		data.Reference, data.Zone, data.Hours, data.CreatedAt = o.Reference(), o.Zone, o.Hours, o.CreatedAt.In(parking.Location)
+		data.Status = paymentStatus(o)
+		if o.ValidUntil.Valid {
+			data.PaidUntil = o.ValidUntil.Time.In(parking.Location)
+		}
+	}
+
+	w.WriteHeader(status)
+	err = BaseTemplate.ExecuteTemplate(w, "payment_status", data)
+	if err != nil {
+		log.Printf("template execution failed: %s", err)
+	}
+}
+
+// paymentStatus describes where an order is for its payer.
+func paymentStatus(o store.Order) string {
+	switch o.State {
+	case store.OrderPending:
+		return "Waiting for payment."
+	case store.OrderExpired:
+		return "The invoice expired without being paid."
+	case store.OrderAccepted, store.OrderPaid:
+		return "Paid, the parking SMS is being sent."
+	case store.OrderSmsFailed:
+		return "Paid, sending the parking SMS is being retried."
+	case store.OrderConfirmed:
+		if len(o.Reply) > 0 {
+			return "Parking confirmed by SMS parking."
+		}
+		if o.ReplyFollowup > 0 {
+			return "The parking SMS was sent but SMS parking has not confirmed it yet, we are checking with them."
+		}
+		return "The parking SMS was sent, waiting for SMS parking to confirm it."
+	case store.OrderRejected:
+		return "SMS parking refused the purchase, please contact support."
+	case store.OrderCancelled:
+		return "Parking could not be bought, the payment was returned."
+	case store.OrderRefundOwed:
+		return "The payment will be refunded."
+	case store.OrderRefunded:
+		return "The payment was refunded."
+	}
+	return string(o.State)
+}
+
+// distinctPrefix is the shortest prefix of hash no other of orders shares.
+func distinctPrefix(hash string, orders []store.Order) string {
+	for n := links.PrefixLength; n < len(hash); n++ {
+		shared := false
+		for _, o := range orders {
+			if o.PaymentHash != hash && strings.HasPrefix(o.PaymentHash, hash[:n]) {
+				shared = true
+				break
+			}
+		}
+		if !shared {
+			return hash[:n]
+		}
+	}
+	return hash
+}
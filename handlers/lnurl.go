@@ -0,0 +1,311 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ljightningparking/catalogue"
+	"ljightningparking/clock"
+	"ljightningparking/lnd"
+	"ljightningparking/money"
+	"ljightningparking/parking"
+	"ljightningparking/price"
+	"ljightningparking/ratelimit"
+	"ljightningparking/store"
+	"ljightningparking/verify"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// lnurlMetadata describes the purchase to the wallet, naming the Lightning
+// Address it was requested by, if any, as LUD-16 asks. The invoice's
+// description hash commits to it, so it only depends on the order.
+func (o orderRequest) lnurlMetadata(address string) string {
+	text := fmt.Sprintf("Parking in zone %s for %s, %s h", o.zone.Name, o.plate, parking.FormatHours(o.hours))
+	if o.product.Kind != catalogue.Hourly {
+		text = fmt.Sprintf("%s for %s, %s %s", o.product.Name, o.plate, parking.FormatHours(o.hours), o.product.Unit)
+	}
+	metadata := [][]string{{"text/plain", text}}
+	if len(address) > 0 {
+		metadata = append(metadata, []string{"text/identifier", address})
+	}
+	encoded, _ := json.Marshal(metadata)
+	return string(encoded)
+}
+
+// lightningAddress is the Lightning Address of the order on host, named by
+// its zone, or its product besides hourly parking.
+func (o orderRequest) lightningAddress(host string) string {
+	name := o.zone.Name
+	if o.product.Kind != catalogue.Hourly {
+		name = o.product.ID
+	}
+	return strings.ToLower(name+"-"+o.plate+"-"+parking.FormatHours(o.hours)) + "@" + host
+}
+
+func (o orderRequest) lnurlQuery(address bool) string {
+	query := url.Values{
+		"zone":  {o.zone.Name},
+		"plate": {o.plate},
+		"hours": {parking.FormatHours(o.hours)},
+	}
+	if o.product.Kind != catalogue.Hourly {
+		query = url.Values{
+			"product":  {o.product.ID},
+			"plate":    {o.plate},
+			"quantity": {parking.FormatHours(o.hours)},
+		}
+	}
+	if address {
+		query.Set("address", "1")
+	}
+	return query.Encode()
+}
+
+// parseLnurlOrder validates the order of an LNURL query: hourly parking in
+// the zone, plate and hours parameters, or the product, plate and quantity
+// ones.
+func parseLnurlOrder(query url.Values) (orderRequest, error) {
+	if product := query.Get("product"); len(product) > 0 {
+		return parseProductRequest(product, query.Get("plate"), query.Get("quantity"))
+	}
+	return parseOrderRequest(query.Get("zone"), query.Get("plate"), query.Get("hours"))
+}
+
+// LnurlPayHandler is the first step of LNURL-pay (LUD-06) for the order in
+// the query parameters, see parseLnurlOrder.
+func LnurlPayHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	order, err := parseLnurlOrder(query)
+	if err != nil {
+		lnurlError(w, err.Error())
+		return
+	}
+
+	lnurlPayRequest(w, r, order, false)
+}
+
+// LightningAddressHandler serves /.well-known/lnurlp/{zone}-{plate}-{hours},
+// a Lightning Address (LUD-16) for a parking purchase, e.g.
+// c1-lj123ab-1.5@example.com, and {product}-{plate}-{quantity} for the other
+// products.
+func LightningAddressHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/.well-known/lnurlp/"), "-")
+	if len(parts) < 3 {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	// product ids may have dashes, plates and quantities don't
+	name := strings.Join(parts[:len(parts)-2], "-")
+	plate, quantity := parts[len(parts)-2], parts[len(parts)-1]
+
+	var order orderRequest
+	var err error
+	if zone, ok := zoneNamed(name); ok {
+		order, err = parseOrderRequest(zone.Name, plate, quantity)
+	} else {
+		order, err = parseProductRequest(productID(name), plate, quantity)
+	}
+	if err != nil {
+		lnurlError(w, err.Error())
+		return
+	}
+
+	lnurlPayRequest(w, r, order, true)
+}
+
+// zoneNamed finds a zone by its name in any case, as addresses are lower
+// case.
+func zoneNamed(name string) (parking.Zone, bool) {
+	for _, z := range parking.AllZones() {
+		if strings.EqualFold(z.Name, name) {
+			return z, true
+		}
+	}
+	return parking.Zone{}, false
+}
+
+// productID is the id of the product name refers to in any case, name itself
+// when there is none.
+func productID(name string) string {
+	for _, p := range catalogue.All() {
+		if strings.EqualFold(p.ID, name) {
+			return p.ID
+		}
+	}
+	return name
+}
+
+// lnurlPayRequest answers the first step of LNURL-pay, for a Lightning
+// Address if address is set.
+func lnurlPayRequest(w http.ResponseWriter, r *http.Request, order orderRequest, address bool) {
+	fee, _, err := catalogue.Quote(order.product, clock.Now(), order.hours)
+	if err != nil {
+		lnurlError(w, err.Error())
+		return
+	}
+	breakdown, err := price.Break(fee)
+	if err != nil {
+		lnurlError(w, "exchange rate is currently unavailable, please try again later")
+		log.Printf("error quoting lnurl order: %s", err)
+		return
+	}
+
+	var identifier string
+	if address {
+		identifier = order.lightningAddress(r.Host)
+	}
+
+	writeJSON(w, struct {
+		Tag            string `json:"tag"`
+		Callback       string `json:"callback"`
+		MinSendable    int64  `json:"minSendable"`
+		MaxSendable    int64  `json:"maxSendable"`
+		Metadata       string `json:"metadata"`
+		CommentAllowed int    `json:"commentAllowed"`
+	}{
+		Tag:         "payRequest",
+		Callback:    baseURL(r) + "/lnurl/callback?" + order.lnurlQuery(address),
+		MinSendable: int64(money.Sats(breakdown.Sats)),
+		MaxSendable: int64(money.Sats(breakdown.Sats)),
+		Metadata:    order.lnurlMetadata(identifier),
+	})
+}
+
+// LnurlCallbackHandler creates the invoice for an LNURL-pay order once the
+// wallet has picked the amount. The invoice is settled and its parking SMS
+// sent like any other.
+func LnurlCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	order, err := parseLnurlOrder(query)
+	if err != nil {
+		lnurlError(w, err.Error())
+		return
+	}
+
+	msats, err := strconv.ParseInt(query.Get("amount"), 10, 64)
+	amount := money.Msat(msats)
+	if err != nil || amount <= 0 || amount != money.Sats(amount.Sats()) {
+		lnurlError(w, "amount must be a whole number of sats in millisatoshis")
+		return
+	}
+
+	if lnd.InvoiceHandler == nil {
+		lnurlError(w, "lightning payments are not available")
+		return
+	}
+
+	ip := clientIP(r)
+	if !ratelimit.Allow(ip) {
+		lnurlError(w, errRateLimited.Error())
+		return
+	}
+	if verify.Required(ip) {
+		lnurlError(w, "too many invoices from your address, please pay on the website")
+		return
+	}
+
+	var identifier string
+	if len(query.Get("address")) > 0 {
+		identifier = order.lightningAddress(r.Host)
+	}
+	hash := sha256.Sum256([]byte(order.lnurlMetadata(identifier)))
+	invoice, err := lnd.InvoiceHandler.GetLnurlInvoice(order.product, order.plate, order.hours, amount, hash[:])
+	if errors.Is(err, lnd.ErrAmount) {
+		lnurlError(w, "the price changed, please scan again")
+		return
+	}
+	if errors.Is(err, lnd.ErrBusy) {
+		lnurlError(w, "too many payments right now, please try again in a minute")
+		return
+	}
+	if errors.Is(err, lnd.ErrTooManyOutstanding) {
+		lnurlError(w, err.Error())
+		return
+	}
+	if err != nil {
+		lnurlError(w, "error while generating ln invoice")
+		log.Printf("error while generating lnurl invoice: %s", err)
+		return
+	}
+	verify.Created(ip)
+
+	writeJSON(w, struct {
+		PaymentRequest string        `json:"pr"`
+		Routes         []interface{} `json:"routes"`
+		Verify         string        `json:"verify,omitempty"`
+	}{invoice.PaymentRequest, []interface{}{}, verifyURL(r, invoice.Receipt.Record.PaymentHash)})
+}
+
+// verifyURL is where anyone can check whether an invoice was paid, empty
+// without a database to look it up in.
+func verifyURL(r *http.Request, paymentHash string) string {
+	if store.DB == nil {
+		return ""
+	}
+	return baseURL(r) + "/lnurl/verify/" + paymentHash
+}
+
+// LnurlVerifyHandler serves LNURL-verify (LUD-21) at /lnurl/verify/{payment
+// hash}, telling whether an invoice was settled and its preimage once it
+// was, so kiosks and bots can confirm payments without API credentials.
+func LnurlVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	hash := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/lnurl/verify/"))
+	if r.Method != "GET" || store.DB == nil || len(hash) != 64 {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	o, err := store.GetOrder(hash)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		lnurlError(w, "Not found")
+		return
+	}
+	if err != nil {
+		lnurlError(w, "error loading invoice")
+		log.Printf("error loading order %s for lnurl verify: %s", hash, err)
+		return
+	}
+
+	settled := o.InvoiceSettled()
+	var preimage *string
+	if settled && len(o.Preimage) > 0 {
+		preimage = &o.Preimage
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, struct {
+		Status         string  `json:"status"`
+		Settled        bool    `json:"settled"`
+		Preimage       *string `json:"preimage"`
+		PaymentRequest string  `json:"pr"`
+	}{"OK", settled, preimage, o.PaymentRequest})
+}
+
+func lnurlError(w http.ResponseWriter, reason string) {
+	writeJSON(w, struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}{"ERROR", reason})
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"ljightningparking/catalogue"
+	"ljightningparking/clock"
+	"ljightningparking/lnd"
+	"ljightningparking/parking"
+	"ljightningparking/ratelimit"
+	"ljightningparking/verify"
+	"time"
+)
+
+// orderRequest is a validated purchase, shared by the web form, the JSON API
+// and LNURL. hours is the quantity of products other than hourly parking, and
+// zone is empty for products outside zones.
+type orderRequest struct {
+	product catalogue.Product
+	zone    parking.Zone
+	plate   string
+	hours   float64
+}
+
+var (
+	errUnavailable          = errors.New("lightning payments are not available")
+	errVerificationRequired = errors.New("too many invoices from this address, a verification payment is required")
+	errRateLimited          = errors.New("too many invoices are being requested, please try again in a minute")
+)
+
+// parseOrderRequest validates a purchase. Its errors are meant for the user.
+// The test zone can't be bought here, see parseTestOrderRequest.
+func parseOrderRequest(zoneName, plate, hours string) (orderRequest, error) {
+	zone, ok := parking.GetZone(zoneName)
+	if !ok || parking.IsTestZone(zone.Name) {
+		return orderRequest{}, fmt.Errorf("zone does not exist: %s", zoneName)
+	}
+	return parseZoneOrder(zone, plate, hours)
+}
+
+// parseTestOrderRequest validates a purchase in the test zone, which only
+// admins make, from the diagnostics page.
+func parseTestOrderRequest(plate, hours string) (orderRequest, error) {
+	zone, ok := parking.GetZone(parking.TestZoneName)
+	if !ok {
+		return orderRequest{}, fmt.Errorf("zone does not exist: %s", parking.TestZoneName)
+	}
+	return parseZoneOrder(zone, plate, hours)
+}
+
+func parseZoneOrder(zone parking.Zone, plate, hours string) (orderRequest, error) {
+	if zone.Informational {
+		return orderRequest{}, notSold(zone)
+	}
+
+	plate, err := parking.NormalizePlate(plate)
+	if err != nil {
+		return orderRequest{}, err
+	}
+
+	hoursFloat, err := zone.ParseHours(hours)
+	if err != nil {
+		return orderRequest{}, fmt.Errorf("invalid hours to park: %s", err)
+	}
+
+	if zone.Fee(clock.Now(), hoursFloat) <= 0 {
+		until := zone.PaidUntil(clock.Now(), hoursFloat).In(parking.Location)
+		return orderRequest{}, fmt.Errorf("parking in zone %s is free until %s", zone.Name, until.Format("Mon 15:04"))
+	}
+
+	return orderRequest{catalogue.HourlyProduct(zone), zone, plate, hoursFloat}, nil
+}
+
+// parseProductRequest validates the purchase of a catalogue product. Its
+// errors are meant for the user.
+func parseProductRequest(productID, plate, quantity string) (orderRequest, error) {
+	product, ok := catalogue.Get(productID)
+	if !ok {
+		return orderRequest{}, fmt.Errorf("product does not exist: %s", productID)
+	}
+	if product.Kind == catalogue.Hourly {
+		return parseOrderRequest(product.Zone, plate, quantity)
+	}
+
+	var zone parking.Zone
+	if len(product.Zone) > 0 {
+		zone, ok = parking.GetZone(product.Zone)
+		if !ok {
+			return orderRequest{}, fmt.Errorf("zone does not exist: %s", product.Zone)
+		}
+		if zone.Informational {
+			return orderRequest{}, notSold(zone)
+		}
+	}
+
+	plate, err := parking.NormalizePlate(plate)
+	if err != nil {
+		return orderRequest{}, err
+	}
+
+	amount, err := catalogue.ParseQuantity(product, quantity)
+	if err != nil {
+		return orderRequest{}, fmt.Errorf("invalid quantity: %s", err)
+	}
+
+	return orderRequest{product, zone, plate, amount}, nil
+}
+
+// notSold explains that a zone sold only at parking meters can't be bought
+// here, rather than taking money for parking SMS parking won't register.
+func notSold(zone parking.Zone) error {
+	if len(zone.Nearest) == 0 {
+		return fmt.Errorf("parking in zone %s is not available via SMS or Lightning, please pay at a parking meter", zone.Name)
+	}
+	return fmt.Errorf("parking in zone %s is not available via SMS or Lightning, the nearest zone sold here is %s", zone.Name, zone.Nearest)
+}
+
+// issueInvoice gets the invoice for an order from ip, applying any
+// verification deposit it paid. An unexpired invoice for the same order is
+// reused, only creating new ones counts against the rate limits.
+func issueInvoice(ip string, o orderRequest) (lnd.Invoice, error) {
+	if lnd.InvoiceHandler == nil {
+		return lnd.Invoice{}, errUnavailable
+	}
+	if invoice, ok := lnd.InvoiceHandler.CachedInvoice(o.product, o.plate, o.hours); ok {
+		return invoice, nil
+	}
+	if !ratelimit.Allow(ip) {
+		return lnd.Invoice{}, errRateLimited
+	}
+	if verify.Required(ip) {
+		return lnd.Invoice{}, errVerificationRequired
+	}
+
+	invoice, err := lnd.InvoiceHandler.GetInvoice(o.product, o.plate, o.hours, verify.Credit(ip))
+	if err != nil {
+		return invoice, err
+	}
+
+	verify.Created(ip)
+	if invoice.CreditedSats > 0 {
+		verify.Reserve(ip, invoice.Receipt.Record.PaymentHash, invoice.CreditedSats, time.Unix(invoice.Expiry, 0))
+	}
+	return invoice, nil
+}
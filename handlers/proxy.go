@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"fmt"
+	"ljightningparking/links"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the networks of reverse proxies whose X-Forwarded-For
+// and X-Real-IP headers are believed.
+var trustedProxies []*net.IPNet
+
+// SetTrustedProxies parses a comma separated list of proxy CIDRs or single
+// addresses.
+func SetTrustedProxies(list string) error {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return fmt.Errorf("invalid proxy address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("invalid proxy network %q", entry)
+		}
+		networks = append(networks, network)
+	}
+
+	trustedProxies = networks
+	return nil
+}
+
+func trusted(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client. Behind a trusted proxy it is
+// the last address in X-Forwarded-For that is not a trusted proxy itself, or
+// X-Real-IP; headers from anyone else are ignored as they can be forged.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	remote := net.ParseIP(host)
+	if remote == nil || !trusted(remote) {
+		return host
+	}
+
+	var forwarded []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(value, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break
+		}
+		if !trusted(ip) || i == 0 {
+			return ip.String()
+		}
+	}
+
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+
+	return host
+}
+
+// baseURL is where clients reach the service, links.PublicURL or else the
+// host of r with the scheme it came in with, as forwarded by a trusted proxy.
+func baseURL(r *http.Request) string {
+	if len(links.PublicURL) > 0 {
+		return strings.TrimRight(links.PublicURL, "/")
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if remote := net.ParseIP(host); remote != nil && trusted(remote) {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+	}
+	return scheme + "://" + r.Host
+}
+
+// AccessLog logs every request with the real client address.
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s %s %s", clientIP(r), r.Method, r.URL.Path)
+		next.ServeHTTP(w, r)
+	})
+}
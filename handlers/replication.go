@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"io/ioutil"
+	"ljightningparking/store"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// ReplicationToken authenticates standbys following this instance's writes.
+// Replication is disabled when empty.
+var ReplicationToken string
+
+// replicationWait is how long a standby's request for new writes is held
+// open when there are none, so they reach it as soon as they happen. It is
+// shorter than the shutdown timeout, which waits for requests in progress.
+const replicationWait = 8 * time.Second
+
+func replicationAllowed(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "GET" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return false
+	}
+
+	token := r.Header.Get("X-Replication-Token")
+	if len(ReplicationToken) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(ReplicationToken)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if store.DB == nil {
+		http.Error(w, "no database configured", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// ReplicationLogHandler returns the writes after the after parameter's
+// sequence number, waiting for new ones if there are none yet.
+func ReplicationLogHandler(w http.ResponseWriter, r *http.Request) {
+	if !replicationAllowed(w, r) {
+		return
+	}
+
+	after, err := strconv.ParseInt(r.FormValue("after"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid after", http.StatusBadRequest)
+		return
+	}
+
+	entries, err := store.JournalSince(after, 500, replicationWait, r.Context().Done())
+	if err == store.ErrJournalPruned {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, "error reading replication log", http.StatusInternalServerError)
+		log.Printf("error reading replication log: %s", err)
+		return
+	}
+	if entries == nil {
+		entries = []store.JournalEntry{}
+	}
+
+	writeJSONStatus(w, http.StatusOK, map[string]interface{}{"entries": entries})
+}
+
+// ReplicationSnapshotHandler sends a copy of the database a new standby
+// starts from, with the sequence number it contains in X-Replication-Seq.
+func ReplicationSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if !replicationAllowed(w, r) {
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "ljp-snapshot")
+	if err != nil {
+		http.Error(w, "error creating snapshot", http.StatusInternalServerError)
+		log.Printf("error creating snapshot directory: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "snapshot.db")
+	seq, err := store.Snapshot(path)
+	if err != nil {
+		http.Error(w, "error creating snapshot", http.StatusInternalServerError)
+		log.Printf("error creating snapshot: %s", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("X-Replication-Seq", strconv.FormatInt(seq, 10))
+	http.ServeFile(w, r, path)
+}
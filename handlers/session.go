@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"ljightningparking/clock"
+	"ljightningparking/parking"
+	"ljightningparking/store"
+	"ljightningparking/theme"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// activeSession is a plate's running parking in a zone, with how much longer
+// it can be extended before reaching the zone's maximum parking time.
+type activeSession struct {
+	Zone             string    `json:"zone"`
+	StartedAt        time.Time `json:"startedAt"`
+	PaidUntil        time.Time `json:"paidUntil"`
+	Hours            float64   `json:"hours"`
+	RemainingMinutes int       `json:"remainingMinutes"`
+	ExtendableHours  float64   `json:"extendableHours"`
+}
+
+func newActiveSession(s store.ParkingSession, now time.Time) activeSession {
+	session := activeSession{
+		Zone:             s.Zone,
+		StartedAt:        s.StartedAt.In(parking.Location),
+		PaidUntil:        s.PaidUntil.In(parking.Location),
+		Hours:            s.Hours,
+		RemainingMinutes: int(math.Ceil(s.Remaining(now).Minutes())),
+	}
+	if zone, ok := parking.GetZone(s.Zone); ok {
+		session.ExtendableHours = extendableHours(zone, s)
+	}
+	return session
+}
+
+// extendableHours is the parking a session can still be extended by, in the
+// half hours the form takes.
+func extendableHours(zone parking.Zone, s store.ParkingSession) float64 {
+	return math.Max(0, math.Floor((zone.MaxTime-s.Hours)*2)/2)
+}
+
+// SessionHandler shows the plate's parking that is paid for and still
+// running, with the time left and a form to extend it.
+func SessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	if store.DB == nil {
+		http.Error(w, "parking sessions are not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	renderSessions(w, r, http.StatusOK, "")
+}
+
+func renderSessions(w http.ResponseWriter, r *http.Request, status int, problem string) {
+	data := struct {
+		Theme    theme.Theme     `json:"-"`
+		Plate    string          `json:"plate"`
+		Sessions []activeSession `json:"sessions"`
+		Error    string          `json:"error,omitempty"`
+	}{Theme: theme.For(r), Plate: r.FormValue("plate"), Sessions: []activeSession{}, Error: problem}
+
+	if len(data.Plate) > 0 {
+		plate, err := parking.NormalizePlate(data.Plate)
+		if err != nil {
+			status, data.Error = http.StatusBadRequest, err.Error()
+		} else {
+			data.Plate = plate
+			now := clock.Now()
+			sessions, err := store.ActiveSessions(plate, now)
+			if err != nil {
+				http.Error(w, "error loading parking sessions", http.StatusInternalServerError)
+				log.Printf("error loading parking sessions of %s: %s", plate, err)
+				return
+			}
+			for _, s := range sessions {
+				data.Sessions = append(data.Sessions, newActiveSession(s, now))
+			}
+		}
+	}
+
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		err := json.NewEncoder(w).Encode(data)
+		if err != nil {
+			log.Printf("error encoding sessions response: %s", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err := BaseTemplate.ExecuteTemplate(w, "session", data)
+	if err != nil {
+		log.Printf("template execution failed: %s", err)
+	}
+}
+
+// ExtendHandler creates the invoice for more parking in a zone where the
+// plate's parking is still running. Its parking SMS goes out on settlement
+// like any other, and is added to the time left by the operator.
+func ExtendHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	if store.DB == nil {
+		http.Error(w, "parking sessions are not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	order, err := parseOrderRequest(r.FormValue("zone"), r.FormValue("plate"), r.FormValue("hours"))
+	if err != nil {
+		renderSessions(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	session, err := store.GetSession(order.plate, order.zone.Name)
+	if err == sql.ErrNoRows || (err == nil && !session.Active(clock.Now())) {
+		renderSessions(w, r, http.StatusBadRequest, fmt.Sprintf("no parking running in zone %s to extend", order.zone.Name))
+		return
+	}
+	if err != nil {
+		http.Error(w, "error loading parking session", http.StatusInternalServerError)
+		log.Printf("error loading parking session of %s: %s", order.plate, err)
+		return
+	}
+
+	if left := extendableHours(order.zone, session); order.hours > left {
+		renderSessions(w, r, http.StatusBadRequest, fmt.Sprintf("parking in zone %s can only be extended by %s more hours, the maximum is %s hours",
+			order.zone.Name, parking.FormatHours(left), parking.FormatHours(order.zone.MaxTime)))
+		return
+	}
+
+	renderInvoice(w, r, order)
+}
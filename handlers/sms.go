@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"ljightningparking/alerts"
+	"ljightningparking/audit"
+	"ljightningparking/balance"
+	"ljightningparking/clock"
+	"ljightningparking/events"
+	"ljightningparking/jobs"
+	"ljightningparking/links"
+	"ljightningparking/lnd"
+	"ljightningparking/metrics"
+	"ljightningparking/money"
+	"ljightningparking/parking"
+	"ljightningparking/sms"
+	"ljightningparking/store"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SmsWebhookSecret authenticates the SMS gateway posting operator replies.
+// The incoming SMS endpoint is disabled when empty.
+var SmsWebhookSecret string
+
+type incomingSms struct {
+	From string `json:"from"`
+	Body string `json:"body"`
+}
+
+// IncomingSmsHandler receives the SMS parking operator's replies from the SMS
+// gateway and records them on the order they answer.
+func IncomingSmsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	secret := r.Header.Get("X-Webhook-Secret")
+	if len(SmsWebhookSecret) == 0 || subtle.ConstantTimeCompare([]byte(secret), []byte(SmsWebhookSecret)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var msg incomingSms
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		err := json.NewDecoder(r.Body).Decode(&msg)
+		if err != nil {
+			http.Error(w, "invalid json", http.StatusBadRequest)
+			return
+		}
+	} else {
+		msg.From = r.FormValue("from")
+		msg.Body = r.FormValue("body")
+	}
+
+	status := recordReply(msg)
+	sms.RecordIncoming("webhook", msg.From, msg.Body, status)
+
+	err := json.NewEncoder(w).Encode(map[string]string{"status": status})
+	if err != nil {
+		log.Printf("error encoding incoming sms response: %s", err)
+	}
+}
+
+var smsParseFailures = metrics.NewCounter("ljp_sms_parse_failures_total", "Operator SMS replies that could not be parsed.")
+
+func recordReply(msg incomingSms) string {
+	reply, err := balance.ParseReply(msg.Body)
+	if err != nil {
+		log.Printf("error parsing operator sms from %s: %s: %s", msg.From, err, msg.Body)
+		smsParseFailures.Inc()
+		return "unparsed"
+	}
+
+	if reply.HasBalance {
+		err = balance.InsertBalance(reply.BalanceEur, reply.Kind)
+		if err != nil {
+			log.Printf("error logging operator balance: %s", err)
+		}
+		// alert on a low balance right away rather than on the next check
+		if err := jobs.RunNow("balance"); err != nil {
+			log.Printf("error starting the balance check: %s", err)
+		}
+	}
+
+	if reply.Kind == balance.Balance || store.DB == nil {
+		return "recorded"
+	}
+
+	order, err := store.OrderAwaitingReply(reply.Zone, reply.Plate, clock.Now())
+	if err == sql.ErrNoRows {
+		log.Printf("no order awaiting operator reply for %s %s", reply.Zone, reply.Plate)
+		return "unmatched"
+	}
+	if err != nil {
+		log.Printf("error matching operator reply: %s", err)
+		return "error"
+	}
+
+	state := store.OrderConfirmed
+	if reply.Kind == balance.Rejected {
+		state = store.OrderRejected
+	}
+
+	err = store.SetOrderReply(order.PaymentHash, state, string(reply.Kind), reply.ValidUntil, reply.PriceEur)
+	if err != nil {
+		log.Printf("error recording operator reply for %s: %s", order.PaymentHash, err)
+		return "error"
+	}
+
+	if reply.Kind != balance.Rejected && !reply.ValidUntil.IsZero() && len(order.Zone) > 0 {
+		err = store.SetSessionPaidUntil(order.Plate, order.Zone, reply.ValidUntil)
+		if err != nil {
+			log.Printf("error updating parking session of %s: %s", order.Plate, err)
+		}
+	}
+
+	if parking.IsTestZone(order.Zone) {
+		detail := string(reply.Kind)
+		if !reply.ValidUntil.IsZero() {
+			detail += " until " + reply.ValidUntil.Format(time.RFC3339)
+		}
+		err = store.RecordTestStep(order.PaymentHash, store.TestReplied, detail)
+		if err != nil {
+			log.Printf("error recording test step of %s: %s", order.PaymentHash, err)
+		}
+	}
+
+	if order.ReplyFollowup == store.FollowupEscalated {
+		alerts.ResolveFor(order.PaymentHash, balance.OverdueAlert(order), fmt.Sprintf("the operator replied %s to the parking SMS for %s", reply.Kind, order.Plate))
+	}
+
+	event := events.Event{Name: events.Confirmed, Link: links.Payment(order.PaymentHash)}
+	if reply.Kind == balance.Rejected {
+		event.Name = events.Rejected
+	}
+	if !reply.ValidUntil.IsZero() {
+		event.ValidUntil = reply.ValidUntil.Format(time.RFC3339)
+	}
+	events.Publish(order.PaymentRequest, event)
+
+	if lnd.InvoiceHandler != nil && len(order.Preimage) > 0 && !order.Settled {
+		if reply.Kind == balance.Rejected {
+			err = lnd.InvoiceHandler.CancelHeld(order.PaymentHash)
+		} else {
+			err = lnd.InvoiceHandler.SettleHeld(order.PaymentHash)
+		}
+		if err != nil {
+			log.Printf("error resolving held payment for %s: %s", order.PaymentHash, err)
+		}
+	}
+
+	audit.Record(audit.Entry{
+		Kind:        audit.Audit,
+		Action:      "operator_" + string(reply.Kind),
+		PaymentHash: order.PaymentHash,
+		Zone:        order.Zone,
+		Plate:       order.Plate,
+		Eur:         money.EUR(reply.PriceEur),
+	})
+
+	return "matched"
+}
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"ljightningparking/admin"
+	"ljightningparking/audit"
+	"ljightningparking/clock"
+	"ljightningparking/parking"
+	"ljightningparking/store"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tokenNameKey is the request context key of the name of the API token
+// RequireScope let a request through with.
+type tokenNameKey struct{}
+
+// RequireScope lets admins through, and reads by API tokens with scope.
+// Scoped tokens never write, anything but GET needs an admin.
+func RequireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	requireAdmin := RequireAdmin(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if validAdminToken(r) || validAdminSession(r) {
+			next(w, r)
+			return
+		}
+
+		if t, ok := admin.LookupToken(bearerToken(r)); ok {
+			if !t.Allows(scope) {
+				http.Error(w, "the token lacks the "+scope+" scope", http.StatusForbidden)
+				return
+			}
+			if r.Method != "GET" {
+				http.Error(w, "api tokens can only read", http.StatusForbidden)
+				return
+			}
+			next(w, r.WithContext(context.WithValue(r.Context(), tokenNameKey{}, t.Name)))
+			return
+		}
+
+		requireAdmin(w, r)
+	}
+}
+
+// maxTokenDays caps how long an API token is issued for, tokens are reissued
+// rather than kept forever.
+const maxTokenDays = 366
+
+// AdminTokensHandler lists the scoped API tokens. POST issues a token with
+// the name, scope and days parameters, showing it once, or revokes the
+// token with the id parameter when revoke is set.
+func AdminTokensHandler(w http.ResponseWriter, r *http.Request) {
+	if store.DB == nil {
+		http.Error(w, "no database configured", http.StatusNotFound)
+		return
+	}
+
+	var issued string
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if len(r.FormValue("revoke")) > 0 {
+			id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+			if err != nil {
+				http.Error(w, "invalid token id", http.StatusBadRequest)
+				return
+			}
+			revoked, err := admin.RevokeToken(id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				log.Printf("error revoking api token %d: %s", id, err)
+				return
+			}
+			if revoked {
+				audit.Record(audit.Entry{Kind: audit.Audit, Action: "api_token_revoked", Detail: fmt.Sprintf("token %d by %s", id, adminName(r))})
+			}
+			http.Redirect(w, r, "/admin/tokens", http.StatusSeeOther)
+			return
+		}
+
+		days, err := parking.ParseCount(r.FormValue("days"))
+		if err != nil || days < 1 || days > maxTokenDays {
+			http.Error(w, fmt.Sprintf("days must be between 1 and %d", maxTokenDays), http.StatusBadRequest)
+			return
+		}
+		name, scopes := r.FormValue("name"), r.Form["scope"]
+		issued, err = admin.IssueToken(name, scopes, clock.Now().AddDate(0, 0, days), adminName(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		audit.Record(audit.Entry{
+			Kind:   audit.Audit,
+			Action: "api_token_issued",
+			Detail: fmt.Sprintf("%s with %s for %d days by %s", name, strings.Join(scopes, ", "), days, adminName(r)),
+		})
+		if wantsJSON(r) {
+			err = json.NewEncoder(w).Encode(map[string]string{"token": issued})
+			if err != nil {
+				log.Printf("error encoding api token: %s", err)
+			}
+			return
+		}
+	default:
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+
+	tokens, err := admin.ListTokens()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("error loading api tokens: %s", err)
+		return
+	}
+
+	if wantsJSON(r) {
+		err = json.NewEncoder(w).Encode(tokens)
+		if err != nil {
+			log.Printf("error encoding api tokens: %s", err)
+		}
+		return
+	}
+
+	data := struct {
+		Tokens []admin.APIToken
+		Scopes []string
+		Issued string
+		Now    time.Time
+	}{tokens, admin.Scopes, issued, clock.Now()}
+	err = BaseTemplate.ExecuteTemplate(w, "admin_tokens", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("template execution failed: %s", err)
+	}
+}
+
+type apiEnforcement struct {
+	Plate    string         `json:"plate"`
+	Paid     bool           `json:"paid"`
+	Sessions []apiPaidUntil `json:"sessions"`
+}
+
+type apiPaidUntil struct {
+	Zone      string    `json:"zone"`
+	PaidUntil time.Time `json:"paid_until"`
+}
+
+// EnforcementHandler tells parking enforcement whether the plate parameter
+// has paid parking right now, in the zone parameter if given. Only running
+// sessions are shown, and every lookup is audited.
+func EnforcementHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	if store.DB == nil {
+		apiError(w, http.StatusServiceUnavailable, "no database configured")
+		return
+	}
+
+	plate, err := parking.NormalizePlate(r.URL.Query().Get("plate"))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	zone := r.URL.Query().Get("zone")
+
+	sessions, err := store.ActiveSessions(plate, clock.Now())
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "error looking up the plate")
+		log.Printf("error looking up sessions of %s: %s", plate, err)
+		return
+	}
+
+	result := apiEnforcement{Plate: plate, Sessions: []apiPaidUntil{}}
+	for _, s := range sessions {
+		if len(zone) > 0 && !strings.EqualFold(s.Zone, zone) {
+			continue
+		}
+		result.Sessions = append(result.Sessions, apiPaidUntil{s.Zone, s.PaidUntil})
+	}
+	result.Paid = len(result.Sessions) > 0
+
+	audit.Record(audit.Entry{
+		Kind:   audit.Audit,
+		Action: "enforcement_lookup",
+		Zone:   zone,
+		Plate:  plate,
+		Detail: fmt.Sprintf("by %s, paid %t", adminName(r), result.Paid),
+	})
+	writeJSON(w, result)
+}
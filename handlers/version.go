@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"encoding/json"
+	"html/template"
+	"ljightningparking/links"
+	"ljightningparking/parking"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ClientVersion is the version of the pages' scripts and of the endpoints
+// they call. Bump it when an endpoint changes in a way the previous pages'
+// scripts don't understand, and keep answering the previous version the old
+// way: a pay page left open across a deploy must still see its payment
+// through. Requests without a version, from pages before versioning and
+// from other clients, count as current.
+const ClientVersion = 1
+
+// minClientVersion is the oldest version still served, older pages are told
+// to refresh.
+const minClientVersion = ClientVersion - 1
+
+const (
+	clientVersionHeader = "X-Client-Version"
+	// clientRefreshHeader asks a page to refresh once the user is done.
+	clientRefreshHeader = "X-Client-Refresh"
+)
+
+// TemplateFuncs are the functions the page templates use.
+var TemplateFuncs = template.FuncMap{
+	"clientVersion": func() int { return ClientVersion },
+	"paymentLink":   links.Payment,
+	"hourStep":      hourStep,
+	"hoursExample":  hoursExample,
+}
+
+// hourStep is the smallest amount of hours to buy, as users type it.
+func hourStep() string {
+	return strings.Replace(parking.FormatHours(parking.HourStep()), ".", ",", 1)
+}
+
+// hoursExample shows how to type a parking time that can be bought.
+func hoursExample() string {
+	if parking.HalfHours {
+		return "1,5 or 90 min"
+	}
+	return "2 or 120 min"
+}
+
+// clientVersion is the version of the page making a request, sent in a header
+// or, by EventSource which can't set headers, in the v parameter. A request
+// without one is taken to be current.
+func clientVersion(r *http.Request) int {
+	value := r.Header.Get(clientVersionHeader)
+	if len(value) == 0 {
+		value = r.URL.Query().Get("v")
+	}
+	if len(value) == 0 {
+		return ClientVersion
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil || version < 1 {
+		return 1
+	}
+	return version
+}
+
+func outdatedClient(r *http.Request) bool {
+	return clientVersion(r) < ClientVersion
+}
+
+// Versioned wraps an endpoint the pages call, asking outdated pages to
+// refresh when convenient and refusing the ones too old to be served.
+func Versioned(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(clientVersionHeader, strconv.Itoa(ClientVersion))
+
+		version := clientVersion(r)
+		if version < minClientVersion {
+			w.Header().Set(clientRefreshHeader, "now")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusGone)
+			err := json.NewEncoder(w).Encode(map[string]interface{}{
+				"error":   "this page is out of date, please refresh it",
+				"refresh": true,
+			})
+			if err != nil {
+				log.Printf("error encoding outdated client response: %s", err)
+			}
+			return
+		}
+		if version < ClientVersion {
+			w.Header().Set(clientRefreshHeader, "soft")
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"ljightningparking/clock"
+	"ljightningparking/events"
+	"ljightningparking/theme"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// WallToken grants read-only access to the wall display of payments, the
+// display is disabled when empty. It is separate from the admin token as it
+// ends up on screens in public places.
+var WallToken string
+
+// validWallToken accepts the token as a query parameter, as EventSource
+// can't send headers, or as a bearer token.
+func validWallToken(r *http.Request) bool {
+	if len(WallToken) == 0 {
+		return false
+	}
+	token := r.URL.Query().Get("token")
+	if len(token) == 0 {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(WallToken)) == 1
+}
+
+// WallHandler shows payments as they arrive, in large type for a screen in
+// a lobby.
+func WallHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" || len(WallToken) == 0 {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	if !validWallToken(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	data := struct {
+		Theme theme.Theme
+		Token string
+	}{theme.For(r), r.URL.Query().Get("token")}
+
+	err := BaseTemplate.ExecuteTemplate(w, "wall", data)
+	if err != nil {
+		log.Printf("template execution failed: %s", err)
+	}
+}
+
+// WallEventsHandler streams the payments for the wall display as server-sent
+// events, starting with the latest ones. Only zone, hours, sats and time are
+// sent.
+func WallEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" || len(WallToken) == 0 {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+		return
+	}
+	if !validWallToken(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	recent, ch, unsubscribe := events.SubscribePayments()
+	defer unsubscribe()
+	if ch == nil {
+		http.Error(w, "too many wall displays", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	for _, p := range recent {
+		writePayment(w, p)
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case p := <-ch:
+			writePayment(w, p)
+		case <-clock.After(eventsKeepAlive):
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writePayment(w http.ResponseWriter, p events.Payment) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("error encoding payment event: %s", err)
+		return
+	}
+	fmt.Fprintf(w, "event: payment\ndata: %s\n\n", data)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"ljightningparking/config"
+	"ljightningparking/parking"
+	"ljightningparking/store"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// wizard asks its questions on stdin.
+type wizard struct {
+	in *bufio.Reader
+}
+
+// ask prompts for a value, returning fallback when the answer is empty.
+func (w wizard) ask(question, fallback string) string {
+	if len(fallback) > 0 {
+		fmt.Printf("%s [%s]: ", question, fallback)
+	} else {
+		fmt.Printf("%s: ", question)
+	}
+	answer, err := w.in.ReadString('\n')
+	if err != nil && len(answer) == 0 {
+		log.Fatalf("aborted")
+	}
+	answer = strings.TrimSpace(answer)
+	if len(answer) == 0 {
+		return fallback
+	}
+	return answer
+}
+
+func (w wizard) confirm(question string) bool {
+	return strings.ToLower(w.ask(question+" [y/N]", "")) == "y"
+}
+
+// askProbed asks for a value until probe accepts it or the user keeps it
+// regardless.
+func (w wizard) askProbed(question, fallback string, probe func(string) error) string {
+	for {
+		value := w.ask(question, fallback)
+		err := probe(value)
+		if err == nil {
+			fmt.Println("  ok")
+			return value
+		}
+		fmt.Printf("  %s\n", err)
+		if w.confirm("  Keep it anyway?") {
+			return value
+		}
+		fallback = value
+	}
+}
+
+// runInit interactively writes a config file, probing the lnd node, SMS
+// gateway, zones file and database as their settings are entered.
+func runInit(args []string) {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	configPath := fs.String("config", "ljightningparking.conf", "config file to write")
+	fs.Parse(args)
+
+	w := wizard{bufio.NewReader(os.Stdin)}
+
+	if _, err := os.Stat(*configPath); err == nil && !w.confirm(fmt.Sprintf("%s exists, overwrite it?", *configPath)) {
+		return
+	}
+
+	fmt.Println("Lightning node, the invoice macaroon is enough.")
+	lndAddress := w.ask("lnd REST address", "localhost:8080")
+	macaroonPath := w.askProbed("Invoice macaroon path", os.ExpandEnv("$HOME/.lnd/data/chain/bitcoin/mainnet/invoice.macaroon"), func(path string) error {
+		return probeLnd(lndAddress, path)
+	})
+
+	fmt.Println("SMS gateway, the phone sending parking SMS.")
+	gateway := w.askProbed("SMS gateway url", "http://localhost:8080/send", probeGateway)
+	keyPath := w.askProbed("SMS gateway key file, created if missing", "sms.key", func(path string) error {
+		return probeKey(w, path)
+	})
+
+	fmt.Println("Parking zones, leave empty for the built in zones of Ljubljana.")
+	zonesPath := w.askProbed("Zones file", "", probeZones)
+
+	fmt.Println("Database of orders, SMS replies and admin users.")
+	dbPath := w.askProbed("SQLite database path", "ljightningparking.db", probeDatabase)
+
+	settings := []config.Setting{
+		{Name: "lnd", Value: lndAddress},
+		{Name: "macaroon", Value: macaroonPath},
+		{Name: "sms-provider", Value: "gateway"},
+		{Name: "sms-gateway", Value: gateway},
+		{Name: "sms-key", Value: keyPath},
+		{Name: "db", Value: dbPath},
+	}
+	if len(zonesPath) > 0 {
+		settings = append(settings, config.Setting{Name: "zones", Value: zonesPath})
+	}
+
+	err := config.Write(*configPath, "written by ljightningparking init on "+time.Now().Format("2006-01-02"), settings)
+	if err != nil {
+		log.Fatalf("error writing %s: %s", *configPath, err)
+	}
+	fmt.Printf("wrote %s, start the server with -config %s\n", *configPath, *configPath)
+}
+
+// probeLnd lists one invoice, which the invoice macaroon is allowed to.
+func probeLnd(address, macaroonPath string) error {
+	macaroon, err := ioutil.ReadFile(macaroonPath)
+	if err != nil {
+		return fmt.Errorf("error reading macaroon: %s", err)
+	}
+
+	request, err := http.NewRequest("GET", fmt.Sprintf("https://%s/v1/invoices?num_max_invoices=1", address), nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Grpc-Metadata-macaroon", hex.EncodeToString(macaroon))
+
+	client := http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		Timeout:   5 * time.Second,
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return fmt.Errorf("error connecting to lnd: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var rpcErr struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&rpcErr)
+		return fmt.Errorf("lnd returned %s: %s", resp.Status, rpcErr.Message)
+	}
+	return nil
+}
+
+// probeGateway only checks the gateway answers, it must not send an SMS.
+func probeGateway(url string) error {
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("error connecting to the gateway: %s", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// probeKey checks the gateway key is 32 bytes, offering to generate a
+// missing one.
+func probeKey(w wizard, path string) error {
+	key, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && w.confirm(fmt.Sprintf("  %s does not exist, generate it?", path)) {
+		key, err = newKey()
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(path, key, 0600)
+		if err != nil {
+			return err
+		}
+		fmt.Println("  copy it to the gateway phone as well")
+	}
+	if err != nil {
+		return err
+	}
+
+	if n := len(strings.TrimSpace(string(key))); n != 32 {
+		return fmt.Errorf("key must be 32 bytes, got %d", n)
+	}
+	return nil
+}
+
+// newKey returns 32 random letters and digits, easy to type into the
+// gateway app.
+func newKey() ([]byte, error) {
+	const alphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+	key := make([]byte, 32)
+	for i := range key {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+		if err != nil {
+			return nil, err
+		}
+		key[i] = alphabet[n.Int64()]
+	}
+	return key, nil
+}
+
+func probeZones(path string) error {
+	if len(path) == 0 {
+		return nil
+	}
+
+	parking.ZonesFile = path
+	zones, err := parking.ReloadZones()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("  %d zones\n", zones)
+	return nil
+}
+
+// probeDatabase opens the database, creating and migrating it if needed.
+func probeDatabase(path string) error {
+	err := store.Open(path, store.DefaultOptions)
+	if err != nil {
+		return err
+	}
+	store.DB.Close()
+	store.DB = nil
+	return nil
+}
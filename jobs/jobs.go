@@ -0,0 +1,210 @@
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"ljightningparking/clock"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Schedule returns when a job is next due after a given time.
+type Schedule interface {
+	Next(after time.Time) time.Time
+	String() string
+}
+
+// Every runs a job at a fixed interval.
+type Every time.Duration
+
+func (e Every) Next(after time.Time) time.Time {
+	return after.Add(time.Duration(e))
+}
+
+func (e Every) String() string {
+	return "every " + time.Duration(e).String()
+}
+
+// Daily runs a job once a day at the given local hour.
+type Daily int
+
+func (d Daily) Next(after time.Time) time.Time {
+	next := time.Date(after.Year(), after.Month(), after.Day(), int(d), 0, 0, 0, after.Location())
+	if !next.After(after) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+func (d Daily) String() string {
+	return fmt.Sprintf("daily at %02d:00", int(d))
+}
+
+// Status is a job's schedule and the outcome of its runs so far.
+type Status struct {
+	Name         string
+	Schedule     string
+	Running      bool
+	Next         time.Time
+	LastStart    time.Time
+	LastDuration time.Duration
+	LastError    string
+	Runs         int
+	Failures     int
+	// Skipped counts runs left out because the previous one was still going.
+	Skipped int
+}
+
+type job struct {
+	schedule Schedule
+	jitter   time.Duration
+	run      func() error
+	status   Status
+}
+
+var (
+	jobs = make(map[string]*job)
+	mu   sync.Mutex
+
+	started  bool
+	stopping bool
+	stop     = make(chan struct{})
+	// running counts the runs in progress, Stop waits for them.
+	running sync.WaitGroup
+)
+
+var ErrUnknownJob = errors.New("unknown job")
+
+// Add registers a job. Each run is delayed by a random duration up to jitter
+// so jobs sharing a schedule don't all fire at once. Jobs added after Start
+// are started right away.
+func Add(name string, schedule Schedule, jitter time.Duration, run func() error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	j := &job{schedule: schedule, jitter: jitter, run: run, status: Status{Name: name, Schedule: schedule.String()}}
+	jobs[name] = j
+	if started {
+		go loop(j)
+	}
+}
+
+// Start runs the registered jobs on their schedules.
+func Start() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	started = true
+	for _, j := range jobs {
+		go loop(j)
+	}
+}
+
+func loop(j *job) {
+	for {
+		next := j.schedule.Next(clock.Now())
+		if j.jitter > 0 {
+			next = next.Add(time.Duration(rand.Int63n(int64(j.jitter))))
+		}
+
+		mu.Lock()
+		j.status.Next = next
+		mu.Unlock()
+
+		select {
+		case <-clock.After(next.Sub(clock.Now())):
+		case <-stop:
+			return
+		}
+		execute(j)
+	}
+}
+
+// Stop keeps jobs from starting again and waits up to timeout for the runs in
+// progress to finish. It reports whether they did.
+func Stop(timeout time.Duration) bool {
+	mu.Lock()
+	if !stopping {
+		stopping = true
+		close(stop)
+	}
+	mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-clock.After(timeout):
+		return false
+	}
+}
+
+// execute runs a job unless its previous run is still going.
+func execute(j *job) {
+	mu.Lock()
+	if stopping {
+		mu.Unlock()
+		return
+	}
+	if j.status.Running {
+		j.status.Skipped++
+		mu.Unlock()
+		log.Printf("Skipping job %s, its previous run is still going", j.status.Name)
+		return
+	}
+	j.status.Running = true
+	j.status.LastStart = clock.Now()
+	running.Add(1)
+	mu.Unlock()
+	defer running.Done()
+
+	err := j.run()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	j.status.Running = false
+	j.status.LastDuration = clock.Since(j.status.LastStart)
+	j.status.Runs++
+	j.status.LastError = ""
+	if err != nil {
+		j.status.Failures++
+		j.status.LastError = err.Error()
+		log.Printf("Job %s failed: %s", j.status.Name, err)
+	}
+}
+
+// RunNow starts a job outside its schedule.
+func RunNow(name string) error {
+	mu.Lock()
+	j, ok := jobs[name]
+	mu.Unlock()
+
+	if !ok {
+		return ErrUnknownJob
+	}
+	go execute(j)
+	return nil
+}
+
+// Statuses returns the status of every job, ordered by name.
+func Statuses() []Status {
+	mu.Lock()
+	defer mu.Unlock()
+
+	statuses := make([]Status, 0, len(jobs))
+	for _, j := range jobs {
+		statuses = append(statuses, j.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
@@ -0,0 +1,26 @@
+package links
+
+import "strings"
+
+// PublicURL is where the service is reachable, like
+// https://parking.example.com, making the links in notifications absolute.
+// Links are paths on the service when it is empty.
+var PublicURL string
+
+// PrefixLength is how much of the payment hash payment links carry, long
+// enough to practically never be shared by two payments.
+const PrefixLength = 12
+
+// MinPrefixLength is the shortest prefix a payment link resolves, the length
+// of the order reference users quote to support.
+const MinPrefixLength = 8
+
+// Payment is the canonical link to a payment's status, /p/ and the start of
+// its payment hash, for notifications and support conversations to refer to.
+func Payment(paymentHash string) string {
+	prefix := strings.ToLower(paymentHash)
+	if len(prefix) > PrefixLength {
+		prefix = prefix[:PrefixLength]
+	}
+	return strings.TrimRight(PublicURL, "/") + "/p/" + prefix
+}
@@ -0,0 +1,98 @@
+package lnd
+
+import (
+	"errors"
+	"fmt"
+	"ljightningparking/audit"
+	"ljightningparking/metrics"
+	"ljightningparking/money"
+	"ljightningparking/store"
+	"log"
+)
+
+var amountMismatches = metrics.NewCounter("ljp_invoice_amount_mismatches_total", "Paid invoices whose amount differs from what they asked for, by underpaid or overpaid.", "kind")
+
+// checkAmount compares what was paid for an invoice with the sats it asked
+// for and reports whether it is fully paid. lnd only reports an invoice
+// accepted or settled once all parts of a multi-path payment arrived, so an
+// underpayment means something is off: it buys no parking and is tagged for
+// an admin to look at. An overpayment still buys the parking, the excess is
+// recorded in the ledger and an admin records sending it back from the admin
+// session page.
+func checkAmount(key InvoiceKey, paymentHash string, expected, paid int64) bool {
+	err := store.SetOrderAmountPaid(paymentHash, paid)
+	if err != nil {
+		log.Printf("Error recording amount paid for %s: %s", paymentHash, err)
+	}
+
+	switch {
+	case expected <= 0 || paid == expected:
+		return true
+	case paid < expected:
+		amountMismatches.Inc("underpaid")
+		log.Printf("Invoice %s underpaid, %d of %d sats", paymentHash, paid, expected)
+		audit.Record(audit.Entry{
+			Kind:        audit.Ledger,
+			Action:      "invoice_underpaid",
+			PaymentHash: paymentHash,
+			Zone:        key.Name(),
+			Plate:       key.Plate,
+			Sats:        paid,
+			Detail:      fmt.Sprintf("paid %d of %d sats", paid, expected),
+		})
+		err = store.SetOrderTag(paymentHash, store.TagInvestigating)
+		if err != nil {
+			log.Printf("Error tagging underpaid order %s: %s", paymentHash, err)
+		}
+		return false
+	default:
+		amountMismatches.Inc("overpaid")
+		audit.Record(audit.Entry{
+			Kind:        audit.Ledger,
+			Action:      "invoice_overpaid",
+			PaymentHash: paymentHash,
+			Zone:        key.Name(),
+			Plate:       key.Plate,
+			Sats:        paid - expected,
+			Detail:      fmt.Sprintf("paid %d sats for %d", paid, expected),
+		})
+		return true
+	}
+}
+
+var ErrNoOverpayment = errors.New("no overpayment left to return")
+
+// RecordOverpaymentReturned records that an admin sent back the sats an order
+// was overpaid by, the same way bulk refunds are recorded. Nothing is paid
+// out here.
+func RecordOverpaymentReturned(paymentHash, admin string) error {
+	o, err := store.GetOrder(paymentHash)
+	if err != nil {
+		return err
+	}
+	excess := o.Overpaid()
+
+	refunded, err := store.SetOverpaymentRefunded(paymentHash)
+	if err != nil {
+		return err
+	}
+	if !refunded {
+		return ErrNoOverpayment
+	}
+
+	var eur money.Cents
+	if o.Sats > 0 {
+		eur = money.EUR(o.Eur * float64(excess) / float64(o.Sats))
+	}
+	audit.Record(audit.Entry{
+		Kind:        audit.Ledger,
+		Action:      "overpayment_refunded",
+		PaymentHash: paymentHash,
+		Zone:        o.Zone,
+		Plate:       o.Plate,
+		Sats:        -excess,
+		Eur:         -eur,
+		Detail:      "returned by " + admin,
+	})
+	return store.AddOrderNote(paymentHash, admin, fmt.Sprintf("sent back the %d sats overpaid", excess))
+}
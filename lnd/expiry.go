@@ -0,0 +1,128 @@
+package lnd
+
+import (
+	"container/heap"
+	"errors"
+	"ljightningparking/clock"
+	"ljightningparking/store"
+	"log"
+	"time"
+)
+
+// MaxOutstandingPerPlate caps the unpaid, unexpired invoices one plate can
+// have at once. Zero disables the cap.
+var MaxOutstandingPerPlate = 3
+
+// ErrTooManyOutstanding is returned instead of creating another invoice for
+// a plate that has MaxOutstandingPerPlate unpaid invoices already.
+var ErrTooManyOutstanding = errors.New("too many unpaid invoices for this plate, pay or wait for one to expire")
+
+// expiring is an invoice to drop from the cache once it expires unpaid.
+type expiring struct {
+	at             int64
+	paymentRequest string
+	paymentHash    string
+}
+
+// expiryQueue is a heap of invoices by expiry, soonest first.
+type expiryQueue []expiring
+
+func (q expiryQueue) Len() int            { return len(q) }
+func (q expiryQueue) Less(i, j int) bool  { return q[i].at < q[j].at }
+func (q expiryQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *expiryQueue) Push(x interface{}) { *q = append(*q, x.(expiring)) }
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+// expireAt schedules dropping an invoice once it expires, waking the expiry
+// loop if it is the soonest to do so.
+func (h *Handler) expireAt(paymentRequest, paymentHash string, at int64) {
+	h.expiry.Lock()
+	soonest := len(h.expiry.queue) == 0 || at < h.expiry.queue[0].at
+	heap.Push(&h.expiry.queue, expiring{at, paymentRequest, paymentHash})
+	h.expiry.Unlock()
+
+	if soonest {
+		select {
+		case h.expiry.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// runExpiry drops invoices from the cache as they expire.
+func (h *Handler) runExpiry() {
+	for {
+		wait := time.Minute
+		h.expiry.Lock()
+		if len(h.expiry.queue) > 0 {
+			if until := time.Duration(h.expiry.queue[0].at-clock.Now().Unix()) * time.Second; until < wait {
+				wait = until
+			}
+		}
+		h.expiry.Unlock()
+
+		if wait > 0 {
+			select {
+			case <-clock.After(wait):
+			case <-h.expiry.wake:
+				continue
+			}
+		}
+
+		now := clock.Now().Unix()
+		for {
+			h.expiry.Lock()
+			if len(h.expiry.queue) == 0 || h.expiry.queue[0].at > now {
+				h.expiry.Unlock()
+				break
+			}
+			e := heap.Pop(&h.expiry.queue).(expiring)
+			h.expiry.Unlock()
+
+			h.expire(e)
+		}
+	}
+}
+
+// expire drops an invoice that expired, marking its order expired unless it
+// was paid meanwhile. Hold invoices stay held until their subscription ends,
+// lnd may still report them accepted.
+func (h *Handler) expire(e expiring) {
+	h.invoices.Lock()
+	delete(h.invoices.verifications, e.paymentRequest)
+	key, ok := h.invoices.invoiceToKey[e.paymentRequest]
+	if ok {
+		h.invoices.forget(key, e.paymentRequest)
+	}
+	h.invoices.Unlock()
+
+	if ok {
+		err := store.SetOrderState(e.paymentHash, store.OrderExpired)
+		if err != nil {
+			log.Printf("Error expiring order: %s", err)
+		}
+	}
+}
+
+// outstanding counts the unpaid invoices of a plate. The caller holds the
+// invoices lock.
+func (c *InvoiceCache) outstanding(plate string) int {
+	return c.byPlate[plate]
+}
+
+// add starts tracking an unpaid invoice, caching it by key too when shared.
+// The caller holds the invoices lock.
+func (c *InvoiceCache) add(key InvoiceKey, inv Invoice, shared bool) {
+	if shared {
+		c.keyToInvoice[key] = inv
+	}
+	if _, ok := c.invoiceToKey[inv.PaymentRequest]; !ok {
+		c.byPlate[key.Plate]++
+	}
+	c.invoiceToKey[inv.PaymentRequest] = key
+}
@@ -1,61 +1,178 @@
 package lnd
 
 import (
-	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
+	"ljightningparking/audit"
+	"ljightningparking/catalogue"
+	"ljightningparking/clock"
+	"ljightningparking/coalesce"
+	"ljightningparking/events"
+	"ljightningparking/links"
+	"ljightningparking/metrics"
+	"ljightningparking/money"
 	"ljightningparking/parking"
 	"ljightningparking/price"
+	"ljightningparking/receipt"
 	"ljightningparking/sms"
+	"ljightningparking/stats"
+	"ljightningparking/store"
+	"ljightningparking/verify"
 	"log"
 	"net/http"
 	"os"
-	"strings"
 	"sync"
 	"time"
 )
 
 const SETTLED = "SETTLED"
 
+var (
+	invoicesCreated = metrics.NewCounter("ljp_invoices_created_total", "Invoices created, by zone or product.", "zone")
+	invoicesSettled = metrics.NewCounter("ljp_invoices_settled_total", "Invoices paid, by zone or product.", "zone")
+	parkingSms      = metrics.NewCounter("ljp_parking_sms_total", "Parking SMS of paid orders by outcome, sent or failed after all retries.", "result")
+	settlementSms   = metrics.NewHistogram("ljp_settlement_sms_seconds", "Time from payment to the parking SMS being sent.",
+		[]float64{1, 2, 5, 10, 30, 60, 120, 300, 600, 1800})
+	subscriptionUp = metrics.NewGauge("ljp_lnd_subscription_up", "Whether the lnd invoice subscription is connected.")
+)
+
 type Handler struct {
-	httpClient http.Client
-	macaroon   string
-	invoices   InvoiceCache
-	lndAddress string
+	httpClient   http.Client
+	streamClient http.Client
+	macaroon     string
+	invoices     InvoiceCache
+	lndAddress   string
+	throttle     *throttle
+	settleIndex  struct {
+		value uint64
+		// inFlight maps settled invoices whose parking SMS is still going
+		// out to their settle index.
+		inFlight map[string]uint64
+		sync.Mutex
+	}
+	lag struct {
+		value Lag
+		sync.Mutex
+	}
+	expiry struct {
+		queue expiryQueue
+		wake  chan struct{}
+		sync.Mutex
+	}
+	// stop ends the invoice subscriptions when the service shuts down.
+	stop     context.Context
+	cancel   context.CancelFunc
+	checking sync.WaitGroup
 }
 
 type InvoiceCache struct {
 	keyToInvoice map[InvoiceKey]Invoice
 	invoiceToKey map[string]InvoiceKey
+	// verifications maps 1 sat verification invoices to the paying client ip
+	verifications map[string]string
+	// held maps hold invoice payment hashes to what settles or cancels them
+	held map[string]heldInvoice
+	// sending maps payment hashes to the orders whose parking SMS is queued
+	sending map[string]sending
+	// byPlate counts the unpaid invoices of each plate
+	byPlate map[string]int
 	sync.Mutex
 }
 
+type sending struct {
+	key            InvoiceKey
+	paymentRequest string
+	// paidAt is when the payment arrived, zero for orders queued before a
+	// restart.
+	paidAt time.Time
+}
+
+// forget drops a paid or expired invoice. The invoice for its key is only
+// dropped if it is the same one, as LNURL invoices are not cached by key.
+func (c *InvoiceCache) forget(key InvoiceKey, paymentRequest string) {
+	if _, ok := c.invoiceToKey[paymentRequest]; ok {
+		c.byPlate[key.Plate]--
+		if c.byPlate[key.Plate] <= 0 {
+			delete(c.byPlate, key.Plate)
+		}
+	}
+	delete(c.invoiceToKey, paymentRequest)
+	if c.keyToInvoice[key].PaymentRequest == paymentRequest {
+		delete(c.keyToInvoice, key)
+	}
+}
+
+// InvoiceKey is what an invoice buys. Hours is the quantity of the product,
+// which is hourly parking in Zone unless set otherwise.
 type InvoiceKey struct {
-	Zone  parking.Zone
-	Plate string
-	Hours int64
+	Zone    parking.Zone
+	Plate   string
+	Hours   float64
+	Product catalogue.Product
 }
 
+func (k InvoiceKey) product() catalogue.Product {
+	if len(k.Product.ID) == 0 {
+		return catalogue.HourlyProduct(k.Zone)
+	}
+	return k.Product
+}
+
+// Name is the zone the purchase is for, or the product for purchases outside
+// zones, as recorded in stats and audit entries.
+func (k InvoiceKey) Name() string {
+	if len(k.Zone.Name) == 0 {
+		return k.Product.ID
+	}
+	return k.Zone.Name
+}
+
+// Message is the SMS fulfilling the purchase, "" when none is sent.
 func (k InvoiceKey) Message() string {
-	return fmt.Sprintf("%s %s %d", k.Zone.Name, k.Plate, k.Hours)
+	return catalogue.Message(k.product(), k.Plate, k.Hours, clock.Now())
 }
 
-func (k InvoiceKey) GetSatsToPay() int64 {
+// OrderKey is the key of a stored order.
+func OrderKey(o store.Order) (InvoiceKey, error) {
+	key := InvoiceKey{Plate: o.Plate, Hours: o.Hours}
 
-	btcPrice := price.GetPrice("btceur")
-	if btcPrice < 0 {
-		return -1
+	if len(o.Product) > 0 {
+		product, ok := catalogue.Get(o.Product)
+		if !ok {
+			return key, fmt.Errorf("unknown product %s", o.Product)
+		}
+		key.Product = product
 	}
 
-	return int64(k.Zone.GetParkingFee(k.Hours) / btcPrice * 1e-8)
+	if len(o.Zone) > 0 {
+		zone, ok := parking.GetZone(o.Zone)
+		if !ok {
+			return key, fmt.Errorf("unknown zone %s", o.Zone)
+		}
+		key.Zone = zone
+	}
+	if len(o.Product) == 0 {
+		key.Product = catalogue.HourlyProduct(key.Zone)
+	}
+	return key, nil
 }
 
 type Invoice struct {
 	PaymentRequest string
 	Expiry         int64
+	StaleRate      bool
+	Variant        string
+	Receipt        receipt.Signed
+	CreditedSats   int64
+	// PaidUntil is when the parking bought with this invoice runs out.
+	PaidUntil time.Time
+	Breakdown price.Breakdown
 }
 
 type RpcResponse struct {
@@ -64,10 +181,15 @@ type RpcResponse struct {
 }
 
 type RpcInvoice struct {
+	RHash          []byte `json:"r_hash"`
 	PaymentRequest string `json:"payment_request"`
-	CreationDate   int64  `json:"creation_date"`
-	Expiry         int64  `json:"Expiry"`
+	CreationDate   int64  `json:"creation_date,string"`
+	Value          int64  `json:"value,string"`
+	AmtPaidSat     int64  `json:"amt_paid_sat,string"`
+	Expiry         int64  `json:"expiry,string"`
 	State          string `json:"state"`
+	SettleIndex    uint64 `json:"settle_index,string"`
+	SettleDate     int64  `json:"settle_date,string"`
 }
 
 var InvoiceHandler *Handler
@@ -90,133 +212,651 @@ func InitHandler(lndAddress, macaroonPath string) {
 			Transport: insecureTransport,
 			Timeout:   5 * time.Second,
 		},
+		streamClient: http.Client{
+			Transport: insecureTransport,
+		},
 		macaroon: fmt.Sprintf("%02x", data),
 		invoices: InvoiceCache{
-			keyToInvoice: make(map[InvoiceKey]Invoice),
-			invoiceToKey: make(map[string]InvoiceKey),
-			Mutex:        sync.Mutex{},
+			keyToInvoice:  make(map[InvoiceKey]Invoice),
+			invoiceToKey:  make(map[string]InvoiceKey),
+			verifications: make(map[string]string),
+			held:          make(map[string]heldInvoice),
+			sending:       make(map[string]sending),
+			byPlate:       make(map[string]int),
+			Mutex:         sync.Mutex{},
 		},
 		lndAddress: lndAddress,
+		throttle:   newThrottle(4, 16),
 	}
 
+	InvoiceHandler.stop, InvoiceHandler.cancel = context.WithCancel(context.Background())
+	InvoiceHandler.expiry.wake = make(chan struct{}, 1)
+	go InvoiceHandler.runExpiry()
+
+	sms.OnResult = InvoiceHandler.dispatched
+	InvoiceHandler.restore()
+
+	InvoiceHandler.checking.Add(1)
 	go InvoiceHandler.RunInvoiceChecker()
 }
 
-func (h *Handler) GetInvoice(zone parking.Zone, plate string, hours int64) Invoice {
+// Close ends the invoice subscriptions and waits for the invoice update in
+// progress, if any, to be processed.
+func (h *Handler) Close() {
+	h.cancel()
+	h.checking.Wait()
+}
 
-	key := InvoiceKey{zone, plate, hours}
+// GetInvoice returns an unexpired invoice for quantity of a product, creating
+// a new one if needed. creditSats is deducted from a newly created invoice,
+// the amount actually deducted is returned in Invoice.CreditedSats.
+func (h *Handler) GetInvoice(product catalogue.Product, plate string, quantity float64, creditSats int64) (Invoice, error) {
 
+	key, err := productKey(product, plate, quantity)
+	if err != nil {
+		return Invoice{}, err
+	}
+
+	if inv, ok := h.cached(key); ok {
+		return inv, nil
+	}
+
+	start := clock.Now()
+	breakdown, until, err := quote(key, start)
+	if err != nil {
+		return Invoice{}, err
+	}
+	satsToPay := breakdown.Sats
+
+	if creditSats > satsToPay-1 {
+		creditSats = satsToPay - 1
+	}
+	if creditSats > 0 {
+		satsToPay -= creditSats
+	} else {
+		creditSats = 0
+	}
+
+	return h.createInvoice(key, start, breakdown, until, satsToPay, creditSats, nil)
+}
+
+// CachedInvoice returns the unexpired invoice already created for quantity
+// of a product, so asking for the same purchase again reuses it.
+func (h *Handler) CachedInvoice(product catalogue.Product, plate string, quantity float64) (Invoice, bool) {
+	key, err := productKey(product, plate, quantity)
+	if err != nil {
+		return Invoice{}, false
+	}
+	return h.cached(key)
+}
+
+func (h *Handler) cached(key InvoiceKey) (Invoice, bool) {
 	h.invoices.Lock()
 	inv, ok := h.invoices.keyToInvoice[key]
 	h.invoices.Unlock()
 
-	now := time.Now().Unix()
+	return inv, ok && inv.Expiry > clock.Now().Unix()
+}
+
+func productKey(product catalogue.Product, plate string, quantity float64) (InvoiceKey, error) {
+	key := InvoiceKey{Plate: plate, Hours: quantity, Product: product}
+	if len(product.Zone) > 0 {
+		zone, ok := parking.GetZone(product.Zone)
+		if !ok {
+			return key, fmt.Errorf("zone does not exist: %s", product.Zone)
+		}
+		key.Zone = zone
+	}
+	return key, nil
+}
+
+// quotes shares the quote of a purchase between identical requests arriving
+// together, it doesn't depend on the plate.
+var quotes = coalesce.Group{Name: "quote"}
+
+type quoted struct {
+	breakdown price.Breakdown
+	until     time.Time
+}
+
+// quote prices a purchase made at start, or by a call in progress pricing
+// the same purchase a moment earlier.
+func quote(key InvoiceKey, start time.Time) (price.Breakdown, time.Time, error) {
+	product := key.product()
+	v, err := quotes.Do(product.ID+" "+parking.FormatHours(key.Hours), func() (interface{}, error) {
+		breakdown, until, err := quoteAt(product, key.Hours, start)
+		return quoted{breakdown, until}, err
+	})
+	q, _ := v.(quoted)
+	return q.breakdown, q.until, err
+}
 
-	if ok && inv.Expiry > now {
-		return inv
+func quoteAt(product catalogue.Product, quantity float64, start time.Time) (price.Breakdown, time.Time, error) {
+	fee, until, err := catalogue.Quote(product, start, quantity)
+	if err != nil {
+		return price.Breakdown{}, until, err
 	}
+	if fee <= 0 {
+		return price.Breakdown{}, until, fmt.Errorf("%s is free at this time", product.Name)
+	}
+
+	breakdown, err := price.Break(fee)
+	if err != nil {
+		return breakdown, until, fmt.Errorf("error while getting sats to pay: %w", err)
+	}
+	return breakdown, until, nil
+}
 
-	satsToPay := key.GetSatsToPay()
-	if satsToPay < 0 {
-		log.Printf("Error while getting sats to pay")
-		return Invoice{}
+// ErrAmount is returned for an LNURL payment amount that doesn't cover the fee.
+var ErrAmount = errors.New("amount does not match the parking fee")
+
+// LnurlTolerance is how much more than the current quote an LNURL payment may
+// be, as the rate can move between the wallet fetching the amount and paying.
+// Less than the quote is never accepted, the wallet fetches a new amount.
+const LnurlTolerance = 0.02
+
+// GetLnurlInvoice creates an invoice for an LNURL-pay callback. The amount is
+// the one the wallet chose, in whole sats, and the description hash commits to
+// the LNURL metadata, so these invoices are never shared with the web flow.
+func (h *Handler) GetLnurlInvoice(product catalogue.Product, plate string, quantity float64, amount money.Msat, descriptionHash []byte) (Invoice, error) {
+	key, err := productKey(product, plate, quantity)
+	if err != nil {
+		return Invoice{}, err
 	}
 
-	request, err := http.NewRequest("POST", fmt.Sprintf("https://%s/v1/invoices", h.lndAddress), strings.NewReader(fmt.Sprintf(`{"expiry": 300, "value": %d}`, satsToPay)))
+	start := clock.Now()
+	breakdown, until, err := quote(key, start)
 	if err != nil {
-		log.Fatalf("Error constructing a new request struct: %v", err)
+		return Invoice{}, err
+	}
+	quoted := money.Sats(breakdown.Sats)
+	if amount < quoted || float64(amount) > float64(quoted)*(1+LnurlTolerance) {
+		return Invoice{}, ErrAmount
 	}
 
-	request.Header.Set("Grpc-Metadata-macaroon", h.macaroon)
+	return h.createInvoice(key, start, breakdown, until, amount.Sats(), 0, descriptionHash)
+}
 
-	resp, err := h.httpClient.Do(request)
+// createInvoice adds the hold invoice for an order and starts tracking it. A
+// nil description hash commits the invoice to the order document instead.
+func (h *Handler) createInvoice(key InvoiceKey, start time.Time, breakdown price.Breakdown, until time.Time, satsToPay, creditSats int64, descriptionHash []byte) (Invoice, error) {
+	zone, plate, hours := key.Zone, key.Plate, key.Hours
+	var productID string
+	if p := key.product(); p.Kind != catalogue.Hourly {
+		productID = p.ID
+	}
+	now := start.Unix()
+
+	if MaxOutstandingPerPlate > 0 {
+		h.invoices.Lock()
+		outstanding := h.invoices.outstanding(plate)
+		h.invoices.Unlock()
+		if outstanding >= MaxOutstandingPerPlate {
+			return Invoice{}, ErrTooManyOutstanding
+		}
+	}
+
+	err := h.throttle.acquire()
 	if err != nil {
-		log.Fatalf("Error making a post request to get a new inv: %v", err)
+		return Invoice{}, err
+	}
+	defer h.throttle.release()
+
+	document := receipt.OrderDocument{
+		Service:   receipt.Service,
+		Product:   productID,
+		Zone:      zone.Name,
+		Plate:     plate,
+		Hours:     hours,
+		Eur:       breakdown.Total.Eur(),
+		Sats:      satsToPay,
+		Rate:      breakdown.Quote.Rate,
+		CreatedAt: now,
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	preimage, paymentHash, err := newPreimage()
 	if err != nil {
-		log.Fatalf("Error reading response body: %v", err)
+		return Invoice{}, fmt.Errorf("error generating preimage: %w", err)
 	}
 
-	var response RpcInvoice
-	err = json.Unmarshal(body, &response)
+	shared := descriptionHash == nil
+	if shared {
+		descriptionHash = document.Hash()
+	}
+
+	response, err := h.addHoldInvoice(satsToPay, paymentHash, descriptionHash)
 	if err != nil {
-		log.Fatalf("Error unmarshling new inv: %v", err)
+		return Invoice{}, err
+	}
+
+	err = store.InsertOrderDocument(document.HexHash(), hex.EncodeToString(response.RHash), document.Canonical())
+	if err != nil {
+		log.Printf("Error storing order document: %s", err)
 	}
 
 	newInvoice := Invoice{
 		PaymentRequest: response.PaymentRequest,
 		Expiry:         now + 300,
+		StaleRate:      breakdown.Quote.Stale,
+		Breakdown:      breakdown,
+		CreditedSats:   creditSats,
+		PaidUntil:      until,
+		Receipt: receipt.Sign(receipt.Record{
+			PaymentHash: hex.EncodeToString(response.RHash),
+			OrderHash:   document.HexHash(),
+			Zone:        zone.Name,
+			Plate:       plate,
+			Hours:       hours,
+			Eur:         breakdown.Total.Eur(),
+			Sats:        satsToPay,
+			Rate:        breakdown.Quote.Rate,
+			CreatedAt:   now,
+		}),
 	}
 
 	h.invoices.Lock()
-	h.invoices.keyToInvoice[key] = newInvoice
-	h.invoices.invoiceToKey[response.PaymentRequest] = key
+	h.invoices.add(key, newInvoice, shared)
 	h.invoices.Unlock()
 
-	go func(paymentRequest string) {
-		time.Sleep(300*time.Second)
-		h.invoices.Lock()
-		id, ok := h.invoices.invoiceToKey[paymentRequest]
-		if ok {
-			delete(h.invoices.invoiceToKey, paymentRequest)
-			delete(h.invoices.keyToInvoice, id)
-		}
-		h.invoices.Unlock()
-	}(response.PaymentRequest)
+	signedReceipt, _ := json.Marshal(newInvoice.Receipt)
+	err = store.InsertOrder(store.Order{
+		PaymentHash:    newInvoice.Receipt.Record.PaymentHash,
+		PaymentRequest: newInvoice.PaymentRequest,
+		Zone:           zone.Name,
+		Product:        productID,
+		Plate:          plate,
+		Hours:          hours,
+		Sats:           satsToPay,
+		Eur:            newInvoice.Receipt.Record.Eur,
+		State:          store.OrderPending,
+		ExpiresAt:      newInvoice.Expiry,
+		Receipt:        string(signedReceipt),
+		Preimage:       hex.EncodeToString(preimage),
+	})
+	if err != nil {
+		log.Printf("Error storing order: %s", err)
+	}
 
-	return newInvoice
+	if !parking.IsTestZone(key.Zone.Name) {
+		stats.Record(key.Name(), stats.Invoiced)
+		invoicesCreated.Inc(key.Name())
+	}
+	testStep(key, newInvoice.Receipt.Record.PaymentHash, store.TestInvoiced, fmt.Sprintf("%d sats", satsToPay))
+	audit.Record(audit.Entry{
+		Kind:        audit.Audit,
+		Action:      "invoice_created",
+		PaymentHash: newInvoice.Receipt.Record.PaymentHash,
+		Zone:        key.Name(),
+		Plate:       plate,
+		Sats:        satsToPay,
+		Eur:         breakdown.Total,
+	})
+
+	h.hold(newInvoice.Receipt.Record.PaymentHash, newInvoice.PaymentRequest, key, preimage, holdOpen, newInvoice.Expiry)
+	h.expireAt(newInvoice.PaymentRequest, newInvoice.Receipt.Record.PaymentHash, newInvoice.Expiry)
+
+	return newInvoice, nil
 }
 
-func (h *Handler) RunInvoiceChecker() {
-	conn, err := tls.Dial("tcp", h.lndAddress, &tls.Config{InsecureSkipVerify: true})
-	if err != nil {
-		log.Fatalf("Error connecting to lnd rpc server: %v", err)
+// restore reloads unexpired invoices from the database after a restart and
+// retries the parking SMS of orders that were paid but never dispatched.
+func (h *Handler) restore() {
+	if store.DB == nil {
+		return
 	}
-	defer conn.Close()
 
-	_, err = conn.Write([]byte(fmt.Sprintf("GET /v1/invoices/subscribe HTTP/1.0\nGrpc-Metadata-macaroon: %s\r\n\r\n", h.macaroon)))
+	pending, err := store.PendingOrders(clock.Now())
 	if err != nil {
-		log.Fatalf("Error writing to lnd rpc server: %v", err)
+		log.Printf("Error loading pending orders: %s", err)
 	}
+	for _, o := range pending {
+		key, err := OrderKey(o)
+		if err != nil {
+			log.Printf("Pending order %s: %s", o.PaymentHash, err)
+			continue
+		}
+		inv := Invoice{PaymentRequest: o.PaymentRequest, Expiry: o.ExpiresAt}
+		json.Unmarshal([]byte(o.Receipt), &inv.Receipt)
+		inv.Receipt.Record.PaymentHash = o.PaymentHash
 
-	reader := bufio.NewReader(conn)
+		h.invoices.Lock()
+		h.invoices.add(key, inv, true)
+		h.invoices.Unlock()
 
-	for {
-		msg, readErr := reader.ReadBytes('\n')
-		if readErr != nil && readErr != io.EOF {
-			log.Fatalf("Error reading from lnd rpc server: %v", readErr)
+		if preimage, err := hex.DecodeString(o.Preimage); err == nil && len(preimage) > 0 {
+			h.hold(o.PaymentHash, o.PaymentRequest, key, preimage, holdOpen, o.ExpiresAt)
 		}
+		h.expireAt(o.PaymentRequest, o.PaymentHash, o.ExpiresAt)
+	}
+	log.Printf("Restored %d pending invoices", len(pending))
+
+	h.restoreHeld()
 
-		var response RpcResponse
-		err = json.Unmarshal(msg, &response)
-		if err == nil {
-			if response.Error != nil {
-				log.Printf("Error from rpc server: %v", response.Error)
+	// parking bought longer ago than an sms is retried for is not sent late
+	undispatched, err := store.UndispatchedOrders(clock.Now().Add(-sms.RetryFor))
+	if err != nil {
+		log.Printf("Error loading undispatched orders: %s", err)
+	}
+	go func() {
+		for _, o := range undispatched {
+			state, err := store.SmsState(o.PaymentHash)
+			if err != nil {
+				log.Printf("Error checking sms of undispatched order %s: %s", o.PaymentHash, err)
 				continue
 			}
-			log.Println(response)
-			if response.Result.State != SETTLED {
+			if state == store.SmsFailed || state == store.SmsCancelled {
 				continue
 			}
-			h.invoices.Lock()
-			key, ok := h.invoices.invoiceToKey[response.Result.PaymentRequest]
-			if ok {
-				smsErr := sms.Send(key.Message())
-				if smsErr != nil {
-					log.Printf("Error sending sms: %s", err)
-				}
-				delete(h.invoices.invoiceToKey, response.Result.PaymentRequest)
-				delete(h.invoices.keyToInvoice, key)
+			key, err := OrderKey(o)
+			if err != nil {
+				log.Printf("Undispatched order %s: %s", o.PaymentHash, err)
+				continue
 			}
-			h.invoices.Unlock()
+			log.Printf("Retrying parking sms of order %s", o.PaymentHash)
+			h.dispatch(key, o.PaymentHash, o.PaymentRequest)
+		}
+	}()
+}
+
+// GetVerificationInvoice creates the 1 sat invoice a client ip pays to prove
+// it is a real wallet user.
+func (h *Handler) GetVerificationInvoice(ip string) (Invoice, error) {
+	err := h.throttle.acquire()
+	if err != nil {
+		return Invoice{}, err
+	}
+	defer h.throttle.release()
+
+	response, err := h.addInvoice(verify.DepositSats, nil)
+	if err != nil {
+		return Invoice{}, err
+	}
+
+	expiry := clock.Now().Unix() + 300
+
+	h.invoices.Lock()
+	h.invoices.verifications[response.PaymentRequest] = ip
+	h.invoices.Unlock()
+	h.expireAt(response.PaymentRequest, "", expiry)
+
+	return Invoice{
+		PaymentRequest: response.PaymentRequest,
+		Expiry:         expiry,
+	}, nil
+}
+
+func (h *Handler) addInvoice(satsToPay int64, descriptionHash []byte) (RpcInvoice, error) {
+	var response RpcInvoice
+
+	err := h.post("/v1/invoices", struct {
+		Expiry          int64  `json:"expiry,string"`
+		Value           int64  `json:"value,string"`
+		DescriptionHash []byte `json:"description_hash,omitempty"`
+	}{300, satsToPay, descriptionHash}, &response)
+	if err != nil {
+		return response, fmt.Errorf("error adding invoice: %w", err)
+	}
+
+	return response, nil
+}
+
+// get makes an lnd REST GET call, decoding its response into response.
+func (h *Handler) get(path string, response interface{}) error {
+	request, err := http.NewRequest("GET", fmt.Sprintf("https://%s%s", h.lndAddress, path), nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Grpc-Metadata-macaroon", h.macaroon)
+
+	resp, err := h.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var rpcErr RpcError
+		json.NewDecoder(resp.Body).Decode(&rpcErr)
+		return fmt.Errorf("lnd returned %d: %s", resp.StatusCode, rpcErr.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// Ping checks lnd answers invoice calls with our macaroon.
+func (h *Handler) Ping() error {
+	var response struct{}
+	return h.get("/v1/invoices?num_max_invoices=1", &response)
+}
+
+// post makes an lnd REST call, decoding its response into response when it
+// is not nil.
+func (h *Handler) post(path string, body, response interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", fmt.Sprintf("https://%s%s", h.lndAddress, path), bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("error constructing a new request struct: %v", err)
+	}
+
+	request.Header.Set("Grpc-Metadata-macaroon", h.macaroon)
+
+	resp, err := h.httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("error making a post request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading response body: %v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var rpcErr RpcError
+		json.Unmarshal(data, &rpcErr)
+		if isRateLimited(resp.StatusCode, rpcErr) {
+			h.throttle.backOff()
+			return ErrBusy
+		}
+		return fmt.Errorf("lnd returned %d: %s", resp.StatusCode, rpcErr.Message)
+	}
+
+	if response == nil {
+		return nil
+	}
+	err = json.Unmarshal(data, response)
+	if err != nil {
+		return fmt.Errorf("error unmarshling response: %v", err)
+	}
+
+	return nil
+}
+
+// settle handles a settled invoice: a verification deposit unlocks its client,
+// a parking invoice gets its SMS sent.
+func (h *Handler) settle(result RpcInvoice) {
+	paymentHash := hex.EncodeToString(result.RHash)
+
+	h.invoices.Lock()
+	if ip, ok := h.invoices.verifications[result.PaymentRequest]; ok {
+		verify.Paid(ip)
+		delete(h.invoices.verifications, result.PaymentRequest)
+	}
+	key, ok := h.invoices.invoiceToKey[result.PaymentRequest]
+	inv := h.invoices.keyToInvoice[key]
+	if ok {
+		h.invoices.forget(key, result.PaymentRequest)
+	}
+	h.invoices.Unlock()
+
+	if !ok {
+		// settled while we were down and its invoice is not cached anymore
+		key, ok = h.unsettledOrder(paymentHash)
+	}
+	if !ok {
+		return
+	}
+
+	audit.Record(audit.Entry{
+		Kind:        audit.Ledger,
+		Action:      "invoice_settled",
+		PaymentHash: paymentHash,
+		Zone:        key.Name(),
+		Plate:       key.Plate,
+		Sats:        result.AmtPaidSat,
+	})
+	if !checkAmount(key, paymentHash, result.Value, result.AmtPaidSat) {
+		// the sats are ours already, an admin has to send them back
+		err := store.SetOrderState(paymentHash, store.OrderRefundOwed)
+		if err != nil {
+			log.Printf("Error updating underpaid order %s: %s", paymentHash, err)
 		}
+		events.Publish(result.PaymentRequest, events.Event{Name: events.RefundOwed, Link: links.Payment(paymentHash)})
+		return
+	}
+	verify.Spend(paymentHash)
+	recordPayment(key, result.AmtPaidSat, inv.Variant)
+	if !parking.IsTestZone(key.Zone.Name) {
+		invoicesSettled.Inc(key.Name())
+	}
+	testStep(key, paymentHash, store.TestPaid, fmt.Sprintf("%d sats", result.AmtPaidSat))
+	err := store.SetOrderState(paymentHash, store.OrderPaid)
+	if err != nil {
+		log.Printf("Error updating order: %s", err)
+	}
+	shareRevenue(paymentHash)
+	events.Publish(result.PaymentRequest, events.Event{Name: events.Paid, Link: links.Payment(paymentHash)})
+
+	h.dispatch(key, paymentHash, result.PaymentRequest)
+}
+
+// unsettledOrder looks up a stored order that was not marked paid yet.
+func (h *Handler) unsettledOrder(paymentHash string) (InvoiceKey, bool) {
+	if store.DB == nil {
+		return InvoiceKey{}, false
+	}
+
+	o, err := store.GetOrder(paymentHash)
+	if err != nil || (o.State != store.OrderPending && o.State != store.OrderExpired) {
+		return InvoiceKey{}, false
+	}
+
+	key, err := OrderKey(o)
+	if err != nil {
+		log.Printf("Settled order %s: %s", paymentHash, err)
+		return InvoiceKey{}, false
+	}
+
+	return key, true
+}
+
+// publishDispatch tells the pay page whether the parking SMS went through.
+func publishDispatch(paymentHash, paymentRequest string, smsErr error) {
+	event := events.Event{Name: events.SmsSent, Link: links.Payment(paymentHash)}
+	if smsErr != nil {
+		event.Name = events.SmsFailed
+	}
+	events.Publish(paymentRequest, event)
+}
+
+// dispatch queues the parking SMS of a paid order, its outcome is handled by
+// dispatched.
+func (h *Handler) dispatch(key InvoiceKey, paymentHash, paymentRequest string) {
+	h.invoices.Lock()
+	h.invoices.sending[paymentHash] = sending{key, paymentRequest, clock.Now()}
+	h.invoices.Unlock()
 
-		if readErr == io.EOF {
-			break
+	message := key.Message()
+	if len(message) == 0 {
+		// nothing to send for this product
+		go h.dispatched(paymentHash, nil)
+		return
+	}
+	if parking.IsTestZone(key.Zone.Name) {
+		sms.EnqueueTo(paymentHash, TestSmsTo, message)
+		return
+	}
+	sms.Enqueue(paymentHash, message)
+}
+
+// dispatched records the outcome of a parking SMS and, for hold invoices,
+// settles the payment or cancels it when the SMS could not be sent.
+func (h *Handler) dispatched(paymentHash string, smsErr error) {
+	h.untrack(paymentHash)
+
+	h.invoices.Lock()
+	s, ok := h.invoices.sending[paymentHash]
+	delete(h.invoices.sending, paymentHash)
+	held, isHeld := h.invoices.held[paymentHash]
+	h.invoices.Unlock()
+
+	if !ok && store.DB != nil {
+		// queued before a restart
+		o, err := store.GetOrder(paymentHash)
+		if err != nil {
+			log.Printf("Error loading order of sms %s: %s", paymentHash, err)
+			return
+		}
+		key, _ := OrderKey(o)
+		s = sending{key: key, paymentRequest: o.PaymentRequest}
+	}
+
+	if smsErr != nil {
+		log.Printf("Error sending sms: %s", smsErr)
+		audit.Record(audit.Entry{Kind: audit.Audit, Action: "sms_failed", PaymentHash: paymentHash, Detail: smsErr.Error()})
+		parkingSms.Inc("failed")
+		testStep(s.key, paymentHash, store.TestSmsFailed, smsErr.Error())
+	} else {
+		parkingSms.Inc("sent")
+		if !s.paidAt.IsZero() {
+			settlementSms.Observe(clock.Since(s.paidAt).Seconds())
+		}
+		if !parking.IsTestZone(s.key.Zone.Name) {
+			stats.Record(s.key.Name(), stats.Confirmed)
 		}
+		recordSession(s.key, clock.Now())
+		testStep(s.key, paymentHash, store.TestSmsSent, TestSmsTo)
+		audit.Record(audit.Entry{Kind: audit.Audit, Action: "sms_sent", PaymentHash: paymentHash})
+	}
+
+	err := store.RecordSmsAttempt(paymentHash, smsErr)
+	if err != nil {
+		log.Printf("Error updating order: %s", err)
+	}
+	publishDispatch(paymentHash, s.paymentRequest, smsErr)
+
+	if !isHeld || held.state != holdAccepted {
+		return
+	}
+	if smsErr != nil {
+		err = h.CancelHeld(paymentHash)
+	} else if SettleOnReply {
+		go h.settleAfter(paymentHash, ReplyTimeout)
+		return
+	} else {
+		err = h.SettleHeld(paymentHash)
+	}
+	if err != nil {
+		log.Printf("Error resolving hold invoice %s: %s", paymentHash, err)
+	}
+}
+
+// SetVariant remembers which experiment variant label the invoice was shown
+// with, so a payment can be attributed to it.
+func (h *Handler) SetVariant(paymentRequest, variant string) {
+	h.invoices.Lock()
+	defer h.invoices.Unlock()
+
+	key, ok := h.invoices.invoiceToKey[paymentRequest]
+	if !ok {
+		return
 	}
+	inv := h.invoices.keyToInvoice[key]
+	inv.Variant = variant
+	h.invoices.keyToInvoice[key] = inv
 }
 
 func (h *Handler) CheckInvoice(paymentRequest string) bool {
@@ -224,6 +864,7 @@ func (h *Handler) CheckInvoice(paymentRequest string) bool {
 	defer h.invoices.Unlock()
 
 	_, ok := h.invoices.invoiceToKey[paymentRequest]
+	_, verifying := h.invoices.verifications[paymentRequest]
 
-	return !ok
+	return !ok && !verifying
 }
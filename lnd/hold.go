@@ -0,0 +1,405 @@
+package lnd
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"ljightningparking/audit"
+	"ljightningparking/clock"
+	"ljightningparking/events"
+	"ljightningparking/links"
+	"ljightningparking/store"
+	"ljightningparking/verify"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	ACCEPTED = "ACCEPTED"
+	CANCELED = "CANCELED"
+)
+
+// SettleOnReply keeps a held payment until SMS parking confirms the purchase,
+// instead of settling as soon as the parking SMS is sent.
+var SettleOnReply = false
+
+// ReplyTimeout is how long a held payment waits for the operator's reply
+// before it is settled anyway, the parking SMS having gone through.
+const ReplyTimeout = 10 * time.Minute
+
+// Hold invoice states in InvoiceCache.held.
+const (
+	holdOpen     = "open"
+	holdAccepted = "accepted"
+)
+
+// heldInvoice is a hold invoice whose preimage we keep until the parking SMS
+// decides whether its payment is settled or cancelled.
+type heldInvoice struct {
+	paymentRequest string
+	key            InvoiceKey
+	preimage       []byte
+	state          string
+}
+
+func newPreimage() ([]byte, []byte, error) {
+	preimage := make([]byte, 32)
+	_, err := rand.Read(preimage)
+	if err != nil {
+		return nil, nil, err
+	}
+	hash := sha256.Sum256(preimage)
+	return preimage, hash[:], nil
+}
+
+func (h *Handler) addHoldInvoice(satsToPay int64, paymentHash, descriptionHash []byte) (RpcInvoice, error) {
+	var response RpcInvoice
+
+	err := h.post("/v2/invoices/hodl", struct {
+		Hash            []byte `json:"hash"`
+		Expiry          int64  `json:"expiry,string"`
+		Value           int64  `json:"value,string"`
+		DescriptionHash []byte `json:"description_hash,omitempty"`
+	}{paymentHash, 300, satsToPay, descriptionHash}, &response)
+	if err != nil {
+		return response, fmt.Errorf("error adding hold invoice: %w", err)
+	}
+
+	response.RHash = paymentHash
+	return response, nil
+}
+
+// hold starts tracking a hold invoice until it is paid or expires.
+func (h *Handler) hold(paymentHash, paymentRequest string, key InvoiceKey, preimage []byte, state string, expiry int64) {
+	h.invoices.Lock()
+	h.invoices.held[paymentHash] = heldInvoice{paymentRequest, key, preimage, state}
+	h.invoices.Unlock()
+
+	if state == holdOpen {
+		go h.watchHold(paymentHash, expiry)
+	}
+}
+
+// watchHold follows a single hold invoice, as lnd only reports the accepted
+// state to subscribers of that invoice. The invoice stops being held once
+// it can no longer be paid.
+func (h *Handler) watchHold(paymentHash string, expiry int64) {
+	defer h.dropOpen(paymentHash)
+	delay := minReconnectDelay
+
+	for {
+		done, err := h.subscribeHold(paymentHash)
+		if done || h.stop.Err() != nil {
+			return
+		}
+		if clock.Now().Unix() > expiry && !h.isHeld(paymentHash, holdAccepted) {
+			return
+		}
+		log.Printf("Hold invoice %s subscription ended, reconnecting in %s: %v", paymentHash, delay, err)
+
+		select {
+		case <-clock.After(delay):
+		case <-h.stop.Done():
+			return
+		}
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// subscribeHold streams updates of one invoice and reports whether it
+// reached a final state.
+func (h *Handler) subscribeHold(paymentHash string) (bool, error) {
+	hash, err := hex.DecodeString(paymentHash)
+	if err != nil {
+		return true, err
+	}
+
+	request, err := http.NewRequestWithContext(h.stop, "GET", fmt.Sprintf("https://%s/v2/invoices/subscribe/%s", h.lndAddress, base64.URLEncoding.EncodeToString(hash)), nil)
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Grpc-Metadata-macaroon", h.macaroon)
+
+	resp, err := h.streamClient.Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("lnd returned %d", resp.StatusCode)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	for {
+		msg, err := reader.ReadBytes('\n')
+		if len(msg) > 0 {
+			var response RpcResponse
+			if jsonErr := json.Unmarshal(msg, &response); jsonErr != nil {
+				log.Printf("Error unmarshaling hold invoice update: %s", jsonErr)
+			} else if response.Error != nil {
+				log.Printf("Error from rpc server: %v", response.Error)
+			} else {
+				switch response.Result.State {
+				case ACCEPTED:
+					h.accept(paymentHash, response.Result.Value, response.Result.AmtPaidSat)
+				case SETTLED, CANCELED:
+					return true, nil
+				}
+			}
+		}
+		if err == io.EOF {
+			return false, fmt.Errorf("lnd closed the subscription")
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// dropOpen stops holding an invoice that was never paid.
+func (h *Handler) dropOpen(paymentHash string) {
+	h.invoices.Lock()
+	defer h.invoices.Unlock()
+
+	if held, ok := h.invoices.held[paymentHash]; ok && held.state == holdOpen {
+		delete(h.invoices.held, paymentHash)
+	}
+}
+
+func (h *Handler) isHeld(paymentHash, state string) bool {
+	h.invoices.Lock()
+	defer h.invoices.Unlock()
+
+	held, ok := h.invoices.held[paymentHash]
+	return ok && held.state == state
+}
+
+// accept handles a paid hold invoice: the parking SMS is queued while lnd
+// holds the payment, which is settled once the SMS went through and
+// cancelled, refunding the user, if it could not be sent or the invoice was
+// underpaid.
+func (h *Handler) accept(paymentHash string, value, amtPaidSat int64) {
+	h.invoices.Lock()
+	held, ok := h.invoices.held[paymentHash]
+	if ok && held.state != holdOpen {
+		h.invoices.Unlock()
+		return
+	}
+	if !ok {
+		// the invoice expired from the cache as it was paid, or was issued
+		// before a restart
+		h.invoices.Unlock()
+		stored, o, found := h.storedHeld(paymentHash)
+		if _, err := OrderKey(o); err != nil || !found || o.State != store.OrderPending && o.State != store.OrderExpired {
+			log.Printf("Accepted hold invoice %s is not awaiting payment, cancelling it", paymentHash)
+			err := h.cancelInvoice(paymentHash)
+			if err != nil {
+				log.Printf("Error cancelling hold invoice %s: %s", paymentHash, err)
+			}
+			return
+		}
+		held = stored
+		h.invoices.Lock()
+		if _, taken := h.invoices.held[paymentHash]; taken {
+			h.invoices.Unlock()
+			return
+		}
+	}
+	held.state = holdAccepted
+	h.invoices.held[paymentHash] = held
+
+	inv := h.invoices.keyToInvoice[held.key]
+	h.invoices.forget(held.key, held.paymentRequest)
+	h.invoices.Unlock()
+
+	audit.Record(audit.Entry{
+		Kind:        audit.Ledger,
+		Action:      "invoice_accepted",
+		PaymentHash: paymentHash,
+		Zone:        held.key.Name(),
+		Plate:       held.key.Plate,
+		Sats:        amtPaidSat,
+	})
+	if !checkAmount(held.key, paymentHash, value, amtPaidSat) {
+		err := h.CancelHeld(paymentHash)
+		if err != nil {
+			log.Printf("Error cancelling underpaid hold invoice %s: %s", paymentHash, err)
+		}
+		return
+	}
+	verify.Spend(paymentHash)
+	variant := ""
+	if inv.PaymentRequest == held.paymentRequest {
+		variant = inv.Variant
+	}
+	recordPayment(held.key, amtPaidSat, variant)
+	testStep(held.key, paymentHash, store.TestPaid, fmt.Sprintf("%d sats held", amtPaidSat))
+	err := store.SetOrderState(paymentHash, store.OrderAccepted)
+	if err != nil {
+		log.Printf("Error updating order: %s", err)
+	}
+	events.Publish(held.paymentRequest, events.Event{Name: events.Paid, Link: links.Payment(paymentHash)})
+
+	h.dispatch(held.key, paymentHash, held.paymentRequest)
+}
+
+// settleAfter settles a held payment whose operator reply never came.
+func (h *Handler) settleAfter(paymentHash string, wait time.Duration) {
+	<-clock.After(wait)
+
+	if !h.isHeld(paymentHash, holdAccepted) {
+		return
+	}
+	log.Printf("No operator reply for %s, settling", paymentHash)
+	err := h.SettleHeld(paymentHash)
+	if err != nil {
+		log.Printf("Error settling hold invoice %s: %s", paymentHash, err)
+	}
+}
+
+// SettleHeld claims the payment of an accepted hold invoice.
+func (h *Handler) SettleHeld(paymentHash string) error {
+	held, ok := h.release(paymentHash)
+	if !ok {
+		return fmt.Errorf("no held payment %s", paymentHash)
+	}
+
+	err := h.post("/v2/invoices/settle", struct {
+		Preimage []byte `json:"preimage"`
+	}{held.preimage}, nil)
+	if err != nil {
+		return err
+	}
+
+	audit.Record(audit.Entry{
+		Kind:        audit.Ledger,
+		Action:      "invoice_settled",
+		PaymentHash: paymentHash,
+		Zone:        held.key.Name(),
+		Plate:       held.key.Plate,
+	})
+	testStep(held.key, paymentHash, store.TestSettled, "")
+	err = store.SetOrderSettled(paymentHash, true)
+	if err != nil {
+		return err
+	}
+	shareRevenue(paymentHash)
+	return nil
+}
+
+// CancelHeld cancels an accepted hold invoice, returning the payment to the
+// user.
+func (h *Handler) CancelHeld(paymentHash string) error {
+	held, ok := h.release(paymentHash)
+	if !ok {
+		return fmt.Errorf("no held payment %s", paymentHash)
+	}
+
+	err := h.cancelInvoice(paymentHash)
+	if err != nil {
+		return err
+	}
+
+	audit.Record(audit.Entry{
+		Kind:        audit.Ledger,
+		Action:      "invoice_cancelled",
+		PaymentHash: paymentHash,
+		Zone:        held.key.Name(),
+		Plate:       held.key.Plate,
+	})
+	events.Publish(held.paymentRequest, events.Event{Name: events.Cancelled, Link: links.Payment(paymentHash)})
+	reverseRevenue(paymentHash)
+	return store.SetOrderSettled(paymentHash, false)
+}
+
+// release stops tracking a held payment, falling back to the store for
+// payments held across a restart.
+func (h *Handler) release(paymentHash string) (heldInvoice, bool) {
+	h.invoices.Lock()
+	held, ok := h.invoices.held[paymentHash]
+	delete(h.invoices.held, paymentHash)
+	h.invoices.Unlock()
+
+	if ok {
+		return held, ok
+	}
+	held, _, ok = h.storedHeld(paymentHash)
+	return held, ok
+}
+
+// storedHeld returns a hold invoice as its order has it, for payments the
+// cache no longer tracks.
+func (h *Handler) storedHeld(paymentHash string) (heldInvoice, store.Order, bool) {
+	if store.DB == nil {
+		return heldInvoice{}, store.Order{}, false
+	}
+
+	o, err := store.GetOrder(paymentHash)
+	if err != nil || len(o.Preimage) == 0 || o.Settled || o.State == store.OrderCancelled {
+		return heldInvoice{}, o, false
+	}
+	held := heldInvoice{paymentRequest: o.PaymentRequest}
+	held.preimage, err = hex.DecodeString(o.Preimage)
+	held.key, _ = OrderKey(o)
+	return held, o, err == nil
+}
+
+// cancelInvoice has lnd cancel a hold invoice, returning any payment.
+func (h *Handler) cancelInvoice(paymentHash string) error {
+	hash, _ := hex.DecodeString(paymentHash)
+	return h.post("/v2/invoices/cancel", struct {
+		PaymentHash []byte `json:"payment_hash"`
+	}{hash}, nil)
+}
+
+// restoreHeld resumes hold invoices that were paid but not yet resolved when
+// the service stopped.
+func (h *Handler) restoreHeld() {
+	held, err := store.HeldOrders()
+	if err != nil {
+		log.Printf("Error loading held orders: %s", err)
+	}
+
+	for _, o := range held {
+		key, err := OrderKey(o)
+		if err != nil {
+			log.Printf("Held order %s: %s", o.PaymentHash, err)
+			continue
+		}
+		preimage, err := hex.DecodeString(o.Preimage)
+		if err != nil {
+			log.Printf("Held order %s has a bad preimage: %s", o.PaymentHash, err)
+			continue
+		}
+
+		switch o.State {
+		case store.OrderAccepted:
+			// lnd replays the accepted state, which sends the parking sms
+			h.hold(o.PaymentHash, o.PaymentRequest, key, preimage, holdOpen, o.ExpiresAt)
+		case store.OrderConfirmed:
+			h.hold(o.PaymentHash, o.PaymentRequest, key, preimage, holdAccepted, o.ExpiresAt)
+			if SettleOnReply && len(o.Reply) == 0 {
+				go h.settleAfter(o.PaymentHash, ReplyTimeout-clock.Since(o.UpdatedAt))
+				continue
+			}
+			err = h.SettleHeld(o.PaymentHash)
+		default:
+			h.hold(o.PaymentHash, o.PaymentRequest, key, preimage, holdAccepted, o.ExpiresAt)
+			err = h.CancelHeld(o.PaymentHash)
+		}
+		if err != nil {
+			log.Printf("Error resolving hold invoice %s: %s", o.PaymentHash, err)
+		}
+	}
+	log.Printf("Restored %d held payments", len(held))
+}
@@ -0,0 +1,165 @@
+package lnd
+
+import (
+	"fmt"
+	"ljightningparking/alerts"
+	"ljightningparking/clock"
+	"ljightningparking/metrics"
+	"time"
+)
+
+// lagAlert is the alert fired when settled invoices are not processed.
+const lagAlert = "InvoiceConsumerLag"
+
+func init() {
+	metrics.GaugeFunc("ljp_invoice_settle_lag", "Settled invoices lnd has that are not processed yet.", func() (float64, bool) {
+		if InvoiceHandler == nil {
+			return 0, false
+		}
+		lag := InvoiceHandler.Lag()
+		return float64(lag.Lag), !lag.CheckedAt.IsZero()
+	})
+}
+
+// Lag compares the settle index processed, up to the oldest settled invoice
+// whose parking SMS is still going out, with the latest one of the node.
+type Lag struct {
+	Processed uint64    `json:"processed"`
+	Latest    uint64    `json:"latest"`
+	Lag       uint64    `json:"lag"`
+	CheckedAt time.Time `json:"checked_at"`
+	// Behind is since when the lag has been above the alert threshold.
+	Behind time.Time `json:"behind"`
+}
+
+// track marks a settled invoice as being processed until its parking SMS
+// went out or failed.
+func (h *Handler) track(paymentHash string, index uint64) {
+	h.settleIndex.Lock()
+	defer h.settleIndex.Unlock()
+
+	if h.settleIndex.inFlight == nil {
+		h.settleIndex.inFlight = make(map[string]uint64)
+	}
+	h.settleIndex.inFlight[paymentHash] = index
+}
+
+func (h *Handler) untrack(paymentHash string) {
+	h.settleIndex.Lock()
+	defer h.settleIndex.Unlock()
+
+	delete(h.settleIndex.inFlight, paymentHash)
+}
+
+// processedIndex is the highest settle index up to which every settled
+// invoice was handled.
+func (h *Handler) processedIndex() uint64 {
+	received := h.lastSettleIndex()
+
+	h.settleIndex.Lock()
+	defer h.settleIndex.Unlock()
+
+	processed := received
+	for _, index := range h.settleIndex.inFlight {
+		if index > 0 && index <= processed {
+			processed = index - 1
+		}
+	}
+	return processed
+}
+
+const (
+	// settleScanPage is how many invoices latestSettleIndex loads at once.
+	settleScanPage = 100
+	// settleScanMargin allows for hold invoices, settled a while after they
+	// expired.
+	settleScanMargin = time.Hour
+	// maxSettleScanPages bounds the invoices latestSettleIndex looks at.
+	maxSettleScanPages = 100
+)
+
+// latestSettleIndex asks lnd for the settle index of its most recently
+// settled invoice. lnd lists invoices by when they were added, not settled,
+// so it pages back from the newest until the invoices left all expired well
+// before the latest settlement found, none of them can have been settled
+// after it.
+func (h *Handler) latestSettleIndex() (uint64, error) {
+	var latest uint64
+	var latestAt int64
+	var offset uint64
+	for page := 0; page < maxSettleScanPages; page++ {
+		var response struct {
+			Invoices         []RpcInvoice `json:"invoices"`
+			FirstIndexOffset uint64       `json:"first_index_offset,string"`
+		}
+		path := fmt.Sprintf("/v1/invoices?reversed=true&num_max_invoices=%d", settleScanPage)
+		if offset > 0 {
+			path += fmt.Sprintf("&index_offset=%d", offset)
+		}
+		err := h.get(path, &response)
+		if err != nil {
+			return 0, err
+		}
+
+		for _, invoice := range response.Invoices {
+			if invoice.SettleIndex > latest {
+				latest = invoice.SettleIndex
+				latestAt = invoice.SettleDate
+			}
+		}
+
+		done := latest > 0
+		for _, invoice := range response.Invoices {
+			if invoice.CreationDate+invoice.Expiry+int64(settleScanMargin/time.Second) >= latestAt {
+				done = false
+			}
+		}
+		if done || len(response.Invoices) < settleScanPage || response.FirstIndexOffset <= 1 {
+			return latest, nil
+		}
+		offset = response.FirstIndexOffset
+	}
+	return latest, nil
+}
+
+// CheckLag is a job measuring how far processing of settled invoices is
+// behind lnd, alerting when it stays behind by more than
+// alerts.Config.SettleLag invoices for alerts.Config.SettleLagFor.
+func (h *Handler) CheckLag() error {
+	latest, err := h.latestSettleIndex()
+	if err != nil {
+		return fmt.Errorf("error loading latest settle index: %w", err)
+	}
+	processed := h.processedIndex()
+
+	h.lag.Lock()
+	lag := Lag{Processed: processed, Latest: latest, CheckedAt: clock.Now()}
+	if latest > processed {
+		lag.Lag = latest - processed
+	}
+	if lag.Lag > uint64(alerts.Config.SettleLag) {
+		lag.Behind = h.lag.value.Behind
+		if lag.Behind.IsZero() {
+			lag.Behind = lag.CheckedAt
+		}
+	}
+	h.lag.value = lag
+	h.lag.Unlock()
+
+	switch {
+	case lag.Behind.IsZero():
+		alerts.Resolve(lagAlert, fmt.Sprintf("settled invoices are processed up to settle index %d of %d", processed, latest))
+	case clock.Since(lag.Behind) >= alerts.Config.SettleLagFor:
+		alerts.Fire(lagAlert, fmt.Sprintf("settled invoices are processed up to settle index %d of %d, %d behind since %s",
+			processed, latest, lag.Lag, lag.Behind.Format(time.RFC3339)))
+	}
+	return nil
+}
+
+// Lag returns the last measured invoice processing lag.
+func (h *Handler) Lag() Lag {
+	h.lag.Lock()
+	defer h.lag.Unlock()
+
+	return h.lag.value
+}
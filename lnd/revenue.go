@@ -0,0 +1,23 @@
+package lnd
+
+import (
+	"ljightningparking/revenue"
+	"log"
+)
+
+// shareRevenue records the revenue shares of a settled payment.
+func shareRevenue(paymentHash string) {
+	err := revenue.Record(paymentHash)
+	if err != nil {
+		log.Printf("Error recording revenue shares of %s: %s", paymentHash, err)
+	}
+}
+
+// reverseRevenue takes back the revenue shares of a payment returned to the
+// user.
+func reverseRevenue(paymentHash string) {
+	err := revenue.Reverse(paymentHash)
+	if err != nil {
+		log.Printf("Error reversing revenue shares of %s: %s", paymentHash, err)
+	}
+}
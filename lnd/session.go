@@ -0,0 +1,42 @@
+package lnd
+
+import (
+	"database/sql"
+	"ljightningparking/catalogue"
+	"ljightningparking/store"
+	"log"
+	"time"
+)
+
+// recordSession adds hourly parking whose SMS went out at sentAt to the
+// plate's session in its zone. Parking bought while the session is still
+// running extends it, as the operator adds it to the time left.
+func recordSession(key InvoiceKey, sentAt time.Time) {
+	if store.DB == nil || len(key.Zone.Name) == 0 || key.product().Kind != catalogue.Hourly {
+		return
+	}
+
+	session, err := store.GetSession(key.Plate, key.Zone.Name)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error loading parking session of %s: %s", key.Plate, err)
+		return
+	}
+
+	if session.Active(sentAt) {
+		session.Hours += key.Hours
+	} else {
+		session = store.ParkingSession{
+			Plate:     key.Plate,
+			Zone:      key.Zone.Name,
+			StartedAt: sentAt,
+			PaidUntil: sentAt,
+			Hours:     key.Hours,
+		}
+	}
+	session.PaidUntil = key.Zone.PaidUntil(session.PaidUntil, key.Hours)
+
+	err = store.SaveSession(session)
+	if err != nil {
+		log.Printf("Error saving parking session of %s: %s", key.Plate, err)
+	}
+}
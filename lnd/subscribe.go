@@ -0,0 +1,150 @@
+package lnd
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"ljightningparking/clock"
+	"ljightningparking/store"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
+
+	settleIndexSetting = "lnd_settle_index"
+)
+
+// RunInvoiceChecker keeps an invoice subscription to lnd open until the
+// handler is closed, reconnecting with exponential backoff. Subscribing from
+// the last processed settle index makes lnd replay every invoice settled
+// while we were disconnected or down.
+func (h *Handler) RunInvoiceChecker() {
+	defer h.checking.Done()
+	delay := minReconnectDelay
+
+	for {
+		connected, err := h.subscribeInvoices()
+		if h.stop.Err() != nil {
+			log.Printf("Invoice subscription closed")
+			return
+		}
+		if connected {
+			delay = minReconnectDelay
+		}
+		log.Printf("Invoice subscription ended, reconnecting in %s: %v", delay, err)
+
+		select {
+		case <-clock.After(delay):
+		case <-h.stop.Done():
+			return
+		}
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// subscribeInvoices streams invoice updates until the connection drops. It
+// reports whether it got connected at all, so backoff can be reset.
+func (h *Handler) subscribeInvoices() (bool, error) {
+	settleIndex := h.lastSettleIndex()
+
+	request, err := http.NewRequestWithContext(h.stop, "GET", fmt.Sprintf("https://%s/v1/invoices/subscribe?settle_index=%d", h.lndAddress, settleIndex), nil)
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Grpc-Metadata-macaroon", h.macaroon)
+
+	resp, err := h.streamClient.Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("lnd returned %d", resp.StatusCode)
+	}
+
+	log.Printf("Subscribed to lnd invoices from settle index %d", settleIndex)
+	subscriptionUp.Set(1)
+	defer subscriptionUp.Set(0)
+
+	reader := bufio.NewReader(resp.Body)
+	for {
+		msg, err := reader.ReadBytes('\n')
+		if len(msg) > 0 {
+			h.handleUpdate(msg)
+		}
+		if err == io.EOF {
+			return true, fmt.Errorf("lnd closed the subscription")
+		}
+		if err != nil {
+			return true, err
+		}
+	}
+}
+
+func (h *Handler) handleUpdate(msg []byte) {
+	var response RpcResponse
+	err := json.Unmarshal(msg, &response)
+	if err != nil {
+		log.Printf("Error unmarshaling invoice update: %s", err)
+		return
+	}
+	if response.Error != nil {
+		log.Printf("Error from rpc server: %v", response.Error)
+		return
+	}
+	if response.Result.State != SETTLED {
+		return
+	}
+
+	paymentHash := hex.EncodeToString(response.Result.RHash)
+	h.track(paymentHash, response.Result.SettleIndex)
+	h.settle(response.Result)
+	h.setSettleIndex(response.Result.SettleIndex)
+
+	h.invoices.Lock()
+	_, sending := h.invoices.sending[paymentHash]
+	h.invoices.Unlock()
+	if !sending {
+		h.untrack(paymentHash)
+	}
+}
+
+func (h *Handler) lastSettleIndex() uint64 {
+	h.settleIndex.Lock()
+	defer h.settleIndex.Unlock()
+
+	if h.settleIndex.value == 0 {
+		value, err := store.GetSetting(settleIndexSetting, "0")
+		if err != nil {
+			log.Printf("Error loading settle index: %s", err)
+		}
+		h.settleIndex.value, _ = strconv.ParseUint(value, 10, 64)
+	}
+	return h.settleIndex.value
+}
+
+func (h *Handler) setSettleIndex(index uint64) {
+	h.settleIndex.Lock()
+	defer h.settleIndex.Unlock()
+
+	if index <= h.settleIndex.value {
+		return
+	}
+	h.settleIndex.value = index
+
+	err := store.SetSetting(settleIndexSetting, strconv.FormatUint(index, 10))
+	if err != nil {
+		log.Printf("Error saving settle index: %s", err)
+	}
+}
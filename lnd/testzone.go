@@ -0,0 +1,41 @@
+package lnd
+
+import (
+	"ljightningparking/clock"
+	"ljightningparking/events"
+	"ljightningparking/parking"
+	"ljightningparking/stats"
+	"ljightningparking/store"
+	"log"
+)
+
+// TestSmsTo is the number the parking SMS of test zone purchases go to.
+var TestSmsTo string
+
+// recordPayment counts a payment in the stats and shows it on the wall
+// displays, except for test zone purchases. variant is the pay page variant
+// the invoice was shown with, if any.
+func recordPayment(key InvoiceKey, sats int64, variant string) {
+	if parking.IsTestZone(key.Zone.Name) {
+		return
+	}
+	stats.Record(key.Name(), stats.Paid)
+	stats.RecordPayment(sats)
+	stats.RecordPayer(key.Plate)
+	if len(variant) > 0 {
+		stats.RecordVariant(variant, stats.Paid)
+	}
+	events.PublishPayment(events.Payment{Zone: key.Name(), Hours: key.Hours, Sats: sats, Time: clock.Now()})
+}
+
+// testStep records how far a test zone purchase got, it does nothing for
+// other purchases.
+func testStep(key InvoiceKey, paymentHash, step, detail string) {
+	if !parking.IsTestZone(key.Zone.Name) {
+		return
+	}
+	err := store.RecordTestStep(paymentHash, step, detail)
+	if err != nil {
+		log.Printf("Error recording test step %s of %s: %s", step, paymentHash, err)
+	}
+}
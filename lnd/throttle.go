@@ -0,0 +1,90 @@
+package lnd
+
+import (
+	"errors"
+	"ljightningparking/clock"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrBusy is returned when lnd is rate limiting us or too many invoices are
+// being created at once. Callers should ask the user to retry shortly.
+var ErrBusy = errors.New("lnd is busy, retry in a few seconds")
+
+const (
+	queueWait    = 3 * time.Second
+	backOffDelay = 5 * time.Second
+)
+
+// grpc status codes lnd's REST proxy reports when it is overloaded.
+const (
+	grpcResourceExhausted = 8
+	grpcUnavailable       = 14
+)
+
+type RpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// throttle limits concurrent invoice creation to a few slots with a short
+// waiting queue, and stops calling lnd for a while after it pushes back.
+type throttle struct {
+	slots        chan struct{}
+	queue        chan struct{}
+	backOffUntil time.Time
+	sync.Mutex
+}
+
+func newThrottle(concurrent, queued int) *throttle {
+	return &throttle{
+		slots: make(chan struct{}, concurrent),
+		queue: make(chan struct{}, queued),
+	}
+}
+
+func (t *throttle) acquire() error {
+	t.Lock()
+	backingOff := clock.Now().Before(t.backOffUntil)
+	t.Unlock()
+	if backingOff {
+		return ErrBusy
+	}
+
+	select {
+	case t.queue <- struct{}{}:
+	default:
+		return ErrBusy
+	}
+	defer func() { <-t.queue }()
+
+	select {
+	case t.slots <- struct{}{}:
+		return nil
+	case <-time.After(queueWait):
+		return ErrBusy
+	}
+}
+
+func (t *throttle) release() {
+	<-t.slots
+}
+
+func (t *throttle) backOff() {
+	t.Lock()
+	t.backOffUntil = clock.Now().Add(backOffDelay)
+	t.Unlock()
+}
+
+func isRateLimited(status int, rpcErr RpcError) bool {
+	if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+		return true
+	}
+	if rpcErr.Code == grpcResourceExhausted || rpcErr.Code == grpcUnavailable {
+		return true
+	}
+	msg := strings.ToLower(rpcErr.Message)
+	return strings.Contains(msg, "rate limit") || strings.Contains(msg, "too many") || strings.Contains(msg, "resource exhausted")
+}
@@ -0,0 +1,81 @@
+package lnd
+
+import (
+	"errors"
+	"ljightningparking/audit"
+	"ljightningparking/sms"
+	"ljightningparking/store"
+)
+
+// ErrNotTransferable is returned when moving an order to another plate after
+// its parking SMS went out, or for an order that was not paid.
+var ErrNotTransferable = errors.New("only paid sessions whose parking sms was not sent yet can be transferred")
+
+// Transferable reports whether an order can still move to another plate: it
+// is paid and its parking SMS, which starts the parking, was not sent.
+func Transferable(o store.Order) bool {
+	switch o.State {
+	case store.OrderPaid, store.OrderAccepted:
+	case store.OrderSmsFailed:
+		// a hold invoice is refunded when its sms fails
+		if len(o.Preimage) > 0 {
+			return false
+		}
+	default:
+		return false
+	}
+
+	state, err := store.SmsState(o.PaymentHash)
+	return err == nil && state != store.SmsSent
+}
+
+// Transfer moves a paid order whose parking SMS was not sent yet to another
+// plate, correcting a typo. The SMS queued for the old plate is withdrawn and
+// one for the new plate is queued instead.
+func (h *Handler) Transfer(paymentHash, plate, admin string) error {
+	o, err := store.GetOrder(paymentHash)
+	if err != nil {
+		return err
+	}
+	if !Transferable(o) {
+		return ErrNotTransferable
+	}
+
+	_, err = sms.Cancel(paymentHash)
+	if err == sms.ErrSending {
+		return ErrNotTransferable
+	}
+	if err != nil {
+		return err
+	}
+
+	err = store.SetOrderPlate(paymentHash, plate)
+	if err != nil {
+		return err
+	}
+
+	key, err := OrderKey(o)
+	if err != nil {
+		return err
+	}
+	key.Plate = plate
+
+	h.invoices.Lock()
+	if held, ok := h.invoices.held[paymentHash]; ok {
+		held.key = key
+		h.invoices.held[paymentHash] = held
+	}
+	h.invoices.Unlock()
+
+	audit.Record(audit.Entry{
+		Kind:        audit.Audit,
+		Action:      "order_transferred",
+		PaymentHash: paymentHash,
+		Zone:        key.Name(),
+		Plate:       plate,
+		Detail:      "from " + o.Plate + " by " + admin,
+	})
+
+	h.dispatch(key, paymentHash, o.PaymentRequest)
+	return nil
+}
@@ -0,0 +1,121 @@
+package maintenance
+
+import (
+	"database/sql"
+	"errors"
+	"ljightningparking/clock"
+	"ljightningparking/store"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Pruner deletes rows that are past their retention and returns how many.
+type Pruner func(db *sql.DB, now time.Time) (int64, error)
+
+type Report struct {
+	Started     time.Time
+	Duration    time.Duration
+	Pruned      map[string]int64
+	BytesBefore int64
+	BytesAfter  int64
+	Error       string
+}
+
+func (r Report) Reclaimed() int64 {
+	return r.BytesBefore - r.BytesAfter
+}
+
+var (
+	pruners = make(map[string]Pruner)
+
+	last struct {
+		report Report
+		sync.Mutex
+	}
+)
+
+// Register adds a pruner run by every maintenance pass. Packages owning
+// tables with retention register theirs from main.
+func Register(name string, p Pruner) {
+	pruners[name] = p
+}
+
+func LastReport() Report {
+	last.Lock()
+	defer last.Unlock()
+
+	return last.report
+}
+
+// Run prunes expired rows and then vacuums and analyzes the database.
+func Run() Report {
+	report := Report{Started: clock.Now(), Pruned: make(map[string]int64)}
+	report.BytesBefore, _ = databaseSize(store.DB)
+
+	err := store.Serialized(func() error {
+		return run(&report)
+	})
+	if err != nil {
+		report.Error = err.Error()
+		log.Printf("error during maintenance: %s", err)
+	}
+
+	report.BytesAfter, _ = databaseSize(store.DB)
+	report.Duration = clock.Since(report.Started)
+
+	log.Printf("maintenance pruned %v and reclaimed %d bytes in %s", report.Pruned, report.Reclaimed(), report.Duration)
+
+	last.Lock()
+	last.report = report
+	last.Unlock()
+
+	return report
+}
+
+func run(report *Report) error {
+	names := make([]string, 0, len(pruners))
+	for name := range pruners {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		n, err := pruners[name](store.DB, report.Started)
+		if err != nil {
+			return err
+		}
+		report.Pruned[name] = n
+	}
+
+	_, err := store.DB.Exec("VACUUM")
+	if err != nil {
+		return err
+	}
+	_, err = store.DB.Exec("ANALYZE")
+	return err
+}
+
+func databaseSize(db *sql.DB) (int64, error) {
+	var pages, pageSize int64
+	err := db.QueryRow("PRAGMA page_count").Scan(&pages)
+	if err != nil {
+		return 0, err
+	}
+	err = db.QueryRow("PRAGMA page_size").Scan(&pageSize)
+	if err != nil {
+		return 0, err
+	}
+	return pages * pageSize, nil
+}
+
+// Job runs maintenance for the job scheduler, which should run it daily when
+// nobody is parking.
+func Job() error {
+	report := Run()
+	if len(report.Error) > 0 {
+		return errors.New(report.Error)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"ljightningparking/maintenance"
+	"ljightningparking/store"
+	"log"
+)
+
+// runMaintenance runs a maintenance pass right away, e.g. from cron.
+func runMaintenance(args []string) {
+	fs := flag.NewFlagSet("maintenance", flag.ExitOnError)
+	dbPath := fs.String("db", "ljightningparking.db", "sqlite database path")
+	fs.Parse(args)
+
+	err := store.Open(*dbPath, store.DefaultOptions)
+	if err != nil {
+		log.Fatalf("error opening database: %s", err)
+	}
+	defer store.DB.Close()
+
+	registerPruners()
+	report := maintenance.Run()
+	if len(report.Error) > 0 {
+		log.Fatalf("maintenance failed: %s", report.Error)
+	}
+
+	for name, n := range report.Pruned {
+		fmt.Printf("%s: pruned %d rows\n", name, n)
+	}
+	fmt.Printf("reclaimed %d bytes (%d -> %d) in %s\n", report.Reclaimed(), report.BytesBefore, report.BytesAfter, report.Duration)
+}
+
+// registerPruners registers the retention of every table that has one, for
+// the server and the maintenance command alike. The replication log is kept
+// a week whether or not this instance journals, a standby keeps one too.
+func registerPruners() {
+	maintenance.Register("short_links", store.PruneShortLinks)
+	maintenance.Register("sms_queue", store.PruneSmsQueue)
+	maintenance.Register("parking_sessions", store.PruneSessions)
+	maintenance.Register("test_steps", store.PruneTestSteps)
+	maintenance.Register("feedback", store.PruneFeedback)
+	maintenance.Register("replication_log", store.PruneJournal)
+}
@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"ljightningparking/clock"
+	"net/http"
+	"strconv"
+)
+
+var (
+	httpDuration = NewHistogram("ljp_http_request_duration_seconds", "Time to serve http requests, by route.", DefBuckets, "handler")
+	httpRequests = NewCounter("ljp_http_requests_total", "Http requests served, by route and status code.", "handler", "code")
+)
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Instrument measures the latency and status codes of a route's handler.
+// Streaming handlers should not be instrumented, as the recorder hides
+// http.Flusher.
+func Instrument(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := clock.Now()
+		recorder := &statusRecorder{w, http.StatusOK}
+		next(recorder, r)
+
+		httpDuration.Observe(clock.Since(start).Seconds(), route)
+		httpRequests.Inc(route, strconv.Itoa(recorder.status))
+	}
+}
@@ -0,0 +1,274 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric is anything written in the Prometheus text format.
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+var registry struct {
+	metrics []metric
+	sync.Mutex
+}
+
+func register(m metric) {
+	registry.Lock()
+	defer registry.Unlock()
+
+	registry.metrics = append(registry.metrics, m)
+}
+
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d desc) header(w *bufio.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, kind)
+}
+
+// labelKey joins label values into a map key.
+func (d desc) labelKey(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metric %s has %d labels, got %d values", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\x00")
+}
+
+// format renders the labels of a key, with an extra label if given.
+func (d desc) format(key string, extra ...string) string {
+	var pairs []string
+	if len(d.labels) > 0 {
+		for i, value := range strings.Split(key, "\x00") {
+			pairs = append(pairs, d.labels[i]+"="+strconv.Quote(value))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"="+strconv.Quote(extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counter only goes up, per combination of label values.
+type Counter struct {
+	desc
+	values map[string]float64
+	sync.Mutex
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{desc: desc{name, help, labels}, values: make(map[string]float64)}
+	register(c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := c.labelKey(labelValues)
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.values[key] += v
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.header(w, "counter")
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.format(key), formatValue(c.values[key]))
+	}
+}
+
+// Gauge is a value that goes up and down.
+type Gauge struct {
+	desc
+	values map[string]float64
+	sync.Mutex
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{desc: desc{name, help, labels}, values: make(map[string]float64)}
+	register(g)
+	return g
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	key := g.labelKey(labelValues)
+
+	g.Lock()
+	defer g.Unlock()
+
+	g.values[key] = v
+}
+
+func (g *Gauge) write(w *bufio.Writer) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.header(w, "gauge")
+	for _, key := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.format(key), formatValue(g.values[key]))
+	}
+}
+
+// gaugeFunc is a gauge read when scraped.
+type gaugeFunc struct {
+	desc
+	fn func() (float64, bool)
+}
+
+// GaugeFunc registers a gauge whose value is read from fn when scraped. It is
+// left out while fn reports no value.
+func GaugeFunc(name, help string, fn func() (float64, bool)) {
+	register(gaugeFunc{desc{name: name, help: help}, fn})
+}
+
+func (g gaugeFunc) write(w *bufio.Writer) {
+	v, ok := g.fn()
+	g.header(w, "gauge")
+	if ok {
+		fmt.Fprintf(w, "%s %s\n", g.name, formatValue(v))
+	}
+}
+
+// counterFunc is a counter kept elsewhere, read per label value when scraped.
+type counterFunc struct {
+	desc
+	fn func() map[string]float64
+}
+
+// CounterFunc registers a counter with a single label, whose values are read
+// from fn when scraped.
+func CounterFunc(name, help, label string, fn func() map[string]float64) {
+	register(counterFunc{desc{name, help, []string{label}}, fn})
+}
+
+func (c counterFunc) write(w *bufio.Writer) {
+	values := c.fn()
+	c.header(w, "counter")
+	for _, key := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.format(key), formatValue(values[key]))
+	}
+}
+
+// DefBuckets are histogram buckets in seconds for request latencies.
+var DefBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram counts observations into buckets.
+type Histogram struct {
+	desc
+	buckets []float64
+	series  map[string]*series
+	sync.Mutex
+}
+
+type series struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{desc: desc{name, help, labels}, buckets: buckets, series: make(map[string]*series)}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := h.labelKey(labelValues)
+
+	h.Lock()
+	defer h.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &series{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.header(w, "histogram")
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.format(key, "le", formatValue(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.format(key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.format(key), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.format(key), s.count)
+	}
+}
+
+// Bool is 1 for true, for up and down gauges.
+func Bool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Handler serves every registered metric in the Prometheus text format.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	registry.Lock()
+	metrics := append([]metric(nil), registry.metrics...)
+	registry.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	buf := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(buf)
+	}
+	buf.Flush()
+}
@@ -0,0 +1,119 @@
+package money
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Cents is an amount of EUR in whole cents. Prices are computed in cents and
+// only turned into EUR floats where they are stored or shown.
+type Cents int64
+
+// EUR converts an amount in EUR, as configured or stored, rounding to the
+// nearest cent.
+func EUR(eur float64) Cents {
+	return Cents(math.Round(eur * 100))
+}
+
+// Eur is the amount in EUR, for storing and showing.
+func (c Cents) Eur() float64 {
+	return float64(c) / 100
+}
+
+func (c Cents) Add(other Cents) Cents {
+	return c + other
+}
+
+func (c Cents) Sub(other Cents) Cents {
+	return c - other
+}
+
+// Times multiplies by a quantity, rounding to the nearest cent.
+func (c Cents) Times(quantity float64) Cents {
+	return Cents(math.Round(float64(c) * quantity))
+}
+
+// For is what an hourly tariff of c comes to over d, rounded to the nearest
+// cent.
+func (c Cents) For(d time.Duration) Cents {
+	return Cents(math.Round(float64(c) * float64(d) / float64(time.Hour)))
+}
+
+// Percent is p percent of c, rounded to the nearest cent.
+func (c Cents) Percent(p float64) Cents {
+	return Cents(math.Round(float64(c) * p / 100))
+}
+
+// String formats c in EUR with two decimals, e.g. 1.60.
+func (c Cents) String() string {
+	sign := ""
+	if c < 0 {
+		sign, c = "-", -c
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, c/100, c%100)
+}
+
+// MarshalJSON writes c as a number of EUR, like the floats it replaces.
+func (c Cents) MarshalJSON() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *Cents) UnmarshalJSON(data []byte) error {
+	eur, err := strconv.ParseFloat(string(data), 64)
+	if err != nil {
+		return fmt.Errorf("invalid EUR amount %s", data)
+	}
+	*c = EUR(eur)
+	return nil
+}
+
+// Msat is an amount of bitcoin in millisatoshis, the unit of LNURL and
+// Lightning invoices.
+type Msat int64
+
+// Sats converts whole sats.
+func Sats(sats int64) Msat {
+	return Msat(sats * 1000)
+}
+
+// Sats is m in whole sats, rounded down.
+func (m Msat) Sats() int64 {
+	return int64(m) / 1000
+}
+
+func (m Msat) Add(other Msat) Msat {
+	return m + other
+}
+
+func (m Msat) Sub(other Msat) Msat {
+	return m - other
+}
+
+// String formats m in sats with three decimals, e.g. 1234.567.
+func (m Msat) String() string {
+	sign := ""
+	if m < 0 {
+		sign, m = "-", -m
+	}
+	return fmt.Sprintf("%s%d.%03d", sign, m/1000, m%1000)
+}
+
+// Rate converts between EUR and bitcoin at an exchange rate.
+type Rate struct {
+	EurPerBtc float64
+}
+
+const msatPerBtc = 1e11
+
+// Msat is what c buys at the rate, rounded down to a whole msat.
+func (r Rate) Msat(c Cents) Msat {
+	// a hair over so an exact msat amount isn't floored to the one below
+	return Msat(math.Floor(float64(c)/100/r.EurPerBtc*msatPerBtc + 1e-6))
+}
+
+// Cents is what m is worth at the rate, rounded to the nearest cent.
+func (r Rate) Cents(m Msat) Cents {
+	return Cents(math.Round(float64(m) / msatPerBtc * r.EurPerBtc * 100))
+}
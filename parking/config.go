@@ -0,0 +1,168 @@
+package parking
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ZonesFile is the zones config file, empty for the built in zones.
+var ZonesFile string
+
+var zones = struct {
+	byName map[string]Zone
+	sync.RWMutex
+}{byName: defaultZones}
+
+// GetZone looks up a zone by name.
+func GetZone(name string) (Zone, bool) {
+	zones.RLock()
+	defer zones.RUnlock()
+
+	z, ok := zones.byName[name]
+	if !ok && testZone != nil && IsTestZone(name) {
+		return *testZone, true
+	}
+	return z, ok
+}
+
+// AllZones returns every zone, ordered by name.
+func AllZones() []Zone {
+	zones.RLock()
+	all := make([]Zone, 0, len(zones.byName))
+	for _, z := range zones.byName {
+		all = append(all, z)
+	}
+	zones.RUnlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Name < all[j].Name
+	})
+	return all
+}
+
+// zoneConfig is a zone in the zones file. Schedule maps weekdays, e.g. "mon",
+// to a charging window like "07:00-19:00"; without it the zone is charged
+// around the clock. Informational zones name the nearest zone sold here in
+// Nearest, or it is worked out from the zones' geometry. Photos, Entrance and
+// Machine are the zone's wayfinding, photos being https urls or paths on
+// this site.
+type zoneConfig struct {
+	Name          string            `json:"name"`
+	Price         float64           `json:"price"`
+	MaxTime       float64           `json:"max_time"`
+	Schedule      map[string]string `json:"schedule,omitempty"`
+	Geometry      *Geometry         `json:"geometry,omitempty"`
+	Informational bool              `json:"informational,omitempty"`
+	Nearest       string            `json:"nearest,omitempty"`
+	Photos        []string          `json:"photos,omitempty"`
+	Entrance      string            `json:"entrance,omitempty"`
+	Machine       string            `json:"machine,omitempty"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ReloadZones replaces the zones with the ones in ZonesFile. The zones in use
+// are kept if the file is invalid. Invoices already created keep the zone
+// they were priced with.
+func ReloadZones() (int, error) {
+	if len(ZonesFile) == 0 {
+		return 0, errors.New("no zones file configured")
+	}
+
+	data, err := ioutil.ReadFile(ZonesFile)
+	if err != nil {
+		return 0, err
+	}
+
+	loaded, err := parseZones(data)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", ZonesFile, err)
+	}
+
+	zones.Lock()
+	zones.byName = loaded
+	zones.Unlock()
+
+	log.Printf("Loaded %d zones from %s", len(loaded), ZonesFile)
+	return len(loaded), nil
+}
+
+func parseZones(data []byte) (map[string]Zone, error) {
+	var configs []zoneConfig
+	err := json.Unmarshal(data, &configs)
+	if err != nil {
+		return nil, err
+	}
+	if len(configs) == 0 {
+		return nil, errors.New("no zones defined")
+	}
+
+	loaded := make(map[string]Zone, len(configs))
+	for _, c := range configs {
+		if len(c.Name) == 0 {
+			return nil, errors.New("zone without a name")
+		}
+		if _, ok := loaded[c.Name]; ok {
+			return nil, fmt.Errorf("zone %s defined twice", c.Name)
+		}
+		if !c.Informational && (c.Price <= 0 || c.MaxTime <= 0) {
+			return nil, fmt.Errorf("zone %s needs a positive price and max_time", c.Name)
+		}
+
+		z := Zone{Name: c.Name, Price: c.Price, MaxTime: c.MaxTime, Geometry: c.Geometry,
+			Informational: c.Informational, Nearest: c.Nearest}
+		if len(c.Schedule) > 0 {
+			z.Schedule, err = parseSchedule(c.Schedule)
+			if err != nil {
+				return nil, fmt.Errorf("zone %s: %w", c.Name, err)
+			}
+		}
+		if len(c.Photos) > 0 || len(c.Entrance) > 0 || len(c.Machine) > 0 {
+			for _, photo := range c.Photos {
+				if !strings.HasPrefix(photo, "https://") && (!strings.HasPrefix(photo, "/") || strings.HasPrefix(photo, "//")) {
+					return nil, fmt.Errorf("zone %s: photo %q must be an https url or a path on this site", c.Name, photo)
+				}
+			}
+			z.Wayfinding = &Wayfinding{Photos: c.Photos, Entrance: c.Entrance, Machine: c.Machine}
+		}
+		loaded[c.Name] = z
+	}
+
+	err = resolveNearest(loaded)
+	if err != nil {
+		return nil, err
+	}
+	return loaded, nil
+}
+
+func parseSchedule(days map[string]string) (*Schedule, error) {
+	var s Schedule
+	for day, window := range days {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return nil, fmt.Errorf("unknown weekday %q", day)
+		}
+
+		var fromH, fromM, toH, toM int
+		_, err := fmt.Sscanf(window, "%d:%d-%d:%d", &fromH, &fromM, &toH, &toM)
+		if err != nil {
+			return nil, fmt.Errorf("bad window %q on %s, want HH:MM-HH:MM", window, day)
+		}
+		w := Window{fromH*60 + fromM, toH*60 + toM}
+		if w.From < 0 || w.To > 24*60 || w.From >= w.To {
+			return nil, fmt.Errorf("bad window %q on %s", window, day)
+		}
+		s[weekday] = w
+	}
+	return &s, nil
+}
@@ -0,0 +1,113 @@
+package parking
+
+import (
+	"errors"
+	"fmt"
+	"ljightningparking/money"
+	"strings"
+	"time"
+)
+
+// Estimate is the parking to buy in a zone to be covered from Start until
+// End.
+type Estimate struct {
+	Zone  string
+	Start time.Time
+	End   time.Time
+	// Hours is the parking time to buy, zero when End comes before charging
+	// starts again. Charged is the part of it that is billed, the rest
+	// falling into free periods.
+	Hours   float64
+	Charged time.Duration
+	Fee     money.Cents
+	// PaidUntil is when the parking bought runs out, past End when a free
+	// period follows.
+	PaidUntil time.Time
+}
+
+// Free reports whether no parking needs to be bought.
+func (e Estimate) Free() bool {
+	return e.Hours == 0
+}
+
+// Estimate finds the fewest hours, in the steps they are sold in, that keep
+// parking from start paid until at least end.
+func (z Zone) Estimate(start, end time.Time) (Estimate, error) {
+	if !end.After(start) {
+		return Estimate{}, errors.New("the end must be after the start")
+	}
+
+	step := HourStep()
+
+	for hours := 0.0; hours <= z.MaxTime; hours += step {
+		until := z.PaidUntil(start, hours)
+		if until.Before(end) {
+			continue
+		}
+		stop := start.Add(time.Duration(hours * float64(time.Hour)))
+		return Estimate{
+			Zone:      z.Name,
+			Start:     start,
+			End:       end,
+			Hours:     hours,
+			Charged:   z.Schedule.charged(start, stop),
+			Fee:       z.Fee(start, hours),
+			PaidUntil: until,
+		}, nil
+	}
+	return Estimate{}, fmt.Errorf("parking until %s takes more than the zone's maximum parking time of %s hours",
+		end.In(Location).Format("Mon 15:04"), FormatHours(z.MaxTime))
+}
+
+// ParseUntil parses when a user wants to park until: a time like 14:30,
+// which is its next occurrence after now, optionally with today or tomorrow,
+// or a date and time as sent by datetime-local inputs.
+func ParseUntil(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	now = now.In(Location)
+
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, value, Location); err == nil {
+			return t, nil
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+
+	value = strings.ToLower(value)
+
+	days := -1
+	var clockTime []string
+	for _, word := range strings.Fields(value) {
+		switch word {
+		case "today":
+			days = 0
+		case "tomorrow":
+			days = 1
+		case "at", "until":
+		default:
+			clockTime = append(clockTime, word)
+		}
+	}
+	if len(clockTime) != 1 {
+		return time.Time{}, errors.New("give the time to park until like 14:30 or 14:30 tomorrow")
+	}
+
+	hm, err := time.Parse("15:04", strings.Replace(clockTime[0], ".", ":", 1))
+	if err != nil {
+		hm, err = time.Parse("15", clockTime[0])
+	}
+	if err != nil {
+		return time.Time{}, errors.New("give the time to park until like 14:30 or 14:30 tomorrow")
+	}
+
+	t := time.Date(now.Year(), now.Month(), now.Day(), hm.Hour(), hm.Minute(), 0, 0, Location)
+	switch {
+	case days >= 0:
+		t = time.Date(now.Year(), now.Month(), now.Day()+days, hm.Hour(), hm.Minute(), 0, 0, Location)
+	case !t.After(now):
+		t = time.Date(now.Year(), now.Month(), now.Day()+1, hm.Hour(), hm.Minute(), 0, 0, Location)
+	}
+	return t, nil
+}
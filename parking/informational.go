@@ -0,0 +1,90 @@
+package parking
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// resolveNearest checks the nearest zone named for informational zones and
+// works it out from the geometry for those that name none.
+func resolveNearest(zones map[string]Zone) error {
+	names := make([]string, 0, len(zones))
+	for name := range zones {
+		names = append(names, name)
+	}
+	// ties go to the first zone by name, whatever the map order
+	sort.Strings(names)
+
+	for _, name := range names {
+		z := zones[name]
+		if !z.Informational {
+			continue
+		}
+
+		if len(z.Nearest) > 0 {
+			nearest, ok := zones[z.Nearest]
+			if !ok || nearest.Informational {
+				return fmt.Errorf("zone %s: nearest zone %s is not a zone sold here", z.Name, z.Nearest)
+			}
+			continue
+		}
+
+		lon, lat, ok := centroid(z.Geometry)
+		if !ok {
+			continue
+		}
+		best := math.Inf(1)
+		for _, other := range names {
+			o := zones[other]
+			if o.Informational {
+				continue
+			}
+			oLon, oLat, ok := centroid(o.Geometry)
+			if !ok {
+				continue
+			}
+			// close enough to flat within a city
+			dx := (oLon - lon) * math.Cos(lat*math.Pi/180)
+			dy := oLat - lat
+			if d := dx*dx + dy*dy; d < best {
+				best, z.Nearest = d, o.Name
+			}
+		}
+		zones[name] = z
+	}
+	return nil
+}
+
+// centroid is the average of the outer ring points of a zone's polygons,
+// which is near enough its middle to compare distances between zones.
+func centroid(g *Geometry) (lon, lat float64, ok bool) {
+	if g == nil {
+		return 0, 0, false
+	}
+	polygons, err := polygonsOf(*g)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	n := 0
+	for _, p := range polygons {
+		var rings [][][]float64
+		if json.Unmarshal(p, &rings) != nil || len(rings) == 0 {
+			continue
+		}
+		for _, point := range rings[0] {
+			if len(point) < 2 {
+				continue
+			}
+			lon += point[0]
+			lat += point[1]
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, 0, false
+	}
+	return lon / float64(n), lat / float64(n), true
+}
@@ -0,0 +1,112 @@
+package parking
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var errNotNumber = errors.New("not a number")
+
+// ParseNumber parses a number the way people type them here, with a decimal
+// comma or point, e.g. "1,5", "1.5" or "1.234,50". When both are used the
+// last one is the decimal separator, and a separator used more than once
+// groups thousands.
+func ParseNumber(value string) (float64, error) {
+	value = stripSpaces(value)
+	if len(value) == 0 || strings.Trim(value, "+-0123456789.,") != "" {
+		return 0, errNotNumber
+	}
+
+	comma, point := strings.LastIndex(value, ","), strings.LastIndex(value, ".")
+	switch {
+	case comma >= 0 && point >= 0:
+		if comma > point {
+			value = strings.Replace(strings.Replace(value, ".", "", -1), ",", ".", 1)
+		} else {
+			value = strings.Replace(value, ",", "", -1)
+		}
+	case strings.Count(value, ",") > 1:
+		value = strings.Replace(value, ",", "", -1)
+	case strings.Count(value, ".") > 1:
+		value = strings.Replace(value, ".", "", -1)
+	default:
+		value = strings.Replace(value, ",", ".", 1)
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, errNotNumber
+	}
+	return n, nil
+}
+
+// ParseCount parses a whole number, a comma, point or space grouping
+// thousands, e.g. "12.345" or "12 345". A separator not followed by three
+// digits, like in "1,5", is a decimal one and rejected.
+func ParseCount(value string) (int, error) {
+	value = stripSpaces(value)
+	if strings.ContainsAny(value, ",.") {
+		if strings.Contains(value, ",") && strings.Contains(value, ".") {
+			return 0, errNotNumber
+		}
+		value = strings.Replace(value, ",", ".", -1)
+		if !groupedRe.MatchString(value) {
+			return 0, errNotNumber
+		}
+		value = strings.Replace(value, ".", "", -1)
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errNotNumber
+	}
+	return n, nil
+}
+
+// stripSpaces drops spaces, including the narrow and no-break ones grouping
+// thousands.
+func stripSpaces(value string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\u00a0', '\u2009', '\u202f':
+			return -1
+		}
+		return r
+	}, value)
+}
+
+var (
+	groupedRe      = regexp.MustCompile(`^[+-]?[0-9]{1,3}(?:\.[0-9]{3})+$`)
+	durationRe     = regexp.MustCompile(`^(?:\s*[0-9]+(?:[.,][0-9]+)?\s*[a-z]*)+\s*$`)
+	durationPartRe = regexp.MustCompile(`([0-9]+(?:[.,][0-9]+)?)\s*([a-z]*)`)
+)
+
+// parseDuration parses a parking time in hours, as a number of hours like
+// "1,5" or with units like "90 min", "1 h 30 min" or "2 uri".
+func parseDuration(value string) (float64, error) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if n, err := ParseNumber(value); err == nil {
+		return n, nil
+	}
+	if !durationRe.MatchString(value) {
+		return 0, errNotNumber
+	}
+
+	var hours float64
+	for _, part := range durationPartRe.FindAllStringSubmatch(value, -1) {
+		n, err := ParseNumber(part[1])
+		if err != nil {
+			return 0, err
+		}
+		switch part[2] {
+		case "h", "ur", "ura", "ure", "uri", "hour", "hours":
+			hours += n
+		case "m", "min", "mins", "minut", "minuta", "minute", "minutes":
+			hours += n / 60
+		default:
+			return 0, errNotNumber
+		}
+	}
+	return hours, nil
+}
@@ -0,0 +1,275 @@
+package parking
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Geometry is a GeoJSON geometry, a Polygon or MultiPolygon for zones.
+type Geometry struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// openDataKeys are the feature properties holding each zone field in the
+// city's open data, in Slovenian or English depending on the release.
+var openDataKeys = struct {
+	name, price, maxTime, schedule []string
+}{
+	name:     []string{"oznaka", "cona", "zone", "name"},
+	price:    []string{"cena", "price"},
+	maxTime:  []string{"max_cas", "najdaljsi_cas", "max_time"},
+	schedule: []string{"urnik", "schedule"},
+}
+
+var openDataDays = map[string]string{
+	"pon": "mon", "tor": "tue", "sre": "wed", "čet": "thu", "cet": "thu", "pet": "fri", "sob": "sat", "ned": "sun",
+	"mon": "mon", "tue": "tue", "wed": "wed", "thu": "thu", "fri": "fri", "sat": "sat", "sun": "sun",
+}
+
+var dayOrder = []string{"mon", "tue", "wed", "thu", "fri", "sat", "sun"}
+
+var openDataWindow = regexp.MustCompile(`^(\d{1,2})(?:[:.](\d{2}))?\s*-\s*(\d{1,2})(?:[:.](\d{2}))?$`)
+
+// ImportOpenData maps the city's parking zone open data, a GeoJSON feature
+// collection, to a zones file. Features of the same zone are merged into one
+// MultiPolygon.
+func ImportOpenData(data []byte) ([]byte, error) {
+	var collection struct {
+		Features []struct {
+			Properties map[string]interface{} `json:"properties"`
+			Geometry   *Geometry              `json:"geometry"`
+		} `json:"features"`
+	}
+	err := json.Unmarshal(data, &collection)
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make(map[string]*zoneConfig)
+	polygons := make(map[string][]json.RawMessage)
+	for i, f := range collection.Features {
+		name := property(f.Properties, openDataKeys.name)
+		if len(name) == 0 {
+			return nil, fmt.Errorf("feature %d has no zone name", i)
+		}
+
+		c := zoneConfig{Name: name}
+		c.Price, err = number(property(f.Properties, openDataKeys.price))
+		if err != nil {
+			return nil, fmt.Errorf("zone %s price: %w", name, err)
+		}
+		c.MaxTime, err = number(property(f.Properties, openDataKeys.maxTime))
+		if err != nil {
+			return nil, fmt.Errorf("zone %s max time: %w", name, err)
+		}
+		if schedule := property(f.Properties, openDataKeys.schedule); len(schedule) > 0 {
+			c.Schedule, err = openDataSchedule(schedule)
+			if err != nil {
+				return nil, fmt.Errorf("zone %s schedule: %w", name, err)
+			}
+		}
+
+		if existing, ok := configs[name]; ok {
+			if existing.Price != c.Price || existing.MaxTime != c.MaxTime || fmt.Sprint(existing.Schedule) != fmt.Sprint(c.Schedule) {
+				return nil, fmt.Errorf("zone %s has conflicting features", name)
+			}
+		} else {
+			configs[name] = &c
+		}
+
+		if f.Geometry != nil {
+			p, err := polygonsOf(*f.Geometry)
+			if err != nil {
+				return nil, fmt.Errorf("zone %s geometry: %w", name, err)
+			}
+			polygons[name] = append(polygons[name], p...)
+		}
+	}
+
+	imported := make([]zoneConfig, 0, len(configs))
+	for name, c := range configs {
+		if len(polygons[name]) > 0 {
+			coordinates, err := json.Marshal(polygons[name])
+			if err != nil {
+				return nil, err
+			}
+			c.Geometry = &Geometry{"MultiPolygon", coordinates}
+		}
+		imported = append(imported, *c)
+	}
+	sort.Slice(imported, func(i, j int) bool {
+		return imported[i].Name < imported[j].Name
+	})
+
+	file, err := json.MarshalIndent(imported, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	_, err = parseZones(file)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func property(properties map[string]interface{}, keys []string) string {
+	for _, key := range keys {
+		for k, v := range properties {
+			if strings.EqualFold(k, key) && v != nil {
+				return strings.TrimSpace(fmt.Sprint(v))
+			}
+		}
+	}
+	return ""
+}
+
+// number parses amounts like "0,80 €" or "2 h".
+func number(value string) (float64, error) {
+	return ParseNumber(strings.TrimRight(value, " €EURh"))
+}
+
+// openDataSchedule parses charging hours like "pon-pet 7-19, sob 7-13" into
+// the zones file's weekday windows.
+func openDataSchedule(value string) (map[string]string, error) {
+	schedule := make(map[string]string)
+	for _, part := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ';' }) {
+		fields := strings.Fields(strings.ToLower(part))
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("bad entry %q", part)
+		}
+
+		days, err := openDataDayRange(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		m := openDataWindow.FindStringSubmatch(strings.Join(fields[1:], ""))
+		if m == nil {
+			return nil, fmt.Errorf("bad hours %q", part)
+		}
+		window := fmt.Sprintf("%02d:%02d-%02d:%02d", atoi(m[1]), atoi(m[2]), atoi(m[3]), atoi(m[4]))
+		for _, day := range days {
+			schedule[day] = window
+		}
+	}
+	return schedule, nil
+}
+
+// atoi converts a matched number, 0 when the optional group is empty.
+func atoi(value string) int {
+	n, _ := strconv.Atoi(value)
+	return n
+}
+
+func openDataDayRange(value string) ([]string, error) {
+	bounds := strings.SplitN(strings.Trim(value, ":"), "-", 2)
+	first, ok := openDataDays[strings.TrimSuffix(bounds[0], ".")]
+	if !ok {
+		return nil, fmt.Errorf("unknown day %q", bounds[0])
+	}
+	if len(bounds) == 1 {
+		return []string{first}, nil
+	}
+	last, ok := openDataDays[strings.TrimSuffix(bounds[1], ".")]
+	if !ok {
+		return nil, fmt.Errorf("unknown day %q", bounds[1])
+	}
+
+	var days []string
+	in := false
+	for _, day := range dayOrder {
+		in = in || day == first
+		if in {
+			days = append(days, day)
+		}
+		if in && day == last {
+			return days, nil
+		}
+	}
+	return nil, fmt.Errorf("bad day range %q", value)
+}
+
+// polygonsOf returns the polygons of a Polygon or MultiPolygon.
+func polygonsOf(g Geometry) ([]json.RawMessage, error) {
+	switch g.Type {
+	case "Polygon":
+		return []json.RawMessage{g.Coordinates}, nil
+	case "MultiPolygon":
+		var polygons []json.RawMessage
+		err := json.Unmarshal(g.Coordinates, &polygons)
+		return polygons, err
+	}
+	return nil, fmt.Errorf("unsupported geometry type %s", g.Type)
+}
+
+// DiffZones describes how the zones in a zones file differ from the zones in
+// use, one line per added, removed or changed zone.
+func DiffZones(data []byte) ([]string, error) {
+	next, err := parseZones(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var diff []string
+	current := make(map[string]bool)
+	for _, z := range AllZones() {
+		current[z.Name] = true
+		n, ok := next[z.Name]
+		if !ok {
+			diff = append(diff, "- "+z.Name)
+			continue
+		}
+
+		var changes []string
+		if z.Price != n.Price {
+			changes = append(changes, fmt.Sprintf("price %.2f -> %.2f", z.Price, n.Price))
+		}
+		if z.MaxTime != n.MaxTime {
+			changes = append(changes, fmt.Sprintf("max time %s -> %s h", FormatHours(z.MaxTime), FormatHours(n.MaxTime)))
+		}
+		if !sameSchedule(z.Schedule, n.Schedule) {
+			changes = append(changes, "schedule changed")
+		}
+		if !sameGeometry(z.Geometry, n.Geometry) {
+			changes = append(changes, "geometry changed")
+		}
+		if z.Informational != n.Informational {
+			changes = append(changes, fmt.Sprintf("informational %t -> %t", z.Informational, n.Informational))
+		}
+		if len(changes) > 0 {
+			diff = append(diff, fmt.Sprintf("~ %s: %s", z.Name, strings.Join(changes, ", ")))
+		}
+	}
+
+	var added []string
+	for name, z := range next {
+		if !current[name] {
+			added = append(added, fmt.Sprintf("+ %s: %.2f EUR/h, max %s h", name, z.Price, FormatHours(z.MaxTime)))
+		}
+	}
+	sort.Strings(added)
+	return append(diff, added...), nil
+}
+
+func sameSchedule(a, b *Schedule) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func sameGeometry(a, b *Geometry) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	var x, y bytes.Buffer
+	if json.Compact(&x, a.Coordinates) != nil || json.Compact(&y, b.Coordinates) != nil {
+		return false
+	}
+	return a.Type == b.Type && bytes.Equal(x.Bytes(), y.Bytes())
+}
@@ -0,0 +1,67 @@
+package parking
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+var (
+	ErrPlateEmpty      = errors.New("please enter your car's licence plate")
+	ErrPlateCharacters = errors.New("a licence plate may only contain letters and digits")
+	ErrPlateLength     = errors.New("that licence plate is too short or too long")
+	ErrPlateFormat     = errors.New("that does not look like a licence plate, please check it")
+)
+
+// plateLetters are the letters used on plates besides A-Z, Slovenian
+// plates may use Č, Š and Ž.
+const plateLetters = "ČŠŽ"
+
+// NormalizePlate checks a licence plate and returns it the way SMS parking
+// expects it: upper case without spaces, dashes or dots, e.g. "lj ab-123"
+// becomes "LJAB123". Its errors are meant for the user.
+//
+// Slovenian plates are a registration area followed by 4 to 6 letters and
+// digits, at least one of them a digit, e.g. LJ AB-123 or KR 12-ABC.
+// Foreign EU plates vary too much to check their layout, so they only need
+// 2 to 10 letters and digits, both at least once, e.g. ZG 1234-AB or
+// M AB 1234.
+func NormalizePlate(plate string) (string, error) {
+	var b strings.Builder
+	letters, digits := 0, 0
+	for _, r := range strings.ToUpper(strings.TrimSpace(plate)) {
+		switch {
+		case r == ' ' || r == '-' || r == '.' || r == '·':
+			continue
+		case r >= 'A' && r <= 'Z' || strings.ContainsRune(plateLetters, r):
+			letters++
+		case r >= '0' && r <= '9':
+			digits++
+		case unicode.IsSpace(r):
+			continue
+		default:
+			return "", ErrPlateCharacters
+		}
+		b.WriteRune(r)
+	}
+
+	normalized := b.String()
+	length := letters + digits
+	if length == 0 {
+		return "", ErrPlateEmpty
+	}
+	if length < 2 || length > 10 {
+		return "", ErrPlateLength
+	}
+
+	if digits == 0 {
+		return "", ErrPlateFormat
+	}
+	if PlateRegion(normalized) != "" && length >= 6 && length <= 8 {
+		return normalized, nil
+	}
+	if letters == 0 {
+		return "", ErrPlateFormat
+	}
+	return normalized, nil
+}
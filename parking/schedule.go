@@ -0,0 +1,103 @@
+package parking
+
+import (
+	"ljightningparking/money"
+	"time"
+	_ "time/tzdata"
+)
+
+// Location is the time zone zone schedules are defined in.
+var Location, _ = time.LoadLocation("Europe/Ljubljana")
+
+// Window is a daily charging period, in minutes since local midnight.
+type Window struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+// Schedule holds a zone's charging window for each weekday, indexed by
+// time.Weekday. Parking is free outside the windows and a zero window makes
+// the whole day free.
+type Schedule [7]Window
+
+var (
+	// central zones charge 7:00-19:00 on workdays and Saturday mornings
+	centralHours = &Schedule{
+		time.Monday:    {7 * 60, 19 * 60},
+		time.Tuesday:   {7 * 60, 19 * 60},
+		time.Wednesday: {7 * 60, 19 * 60},
+		time.Thursday:  {7 * 60, 19 * 60},
+		time.Friday:    {7 * 60, 19 * 60},
+		time.Saturday:  {7 * 60, 13 * 60},
+	}
+	// outer zones charge 8:00-19:00 on workdays only
+	outerHours = &Schedule{
+		time.Monday:    {8 * 60, 19 * 60},
+		time.Tuesday:   {8 * 60, 19 * 60},
+		time.Wednesday: {8 * 60, 19 * 60},
+		time.Thursday:  {8 * 60, 19 * 60},
+		time.Friday:    {8 * 60, 19 * 60},
+	}
+)
+
+// window returns the charging window on the day of t.
+func (s *Schedule) window(t time.Time) (time.Time, time.Time) {
+	w := s[t.Weekday()]
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, w.From, 0, 0, Location),
+		time.Date(t.Year(), t.Month(), t.Day(), 0, w.To, 0, 0, Location)
+}
+
+// charged returns how much of [from, to) falls into charging windows.
+func (s *Schedule) charged(from, to time.Time) time.Duration {
+	if s == nil {
+		return to.Sub(from)
+	}
+
+	var total time.Duration
+	for day := from.In(Location); day.Before(to); day = time.Date(day.Year(), day.Month(), day.Day()+1, 0, 0, 0, 0, Location) {
+		start, end := s.window(day)
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		if end.After(start) {
+			total += end.Sub(start)
+		}
+	}
+	return total
+}
+
+// nextCharge returns when charging next starts at or after t, or t itself
+// if it is already charged or the schedule is free all week.
+func (s *Schedule) nextCharge(t time.Time) time.Time {
+	if s == nil {
+		return t
+	}
+
+	for i, day := 0, t.In(Location); i < 8; i, day = i+1, time.Date(day.Year(), day.Month(), day.Day()+1, 0, 0, 0, 0, Location) {
+		start, end := s.window(day)
+		if !end.After(start) || !end.After(t) {
+			continue
+		}
+		if start.After(t) {
+			return start
+		}
+		return t
+	}
+	return t
+}
+
+// Fee returns the fee for parking the given hours from start on. Only the
+// time within charging windows is billed.
+func (z Zone) Fee(start time.Time, hours float64) money.Cents {
+	end := start.Add(time.Duration(hours * float64(time.Hour)))
+	return z.Tariff().For(z.Schedule.charged(start, end))
+}
+
+// PaidUntil returns when parking the given hours from start on runs out. If
+// it ends in a free period, it runs until charging starts again.
+func (z Zone) PaidUntil(start time.Time, hours float64) time.Time {
+	return z.Schedule.nextCharge(start.Add(time.Duration(hours * float64(time.Hour))))
+}
@@ -0,0 +1,91 @@
+package parking
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SmsFormat is a layout of the parking SMS, effective from a point in time
+// for the zones matching one of its patterns. Template holds {zone}, {plate}
+// and {hours} placeholders, plus any keyword the operator requires.
+type SmsFormat struct {
+	// Zones are path.Match patterns of zone names, empty for all zones.
+	Zones    []string  `json:"zones"`
+	Template string    `json:"template"`
+	From     time.Time `json:"from"`
+}
+
+const defaultSmsTemplate = "{zone} {plate} {hours}"
+
+// SmsFormats are the configured formats, sorted by From.
+var SmsFormats []SmsFormat
+
+// LoadSmsFormats reads a JSON array of formats, so an announced change of the
+// SMS format can be staged before it takes effect.
+func LoadSmsFormats(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	var formats []SmsFormat
+	err = json.Unmarshal(data, &formats)
+	if err != nil {
+		return err
+	}
+
+	for i, f := range formats {
+		for _, placeholder := range []string{"{zone}", "{plate}", "{hours}"} {
+			if strings.Count(f.Template, placeholder) != 1 {
+				return fmt.Errorf("format %d: template must contain %s once", i, placeholder)
+			}
+		}
+		for _, pattern := range f.Zones {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("format %d: bad zone pattern %q", i, pattern)
+			}
+		}
+		if f.From.IsZero() {
+			return fmt.Errorf("format %d: missing from time", i)
+		}
+	}
+
+	sort.SliceStable(formats, func(i, j int) bool {
+		return formats[i].From.Before(formats[j].From)
+	})
+	SmsFormats = formats
+	return nil
+}
+
+func (f SmsFormat) matches(zone string) bool {
+	if len(f.Zones) == 0 {
+		return true
+	}
+	for _, pattern := range f.Zones {
+		if ok, _ := path.Match(pattern, zone); ok {
+			return ok
+		}
+	}
+	return false
+}
+
+// SmsMessage returns the parking SMS buying hours for plate in this zone,
+// in the latest format in effect at now.
+func (z Zone) SmsMessage(plate string, hours float64, now time.Time) string {
+	template := defaultSmsTemplate
+	for _, f := range SmsFormats {
+		if f.From.After(now) {
+			break
+		}
+		if f.matches(z.Name) {
+			template = f.Template
+		}
+	}
+
+	return strings.NewReplacer("{zone}", z.Name, "{plate}", plate, "{hours}", FormatHours(hours)).Replace(template)
+}
@@ -0,0 +1,56 @@
+package parking
+
+import (
+	"sort"
+	"strings"
+)
+
+// HomeRegion is the registration area of the city the zones are in.
+const HomeRegion = "LJ"
+
+// regions are the Slovenian registration areas, the first two letters of a plate.
+var regions = map[string]bool{
+	"CE": true, "GO": true, "KK": true, "KP": true, "KR": true, "LJ": true,
+	"MB": true, "MS": true, "NM": true, "PO": true, "SG": true,
+}
+
+// PlateRegion infers the registration area from a plate, or "" for foreign
+// and unrecognised plates.
+func PlateRegion(plate string) string {
+	plate = strings.ToUpper(strings.TrimSpace(plate))
+	if len(plate) < 2 || !regions[plate[:2]] {
+		return ""
+	}
+	return plate[:2]
+}
+
+func central(z Zone) bool {
+	return strings.HasPrefix(z.Name, "C")
+}
+
+// SuggestZones orders zone names for the zone picker. Visitors from other
+// regions are likelier to park in the center, so center zones come first for
+// them. The plate is only used for ordering and is not kept.
+func SuggestZones(plate string) []string {
+	visitor := PlateRegion(plate) != HomeRegion
+
+	var zones []Zone
+	for _, z := range AllZones() {
+		if !z.Informational {
+			zones = append(zones, z)
+		}
+	}
+
+	sort.Slice(zones, func(i, j int) bool {
+		if visitor && central(zones[i]) != central(zones[j]) {
+			return central(zones[i])
+		}
+		return zones[i].Name < zones[j].Name
+	})
+
+	names := make([]string, len(zones))
+	for i, z := range zones {
+		names[i] = z.Name
+	}
+	return names
+}
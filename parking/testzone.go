@@ -0,0 +1,20 @@
+package parking
+
+// TestZoneName is the hidden zone the operator buys parking in to verify the
+// whole purchase in production, from the invoice to the confirmation reply.
+// Its parking SMS goes to a test number instead of the operator.
+const TestZoneName = "TEST"
+
+// testZone is nil unless EnableTestZone was called.
+var testZone *Zone
+
+// EnableTestZone makes the test zone available at price EUR an hour. It can be
+// bought like any zone but is not listed with the others.
+func EnableTestZone(price float64) {
+	testZone = &Zone{Name: TestZoneName, Price: price, MaxTime: 1}
+}
+
+// IsTestZone reports whether name is the test zone.
+func IsTestZone(name string) bool {
+	return name == TestZoneName
+}
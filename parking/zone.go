@@ -1,6 +1,11 @@
 package parking
 
-import "math"
+import (
+	"errors"
+	"ljightningparking/money"
+	"math"
+	"strconv"
+)
 
 const (
 	zone1 = 0.8
@@ -9,51 +14,121 @@ const (
 )
 
 type Zone struct {
-	Name string
+	Name  string
 	Price float64
+	// MaxTime is the longest continuous parking time, in hours.
 	MaxTime float64
+	// Schedule is when parking is charged, nil for around the clock.
+	Schedule *Schedule
+	// Geometry is the zone's area, nil when unknown.
+	Geometry *Geometry
+	// Informational zones are sold only at parking meters, not over SMS
+	// parking, so they are listed but can't be bought here. Nearest is the
+	// closest zone that can, empty when unknown.
+	Informational bool
+	Nearest       string
+	// Wayfinding is nil when the zone has none.
+	Wayfinding *Wayfinding
+}
+
+// Wayfinding helps visitors check they picked the right zone.
+type Wayfinding struct {
+	// Photos are urls of pictures of the zone or garage.
+	Photos []string `json:"photos,omitempty"`
+	// Entrance describes how to get in, e.g. a garage's entrance street.
+	Entrance string `json:"entrance,omitempty"`
+	// Machine is where to pay at a parking meter instead, for when paying
+	// here doesn't work out.
+	Machine string `json:"machine,omitempty"`
+}
+
+// HalfHours enables buying parking in half hour steps, for when the operator
+// accepts fractional hours in the parking SMS.
+var HalfHours = false
+
+// HourStep is the smallest amount of hours parking can be bought in.
+func HourStep() float64 {
+	if HalfHours {
+		return 0.5
+	}
+	return 1
+}
+
+// Tariff is the zone's price of an hour of charged parking.
+func (z Zone) Tariff() money.Cents {
+	return money.EUR(z.Price)
+}
+
+// GetParkingFee returns the list price for hours of charged parking. Use Fee
+// to bill a purchase.
+func (z Zone) GetParkingFee(hours float64) money.Cents {
+	return z.Tariff().Times(math.Min(hours, z.MaxTime))
+}
+
+// ParseHours parses and validates the parking time a user asked for in this
+// zone, in hours like "1,5" or with units like "90 min".
+func (z Zone) ParseHours(value string) (float64, error) {
+	hours, err := parseDuration(value)
+	if err != nil {
+		return 0, errors.New("hours must be a number")
+	}
+
+	step := HourStep()
+	if hours < step || math.Mod(hours, step) != 0 {
+		if HalfHours {
+			return 0, errors.New("hours must be a multiple of half an hour")
+		}
+		return 0, errors.New("hours must be a whole number")
+	}
+	if hours > z.MaxTime {
+		return 0, errors.New("hours exceed the zone's maximum parking time of " + FormatHours(z.MaxTime))
+	}
+
+	return hours, nil
+}
+
+// FormatHours formats hours the way the parking SMS expects them, e.g. 2 or 1.5.
+func FormatHours(hours float64) string {
+	return strconv.FormatFloat(hours, 'f', -1, 64)
 }
 
-func (z Zone) GetParkingFee(hours int64) float64 {
-	return math.Min(float64(hours), z.MaxTime)*z.Price
-}
-
-var Zones = map[string]Zone{
-	"C1": {"C1", zone1, 4},
-	"C4": {"C4", zone1, 2},
-	"C5": {"C5", zone1, 2},
-	"C6": {"C6", zone1, 2},
-	"C7": {"C7", zone1, 2},
-	"C9": {"C9", zone1, 2},
-	"C10": {"C10", zone1, 2},
-	"C11": {"C11", zone1, 4},
-	"C13": {"C13", zone1, 4},
-	"C14": {"C14", zone1, 4},
-	"B1": {"B1", zone2, 6},
-	"Pr": {"Pr", zone2, 6},
-	"Kr": {"Kr", zone2, 6},
-	"Mi": {"Mi", zone2, 6},
-	"B2": {"B2", zone3, 10},
-	"B3": {"B3", zone3, 10},
-	"J1": {"J1", zone3, 10},
-	"J2": {"J2", zone3, 10},
-	"J3": {"J3", zone3, 10},
-	"Vo1": {"Vo1", zone3, 10},
-	"Mo1": {"Mo1", zone3, 10},
-	"Mo2": {"Mo2", zone3, 10},
-	"Ko1": {"Ko1", zone3, 10},
-	"Po1": {"Po1", zone3, 10},
-	"R1": {"R1", zone3, 10},
-	"R2": {"R2", zone3, 10},
-	"Tr": {"Tr", zone3, 10},
-	"Rj": {"Rj", zone3, 10},
-	"Mu": {"Mu", zone3, 10},
-	"V1": {"V1", zone3, 10},
-	"V2": {"V2", zone3, 10},
-	"V3": {"V3", zone3, 10},
-	"Rd1": {"Rd1", zone3, 10},
-	"Rd2": {"Rd2", zone3, 10},
-	"Si1": {"Si1", zone3, 10},
-	"Si2": {"Si2", zone3, 10},
-	"Si3": {"Si3", zone3, 10},
+// defaultZones are used when no zones file is configured.
+var defaultZones = map[string]Zone{
+	"C1":  {Name: "C1", Price: zone1, MaxTime: 4, Schedule: centralHours},
+	"C4":  {Name: "C4", Price: zone1, MaxTime: 2, Schedule: centralHours},
+	"C5":  {Name: "C5", Price: zone1, MaxTime: 2, Schedule: centralHours},
+	"C6":  {Name: "C6", Price: zone1, MaxTime: 2, Schedule: centralHours},
+	"C7":  {Name: "C7", Price: zone1, MaxTime: 2, Schedule: centralHours},
+	"C9":  {Name: "C9", Price: zone1, MaxTime: 2, Schedule: centralHours},
+	"C10": {Name: "C10", Price: zone1, MaxTime: 2, Schedule: centralHours},
+	"C11": {Name: "C11", Price: zone1, MaxTime: 4, Schedule: centralHours},
+	"C13": {Name: "C13", Price: zone1, MaxTime: 4, Schedule: centralHours},
+	"C14": {Name: "C14", Price: zone1, MaxTime: 4, Schedule: centralHours},
+	"B1":  {Name: "B1", Price: zone2, MaxTime: 6, Schedule: centralHours},
+	"Pr":  {Name: "Pr", Price: zone2, MaxTime: 6, Schedule: centralHours},
+	"Kr":  {Name: "Kr", Price: zone2, MaxTime: 6, Schedule: centralHours},
+	"Mi":  {Name: "Mi", Price: zone2, MaxTime: 6, Schedule: centralHours},
+	"B2":  {Name: "B2", Price: zone3, MaxTime: 10, Schedule: outerHours},
+	"B3":  {Name: "B3", Price: zone3, MaxTime: 10, Schedule: outerHours},
+	"J1":  {Name: "J1", Price: zone3, MaxTime: 10, Schedule: outerHours},
+	"J2":  {Name: "J2", Price: zone3, MaxTime: 10, Schedule: outerHours},
+	"J3":  {Name: "J3", Price: zone3, MaxTime: 10, Schedule: outerHours},
+	"Vo1": {Name: "Vo1", Price: zone3, MaxTime: 10, Schedule: outerHours},
+	"Mo1": {Name: "Mo1", Price: zone3, MaxTime: 10, Schedule: outerHours},
+	"Mo2": {Name: "Mo2", Price: zone3, MaxTime: 10, Schedule: outerHours},
+	"Ko1": {Name: "Ko1", Price: zone3, MaxTime: 10, Schedule: outerHours},
+	"Po1": {Name: "Po1", Price: zone3, MaxTime: 10, Schedule: outerHours},
+	"R1":  {Name: "R1", Price: zone3, MaxTime: 10, Schedule: outerHours},
+	"R2":  {Name: "R2", Price: zone3, MaxTime: 10, Schedule: outerHours},
+	"Tr":  {Name: "Tr", Price: zone3, MaxTime: 10, Schedule: outerHours},
+	"Rj":  {Name: "Rj", Price: zone3, MaxTime: 10, Schedule: outerHours},
+	"Mu":  {Name: "Mu", Price: zone3, MaxTime: 10, Schedule: outerHours},
+	"V1":  {Name: "V1", Price: zone3, MaxTime: 10, Schedule: outerHours},
+	"V2":  {Name: "V2", Price: zone3, MaxTime: 10, Schedule: outerHours},
+	"V3":  {Name: "V3", Price: zone3, MaxTime: 10, Schedule: outerHours},
+	"Rd1": {Name: "Rd1", Price: zone3, MaxTime: 10, Schedule: outerHours},
+	"Rd2": {Name: "Rd2", Price: zone3, MaxTime: 10, Schedule: outerHours},
+	"Si1": {Name: "Si1", Price: zone3, MaxTime: 10, Schedule: outerHours},
+	"Si2": {Name: "Si2", Price: zone3, MaxTime: 10, Schedule: outerHours},
+	"Si3": {Name: "Si3", Price: zone3, MaxTime: 10, Schedule: outerHours},
 }
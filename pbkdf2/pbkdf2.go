@@ -0,0 +1,49 @@
+// Package pbkdf2 derives keys from passwords as RFC 8018 describes, with the
+// signature of Go 1.24's crypto/pbkdf2 so the service still builds with older
+// toolchains.
+package pbkdf2
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"hash"
+)
+
+// Key derives a keyLength bytes long key from password and salt with iter
+// iterations of HMAC over h.
+func Key(h func() hash.Hash, password string, salt []byte, iter, keyLength int) ([]byte, error) {
+	if iter < 1 {
+		return nil, errors.New("pbkdf2: iterations must be at least 1")
+	}
+	if keyLength < 1 {
+		return nil, errors.New("pbkdf2: key length must be at least 1")
+	}
+
+	prf := hmac.New(h, []byte(password))
+	size := prf.Size()
+	blocks := (keyLength + size - 1) / size
+
+	key := make([]byte, 0, blocks*size)
+	var counter [4]byte
+	u := make([]byte, size)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(counter[:], uint32(block))
+		prf.Write(counter[:])
+		u = prf.Sum(u[:0])
+
+		t := append([]byte(nil), u...)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLength], nil
+}
@@ -0,0 +1,42 @@
+package price
+
+import "ljightningparking/money"
+
+// Markup is the service fee on top of the city tariff, as a fraction of it.
+var Markup = 0.0
+
+// MaxMarkup is the largest Markup the service starts with, a fee as high as
+// the tariff itself is surely a typo.
+const MaxMarkup = 1.0
+
+// Breakdown explains how a parking fee in EUR turns into the sats to pay.
+type Breakdown struct {
+	Tariff money.Cents
+	Markup money.Cents
+	// Total is the tariff plus markup.
+	Total money.Cents
+	Quote Quote
+	// Rounding is what rounding down to a whole number of sats took off.
+	Rounding money.Msat
+	Sats     int64
+}
+
+// Break quotes a city tariff in sats at the current btceur rate.
+func Break(tariff money.Cents) (Breakdown, error) {
+	b := Breakdown{Tariff: tariff}
+
+	quote, err := GetQuote("btceur")
+	if err != nil {
+		return b, err
+	}
+	b.Quote = quote
+
+	b.Total = tariff.Times(1 + Markup)
+	b.Markup = b.Total.Sub(tariff)
+
+	exact := quote.Conversion().Msat(b.Total)
+	b.Sats = exact.Sats()
+	b.Rounding = exact.Sub(money.Sats(b.Sats))
+
+	return b, nil
+}
@@ -1,39 +1,173 @@
 package price
 
 import (
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
+	"errors"
+	"ljightningparking/clock"
+	"ljightningparking/coalesce"
+	"ljightningparking/metrics"
+	"ljightningparking/money"
 	"log"
-	"net/http"
+	"math"
+	"sync"
+	"time"
 )
 
-func GetPrice(pair string) float64 {
+// MaxStale is how old the cached price may be and still be used for quoting
+// when every exchange is unreachable. Zero disables the fallback.
+var MaxStale = 10 * time.Minute
 
-	resp, err := http.Get(fmt.Sprintf("https://www.bitstamp.net/api/v2/ticker/%s/", pair))
-	if err != nil {
-		log.Printf("Error while getting %s price: %s", pair, err)
-		return -1
+// RefreshInterval is how often the cached prices are refreshed.
+var RefreshInterval = 30 * time.Second
+
+// MaxDeviation is how far, as a fraction, a fetched price may be from the
+// cached one before it is rejected as an outlier, unless another exchange
+// confirms it.
+var MaxDeviation = 0.1
+
+// OutlierWindow is how old the cached price may be and still be the one
+// fetched prices are checked against. It is kept apart from MaxStale so that
+// disabling the stale fallback does not disable the outlier check too.
+var OutlierWindow = 10 * time.Minute
+
+var ErrNoPrice = errors.New("no recent price available")
+
+func init() {
+	metrics.GaugeFunc("ljp_btceur_rate_age_seconds", "Age of the cached BTC/EUR price invoices are quoted with.", func() (float64, bool) {
+		q, ok := Cached("btceur")
+		return q.Age().Seconds(), ok
+	})
+}
+
+// Quote is a price together with the time it was fetched at.
+type Quote struct {
+	Rate      float64
+	FetchedAt time.Time
+	// Source is the exchange the price came from.
+	Source string
+	Stale  bool
+}
+
+// Conversion converts amounts at the quoted price.
+func (q Quote) Conversion() money.Rate {
+	return money.Rate{EurPerBtc: q.Rate}
+}
+
+// Age returns how old the price is.
+func (q Quote) Age() time.Duration {
+	return clock.Since(q.FetchedAt)
+}
+
+var cache = struct {
+	quotes map[string]Quote
+	sync.Mutex
+}{quotes: make(map[string]Quote)}
+
+// Refresh fetches the current price of pair into the cache. It is run by the
+// job scheduler every RefreshInterval.
+func Refresh(pair string) error {
+	if _, ok := refresh(pair); !ok {
+		return ErrNoPrice
 	}
+	return nil
+}
 
-	defer resp.Body.Close()
+// Cached returns the cached price for pair, however old, without fetching it.
+func Cached(pair string) (Quote, bool) {
+	cache.Lock()
+	defer cache.Unlock()
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("Error while reading response for %s price: %s", pair, err)
-		return -1
+	q, ok := cache.quotes[pair]
+	return q, ok
+}
+
+// GetQuote returns the cached price for pair. A price older than twice the
+// refresh interval is marked stale and one older than MaxStale is not
+// returned at all. Without a cached price it is fetched right away.
+func GetQuote(pair string) (Quote, error) {
+	cache.Lock()
+	q, ok := cache.quotes[pair]
+	cache.Unlock()
+
+	if !ok {
+		q, ok = refresh(pair)
+	}
+	if !ok {
+		return Quote{}, ErrNoPrice
 	}
 
-	var tickerJson struct{
-		Last float64 `json:"last,string"`
+	if q.Age() > 2*RefreshInterval {
+		if q.Age() > MaxStale {
+			return Quote{}, ErrNoPrice
+		}
+		log.Printf("Using stale %s price from %s", pair, q.FetchedAt.Format(time.RFC3339))
+		q.Stale = true
 	}
+	return q, nil
+}
 
-	err = json.Unmarshal(body, &tickerJson)
+// refreshes makes a burst of page loads without a cached price, or one
+// arriving with the scheduled refresh, ask the exchanges once.
+var refreshes = coalesce.Group{Name: "price"}
+
+type refreshed struct {
+	quote Quote
+	ok    bool
+}
+
+// refresh fetches pair from the exchanges in order until one returns a sane
+// price, and caches it. Concurrent refreshes of a pair share one fetch.
+func refresh(pair string) (Quote, bool) {
+	v, err := refreshes.Do(pair, func() (interface{}, error) {
+		q, ok := fetchPair(pair)
+		return refreshed{q, ok}, nil
+	})
 	if err != nil {
-		log.Printf("Error while unmarshaling ticker response for %s price: %s", pair, err)
-		return -1
+		return Quote{}, false
+	}
+	r := v.(refreshed)
+	return r.quote, r.ok
+}
+
+func fetchPair(pair string) (Quote, bool) {
+	cache.Lock()
+	last, haveLast := cache.quotes[pair]
+	cache.Unlock()
+	checkLast := haveLast && last.Age() <= OutlierWindow
+	haveLast = haveLast && last.Age() <= MaxStale
+
+	var rejected []Quote
+	for _, source := range Sources {
+		rate, err := source.fetch(pair)
+		if err != nil {
+			log.Printf("Error while getting %s price from %s: %s", pair, source.Name, err)
+			continue
+		}
+
+		q := Quote{Rate: rate, FetchedAt: clock.Now(), Source: source.Name}
+		if !checkLast || agrees(rate, last.Rate) {
+			return cacheQuote(pair, q), true
+		}
+
+		// the market may really have moved, if another exchange agrees
+		for _, other := range rejected {
+			if agrees(rate, other.Rate) {
+				return cacheQuote(pair, q), true
+			}
+		}
+		log.Printf("Rejecting %s price %.2f from %s, cached price is %.2f", pair, rate, source.Name, last.Rate)
+		rejected = append(rejected, q)
 	}
 
-	return tickerJson.Last
+	return last, haveLast
+}
+
+func agrees(a, b float64) bool {
+	return math.Abs(a-b) <= MaxDeviation*b
+}
 
+func cacheQuote(pair string, q Quote) Quote {
+	cache.Lock()
+	cache.quotes[pair] = q
+	cache.Unlock()
+	return q
 }
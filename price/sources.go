@@ -0,0 +1,119 @@
+package price
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Source is an exchange prices are fetched from.
+type Source struct {
+	Name string
+	// symbols maps our pair names to the exchange's.
+	symbols map[string]string
+	url     string
+	parse   func(body []byte, symbol string) (float64, error)
+}
+
+// Sources are tried in order, the first one is the primary.
+var Sources = []Source{
+	{
+		Name:    "bitstamp",
+		symbols: map[string]string{"btceur": "btceur"},
+		url:     "https://www.bitstamp.net/api/v2/ticker/%s/",
+		parse: func(body []byte, symbol string) (float64, error) {
+			var ticker struct {
+				Last float64 `json:"last,string"`
+			}
+			err := json.Unmarshal(body, &ticker)
+			return ticker.Last, err
+		},
+	},
+	{
+		Name:    "kraken",
+		symbols: map[string]string{"btceur": "XXBTZEUR"},
+		url:     "https://api.kraken.com/0/public/Ticker?pair=%s",
+		parse: func(body []byte, symbol string) (float64, error) {
+			var ticker struct {
+				Error  []string `json:"error"`
+				Result map[string]struct {
+					Close []string `json:"c"`
+				} `json:"result"`
+			}
+			err := json.Unmarshal(body, &ticker)
+			if err != nil {
+				return 0, err
+			}
+			if len(ticker.Error) > 0 {
+				return 0, errors.New(ticker.Error[0])
+			}
+			if len(ticker.Result[symbol].Close) == 0 {
+				return 0, errors.New("no last trade in response")
+			}
+			return strconv.ParseFloat(ticker.Result[symbol].Close[0], 64)
+		},
+	},
+	{
+		Name:    "coinbase",
+		symbols: map[string]string{"btceur": "BTC-EUR"},
+		url:     "https://api.coinbase.com/v2/prices/%s/spot",
+		parse: func(body []byte, symbol string) (float64, error) {
+			var spot struct {
+				Data struct {
+					Amount float64 `json:"amount,string"`
+				} `json:"data"`
+			}
+			err := json.Unmarshal(body, &spot)
+			return spot.Data.Amount, err
+		},
+	},
+	{
+		Name:    "coingecko",
+		symbols: map[string]string{"btceur": "eur"},
+		url:     "https://api.coingecko.com/api/v3/simple/price?ids=bitcoin&vs_currencies=%s",
+		parse: func(body []byte, symbol string) (float64, error) {
+			var prices struct {
+				Bitcoin map[string]float64 `json:"bitcoin"`
+			}
+			err := json.Unmarshal(body, &prices)
+			return prices.Bitcoin[symbol], err
+		},
+	},
+}
+
+var httpClient = http.Client{Timeout: 5 * time.Second}
+
+func (s Source) fetch(pair string) (float64, error) {
+	symbol, ok := s.symbols[pair]
+	if !ok {
+		return 0, fmt.Errorf("pair %s not supported", pair)
+	}
+
+	resp, err := httpClient.Get(fmt.Sprintf(s.url, symbol))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	rate, err := s.parse(body, symbol)
+	if err != nil {
+		return 0, err
+	}
+	if rate <= 0 {
+		return 0, fmt.Errorf("invalid price %v", rate)
+	}
+	return rate, nil
+}
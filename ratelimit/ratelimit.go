@@ -0,0 +1,151 @@
+package ratelimit
+
+import (
+	"ljightningparking/clock"
+	"sync"
+	"time"
+)
+
+// Limit allows Rate invoices per minute on average, in bursts of up to Burst.
+// A zero Rate disables it.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+var (
+	// PerIP limits the invoices one client ip creates.
+	PerIP = Limit{Rate: 6, Burst: 10}
+	// Global limits the invoices created by everyone together, protecting
+	// lnd's invoice database from floods spread over many addresses.
+	Global = Limit{Rate: 120, Burst: 240}
+	// Feedback limits the feedback one client ip sends, keeping spam out.
+	Feedback = Limit{Rate: 0.2, Burst: 3}
+	// Login limits the admin login attempts of one client ip, and those for
+	// one admin from anywhere, against guessing passwords and codes.
+	Login = Limit{Rate: 1, Burst: 5}
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket for the time passed and takes a token if one is
+// left.
+func (b *bucket) take(l Limit, now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = float64(l.Burst)
+	} else {
+		b.tokens += now.Sub(b.last).Minutes() * l.Rate
+		if b.tokens > float64(l.Burst) {
+			b.tokens = float64(l.Burst)
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full reports whether the bucket refilled completely, so forgetting it
+// changes nothing.
+func (b *bucket) full(l Limit, now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Minutes()*l.Rate >= float64(l.Burst)
+}
+
+// ipBuckets are the buckets of the client ips limited by the same Limit.
+type ipBuckets struct {
+	global bucket
+	byIP   map[string]*bucket
+	pruned time.Time
+	sync.Mutex
+}
+
+var (
+	buckets  = ipBuckets{byIP: make(map[string]*bucket)}
+	feedback = ipBuckets{byIP: make(map[string]*bucket)}
+	logins   = ipBuckets{byIP: make(map[string]*bucket)}
+	users    = ipBuckets{byIP: make(map[string]*bucket)}
+)
+
+// take takes a token from ip's bucket, pruning the quiet ones once a minute.
+// The caller holds the lock.
+func (b *ipBuckets) take(l Limit, ip string, now time.Time) bool {
+	if now.Sub(b.pruned) > time.Minute {
+		b.prune(l, now)
+		b.pruned = now
+	}
+
+	ipBucket, ok := b.byIP[ip]
+	if !ok {
+		ipBucket = &bucket{}
+		b.byIP[ip] = ipBucket
+	}
+	return ipBucket.take(l, now)
+}
+
+// Allow reports whether ip may create another invoice, counting it if so.
+func Allow(ip string) bool {
+	buckets.Lock()
+	defer buckets.Unlock()
+
+	now := clock.Now()
+	if PerIP.Rate > 0 && !buckets.take(PerIP, ip, now) {
+		return false
+	}
+
+	if Global.Rate > 0 && !buckets.global.take(Global, now) {
+		if b, ok := buckets.byIP[ip]; ok {
+			// give back the ip's token, it was not its fault
+			b.tokens++
+		}
+		return false
+	}
+
+	return true
+}
+
+// AllowFeedback reports whether ip may send more feedback, counting it if so.
+func AllowFeedback(ip string) bool {
+	if Feedback.Rate <= 0 {
+		return true
+	}
+
+	feedback.Lock()
+	defer feedback.Unlock()
+	return feedback.take(Feedback, ip, clock.Now())
+}
+
+// AllowLogin reports whether ip may try logging in as name, counting the
+// attempt if so.
+func AllowLogin(ip, name string) bool {
+	if Login.Rate <= 0 {
+		return true
+	}
+
+	now := clock.Now()
+	logins.Lock()
+	allowed := logins.take(Login, ip, now)
+	logins.Unlock()
+	if !allowed {
+		return false
+	}
+
+	users.Lock()
+	defer users.Unlock()
+	return users.take(Login, name, now)
+}
+
+// prune forgets the buckets of ips that have been quiet for long enough to
+// be back at a full burst.
+func (b *ipBuckets) prune(l Limit, now time.Time) {
+	for ip, ipBucket := range b.byIP {
+		if ipBucket.full(l, now) {
+			delete(b.byIP, ip)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package receipt
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// OrderDocument is what an invoice commits to through its description hash.
+// It is hashed before the invoice exists, so unlike Record it can not contain
+// the payment hash. Field order is fixed to keep the encoding canonical.
+type OrderDocument struct {
+	Service   string  `json:"service"`
+	Product   string  `json:"product,omitempty"`
+	Zone      string  `json:"zone"`
+	Plate     string  `json:"plate"`
+	Hours     float64 `json:"hours"`
+	Eur       float64 `json:"eur"`
+	Sats      int64   `json:"sats"`
+	Rate      float64 `json:"btceur_rate"`
+	CreatedAt int64   `json:"created_at"`
+}
+
+const Service = "ljightningparking"
+
+func (d OrderDocument) Canonical() []byte {
+	data, _ := json.Marshal(d)
+	return data
+}
+
+// Hash is the sha256 of the canonical document, used as the invoice's
+// description_hash.
+func (d OrderDocument) Hash() []byte {
+	sum := sha256.Sum256(d.Canonical())
+	return sum[:]
+}
+
+func (d OrderDocument) HexHash() string {
+	return hex.EncodeToString(d.Hash())
+}
@@ -0,0 +1,100 @@
+package receipt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Record is the canonical description of what was sold for an invoice.
+// Field order is fixed so its json encoding is stable and can be re-verified.
+type Record struct {
+	PaymentHash string  `json:"payment_hash"`
+	OrderHash   string  `json:"order_hash"`
+	Zone        string  `json:"zone"`
+	Plate       string  `json:"plate"`
+	Hours       float64 `json:"hours"`
+	Eur         float64 `json:"eur"`
+	Sats        int64   `json:"sats"`
+	Rate        float64 `json:"btceur_rate"`
+	CreatedAt   int64   `json:"created_at"`
+}
+
+// Signed is a record with the ed25519 signature over its canonical encoding.
+type Signed struct {
+	Record    Record `json:"record"`
+	Signature string `json:"signature"`
+}
+
+var signingKey ed25519.PrivateKey
+
+// LoadKey reads the hex encoded ed25519 seed at path, generating and saving a
+// new one if the file does not exist yet.
+func LoadKey(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		seed := make([]byte, ed25519.SeedSize)
+		_, err = rand.Read(seed)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(path, []byte(hex.EncodeToString(seed)), 0600)
+		if err != nil {
+			return err
+		}
+		signingKey = ed25519.NewKeyFromSeed(seed)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return fmt.Errorf("invalid signing key in %s", path)
+	}
+	signingKey = ed25519.NewKeyFromSeed(seed)
+	return nil
+}
+
+func PublicKey() string {
+	if signingKey == nil {
+		return ""
+	}
+	return hex.EncodeToString(signingKey.Public().(ed25519.PublicKey))
+}
+
+func (r Record) Canonical() []byte {
+	data, _ := json.Marshal(r)
+	return data
+}
+
+// Sign signs the record. Without a loaded key the record is returned unsigned.
+func Sign(r Record) Signed {
+	if signingKey == nil {
+		return Signed{Record: r}
+	}
+	return Signed{r, base64.StdEncoding.EncodeToString(ed25519.Sign(signingKey, r.Canonical()))}
+}
+
+func Verify(publicKey string, s Signed) error {
+	key, err := hex.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("invalid public key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(s.Signature)
+	if err != nil {
+		return errors.New("invalid signature encoding")
+	}
+	if !ed25519.Verify(key, s.Record.Canonical(), sig) {
+		return errors.New("signature does not match record")
+	}
+	return nil
+}
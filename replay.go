@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"ljightningparking/balance"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type backupSms struct {
+	Address string
+	Date    time.Time
+	Body    string
+}
+
+type replayRecord struct {
+	Date  time.Time     `json:"date"`
+	Reply balance.Reply `json:"reply"`
+}
+
+// runReplay feeds an exported phone SMS backup through the operator reply
+// parsers, reporting what could not be parsed and optionally writing the
+// parsed replies as json lines.
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay-sms", flag.ExitOnError)
+	file := fs.String("file", "", "sms backup file, xml from SMS Backup & Restore or csv with address,date,body columns")
+	from := fs.String("from", "", "only replay messages from this sender number")
+	out := fs.String("out", "", "write parsed replies as json lines to this file")
+	fs.Parse(args)
+
+	f, err := os.Open(*file)
+	if err != nil {
+		log.Fatalf("error opening sms backup: %s", err)
+	}
+	defer f.Close()
+
+	var messages []backupSms
+	if strings.EqualFold(filepath.Ext(*file), ".csv") {
+		messages, err = readCsvBackup(f)
+	} else {
+		messages, err = readXmlBackup(f)
+	}
+	if err != nil {
+		log.Fatalf("error reading sms backup: %s", err)
+	}
+
+	var encoder *json.Encoder
+	if len(*out) > 0 {
+		outFile, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("error creating output file: %s", err)
+		}
+		defer outFile.Close()
+		encoder = json.NewEncoder(outFile)
+	}
+
+	counts := make(map[balance.Kind]int)
+	failed := 0
+
+	for _, msg := range messages {
+		if len(*from) > 0 && msg.Address != *from {
+			continue
+		}
+
+		reply, err := balance.ParseReply(msg.Body)
+		if err != nil {
+			failed++
+			fmt.Printf("unparsed %s: %s (%s)\n", msg.Date.Format(time.RFC3339), msg.Body, err)
+			continue
+		}
+		counts[reply.Kind]++
+
+		if encoder != nil {
+			err = encoder.Encode(replayRecord{msg.Date, reply})
+			if err != nil {
+				log.Fatalf("error writing parsed reply: %s", err)
+			}
+		}
+	}
+
+	fmt.Printf("success: %d, rejected: %d, balance: %d, unparsed: %d\n", counts[balance.Success], counts[balance.Rejected], counts[balance.Balance], failed)
+}
+
+func readXmlBackup(r io.Reader) ([]backupSms, error) {
+	var backup struct {
+		Messages []struct {
+			Address string `xml:"address,attr"`
+			Date    int64  `xml:"date,attr"`
+			Type    int    `xml:"type,attr"`
+			Body    string `xml:"body,attr"`
+		} `xml:"sms"`
+	}
+
+	err := xml.NewDecoder(r).Decode(&backup)
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []backupSms
+	for _, m := range backup.Messages {
+		// type 1 is an inbox message, everything else we sent ourselves
+		if m.Type != 1 {
+			continue
+		}
+		messages = append(messages, backupSms{m.Address, time.Unix(0, m.Date*int64(time.Millisecond)), m.Body})
+	}
+
+	return messages, nil
+}
+
+func readCsvBackup(r io.Reader) ([]backupSms, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []backupSms
+	for i, row := range rows {
+		if len(row) < 3 {
+			return nil, fmt.Errorf("line %d: expected address,date,body", i+1)
+		}
+		date, err := parseBackupDate(row[1])
+		if err != nil {
+			// tolerate a header line
+			if i == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("line %d: %s", i+1, err)
+		}
+		messages = append(messages, backupSms{row[0], date, row[2]})
+	}
+
+	return messages, nil
+}
+
+func parseBackupDate(value string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(0, ms*int64(time.Millisecond)), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,192 @@
+package replication
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"ljightningparking/clock"
+	"ljightningparking/metrics"
+	"ljightningparking/store"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Primary is the instance a standby follows.
+type Primary struct {
+	URL    string
+	Token  string
+	Client http.Client
+}
+
+func NewPrimary(url, token string) *Primary {
+	// long enough for the primary holding a request open until there are writes
+	return &Primary{URL: url, Token: token, Client: http.Client{Timeout: time.Minute}}
+}
+
+// Status is how far a standby got replaying the primary's writes.
+type Status struct {
+	Primary string
+	// Seq is the last replayed write.
+	Seq int64
+	// LastContact is when the primary last answered.
+	LastContact time.Time
+	LastError   string
+}
+
+var status struct {
+	value Status
+	sync.Mutex
+}
+
+func Current() Status {
+	status.Lock()
+	defer status.Unlock()
+
+	return status.value
+}
+
+func init() {
+	metrics.GaugeFunc("ljp_replication_seq", "Last write of the primary replayed by this standby.", func() (float64, bool) {
+		s := Current()
+		return float64(s.Seq), len(s.Primary) > 0
+	})
+	metrics.GaugeFunc("ljp_replication_last_contact_seconds", "Seconds since this standby last heard from the primary.", func() (float64, bool) {
+		s := Current()
+		return clock.Since(s.LastContact).Seconds(), !s.LastContact.IsZero()
+	})
+}
+
+// ErrBehind is returned once the primary pruned writes the standby has not
+// replayed yet. The standby has to start over from a new snapshot.
+var ErrBehind = errors.New("the primary pruned writes not replayed yet, remove the standby database to start over from a snapshot")
+
+func (p *Primary) get(path string) (*http.Response, error) {
+	request, err := http.NewRequest("GET", p.URL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("X-Replication-Token", p.Token)
+
+	resp, err := p.Client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, ErrBehind
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("primary returned %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// Bootstrap downloads a snapshot of the primary's database to path, unless
+// there is a database there already.
+func (p *Primary) Bootstrap(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	resp, err := p.get("/replication/snapshot")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".snapshot")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, resp.Body)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Downloaded snapshot of %s up to write %s", p.URL, resp.Header.Get("X-Replication-Seq"))
+	return os.Rename(tmp.Name(), path)
+}
+
+// Follow replays the primary's writes into the open database as they happen
+// until stop is closed, retrying when the primary can't be reached.
+func (p *Primary) Follow(stop <-chan struct{}) error {
+	seq, err := store.JournalSeq()
+	if err != nil {
+		return err
+	}
+	setStatus(func(s *Status) {
+		s.Primary, s.Seq = p.URL, seq
+	})
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		entries, err := p.fetch(seq)
+		if err == ErrBehind {
+			return err
+		}
+		if err == nil {
+			err = store.ApplyJournal(entries)
+		}
+		if err != nil {
+			log.Printf("Error replicating from %s: %s", p.URL, err)
+			setStatus(func(s *Status) {
+				s.LastError = err.Error()
+			})
+			select {
+			case <-stop:
+				return nil
+			case <-clock.After(5 * time.Second):
+			}
+			continue
+		}
+
+		if len(entries) > 0 {
+			seq = entries[len(entries)-1].Seq
+		}
+		setStatus(func(s *Status) {
+			s.Seq, s.LastContact, s.LastError = seq, clock.Now(), ""
+		})
+	}
+}
+
+func (p *Primary) fetch(after int64) ([]store.JournalEntry, error) {
+	resp, err := p.get("/replication/log?after=" + url.QueryEscape(strconv.FormatInt(after, 10)))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Entries []store.JournalEntry `json:"entries"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	return body.Entries, err
+}
+
+func setStatus(update func(s *Status)) {
+	status.Lock()
+	defer status.Unlock()
+
+	update(&status.value)
+}
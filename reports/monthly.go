@@ -0,0 +1,174 @@
+package reports
+
+import (
+	"ljightningparking/parking"
+	"ljightningparking/store"
+	"sort"
+	"time"
+)
+
+// ZoneMonth are the key figures of a zone, or of all zones together, over a
+// month.
+type ZoneMonth struct {
+	Zone string `json:"zone"`
+	// Issued are the invoices created, Paid those that were paid.
+	Issued int `json:"issued"`
+	Paid   int `json:"paid"`
+	// SmsFailed are paid orders whose parking SMS never went through, Rejected
+	// those SMS parking refused.
+	SmsFailed int `json:"smsFailed"`
+	Rejected  int `json:"rejected"`
+	// Refunded were paid and then refunded or cancelled.
+	Refunded int     `json:"refunded"`
+	Sats     int64   `json:"sats"`
+	Eur      float64 `json:"eur"`
+	// PaySeconds is the median time from invoice to payment, SmsSeconds and
+	// SmsSecondsP95 the median and 95th percentile from payment to the
+	// parking SMS leaving.
+	PaySeconds    float64 `json:"paySeconds"`
+	SmsSeconds    float64 `json:"smsSeconds"`
+	SmsSecondsP95 float64 `json:"smsSecondsP95"`
+
+	pay, sms []float64
+}
+
+// Conversion is the percentage of invoices that were paid.
+func (z ZoneMonth) Conversion() float64 {
+	if z.Issued == 0 {
+		return 0
+	}
+	return 100 * float64(z.Paid) / float64(z.Issued)
+}
+
+// FailureRate is the percentage of paid orders that did not end in parking.
+func (z ZoneMonth) FailureRate() float64 {
+	if z.Paid == 0 {
+		return 0
+	}
+	return 100 * float64(z.SmsFailed+z.Rejected) / float64(z.Paid)
+}
+
+// Monthly is the report for the city or parking operator on a month of
+// Lightning payments.
+type Monthly struct {
+	Month time.Time   `json:"month"`
+	Zones []ZoneMonth `json:"zones"`
+	Total ZoneMonth   `json:"total"`
+	// Payments are all parking payments of the month as counted by the
+	// operator, 0 when not given. Share is the percentage paid over
+	// Lightning.
+	Payments int     `json:"payments,omitempty"`
+	Share    float64 `json:"share,omitempty"`
+}
+
+// BuildMonthly reports on the local month starting at month. payments are all
+// parking payments the operator counted in it, to work out Lightning's share,
+// or 0 when unknown.
+func BuildMonthly(month time.Time, payments int) (Monthly, error) {
+	from := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, parking.Location)
+	to := from.AddDate(0, 1, 0)
+	report := Monthly{Month: from, Total: ZoneMonth{Zone: "all zones"}, Payments: payments}
+
+	orders, err := store.OrdersSince(from)
+	if err != nil {
+		return report, err
+	}
+
+	byZone := make(map[string]*ZoneMonth)
+	for _, o := range orders {
+		if !o.CreatedAt.Before(to) {
+			break
+		}
+		if parking.IsTestZone(o.Zone) {
+			continue
+		}
+		zone := o.Zone
+		if len(zone) == 0 {
+			zone = "products"
+		}
+		z, ok := byZone[zone]
+		if !ok {
+			z = &ZoneMonth{Zone: zone}
+			byZone[zone] = z
+		}
+		for _, m := range []*ZoneMonth{z, &report.Total} {
+			m.add(o)
+		}
+	}
+
+	for _, z := range byZone {
+		z.summarize()
+		report.Zones = append(report.Zones, *z)
+	}
+	sort.Slice(report.Zones, func(i, j int) bool {
+		return report.Zones[i].Paid > report.Zones[j].Paid
+	})
+	report.Total.summarize()
+
+	if payments > 0 {
+		report.Share = 100 * float64(report.Total.Paid) / float64(payments)
+	}
+	return report, nil
+}
+
+func (z *ZoneMonth) add(o store.Order) {
+	z.Issued++
+	if !paid(o) {
+		return
+	}
+	z.Paid++
+
+	switch o.State {
+	case store.OrderSmsFailed:
+		z.SmsFailed++
+	case store.OrderRejected:
+		z.Rejected++
+	case store.OrderRefundOwed, store.OrderRefunded, store.OrderCancelled:
+		z.Refunded++
+	}
+	if Earned(o) {
+		z.Sats += o.Sats
+		z.Eur += o.Eur
+	}
+
+	// orders from before payment times were recorded
+	if !o.PaidAt.Valid {
+		return
+	}
+	z.pay = append(z.pay, o.PaidAt.Time.Sub(o.CreatedAt).Seconds())
+	if o.SmsSentAt.Valid {
+		z.sms = append(z.sms, o.SmsSentAt.Time.Sub(o.PaidAt.Time).Seconds())
+	}
+}
+
+// paid reports whether an order was paid, hold invoices count once accepted
+// even if cancelled later.
+func paid(o store.Order) bool {
+	switch o.State {
+	case store.OrderPaid, store.OrderAccepted, store.OrderConfirmed, store.OrderRejected, store.OrderSmsFailed, store.OrderRefundOwed, store.OrderRefunded:
+		return true
+	}
+	return o.PaidAt.Valid
+}
+
+func (z *ZoneMonth) summarize() {
+	z.PaySeconds = percentile(z.pay, 0.5)
+	z.SmsSeconds = percentile(z.sms, 0.5)
+	z.SmsSecondsP95 = percentile(z.sms, 0.95)
+}
+
+// percentile is the nearest rank percentile p of values, 0 when empty.
+func percentile(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	i := int(p*float64(len(values))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(values) {
+		i = len(values) - 1
+	}
+	return values[i]
+}
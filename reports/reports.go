@@ -0,0 +1,176 @@
+package reports
+
+import (
+	"ljightningparking/balance"
+	"ljightningparking/clock"
+	"ljightningparking/parking"
+	"ljightningparking/store"
+	"sort"
+	"time"
+)
+
+// Day is the invoices of one local day.
+type Day struct {
+	Date   string  `json:"date"`
+	Issued int     `json:"issued"`
+	Paid   int     `json:"paid"`
+	Sats   int64   `json:"sats"`
+	Eur    float64 `json:"eur"`
+}
+
+// ZoneRevenue is what the paid orders of a zone brought in.
+type ZoneRevenue struct {
+	Zone   string  `json:"zone"`
+	Orders int     `json:"orders"`
+	Sats   int64   `json:"sats"`
+	Eur    float64 `json:"eur"`
+}
+
+// ProductRevenue is what the paid orders of a product brought in.
+type ProductRevenue struct {
+	Product string  `json:"product"`
+	Orders  int     `json:"orders"`
+	Sats    int64   `json:"sats"`
+	Eur     float64 `json:"eur"`
+}
+
+// SmsCounts are the outcomes of the parking SMS of paid orders.
+type SmsCounts struct {
+	// Confirmed were answered with a success reply by SMS parking.
+	Confirmed int `json:"confirmed"`
+	// Unanswered were sent but no reply came yet.
+	Unanswered int `json:"unanswered"`
+	Rejected   int `json:"rejected"`
+	Failed     int `json:"failed"`
+}
+
+// Report covers the orders created and balances reported since Since.
+type Report struct {
+	Since    time.Time        `json:"since"`
+	Days     []Day            `json:"days"`
+	Zones    []ZoneRevenue    `json:"zones"`
+	Products []ProductRevenue `json:"products"`
+	Sms      SmsCounts        `json:"sms"`
+	Balance  []balance.Entry  `json:"balance"`
+	// Pending are unpaid orders whose invoice has not expired.
+	Pending []store.Order `json:"pending"`
+	// Unconfirmed are paid orders without a success reply from SMS parking.
+	Unconfirmed []store.Order `json:"unconfirmed"`
+}
+
+// Build reports on the last days, counted in local days including today.
+func Build(days int) (Report, error) {
+	now := clock.Now().In(parking.Location)
+	since := time.Date(now.Year(), now.Month(), now.Day()-days+1, 0, 0, 0, 0, parking.Location)
+	report := Report{Since: since}
+
+	orders, err := store.OrdersSince(since)
+	if err != nil {
+		return report, err
+	}
+	report.Balance, err = balance.History(since)
+	if err != nil {
+		return report, err
+	}
+
+	byDay := make(map[string]*Day)
+	for d := since; d.Before(now); d = d.AddDate(0, 0, 1) {
+		day := Day{Date: d.Format("2006-01-02")}
+		report.Days = append(report.Days, day)
+	}
+	for i := range report.Days {
+		byDay[report.Days[i].Date] = &report.Days[i]
+	}
+	byZone := make(map[string]*ZoneRevenue)
+	byProduct := make(map[string]*ProductRevenue)
+
+	for _, o := range orders {
+		if parking.IsTestZone(o.Zone) {
+			// the operator's own checks, see the diagnostics
+			continue
+		}
+		day := byDay[o.CreatedAt.In(parking.Location).Format("2006-01-02")]
+		if day != nil {
+			day.Issued++
+		}
+
+		switch {
+		case o.State == store.OrderPending && o.ExpiresAt > now.Unix():
+			report.Pending = append(report.Pending, o)
+		case o.State == store.OrderConfirmed && len(o.Reply) > 0:
+			report.Sms.Confirmed++
+		case o.State == store.OrderConfirmed:
+			report.Sms.Unanswered++
+			report.Unconfirmed = append(report.Unconfirmed, o)
+		case o.State == store.OrderRejected:
+			report.Sms.Rejected++
+		case o.State == store.OrderSmsFailed:
+			report.Sms.Failed++
+			report.Unconfirmed = append(report.Unconfirmed, o)
+		case o.State == store.OrderPaid || o.State == store.OrderAccepted:
+			report.Unconfirmed = append(report.Unconfirmed, o)
+		}
+
+		if !Earned(o) {
+			continue
+		}
+		if day != nil {
+			day.Paid++
+			day.Sats += o.Sats
+			day.Eur += o.Eur
+		}
+		product := o.Product
+		if len(product) == 0 {
+			product = "hourly"
+		}
+		p, ok := byProduct[product]
+		if !ok {
+			p = &ProductRevenue{Product: product}
+			byProduct[product] = p
+		}
+		p.Orders++
+		p.Sats += o.Sats
+		p.Eur += o.Eur
+
+		if len(o.Zone) == 0 {
+			continue
+		}
+		z, ok := byZone[o.Zone]
+		if !ok {
+			z = &ZoneRevenue{Zone: o.Zone}
+			byZone[o.Zone] = z
+		}
+		z.Orders++
+		z.Sats += o.Sats
+		z.Eur += o.Eur
+	}
+
+	for _, z := range byZone {
+		report.Zones = append(report.Zones, *z)
+	}
+	sort.Slice(report.Zones, func(i, j int) bool {
+		return report.Zones[i].Sats > report.Zones[j].Sats
+	})
+	for _, p := range byProduct {
+		report.Products = append(report.Products, *p)
+	}
+	sort.Slice(report.Products, func(i, j int) bool {
+		return report.Products[i].Sats > report.Products[j].Sats
+	})
+
+	return report, nil
+}
+
+// EarnedStates are the states of orders whose payment is kept, see Earned.
+var EarnedStates = []store.OrderState{store.OrderPaid, store.OrderConfirmed, store.OrderRejected, store.OrderSmsFailed}
+
+// Earned reports whether an order's payment was kept, hold invoices count
+// once settled.
+func Earned(o store.Order) bool {
+	for _, s := range EarnedStates {
+		if o.State == s {
+			return len(o.Preimage) == 0 || o.Settled
+		}
+	}
+	return false
+}
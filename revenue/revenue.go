@@ -0,0 +1,274 @@
+package revenue
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"ljightningparking/clock"
+	"ljightningparking/jobs"
+	"ljightningparking/links"
+	"ljightningparking/money"
+	"ljightningparking/parking"
+	"ljightningparking/store"
+	"log"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+)
+
+// Recipient gets a share of the payments in a group of zones, like the owner
+// of a private lot sold on the platform. Each settlement is posted to
+// Webhook, signed with Secret, and the shares are paid out in batches.
+type Recipient struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Zones are path.Match patterns of zone names.
+	Zones []string `json:"zones"`
+	// Percent is the recipient's share of what the buyer paid.
+	Percent float64 `json:"percent"`
+	Webhook string  `json:"webhook,omitempty"`
+	Secret  string  `json:"secret,omitempty"`
+}
+
+// Recipients are the configured revenue share recipients.
+var Recipients []Recipient
+
+// Load reads a JSON array of recipients.
+func Load(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	var recipients []Recipient
+	err = json.Unmarshal(data, &recipients)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for i, r := range recipients {
+		switch {
+		case len(r.ID) == 0:
+			return fmt.Errorf("recipient %d: missing id", i)
+		case seen[r.ID]:
+			return fmt.Errorf("recipient %s defined twice", r.ID)
+		case len(r.Zones) == 0:
+			return fmt.Errorf("recipient %s: no zones", r.ID)
+		case r.Percent <= 0 || r.Percent > 100:
+			return fmt.Errorf("recipient %s: percent must be above 0 and at most 100", r.ID)
+		case len(r.Webhook) > 0 && len(r.Secret) == 0:
+			return fmt.Errorf("recipient %s: a webhook needs a secret to sign it with", r.ID)
+		}
+		for _, pattern := range r.Zones {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("recipient %s: bad zone pattern %q", r.ID, pattern)
+			}
+		}
+		seen[r.ID] = true
+	}
+
+	Recipients = recipients
+	return nil
+}
+
+func (r Recipient) matches(zone string) bool {
+	for _, pattern := range r.Zones {
+		if ok, _ := path.Match(pattern, zone); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Get looks up a recipient by id.
+func Get(id string) (Recipient, bool) {
+	for _, r := range Recipients {
+		if r.ID == id {
+			return r, true
+		}
+	}
+	return Recipient{}, false
+}
+
+// Record stores the shares of a settled payment for the recipients of its
+// zone. Their webhooks are delivered by the revenue-webhooks job.
+func Record(paymentHash string) error {
+	if len(Recipients) == 0 || store.DB == nil {
+		return nil
+	}
+
+	o, err := store.GetOrder(paymentHash)
+	if err != nil {
+		return err
+	}
+	if len(o.Zone) == 0 || parking.IsTestZone(o.Zone) {
+		return nil
+	}
+
+	for _, r := range Recipients {
+		if !r.matches(o.Zone) {
+			continue
+		}
+		err = store.InsertRevenueShare(store.RevenueShare{
+			PaymentHash: paymentHash,
+			Recipient:   r.ID,
+			Zone:        o.Zone,
+			Eur:         money.EUR(o.Eur).Percent(r.Percent),
+			Sats:        int64(math.Floor(float64(o.Sats) * r.Percent / 100)),
+			SettledAt:   clock.Now(),
+		})
+		if err != nil {
+			return fmt.Errorf("recipient %s: %w", r.ID, err)
+		}
+		if len(r.Webhook) > 0 {
+			if err := jobs.RunNow("revenue-webhooks"); err != nil {
+				log.Printf("error starting the revenue webhooks: %s", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Reverse takes back the shares of a refunded or cancelled payment, telling
+// the recipients through their webhooks. The next payout batch deducts
+// shares already paid out.
+func Reverse(paymentHash string) error {
+	if store.DB == nil {
+		return nil
+	}
+
+	reversed, err := store.ReverseRevenueShares(paymentHash)
+	if err != nil {
+		return err
+	}
+	if reversed > 0 {
+		if err := jobs.RunNow("revenue-webhooks"); err != nil {
+			log.Printf("error starting the revenue webhooks: %s", err)
+		}
+	}
+	return nil
+}
+
+// MaxAttempts is how often a webhook is tried, once a minute, before it is
+// given up on. The share is still paid out.
+const MaxAttempts = 24 * 60
+
+var client = http.Client{Timeout: 10 * time.Second}
+
+// Settlement is the body of the webhook posted for each settled payment, and
+// with the "reversal" event and negative amounts for each refunded one. It
+// leaves out the plate.
+type Settlement struct {
+	Event       string      `json:"event"`
+	Recipient   string      `json:"recipient"`
+	PaymentHash string      `json:"payment_hash"`
+	Zone        string      `json:"zone"`
+	Eur         money.Cents `json:"eur"`
+	Sats        int64       `json:"sats"`
+	Percent     float64     `json:"percent"`
+	SettledAt   time.Time   `json:"settled_at"`
+	// Link is the payment's status page, see links.Payment.
+	Link string `json:"link"`
+}
+
+// Deliver is the revenue-webhooks job, posting the settlements not
+// delivered yet.
+func Deliver() error {
+	if len(Recipients) == 0 || store.DB == nil {
+		return nil
+	}
+
+	// shares of recipients without a webhook are never delivered
+	var webhooks []string
+	for _, r := range Recipients {
+		if len(r.Webhook) > 0 {
+			webhooks = append(webhooks, r.ID)
+		}
+	}
+	shares, err := store.UndeliveredShares(webhooks, MaxAttempts, 100)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, s := range shares {
+		r, ok := Get(s.Recipient)
+		if !ok {
+			continue
+		}
+
+		event := "settlement"
+		if s.Reversal {
+			event = "reversal"
+		}
+		deliveryErr := post(r, Settlement{
+			Event:       event,
+			Recipient:   r.ID,
+			PaymentHash: s.PaymentHash,
+			Zone:        s.Zone,
+			Eur:         s.Eur,
+			Sats:        s.Sats,
+			Percent:     r.Percent,
+			SettledAt:   s.SettledAt.UTC(),
+			Link:        links.Payment(s.PaymentHash),
+		})
+		if deliveryErr != nil {
+			failed++
+			log.Printf("Error delivering settlement %s to %s: %s", s.PaymentHash, r.ID, deliveryErr)
+		}
+		err = store.RecordShareDelivery(s.PaymentHash, s.Recipient, s.Reversal, deliveryErr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d settlement webhooks failed", failed, len(shares))
+	}
+	return nil
+}
+
+// post sends a settlement signed the way recipients verify it: the hex
+// HMAC-SHA256 of the timestamp, a dot and the body, keyed with the secret.
+func post(r Recipient, s Settlement) error {
+	body, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(clock.Now().Unix(), 10)
+	request, err := http.NewRequest("POST", r.Webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Ljp-Timestamp", timestamp)
+	request.Header.Set("X-Ljp-Signature", "sha256="+Sign(r.Secret, timestamp, body))
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return errors.New("webhook returned " + resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the signature of a webhook body sent at timestamp.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,151 @@
+package sms
+
+import (
+	"io"
+	"io/ioutil"
+	"ljightningparking/clock"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exchange is one request to or from an SMS provider as it went over the
+// wire, kept for debugging protocol problems with the gateway phone.
+type Exchange struct {
+	At       time.Time `json:"at"`
+	Provider string    `json:"provider"`
+	Incoming bool      `json:"incoming"`
+	URL      string    `json:"url"`
+	// Number is the number sent to, or the sender of an incoming SMS.
+	Number string `json:"number,omitempty"`
+	// Message is the SMS in plain text and Raw what was sent for it, the
+	// gateway's encrypted data or the provider's form, with secrets redacted.
+	Message  string        `json:"message"`
+	Raw      string        `json:"raw,omitempty"`
+	Status   string        `json:"status,omitempty"`
+	Response string        `json:"response,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// DebugStore keeps gateway exchanges for admins to look at.
+type DebugStore interface {
+	Record(e Exchange)
+	// Exchanges returns what is kept, newest first.
+	Exchanges() []Exchange
+}
+
+// Debug keeps the exchanges with the SMS provider when set, it is off by
+// default as they contain plates and phone numbers.
+var Debug DebugStore
+
+// Ring is a DebugStore keeping the last exchanges in memory.
+type Ring struct {
+	entries []Exchange
+	next    int
+	full    bool
+	sync.Mutex
+}
+
+// NewRing keeps the last size exchanges.
+func NewRing(size int) *Ring {
+	return &Ring{entries: make([]Exchange, size)}
+}
+
+func (r *Ring) Record(e Exchange) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+func (r *Ring) Exchanges() []Exchange {
+	r.Lock()
+	defer r.Unlock()
+
+	n := r.next
+	if r.full {
+		n = len(r.entries)
+	}
+	exchanges := make([]Exchange, 0, n)
+	for i := 1; i <= n; i++ {
+		exchanges = append(exchanges, r.entries[(r.next-i+len(r.entries))%len(r.entries)])
+	}
+	return exchanges
+}
+
+// maxResponse is how much of a provider's response is kept.
+const maxResponse = 1024
+
+// record keeps an exchange when debugging is on, reading up to maxResponse
+// of body as the response.
+func record(e Exchange, start time.Time, body io.Reader, err error) {
+	if Debug == nil {
+		return
+	}
+
+	e.At, e.Duration = start, clock.Since(start)
+	e.URL = redactURL(e.URL)
+	if body != nil {
+		data, _ := ioutil.ReadAll(io.LimitReader(body, maxResponse))
+		e.Response = string(data)
+	}
+	if err != nil {
+		e.Error = redact(err.Error())
+	}
+	Debug.Record(e)
+}
+
+// RecordIncoming keeps an SMS the provider posted to us when debugging is on.
+func RecordIncoming(provider, from, message, status string) {
+	if Debug == nil {
+		return
+	}
+	Debug.Record(Exchange{At: clock.Now(), Provider: provider, Incoming: true, Number: from, Message: message, Status: status})
+}
+
+// secretParams are query and form parameters never kept.
+var secretParams = []string{"key", "token", "secret", "password", "auth"}
+
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "(invalid url)"
+	}
+	if u.User != nil {
+		u.User = url.User("redacted")
+	}
+	u.RawQuery = redactForm(u.Query()).Encode()
+	return u.String()
+}
+
+func redactForm(form url.Values) url.Values {
+	redacted := url.Values{}
+	for name, values := range form {
+		for _, secret := range secretParams {
+			if strings.Contains(strings.ToLower(name), secret) {
+				values = []string{"redacted"}
+				break
+			}
+		}
+		redacted[name] = values
+	}
+	return redacted
+}
+
+// redact removes secrets from urls in errors, which net/http includes.
+func redact(message string) string {
+	fields := strings.Fields(message)
+	for i, f := range fields {
+		trimmed := strings.Trim(f, `"':`)
+		if strings.Contains(trimmed, "://") {
+			fields[i] = strings.Replace(f, trimmed, redactURL(trimmed), 1)
+		}
+	}
+	return strings.Join(fields, " ")
+}
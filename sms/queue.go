@@ -0,0 +1,242 @@
+package sms
+
+import (
+	"errors"
+	"ljightningparking/clock"
+	"ljightningparking/metrics"
+	"ljightningparking/store"
+	"log"
+	"sync"
+	"time"
+)
+
+// RetryFor is how long a queued SMS is retried before it is given up on. It
+// must stay well below the expiry of held payments, which are cancelled when
+// their parking SMS fails.
+var RetryFor = 30 * time.Minute
+
+const (
+	minBackoff = 5 * time.Second
+	maxBackoff = 5 * time.Minute
+)
+
+var (
+	attempts  = metrics.NewCounter("ljp_sms_attempts_total", "SMS send attempts, by result ok or error.", "result")
+	gatewayUp = metrics.NewGauge("ljp_sms_gateway_up", "Whether the last SMS send attempt went through.")
+)
+
+// OnResult is called once a queued SMS was sent, or given up on with the
+// last error.
+var OnResult = func(ref string, err error) {}
+
+var queue = struct {
+	items []*store.QueuedSms
+	// sending is the SMS being handed to the gateway, it can't be cancelled.
+	sending *store.QueuedSms
+	wake    chan struct{}
+	sync.Mutex
+}{wake: make(chan struct{}, 1)}
+
+// ErrSending is returned when cancelling an SMS that is being sent.
+var ErrSending = errors.New("the sms is being sent")
+
+// Enqueue queues an SMS that must get through, like a paid parking SMS, and
+// retries it with backoff for RetryFor. Queued SMS are kept in the database
+// so they survive a restart. Nothing is queued if an SMS for ref is queued
+// already, and if one was sent OnResult is called again instead.
+func Enqueue(ref, message string) {
+	EnqueueTo(ref, "", message)
+}
+
+// EnqueueTo queues an SMS like Enqueue, sent to another number than the
+// parking operator's unless to is empty.
+func EnqueueTo(ref, to, message string) {
+	queue.Lock()
+	defer queue.Unlock()
+
+	if queued(ref) {
+		return
+	}
+
+	state, err := store.SmsState(ref)
+	if err != nil {
+		log.Printf("Error checking queued sms %s: %s", ref, err)
+	}
+	switch state {
+	case store.SmsQueued:
+		// loaded by Start
+		return
+	case store.SmsSent:
+		go OnResult(ref, nil)
+		return
+	}
+
+	now := clock.Now()
+	q := &store.QueuedSms{
+		Ref:           ref,
+		To:            to,
+		Message:       message,
+		State:         store.SmsQueued,
+		NextAttemptAt: now.Unix(),
+		Deadline:      now.Add(RetryFor).Unix(),
+	}
+	q.ID, err = store.InsertQueuedSms(*q)
+	if err != nil {
+		log.Printf("Error storing queued sms %s, it is only kept in memory: %s", ref, err)
+	}
+	queue.items = append(queue.items, q)
+
+	select {
+	case queue.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start resumes the SMS queued before a restart and sends queued SMS in the
+// background.
+func Start() {
+	gatewayUp.Set(1)
+
+	stored, err := store.QueuedSmsList()
+	if err != nil {
+		log.Printf("Error loading queued sms: %s", err)
+	}
+
+	queue.Lock()
+	resumed := 0
+	for i := range stored {
+		if !queued(stored[i].Ref) {
+			queue.items = append(queue.items, &stored[i])
+			resumed++
+		}
+	}
+	queue.Unlock()
+
+	if resumed > 0 {
+		log.Printf("Resuming %d queued sms", resumed)
+	}
+	go work()
+}
+
+func queued(ref string) bool {
+	for _, q := range queue.items {
+		if q.Ref == ref {
+			return true
+		}
+	}
+	return false
+}
+
+func work() {
+	for {
+		q, wait := next()
+		if q == nil {
+			select {
+			case <-queue.wake:
+			case <-clock.After(wait):
+			}
+			continue
+		}
+		deliver(q)
+	}
+}
+
+// next returns the SMS due the soonest if it is due, or how long until one is.
+func next() (*store.QueuedSms, time.Duration) {
+	queue.Lock()
+	defer queue.Unlock()
+
+	var due *store.QueuedSms
+	for _, q := range queue.items {
+		if due == nil || q.NextAttemptAt < due.NextAttemptAt {
+			due = q
+		}
+	}
+	if due == nil {
+		return nil, time.Hour
+	}
+
+	wait := time.Unix(due.NextAttemptAt, 0).Sub(clock.Now())
+	if wait > 0 {
+		return nil, wait
+	}
+	queue.sending = due
+	return due, 0
+}
+
+// Cancel withdraws the queued SMS for ref, OnResult is not called for it. It
+// returns false if no SMS is queued for ref.
+func Cancel(ref string) (bool, error) {
+	queue.Lock()
+	defer queue.Unlock()
+
+	for i, q := range queue.items {
+		if q.Ref != ref {
+			continue
+		}
+		if q == queue.sending {
+			return false, ErrSending
+		}
+		queue.items = append(queue.items[:i], queue.items[i+1:]...)
+		q.State = store.SmsCancelled
+		return true, store.UpdateQueuedSms(*q)
+	}
+	return false, nil
+}
+
+func deliver(q *store.QueuedSms) {
+	err := sendTo(q.To, q.Message)
+	q.Attempts++
+	gatewayUp.Set(metrics.Bool(err == nil))
+	if err == nil {
+		attempts.Inc("ok")
+	} else {
+		attempts.Inc("error")
+	}
+
+	if err == nil {
+		q.State, q.LastError = store.SmsSent, ""
+	} else {
+		q.LastError = err.Error()
+		retry := clock.Now().Add(backoff(q.Attempts))
+		if retry.Unix() > q.Deadline {
+			q.State = store.SmsFailed
+		} else {
+			q.NextAttemptAt = retry.Unix()
+		}
+		log.Printf("Error sending sms %s, attempt %d: %s", q.Ref, q.Attempts, err)
+	}
+
+	queue.Lock()
+	queue.sending = nil
+	if q.State != store.SmsQueued {
+		for i, item := range queue.items {
+			if item == q {
+				queue.items = append(queue.items[:i], queue.items[i+1:]...)
+				break
+			}
+		}
+	}
+	queue.Unlock()
+
+	storeErr := store.UpdateQueuedSms(*q)
+	if storeErr != nil {
+		log.Printf("Error updating queued sms %s: %s", q.Ref, storeErr)
+	}
+
+	if q.State != store.SmsQueued {
+		OnResult(q.Ref, err)
+	}
+}
+
+// backoff doubles the wait after every failed attempt.
+func backoff(attempts int) time.Duration {
+	wait := minBackoff
+	for i := 1; i < attempts && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+	return wait
+}
@@ -3,38 +3,201 @@ package sms
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
-	"errors"
 	"fmt"
 	"io"
+	"ljightningparking/clock"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
-var key = []byte("passphrasewhichneedstobe32bytes!")
+// Sender sends an SMS to the parking operator's number.
+type Sender interface {
+	Send(message string) error
+}
+
+var defaultKey = []byte("passphrasewhichneedstobe32bytes!")
 
+var sender Sender = NewGateway("http://localhost:8080/send", defaultKey)
+
+// SetSender replaces the local gateway SMS are sent through.
+func SetSender(s Sender) {
+	sender = s
+}
+
+// Send makes a single attempt at sending an SMS, see Enqueue for parking SMS
+// that must get through.
 func Send(message string) error {
-	cipherText, err := encrypt(key, []byte(message + " " + strconv.Itoa(int(time.Now().Unix()+5))))
+	return sender.Send(message)
+}
+
+// Redirector is a Sender that can send to another number than the parking
+// operator's, like the test number of the test zone.
+type Redirector interface {
+	SendTo(to, message string) error
+}
+
+// sendTo sends to the given number, or the operator's when it is empty.
+func sendTo(to, message string) error {
+	if len(to) == 0 {
+		return sender.Send(message)
+	}
+	r, ok := sender.(Redirector)
+	if !ok {
+		return fmt.Errorf("sms provider can't send to %s", to)
+	}
+	return r.SendTo(to, message)
+}
+
+// Gateway is a phone on the local network sending the SMS it is given. The
+// message is encrypted with a shared key and carries an expiry, so a replayed
+// request is not sent again.
+type Gateway struct {
+	URL    string
+	Key    []byte
+	Client http.Client
+}
+
+// NewGateway returns the gateway at url, with the development key when key is
+// empty.
+func NewGateway(url string, key []byte) *Gateway {
+	if len(key) == 0 {
+		key = defaultKey
+	}
+	return &Gateway{URL: url, Key: key, Client: http.Client{Timeout: 10 * time.Second}}
+}
+
+func (g *Gateway) Send(message string) error {
+	return g.SendTo("", message)
+}
+
+// SendTo asks the gateway to send to another number than the one set up on
+// the phone, which the gateway app takes in the to parameter. The number is
+// not part of the encrypted message, so it comes with sig, the base64
+// HMAC-SHA256 of the number and the encrypted data under the shared key, and
+// the gateway app must refuse a to it can't verify.
+func (g *Gateway) SendTo(to, message string) error {
+	plainText := message + " " + strconv.Itoa(int(clock.Now().Unix()+5))
+	cipherText, err := encrypt(g.Key, []byte(plainText))
 	if err != nil {
 		return err
 	}
 
 	params := url.Values{}
 	params.Add("data", string(cipherText))
+	if len(to) > 0 {
+		params.Add("to", to)
+		params.Add("sig", sign(g.Key, to, cipherText))
+	}
 
-	resp, err := http.Get(fmt.Sprintf("http://localhost:8080/send"))
+	exchange := Exchange{Provider: "gateway", URL: g.URL, Number: to, Message: plainText, Raw: base64.StdEncoding.EncodeToString(cipherText)}
+	start := clock.Now()
+	resp, err := g.Client.Get(g.URL + "?" + params.Encode())
 	if err != nil {
+		record(exchange, start, nil, err)
 		return err
 	}
+	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return errors.New("sending sms failed")
+	exchange.Status = resp.Status
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("sending sms failed: gateway returned %s", resp.Status)
 	}
+	record(exchange, start, resp.Body, err)
+	return err
+}
+
+// Twilio sends SMS through Twilio's messaging API.
+type Twilio struct {
+	AccountSID string
+	AuthToken  string
+	From       string
+	To         string
+	Client     http.Client
+}
+
+func NewTwilio(accountSID, authToken, from, to string) *Twilio {
+	return &Twilio{AccountSID: accountSID, AuthToken: authToken, From: from, To: to, Client: http.Client{Timeout: 10 * time.Second}}
+}
+
+func (t *Twilio) Send(message string) error {
+	return t.SendTo(t.To, message)
+}
+
+func (t *Twilio) SendTo(to, message string) error {
+	endpoint := "https://api.twilio.com/2010-04-01/Accounts/" + url.PathEscape(t.AccountSID) + "/Messages.json"
+	return postForm(&t.Client, "twilio", endpoint, t.AccountSID, t.AuthToken, url.Values{
+		"From": {t.From},
+		"To":   {to},
+		"Body": {message},
+	})
+}
+
+// Elks sends SMS through 46elks.
+type Elks struct {
+	Username string
+	Password string
+	From     string
+	To       string
+	Client   http.Client
+}
+
+func NewElks(username, password, from, to string) *Elks {
+	return &Elks{Username: username, Password: password, From: from, To: to, Client: http.Client{Timeout: 10 * time.Second}}
+}
+
+func (e *Elks) Send(message string) error {
+	return e.SendTo(e.To, message)
+}
+
+func (e *Elks) SendTo(to, message string) error {
+	return postForm(&e.Client, "46elks", "https://api.46elks.com/a1/sms", e.Username, e.Password, url.Values{
+		"from":    {e.From},
+		"to":      {to},
+		"message": {message},
+	})
+}
+
+func postForm(client *http.Client, provider, endpoint, user, password string, form url.Values) error {
+	request, err := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	request.SetBasicAuth(user, password)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	message := form.Get("Body") + form.Get("message")
+	exchange := Exchange{Provider: provider, URL: endpoint, Number: form.Get("To") + form.Get("to"), Message: message, Raw: redactForm(form).Encode()}
+	start := clock.Now()
+	resp, err := client.Do(request)
+	if err != nil {
+		record(exchange, start, nil, err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	exchange.Status = resp.Status
+	if resp.StatusCode/100 != 2 {
+		err = fmt.Errorf("sending sms failed: provider returned %s", resp.Status)
+	}
+	record(exchange, start, resp.Body, err)
+	return err
+}
 
-	return nil
+// sign authenticates the number a gateway request sends to together with its
+// encrypted message, so neither can be swapped for another.
+func sign(key []byte, to string, cipherText []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(to))
+	mac.Write([]byte{0})
+	mac.Write(cipherText)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
 }
 
 func encrypt(key, text []byte) ([]byte, error) {
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"ljightningparking/handlers"
+	"ljightningparking/metrics"
+	"ljightningparking/replication"
+	"ljightningparking/store"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// runStandby keeps a copy of a primary's database up to date, from a snapshot
+// and then by replaying its writes as they happen. To take over, stop the
+// standby and start the service on its database.
+func runStandby(args []string) {
+	fs := flag.NewFlagSet("standby", flag.ExitOnError)
+	primaryURL := fs.String("primary", "", "url of the primary instance, e.g. https://parking.example.com")
+	token := fs.String("token", os.Getenv("REPLICATION_TOKEN"), "the primary's -replication-token, defaults to $REPLICATION_TOKEN")
+	dbPath := fs.String("db", "ljightningparking.db", "sqlite database path, a snapshot of the primary is downloaded if it does not exist")
+	listenAddress := fs.String("listen", ":8081", "listen address of /healthz and /metrics")
+	fs.Parse(args)
+
+	if len(*primaryURL) == 0 || len(*token) == 0 {
+		log.Fatalf("-primary and -token are required")
+	}
+
+	primary := replication.NewPrimary(*primaryURL, *token)
+	err := primary.Bootstrap(*dbPath)
+	if err != nil {
+		log.Fatalf("error downloading snapshot: %s", err)
+	}
+
+	// the replayed writes are journaled too, so a promoted standby can be
+	// followed in turn
+	store.Journal = true
+	err = store.Open(*dbPath, store.DefaultOptions)
+	if err != nil {
+		log.Fatalf("error opening database: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", handlers.HealthHandler)
+	mux.HandleFunc("/metrics", metrics.Handler)
+	server := &http.Server{Addr: *listenAddress, Handler: mux}
+	go func() {
+		err := server.ListenAndServe()
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	stop := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-signals
+		log.Printf("Received %s, stopping replication", sig)
+		close(stop)
+	}()
+
+	log.Printf("Following %s", *primaryURL)
+	err = primary.Follow(stop)
+	server.Shutdown(context.Background())
+	closeErr := store.Close()
+	if err != nil {
+		log.Fatalf("replication stopped: %s", err)
+	}
+	if closeErr != nil {
+		log.Fatalf("error closing database: %s", closeErr)
+	}
+	log.Printf("Stopped at write %d, the database can be served from now", replication.Current().Seq)
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"ljightningparking/config"
+	"ljightningparking/pbkdf2"
+	"ljightningparking/store"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateFiles are the settings naming files the service can't run the same
+// without, bundled by export-state with the config file and the database.
+var stateFiles = []string{"signing-key", "sms-key", "macaroon", "zones", "catalogue", "sms-formats", "theme", "revenue-shares"}
+
+const (
+	stateMagic      = "LJPSTATE1\n"
+	stateFormat     = 1
+	stateIterations = 600000
+	stateSaltLength = 16
+)
+
+// stateManifest describes an exported state archive.
+type stateManifest struct {
+	Format        int         `json:"format"`
+	SchemaVersion int         `json:"schema_version"`
+	CreatedAt     time.Time   `json:"created_at"`
+	Files         []stateFile `json:"files"`
+}
+
+// stateFile is a file the config names, Path being where it was on the
+// exporting host and Name where it is in the archive.
+type stateFile struct {
+	Setting string `json:"setting"`
+	Name    string `json:"name"`
+	Path    string `json:"path"`
+}
+
+// runExportState bundles the config file, a consistent copy of the database
+// and the keys and data files the config names into one archive encrypted
+// with a passphrase, for import-state to restore on another host. Settings
+// given only in the environment or on the command line are not part of it.
+func runExportState(args []string) {
+	fs := flag.NewFlagSet("export-state", flag.ExitOnError)
+	configPath := fs.String("config", "ljightningparking.conf", "config file of the service to export")
+	out := fs.String("out", "ljightningparking.state", "archive to write")
+	passphrase := fs.String("passphrase", os.Getenv("STATE_PASSPHRASE"), "passphrase the archive is encrypted with, defaults to $STATE_PASSPHRASE")
+	fs.Parse(args)
+
+	if len(*passphrase) < 12 {
+		log.Fatalf("a -passphrase of at least 12 characters is required")
+	}
+
+	raw, err := ioutil.ReadFile(*configPath)
+	if err != nil {
+		log.Fatalf("error reading config: %s", err)
+	}
+	settings, err := config.Read(*configPath)
+	if err != nil {
+		log.Fatalf("error parsing config: %s", err)
+	}
+	paths := make(map[string]string)
+	for _, s := range settings {
+		paths[s.Name] = s.Value
+	}
+
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gz)
+	manifest := stateManifest{Format: stateFormat, CreatedAt: time.Now()}
+	var contents [][]byte
+
+	add := func(setting, path string, data []byte) {
+		manifest.Files = append(manifest.Files, stateFile{setting, setting + "/" + filepath.Base(path), path})
+		contents = append(contents, data)
+	}
+	add("config", *configPath, raw)
+
+	if path := paths["db"]; len(path) > 0 {
+		data, version, err := snapshotDatabase(path)
+		if err != nil {
+			log.Fatalf("error copying database: %s", err)
+		}
+		if version > store.LatestSchemaVersion() {
+			log.Fatalf("the database has schema version %d but this build only knows %d, export it with a newer build",
+				version, store.LatestSchemaVersion())
+		}
+		manifest.SchemaVersion = version
+		add("db", path, data)
+	}
+	for _, setting := range stateFiles {
+		path := paths[setting]
+		if len(path) == 0 {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatalf("error reading %s: %s", setting, err)
+		}
+		add(setting, path, data)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		log.Fatalf("error encoding manifest: %s", err)
+	}
+	err = writeTar(tw, "manifest.json", data)
+	for i, f := range manifest.Files {
+		if err == nil {
+			err = writeTar(tw, f.Name, contents[i])
+		}
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		log.Fatalf("error writing archive: %s", err)
+	}
+
+	sealed, err := sealState([]byte(*passphrase), archive.Bytes())
+	if err != nil {
+		log.Fatalf("error encrypting archive: %s", err)
+	}
+	err = ioutil.WriteFile(*out, sealed, 0600)
+	if err != nil {
+		log.Fatalf("error writing %s: %s", *out, err)
+	}
+
+	for _, f := range manifest.Files {
+		fmt.Printf("%s: %s\n", f.Setting, f.Path)
+	}
+	fmt.Printf("wrote %s, schema version %d, restore it with import-state -in %s -dir <directory>\n", *out, manifest.SchemaVersion, *out)
+}
+
+// snapshotDatabase returns a consistent copy of the database, which may be in
+// use by the running service, and its schema version. The database is only
+// read, an older one is exported as it is and migrated once imported.
+func snapshotDatabase(path string) ([]byte, int, error) {
+	tmp, err := ioutil.TempDir("", "ljp-export")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer os.RemoveAll(tmp)
+
+	snapshot := filepath.Join(tmp, "snapshot.db")
+	err = store.CopyDatabase(path, snapshot)
+	if err != nil {
+		return nil, 0, err
+	}
+	version, err := store.SchemaVersion(snapshot)
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := ioutil.ReadFile(snapshot)
+	return data, version, err
+}
+
+// runImportState restores an export-state archive into a directory, writing
+// a config file there that names the restored files. Databases of a newer
+// schema than this build knows are refused, older ones are migrated when the
+// service starts.
+func runImportState(args []string) {
+	fs := flag.NewFlagSet("import-state", flag.ExitOnError)
+	in := fs.String("in", "ljightningparking.state", "archive written by export-state")
+	dir := fs.String("dir", "", "directory to restore into, created if missing")
+	passphrase := fs.String("passphrase", os.Getenv("STATE_PASSPHRASE"), "passphrase the archive was encrypted with, defaults to $STATE_PASSPHRASE")
+	force := fs.Bool("force", false, "overwrite files that exist in the directory")
+	fs.Parse(args)
+
+	if len(*dir) == 0 {
+		log.Fatalf("missing -dir")
+	}
+
+	sealed, err := ioutil.ReadFile(*in)
+	if err != nil {
+		log.Fatalf("error reading archive: %s", err)
+	}
+	archive, err := openState([]byte(*passphrase), sealed)
+	if err != nil {
+		log.Fatalf("error decrypting %s: %s", *in, err)
+	}
+	entries, err := readTar(archive)
+	if err != nil {
+		log.Fatalf("error reading archive: %s", err)
+	}
+
+	var manifest stateManifest
+	err = json.Unmarshal(entries["manifest.json"], &manifest)
+	if err != nil {
+		log.Fatalf("error reading manifest: %s", err)
+	}
+	if manifest.Format != stateFormat {
+		log.Fatalf("archive format %d is not supported, expected %d", manifest.Format, stateFormat)
+	}
+	if manifest.SchemaVersion > store.LatestSchemaVersion() {
+		log.Fatalf("the archived database has schema version %d but this build only knows %d, import it with a newer build",
+			manifest.SchemaVersion, store.LatestSchemaVersion())
+	}
+
+	root, err := filepath.Abs(*dir)
+	if err != nil {
+		log.Fatalf("error resolving %s: %s", *dir, err)
+	}
+	err = os.MkdirAll(root, 0700)
+	if err != nil {
+		log.Fatalf("error creating %s: %s", root, err)
+	}
+
+	// nothing is written unless all of it can be
+	targets := make([]string, len(manifest.Files))
+	used := make(map[string]bool)
+	for i, f := range manifest.Files {
+		if _, ok := entries[f.Name]; !ok {
+			log.Fatalf("archive is missing %s", f.Name)
+		}
+		name := filepath.Base(f.Path)
+		if used[name] {
+			name = f.Setting + "-" + name
+		}
+		used[name] = true
+		targets[i] = filepath.Join(root, name)
+
+		if _, err := os.Stat(targets[i]); err == nil && !*force {
+			log.Fatalf("%s exists, pass -force to overwrite it", targets[i])
+		}
+	}
+
+	restored := make(map[string]string)
+	for i, f := range manifest.Files {
+		data, target := entries[f.Name], targets[i]
+		if f.Setting == "db" {
+			// a stale write-ahead log would be replayed onto the restored database
+			os.Remove(target + "-wal")
+			os.Remove(target + "-shm")
+		}
+		err = ioutil.WriteFile(target, data, 0600)
+		if err != nil {
+			log.Fatalf("error writing %s: %s", target, err)
+		}
+		if f.Setting == "db" {
+			version, err := store.SchemaVersion(target)
+			if err != nil || version != manifest.SchemaVersion {
+				os.Remove(target)
+				log.Fatalf("restored database has schema version %d, the manifest says %d: %v", version, manifest.SchemaVersion, err)
+			}
+		}
+		restored[f.Setting] = target
+		fmt.Printf("%s: %s\n", f.Setting, target)
+	}
+
+	configPath, ok := restored["config"]
+	if !ok {
+		log.Fatalf("archive has no config file")
+	}
+	settings, err := config.Read(configPath)
+	if err != nil {
+		log.Fatalf("error parsing restored config: %s", err)
+	}
+	for i, s := range settings {
+		if path, ok := restored[s.Name]; ok && s.Name != "config" {
+			settings[i].Value = path
+		}
+	}
+	comment := fmt.Sprintf("restored by ljightningparking import-state on %s\nfrom an export of %s", time.Now().Format("2006-01-02"), manifest.CreatedAt.Format("2006-01-02 15:04"))
+	err = config.Write(configPath, comment, settings)
+	if err != nil {
+		log.Fatalf("error writing %s: %s", configPath, err)
+	}
+	fmt.Printf("restored schema version %d, start the server with -config %s\n", manifest.SchemaVersion, configPath)
+}
+
+func writeTar(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+func readTar(archive []byte) (map[string][]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+
+	entries := make(map[string][]byte)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries[header.Name], err = ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sealState encrypts an archive with AES-GCM under a key derived from the
+// passphrase, the magic, salt and nonce going first.
+func sealState(passphrase, plain []byte) ([]byte, error) {
+	salt := make([]byte, stateSaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := stateCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := append([]byte(stateMagic), salt...)
+	sealed = append(sealed, nonce...)
+	return gcm.Seal(sealed, nonce, plain, []byte(stateMagic)), nil
+}
+
+func openState(passphrase, sealed []byte) ([]byte, error) {
+	if !bytes.HasPrefix(sealed, []byte(stateMagic)) {
+		return nil, errors.New("not a state archive")
+	}
+	sealed = sealed[len(stateMagic):]
+	if len(sealed) < stateSaltLength {
+		return nil, errors.New("archive is truncated")
+	}
+	gcm, err := stateCipher(passphrase, sealed[:stateSaltLength])
+	if err != nil {
+		return nil, err
+	}
+	sealed = sealed[stateSaltLength:]
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("archive is truncated")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(stateMagic))
+	if err != nil {
+		return nil, errors.New("wrong passphrase or damaged archive")
+	}
+	return plain, nil
+}
+
+func stateCipher(passphrase, salt []byte) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, string(passphrase), salt, stateIterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,46 @@
+// ljp calls the endpoints the pages use with the version of the page, so the
+// server can keep serving tabs left open across a deploy and ask them to
+// refresh once the user is done.
+window.ljp = (function () {
+
+    let version = document.querySelector('meta[name="client-version"]').content;
+    let notice = null;
+
+    function refresh(now) {
+        if (!notice) {
+            notice = document.createElement("div");
+            notice.setAttribute("role", "status");
+            let container = document.querySelector(".container") || document.body;
+            container.insertBefore(notice, container.firstChild);
+        }
+        if (now) {
+            notice.className = "alert alert-warning";
+            notice.textContent = "This page is out of date, please refresh it.";
+        } else if (!notice.textContent) {
+            notice.className = "alert alert-light small";
+            notice.textContent = "This page has been updated, please refresh it once you are done.";
+        }
+    }
+
+    function checkResponse(response) {
+        let signal = response.headers.get("X-Client-Refresh");
+        if (signal) {
+            refresh(signal === "now");
+        }
+        return response;
+    }
+
+    return {
+        fetch: function (url, options) {
+            options = options || {};
+            options.headers = Object.assign({"X-Client-Version": version}, options.headers);
+            return fetch(url, options).then(checkResponse);
+        },
+        events: function (url) {
+            let source = new EventSource(url + (url.indexOf("?") < 0 ? "?" : "&") + "v=" + version);
+            source.addEventListener("refresh", function () { refresh(false); });
+            return source;
+        }
+    };
+
+})();
@@ -0,0 +1,35 @@
+document.addEventListener("DOMContentLoaded", function() {
+
+    let zone = document.getElementById("zone");
+    let hours = document.getElementById("nHours");
+    let until = document.getElementById("parkUntil");
+    let estimate = document.getElementById("estimate");
+
+    function update() {
+        if (!until.value || !zone.value) {
+            estimate.textContent = "";
+            return;
+        }
+        ljp.fetch("/api/v1/estimate?zone=" + encodeURIComponent(zone.value) + "&until=" + encodeURIComponent(until.value))
+            .then(function (response) { return response.json(); })
+            .then(function (result) {
+                if (result.error) {
+                    estimate.textContent = result.error;
+                    return;
+                }
+                let paidUntil = new Date(result.paid_until).toLocaleString([], {weekday: "short", hour: "2-digit", minute: "2-digit"});
+                if (result.free) {
+                    estimate.textContent = "Parking is free until " + paidUntil + ", no need to pay.";
+                    return;
+                }
+                hours.value = result.hours;
+                estimate.textContent = result.hours + " h for " + result.eur.toFixed(2) + " EUR" +
+                    (result.amount_sat ? " (" + result.amount_sat + " sats)" : "") +
+                    ", paid until " + paidUntil + ".";
+            });
+    }
+
+    until.addEventListener("change", update);
+    zone.addEventListener("change", update);
+
+});
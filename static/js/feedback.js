@@ -0,0 +1,25 @@
+document.addEventListener("DOMContentLoaded", function() {
+
+    document.querySelectorAll(".feedback-form").forEach(function (form) {
+        let status = form.querySelector(".feedback-status");
+
+        form.addEventListener("submit", function (event) {
+            event.preventDefault();
+            status.textContent = "Sending...";
+            ljp.fetch(form.action, {
+                method: "POST",
+                headers: {"Accept": "application/json"},
+                body: new URLSearchParams(new FormData(form))
+            }).then(function (response) {
+                if (!response.ok) {
+                    return response.text().then(function (text) { throw new Error(text); });
+                }
+                form.reset();
+                status.textContent = "Thank you, we got your feedback.";
+            }).catch(function (error) {
+                status.textContent = error.message;
+            });
+        });
+    });
+
+});
@@ -1,22 +1,83 @@
 $(document).ready(function() {
 
+    let paymentRequest = document.getElementsByClassName("card-footer")[0].textContent;
+    let status = document.getElementById("status");
+
     let qrcode = new QRCode("lightningqrcode", {
-        text: document.getElementsByClassName("card-footer")[0].textContent,
+        text: paymentRequest,
         width: 300,
         height: 300
     });
 
-    let counter = 0;
-
-    while (counter < 300) {
-        setTimeout(function () {
-            $.getJSON("localhost:8080/check?data="+document.getElementsByClassName("card-footer")[0].textContent, function (result) {
-                if (result["isPaid"]) {
-                    window.location.replace("http://localhost:8080/");
-                }
-                counter++;
-            });
-        }, 1000);
+    function show(text, kind) {
+        status.textContent = text;
+        status.className = "alert mt-3 alert-" + kind;
+    }
+
+    function handle(state, validUntil, reference) {
+        if (state === "cancelled") {
+            show("Parking could not be bought, your payment was returned.", "warning");
+            return true;
+        } else if (state === "refund_owed") {
+            show("Parking could not be bought, your payment will be refunded. Please contact support.", "warning");
+            return true;
+        } else if (state === "rejected") {
+            show("SMS parking refused the purchase, please contact support.", "danger");
+            return true;
+        } else if (validUntil) {
+            show("Parking confirmed until " + new Date(validUntil).toLocaleString(), "success");
+            return true;
+        } else if (state === "confirmation_pending") {
+            show("Payment received and the parking sms was sent, but SMS parking has not confirmed it yet. " +
+                "We are checking with them and this page updates once they reply. " +
+                "If you contact support, quote reference " + reference + ".", "warning");
+        } else if (state === "sms_failed") {
+            show("Payment received, retrying the parking sms...", "info");
+        } else if (state) {
+            show("Payment received, waiting for the parking confirmation...", "info");
+        }
+        return false;
+    }
+
+    function poll() {
+        let checks = 0;
+        let timer = setInterval(function () {
+            if (++checks > 900) {
+                clearInterval(timer);
+                return;
+            }
+            ljp.fetch("/check?paymentRequest=" + encodeURIComponent(paymentRequest))
+                .then(function (response) { return response.json(); })
+                .then(function (result) {
+                    let state = result["state"];
+                    if (result["isPaid"] && (!state || state === "pending")) {
+                        state = "paid";
+                    }
+                    if (handle(state, result["validUntil"], result["reference"])) {
+                        clearInterval(timer);
+                    }
+                });
+        }, 2000);
     }
 
-});
\ No newline at end of file
+    if (!window.EventSource) {
+        poll();
+        return;
+    }
+
+    let source = ljp.events("/events?paymentRequest=" + encodeURIComponent(paymentRequest));
+    ["paid", "sms_sent", "sms_failed", "cancelled", "confirmed", "rejected", "refund_owed", "confirmation_pending"].forEach(function (name) {
+        source.addEventListener(name, function (e) {
+            let event = JSON.parse(e.data);
+            if (handle(event["name"], event["validUntil"], event["reference"])) {
+                source.close();
+            }
+        });
+    });
+    source.onerror = function () {
+        if (source.readyState === EventSource.CLOSED) {
+            poll();
+        }
+    };
+
+});
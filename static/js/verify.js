@@ -0,0 +1,26 @@
+document.addEventListener("DOMContentLoaded", function() {
+
+    let paymentRequest = document.getElementsByClassName("card-footer")[0].textContent;
+
+    new QRCode("lightningqrcode", {
+        text: paymentRequest,
+        width: 300,
+        height: 300
+    });
+
+    let checks = 0;
+    let timer = setInterval(function () {
+        ljp.fetch("/check?paymentRequest=" + encodeURIComponent(paymentRequest))
+            .then(function (response) { return response.json(); })
+            .then(function (result) {
+                if (result["isPaid"]) {
+                    clearInterval(timer);
+                    document.getElementById("retry").submit();
+                }
+            });
+        if (++checks >= 300) {
+            clearInterval(timer);
+        }
+    }, 1000);
+
+});
@@ -0,0 +1,28 @@
+document.addEventListener("DOMContentLoaded", function() {
+
+    let list = document.getElementById("payments");
+    let maxShown = 15;
+
+    let source = new EventSource("/wall/events?token=" + encodeURIComponent(list.dataset.token));
+    // every connection starts with the latest payments again
+    source.addEventListener("open", function () {
+        list.innerHTML = "";
+    });
+    source.addEventListener("payment", function (event) {
+        let payment = JSON.parse(event.data);
+        let time = new Date(payment.time).toLocaleTimeString([], {hour: "2-digit", minute: "2-digit"});
+
+        let item = document.createElement("li");
+        item.textContent = time + " · zone " + payment.zone + " · " + payment.hours + " h · ";
+        let sats = document.createElement("span");
+        sats.className = "sats";
+        sats.textContent = payment.sats + " sats";
+        item.appendChild(sats);
+
+        list.insertBefore(item, list.firstChild);
+        while (list.children.length > maxShown) {
+            list.removeChild(list.lastChild);
+        }
+    });
+
+});
@@ -0,0 +1,19 @@
+document.addEventListener("DOMContentLoaded", function() {
+
+    let plate = document.getElementById("licencePlate");
+    let zoneList = document.getElementById("zoneList");
+
+    plate.addEventListener("change", function () {
+        ljp.fetch("/zones/suggest?plate=" + encodeURIComponent(plate.value))
+            .then(function (response) { return response.json(); })
+            .then(function (zones) {
+                zoneList.innerHTML = "";
+                zones.forEach(function (zone) {
+                    let option = document.createElement("option");
+                    option.value = zone;
+                    zoneList.appendChild(option);
+                });
+            });
+    });
+
+});
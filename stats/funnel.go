@@ -0,0 +1,93 @@
+package stats
+
+import (
+	"sort"
+	"sync"
+)
+
+// Stage is a step of the payment funnel. Only counts are kept per zone, never
+// plates or anything else identifying the user.
+type Stage string
+
+const (
+	Viewed    Stage = "viewed"
+	Invoiced  Stage = "invoiced"
+	Paid      Stage = "paid"
+	Confirmed Stage = "confirmed"
+)
+
+var Stages = []Stage{Viewed, Invoiced, Paid, Confirmed}
+
+// AllZones is the zone form views are counted under, since the zone is not
+// known until the form is submitted.
+const AllZones = "all"
+
+type ZoneFunnel struct {
+	Zone   string
+	Counts map[Stage]int64
+}
+
+type counters struct {
+	counts map[string]map[Stage]int64
+	sync.Mutex
+}
+
+func newCounters() *counters {
+	return &counters{counts: make(map[string]map[Stage]int64)}
+}
+
+func (c *counters) record(name string, stage Stage) {
+	c.Lock()
+	defer c.Unlock()
+
+	stageCounts, ok := c.counts[name]
+	if !ok {
+		stageCounts = make(map[Stage]int64)
+		c.counts[name] = stageCounts
+	}
+	stageCounts[stage]++
+}
+
+func (c *counters) snapshot() []ZoneFunnel {
+	c.Lock()
+	defer c.Unlock()
+
+	result := make([]ZoneFunnel, 0, len(c.counts))
+	for name, stageCounts := range c.counts {
+		counts := make(map[Stage]int64, len(stageCounts))
+		for stage, n := range stageCounts {
+			counts[stage] = n
+		}
+		result = append(result, ZoneFunnel{name, counts})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Zone < result[j].Zone
+	})
+
+	return result
+}
+
+var (
+	zones    = newCounters()
+	variants = newCounters()
+)
+
+func Record(zone string, stage Stage) {
+	zones.record(zone, stage)
+}
+
+// Funnel returns a copy of the per zone counters sorted by zone name.
+func Funnel() []ZoneFunnel {
+	return zones.snapshot()
+}
+
+// RecordVariant counts a funnel stage for an experiment variant label.
+func RecordVariant(label string, stage Stage) {
+	variants.record(label, stage)
+}
+
+// Variants returns a copy of the experiment counters sorted by label.
+func Variants() []ZoneFunnel {
+	return variants.snapshot()
+}
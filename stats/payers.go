@@ -0,0 +1,165 @@
+package stats
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"ljightningparking/clock"
+	"ljightningparking/parking"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PayerCount is how many different payers paid in a day or a week.
+type PayerCount struct {
+	Start  time.Time `json:"start"`
+	Payers int       `json:"payers"`
+}
+
+// payerPeriod tells payers apart within one day or week by an HMAC of their
+// plate keyed with a random salt. Only the count is kept once the period is
+// over, the salt and identifiers are dropped, so nothing links a payer across
+// periods or back to a plate afterwards. The salt is never written to disk.
+type payerPeriod struct {
+	start time.Time
+	salt  []byte
+	ids   map[string]bool
+	// carried is the count saved before a restart, whose payers can't be
+	// told apart from the ones since.
+	carried int
+}
+
+// count is the payers of the period. Across a restart it is the larger of
+// the counts before and after, undercounting rather than counting a payer
+// twice.
+func (p *payerPeriod) count() int {
+	if p.carried > len(p.ids) {
+		return p.carried
+	}
+	return len(p.ids)
+}
+
+type payerCounter struct {
+	// start returns the start of the period t is in.
+	start   func(t time.Time) time.Time
+	keep    int
+	current *payerPeriod
+	// history holds the counts of the past periods, oldest first.
+	history []PayerCount
+	sync.Mutex
+}
+
+// startOfDay is the local midnight starting t's day, days are cut where the
+// parking is rather than in UTC.
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.In(parking.Location).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, parking.Location)
+}
+
+// startOfWeek is the Monday starting t's ISO week.
+func startOfWeek(t time.Time) time.Time {
+	day := startOfDay(t)
+	return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+}
+
+var (
+	dailyPayers  = &payerCounter{start: startOfDay, keep: 90}
+	weeklyPayers = &payerCounter{start: startOfWeek, keep: 52}
+)
+
+// RecordPayer counts the payer of a paid invoice towards the unique payers of
+// the day and the week.
+func RecordPayer(plate string) {
+	now := clock.Now()
+	dailyPayers.record(plate, now)
+	weeklyPayers.record(plate, now)
+}
+
+// DailyPayers returns the unique payers of the last days, newest first.
+func DailyPayers() []PayerCount {
+	return dailyPayers.counts(clock.Now())
+}
+
+// WeeklyPayers returns the unique payers of the last weeks, newest first.
+func WeeklyPayers() []PayerCount {
+	return weeklyPayers.counts(clock.Now())
+}
+
+func (c *payerCounter) record(plate string, now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.rotate(now)
+	mac := hmac.New(sha256.New, c.current.salt)
+	mac.Write([]byte(strings.ToUpper(plate)))
+	c.current.ids[hex.EncodeToString(mac.Sum(nil)[:8])] = true
+}
+
+// rotate starts a new period with a new salt once now is past the current
+// one, keeping only the count of the finished one. The caller holds the lock.
+func (c *payerCounter) rotate(now time.Time) {
+	start := c.start(now)
+	if c.current != nil && c.current.start.Equal(start) {
+		return
+	}
+
+	if c.current != nil {
+		c.history = append(c.history, PayerCount{c.current.start, c.current.count()})
+		if len(c.history) > c.keep {
+			c.history = c.history[len(c.history)-c.keep:]
+		}
+	}
+
+	c.current = newPayerPeriod(start)
+}
+
+func newPayerPeriod(start time.Time) *payerPeriod {
+	salt := make([]byte, 32)
+	rand.Read(salt)
+	return &payerPeriod{start: start, salt: salt, ids: make(map[string]bool)}
+}
+
+func (c *payerCounter) counts(now time.Time) []PayerCount {
+	c.Lock()
+	defer c.Unlock()
+
+	c.rotate(now)
+	counts := []PayerCount{{c.current.start, c.current.count()}}
+	for i := len(c.history) - 1; i >= 0; i-- {
+		counts = append(counts, c.history[i])
+	}
+	return counts
+}
+
+// payerState is the persisted form of a payerCounter, only counts.
+type payerState struct {
+	Current *PayerCount  `json:"current,omitempty"`
+	History []PayerCount `json:"history,omitempty"`
+}
+
+func (c *payerCounter) state() payerState {
+	c.Lock()
+	defer c.Unlock()
+
+	c.rotate(clock.Now())
+	current := PayerCount{c.current.start, c.current.count()}
+	return payerState{&current, append([]PayerCount(nil), c.history...)}
+}
+
+// restore takes over the state saved by the previous run. It must only be
+// called at startup, before payers are recorded.
+func (c *payerCounter) restore(s payerState) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.history = append(s.History, c.history...)
+	if s.Current != nil {
+		// with a fresh salt, going on from the saved count
+		c.current = newPayerPeriod(s.Current.Start)
+		c.current.carried = s.Current.Payers
+	}
+	// counts a saved period that ended while stopped
+	c.rotate(clock.Now())
+}
@@ -0,0 +1,118 @@
+package stats
+
+import (
+	"encoding/json"
+	"ljightningparking/store"
+	"sync"
+)
+
+const snapshotSetting = "stats_snapshot"
+
+var totals struct {
+	payments int64
+	sats     int64
+	sync.Mutex
+}
+
+// RecordPayment counts a paid invoice towards the all time totals.
+func RecordPayment(sats int64) {
+	totals.Lock()
+	defer totals.Unlock()
+
+	totals.payments++
+	totals.sats += sats
+}
+
+// Totals returns the number of payments and the sats paid in all time.
+func Totals() (int64, int64) {
+	totals.Lock()
+	defer totals.Unlock()
+
+	return totals.payments, totals.sats
+}
+
+// snapshot is the persisted form of the counters.
+type snapshot struct {
+	Zones    map[string]map[Stage]int64 `json:"zones"`
+	Variants map[string]map[Stage]int64 `json:"variants"`
+	Payments int64                      `json:"payments"`
+	Sats     int64                      `json:"sats"`
+	Daily    payerState                 `json:"daily_payers"`
+	Weekly   payerState                 `json:"weekly_payers"`
+}
+
+// Save persists the counters, so they survive a restart. It is a no-op
+// without a database.
+func Save() error {
+	if store.DB == nil {
+		return nil
+	}
+
+	s := snapshot{Zones: zones.copy(), Variants: variants.copy(), Daily: dailyPayers.state(), Weekly: weeklyPayers.state()}
+	s.Payments, s.Sats = Totals()
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return store.SetSetting(snapshotSetting, string(data))
+}
+
+// Load adds the counters saved by the previous run to the current ones. It
+// must only be called once, at startup.
+func Load() error {
+	if store.DB == nil {
+		return nil
+	}
+
+	data, err := store.GetSetting(snapshotSetting, "")
+	if err != nil || len(data) == 0 {
+		return err
+	}
+
+	var s snapshot
+	err = json.Unmarshal([]byte(data), &s)
+	if err != nil {
+		return err
+	}
+
+	zones.merge(s.Zones)
+	variants.merge(s.Variants)
+	dailyPayers.restore(s.Daily)
+	weeklyPayers.restore(s.Weekly)
+
+	totals.Lock()
+	totals.payments += s.Payments
+	totals.sats += s.Sats
+	totals.Unlock()
+
+	return nil
+}
+
+func (c *counters) copy() map[string]map[Stage]int64 {
+	c.Lock()
+	defer c.Unlock()
+
+	result := make(map[string]map[Stage]int64, len(c.counts))
+	for name, stageCounts := range c.counts {
+		result[name] = make(map[Stage]int64, len(stageCounts))
+		for stage, n := range stageCounts {
+			result[name][stage] = n
+		}
+	}
+	return result
+}
+
+func (c *counters) merge(counts map[string]map[Stage]int64) {
+	c.Lock()
+	defer c.Unlock()
+
+	for name, stageCounts := range counts {
+		if c.counts[name] == nil {
+			c.counts[name] = make(map[Stage]int64)
+		}
+		for stage, n := range stageCounts {
+			c.counts[name][stage] += n
+		}
+	}
+}
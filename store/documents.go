@@ -0,0 +1,21 @@
+package store
+
+import "ljightningparking/clock"
+
+// InsertOrderDocument stores the canonical order json an invoice's
+// description hash commits to.
+func InsertOrderDocument(hash, paymentHash string, document []byte) error {
+	if DB == nil {
+		return nil
+	}
+
+	_, err := Exec("INSERT INTO order_documents (hash, payment_hash, document, created_at) VALUES (?, ?, ?, ?)",
+		hash, paymentHash, string(document), clock.Now())
+	return err
+}
+
+func GetOrderDocument(hash string) ([]byte, error) {
+	var document string
+	err := QueryRow("SELECT document FROM order_documents WHERE hash = ?", hash).Scan(&document)
+	return []byte(document), err
+}
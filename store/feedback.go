@@ -0,0 +1,65 @@
+package store
+
+import (
+	"database/sql"
+	"ljightningparking/clock"
+	"time"
+)
+
+// Feedback is what a user reported from the purchase flow.
+type Feedback struct {
+	ID      int64  `json:"id"`
+	Message string `json:"message"`
+	Contact string `json:"contact,omitempty"`
+	// Page is where in the flow the feedback was sent from.
+	Page       string       `json:"page,omitempty"`
+	CreatedAt  time.Time    `json:"created_at"`
+	ResolvedBy string       `json:"resolved_by,omitempty"`
+	ResolvedAt sql.NullTime `json:"-"`
+}
+
+func InsertFeedback(f Feedback) error {
+	_, err := Exec("INSERT INTO feedback (message, contact, page, created_at) VALUES (?, ?, ?, ?)",
+		f.Message, f.Contact, f.Page, clock.Now())
+	return err
+}
+
+// ListFeedback returns the latest feedback, newest first, leaving out the
+// resolved unless all is set.
+func ListFeedback(all bool, limit int) ([]Feedback, error) {
+	query := "SELECT id, message, contact, page, created_at, resolved_by, resolved_at FROM feedback"
+	if !all {
+		query += " WHERE resolved_at IS NULL"
+	}
+	rows, err := Query(query+" ORDER BY id DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var feedback []Feedback
+	for rows.Next() {
+		var f Feedback
+		err = rows.Scan(&f.ID, &f.Message, &f.Contact, &f.Page, &f.CreatedAt, &f.ResolvedBy, &f.ResolvedAt)
+		if err != nil {
+			return nil, err
+		}
+		feedback = append(feedback, f)
+	}
+	return feedback, rows.Err()
+}
+
+// ResolveFeedback marks feedback as dealt with by admin.
+func ResolveFeedback(id int64, admin string) error {
+	_, err := Exec("UPDATE feedback SET resolved_by = ?, resolved_at = ? WHERE id = ? AND resolved_at IS NULL", admin, clock.Now(), id)
+	return err
+}
+
+// PruneFeedback deletes feedback resolved more than 90 days ago.
+func PruneFeedback(db *sql.DB, now time.Time) (int64, error) {
+	result, err := execLocked(db, "DELETE FROM feedback WHERE resolved_at < ?", now.AddDate(0, 0, -90))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,353 @@
+package store
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ljightningparking/clock"
+	"sync"
+	"time"
+)
+
+// Journal records every write in the replication log, for a standby to
+// replay. It is set before the database is written to.
+var Journal bool
+
+// JournalEntry is a write as a standby replays it.
+type JournalEntry struct {
+	Seq       int64           `json:"seq"`
+	Statement string          `json:"statement"`
+	Args      json.RawMessage `json:"args"`
+	CreatedAt int64           `json:"createdAt"`
+}
+
+// ErrJournalPruned is returned for entries that were pruned from the log, a
+// standby that far behind has to start over from a snapshot. So does one
+// ahead of the log, it followed a primary that was since restored.
+var ErrJournalPruned = errors.New("replication log was pruned past the requested entry")
+
+// journal notifies followers waiting for new entries.
+var journal = struct {
+	changed chan struct{}
+	sync.Mutex
+}{changed: make(chan struct{})}
+
+// published wakes the followers waiting for new entries.
+func published() {
+	journal.Lock()
+	defer journal.Unlock()
+
+	close(journal.changed)
+	journal.changed = make(chan struct{})
+}
+
+// execLocked runs a write while the caller holds the writer lock, recording
+// it in the replication log in the same transaction when journaling.
+func execLocked(db *sql.DB, query string, args ...interface{}) (sql.Result, error) {
+	args = normalize(args)
+	if !Journal {
+		return db.Exec(query, args...)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	result, err := tx.Exec(query, args...)
+	if err == nil {
+		err = journalEntry(tx, query, args)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	published()
+	return result, nil
+}
+
+// journalEntry records a write in the replication log within its transaction.
+func journalEntry(tx *sql.Tx, query string, args []interface{}) error {
+	encoded, err := encodeArgs(args)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO replication_log (statement, args, created_at) VALUES (?, ?, ?)", query, encoded, clock.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("replication log: %s", err)
+	}
+	return nil
+}
+
+// Tx is a transaction of several writes, see Transaction.
+type Tx struct {
+	tx        *sql.Tx
+	journaled bool
+}
+
+// Exec runs a write in the transaction, recording it in the replication log
+// when journaling.
+func (t *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	args = normalize(args)
+	result, err := t.tx.Exec(query, args...)
+	if err != nil || !Journal {
+		return result, err
+	}
+	err = journalEntry(t.tx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	t.journaled = true
+	return result, nil
+}
+
+// QueryRow reads within the transaction.
+func (t *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return t.tx.QueryRow(query, normalize(args)...)
+}
+
+// Transaction runs fn's writes at once, committing them unless it returns
+// an error.
+func Transaction(fn func(tx *Tx) error) error {
+	writer.Lock()
+	defer writer.Unlock()
+
+	sqlTx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	tx := &Tx{tx: sqlTx}
+	err = fn(tx)
+	if err != nil {
+		sqlTx.Rollback()
+		return err
+	}
+	err = sqlTx.Commit()
+	if err == nil && tx.journaled {
+		published()
+	}
+	return err
+}
+
+// JournalSeq is the latest entry ever written to the replication log, even
+// if it was pruned since, 0 when there was none.
+func JournalSeq() (int64, error) {
+	var seq int64
+	err := DB.QueryRow("SELECT COALESCE((SELECT seq FROM sqlite_sequence WHERE name = 'replication_log'), 0)").Scan(&seq)
+	return seq, err
+}
+
+// JournalSince returns up to limit entries after seq, waiting up to wait for
+// the first one if there are none yet, or until done is closed.
+func JournalSince(after int64, limit int, wait time.Duration, done <-chan struct{}) ([]JournalEntry, error) {
+	// the latest first, entries written in between only raise the oldest
+	last, err := JournalSeq()
+	if err != nil {
+		return nil, err
+	}
+	var first sql.NullInt64
+	err = DB.QueryRow("SELECT MIN(seq) FROM replication_log").Scan(&first)
+	if err != nil {
+		return nil, err
+	}
+	if after > last || after < last && (!first.Valid || after < first.Int64-1) {
+		return nil, ErrJournalPruned
+	}
+
+	journal.Lock()
+	changed := journal.changed
+	journal.Unlock()
+
+	entries, err := journalEntries(after, limit)
+	if err != nil || len(entries) > 0 || wait <= 0 {
+		return entries, err
+	}
+
+	select {
+	case <-changed:
+	case <-clock.After(wait):
+	case <-done:
+	}
+	return journalEntries(after, limit)
+}
+
+func journalEntries(after int64, limit int) ([]JournalEntry, error) {
+	rows, err := DB.Query("SELECT seq, statement, args, created_at FROM replication_log WHERE seq > ? ORDER BY seq LIMIT ?", after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []JournalEntry
+	for rows.Next() {
+		var e JournalEntry
+		var args string
+		err = rows.Scan(&e.Seq, &e.Statement, &args, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		e.Args = json.RawMessage(args)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// ApplyJournal replays entries from the primary in one transaction, keeping
+// them in the local replication log so a promoted standby carries on from
+// the same sequence.
+func ApplyJournal(entries []JournalEntry) error {
+	writer.Lock()
+	defer writer.Unlock()
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		args, err := decodeArgs(e.Args)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("entry %d: %s", e.Seq, err)
+		}
+		_, err = tx.Exec(e.Statement, normalize(args)...)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("entry %d: %s", e.Seq, err)
+		}
+		_, err = tx.Exec("INSERT INTO replication_log (seq, statement, args, created_at) VALUES (?, ?, ?, ?)",
+			e.Seq, e.Statement, string(e.Args), e.CreatedAt)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("entry %d: %s", e.Seq, err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	if len(entries) > 0 {
+		published()
+	}
+	return nil
+}
+
+// Snapshot writes a consistent copy of the database to path and returns the
+// latest replication log entry it contains.
+func Snapshot(path string) (int64, error) {
+	writer.Lock()
+	defer writer.Unlock()
+
+	_, err := DB.Exec("VACUUM INTO ?", path)
+	if err != nil {
+		return 0, err
+	}
+	return JournalSeq()
+}
+
+// PruneJournal drops replication log entries older than a week, standbys
+// that far behind start over from a snapshot.
+func PruneJournal(db *sql.DB, now time.Time) (int64, error) {
+	result, err := execLocked(db, "DELETE FROM replication_log WHERE created_at < ?", now.AddDate(0, 0, -7).Unix())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// arg is a statement argument with its type, as json has no times or bytes.
+type arg struct {
+	Type  string      `json:"t"`
+	Value interface{} `json:"v"`
+}
+
+func encodeArgs(args []interface{}) (string, error) {
+	encoded := make([]arg, len(args))
+	for i, a := range args {
+		v, err := driver.DefaultParameterConverter.ConvertValue(a)
+		if err != nil {
+			return "", fmt.Errorf("argument %d: %s", i+1, err)
+		}
+		switch v := v.(type) {
+		case nil:
+			encoded[i] = arg{Type: "null"}
+		case int64:
+			encoded[i] = arg{"int", v}
+		case float64:
+			encoded[i] = arg{"float", v}
+		case bool:
+			encoded[i] = arg{"bool", v}
+		case string:
+			encoded[i] = arg{"string", v}
+		case []byte:
+			encoded[i] = arg{"bytes", base64.StdEncoding.EncodeToString(v)}
+		case time.Time:
+			encoded[i] = arg{"time", v.Format(time.RFC3339Nano)}
+		default:
+			return "", fmt.Errorf("argument %d: unsupported type %T", i+1, v)
+		}
+	}
+
+	data, err := json.Marshal(encoded)
+	return string(data), err
+}
+
+func decodeArgs(data []byte) ([]interface{}, error) {
+	var encoded []struct {
+		Type  string          `json:"t"`
+		Value json.RawMessage `json:"v"`
+	}
+	err := json.Unmarshal(data, &encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]interface{}, len(encoded))
+	for i, a := range encoded {
+		switch a.Type {
+		case "null":
+			args[i] = nil
+		case "int":
+			var v int64
+			err = json.Unmarshal(a.Value, &v)
+			args[i] = v
+		case "float":
+			var v float64
+			err = json.Unmarshal(a.Value, &v)
+			args[i] = v
+		case "bool":
+			var v bool
+			err = json.Unmarshal(a.Value, &v)
+			args[i] = v
+		case "string":
+			var v string
+			err = json.Unmarshal(a.Value, &v)
+			args[i] = v
+		case "bytes":
+			var v string
+			err = json.Unmarshal(a.Value, &v)
+			if err == nil {
+				args[i], err = base64.StdEncoding.DecodeString(v)
+			}
+		case "time":
+			var v string
+			err = json.Unmarshal(a.Value, &v)
+			if err == nil {
+				args[i], err = time.Parse(time.RFC3339Nano, v)
+			}
+		default:
+			err = fmt.Errorf("unknown type %s", a.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("argument %d: %s", i+1, err)
+		}
+	}
+	return args, nil
+}
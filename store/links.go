@@ -0,0 +1,82 @@
+package store
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"ljightningparking/clock"
+	"math/big"
+	"time"
+)
+
+const (
+	linkAlphabet   = "23456789abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ"
+	linkCodeLength = 7
+)
+
+// ShortLink points a short code at a longer url until it expires.
+type ShortLink struct {
+	Code   string
+	Target string
+	// ExpiresAt is a unix time, 0 for links that never expire.
+	ExpiresAt int64
+}
+
+func (l ShortLink) Expired() bool {
+	return l.ExpiresAt > 0 && clock.Now().Unix() > l.ExpiresAt
+}
+
+// CreateShortLink stores a new short link to target, expiring with the
+// resource it points at. A zero expiresAt never expires.
+func CreateShortLink(target string, expiresAt time.Time) (ShortLink, error) {
+	link := ShortLink{Target: target}
+	if !expiresAt.IsZero() {
+		link.ExpiresAt = expiresAt.Unix()
+	}
+
+	for attempt := 0; attempt < 5; attempt++ {
+		code, err := linkCode()
+		if err != nil {
+			return link, err
+		}
+
+		result, err := Exec("INSERT OR IGNORE INTO short_links (code, target, expires_at, created_at) VALUES (?, ?, ?, ?)",
+			code, target, link.ExpiresAt, clock.Now())
+		if err != nil {
+			return link, err
+		}
+		if n, _ := result.RowsAffected(); n == 1 {
+			link.Code = code
+			return link, nil
+		}
+	}
+	return link, errors.New("no free short link code")
+}
+
+func GetShortLink(code string) (ShortLink, error) {
+	link := ShortLink{Code: code}
+	err := QueryRow("SELECT target, expires_at FROM short_links WHERE code = ?", code).Scan(&link.Target, &link.ExpiresAt)
+	return link, err
+}
+
+// PruneShortLinks deletes links that expired over a day ago, so for a while
+// they still answer as expired rather than unknown.
+func PruneShortLinks(db *sql.DB, now time.Time) (int64, error) {
+	result, err := execLocked(db, "DELETE FROM short_links WHERE expires_at > 0 AND expires_at < ?", now.Add(-24*time.Hour).Unix())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func linkCode() (string, error) {
+	code := make([]byte, linkCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(linkAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		code[i] = linkAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
@@ -0,0 +1,207 @@
+package store
+
+// migrations are applied in order and must never be edited once released,
+// only appended to.
+var migrations = []string{
+	`CREATE TABLE admin_users (
+		id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL,
+		totp_secret TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE orders (
+		payment_hash TEXT PRIMARY KEY,
+		payment_request TEXT NOT NULL,
+		zone TEXT NOT NULL,
+		plate TEXT NOT NULL,
+		hours INTEGER NOT NULL,
+		sats INTEGER NOT NULL,
+		eur REAL NOT NULL,
+		state TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX orders_plate ON orders (plate);
+	CREATE INDEX orders_zone_created ON orders (zone, created_at);
+	CREATE INDEX orders_state_created ON orders (state, created_at);
+	CREATE INDEX orders_created ON orders (created_at)`,
+	`ALTER TABLE orders ADD COLUMN tag TEXT NOT NULL DEFAULT '';
+	CREATE INDEX orders_tag ON orders (tag);
+	CREATE TABLE order_notes (
+		id INTEGER PRIMARY KEY,
+		payment_hash TEXT NOT NULL REFERENCES orders (payment_hash),
+		author TEXT NOT NULL,
+		body TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX order_notes_hash ON order_notes (payment_hash)`,
+	`ALTER TABLE orders ADD COLUMN expires_at INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE orders ADD COLUMN receipt TEXT NOT NULL DEFAULT '';
+	ALTER TABLE orders ADD COLUMN sms_attempts INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE orders ADD COLUMN sms_error TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE settings (
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	)`,
+	`ALTER TABLE orders ADD COLUMN reply TEXT NOT NULL DEFAULT '';
+	ALTER TABLE orders ADD COLUMN valid_until TIMESTAMP;
+	ALTER TABLE orders ADD COLUMN operator_price_eur REAL NOT NULL DEFAULT 0;
+	CREATE INDEX orders_payment_request ON orders (payment_request);
+	CREATE TABLE balance_log (
+		id INTEGER PRIMARY KEY,
+		balance_eur REAL NOT NULL,
+		source TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE order_documents (
+		hash TEXT PRIMARY KEY,
+		payment_hash TEXT NOT NULL,
+		document TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`ALTER TABLE orders ADD COLUMN preimage TEXT NOT NULL DEFAULT '';
+	ALTER TABLE orders ADD COLUMN settled INTEGER NOT NULL DEFAULT 0`,
+	`CREATE TABLE short_links (
+		code TEXT PRIMARY KEY,
+		target TEXT NOT NULL,
+		expires_at INTEGER NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE sms_queue (
+		id INTEGER PRIMARY KEY,
+		ref TEXT NOT NULL,
+		message TEXT NOT NULL,
+		state TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		next_attempt_at INTEGER NOT NULL,
+		deadline INTEGER NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX sms_queue_ref ON sms_queue (ref);
+	CREATE INDEX sms_queue_state ON sms_queue (state)`,
+	`ALTER TABLE orders ADD COLUMN product TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE parking_sessions (
+		plate TEXT NOT NULL,
+		zone TEXT NOT NULL,
+		started_at INTEGER NOT NULL,
+		paid_until INTEGER NOT NULL,
+		hours REAL NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (plate, zone)
+	)`,
+	`ALTER TABLE sms_queue ADD COLUMN recipient TEXT NOT NULL DEFAULT '';
+	CREATE TABLE test_steps (
+		id INTEGER PRIMARY KEY,
+		payment_hash TEXT NOT NULL,
+		step TEXT NOT NULL,
+		detail TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	);
+	CREATE INDEX test_steps_payment_hash ON test_steps (payment_hash)`,
+	`CREATE TABLE replication_log (
+		seq INTEGER PRIMARY KEY,
+		statement TEXT NOT NULL,
+		args TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	)`,
+	`ALTER TABLE orders ADD COLUMN paid_at TIMESTAMP;
+	ALTER TABLE orders ADD COLUMN sms_sent_at TIMESTAMP`,
+	// times were stored in the zone they had, as the driver formats them
+	`UPDATE admin_users SET created_at = strftime('%Y-%m-%dT%H:%M:%fZ', created_at);
+	UPDATE orders SET created_at = strftime('%Y-%m-%dT%H:%M:%fZ', created_at),
+		updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', updated_at),
+		valid_until = strftime('%Y-%m-%dT%H:%M:%fZ', valid_until),
+		paid_at = strftime('%Y-%m-%dT%H:%M:%fZ', paid_at),
+		sms_sent_at = strftime('%Y-%m-%dT%H:%M:%fZ', sms_sent_at);
+	UPDATE order_notes SET created_at = strftime('%Y-%m-%dT%H:%M:%fZ', created_at);
+	UPDATE balance_log SET created_at = strftime('%Y-%m-%dT%H:%M:%fZ', created_at);
+	UPDATE order_documents SET created_at = strftime('%Y-%m-%dT%H:%M:%fZ', created_at);
+	UPDATE short_links SET created_at = strftime('%Y-%m-%dT%H:%M:%fZ', created_at);
+	UPDATE sms_queue SET created_at = strftime('%Y-%m-%dT%H:%M:%fZ', created_at),
+		updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', updated_at);
+	UPDATE parking_sessions SET updated_at = strftime('%Y-%m-%dT%H:%M:%fZ', updated_at);
+	UPDATE test_steps SET created_at = strftime('%Y-%m-%dT%H:%M:%fZ', created_at)`,
+	`CREATE TABLE revenue_shares (
+		payment_hash TEXT NOT NULL,
+		recipient TEXT NOT NULL,
+		zone TEXT NOT NULL,
+		eur_cents INTEGER NOT NULL,
+		sats INTEGER NOT NULL,
+		settled_at TIMESTAMP NOT NULL,
+		delivered INTEGER NOT NULL DEFAULT 0,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		batch INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (payment_hash, recipient)
+	);
+	CREATE INDEX revenue_shares_recipient_batch ON revenue_shares (recipient, batch);
+	CREATE TABLE payout_batches (
+		id INTEGER PRIMARY KEY,
+		recipient TEXT NOT NULL,
+		eur_cents INTEGER NOT NULL DEFAULT 0,
+		sats INTEGER NOT NULL DEFAULT 0,
+		shares INTEGER NOT NULL DEFAULT 0,
+		created_by TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE feedback (
+		id INTEGER PRIMARY KEY,
+		message TEXT NOT NULL,
+		contact TEXT NOT NULL DEFAULT '',
+		page TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL,
+		resolved_by TEXT NOT NULL DEFAULT '',
+		resolved_at TIMESTAMP
+	)`,
+	`ALTER TABLE orders ADD COLUMN amt_paid_sat INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE orders ADD COLUMN overpayment_refunded INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE orders ADD COLUMN reply_followup INTEGER NOT NULL DEFAULT 0`,
+	`CREATE TABLE api_tokens (
+		id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		token_hash TEXT NOT NULL UNIQUE,
+		scopes TEXT NOT NULL,
+		created_by TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		revoked_at TIMESTAMP,
+		last_used_at TIMESTAMP
+	)`,
+	// sequence numbers of pruned entries were handed out again after a restart
+	`CREATE TABLE replication_log_seq (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		statement TEXT NOT NULL,
+		args TEXT NOT NULL,
+		created_at INTEGER NOT NULL
+	);
+	INSERT INTO replication_log_seq (seq, statement, args, created_at)
+		SELECT seq, statement, args, created_at FROM replication_log;
+	DROP TABLE replication_log;
+	ALTER TABLE replication_log_seq RENAME TO replication_log`,
+	// a refunded payment's share is reversed by a negative one
+	`CREATE TABLE revenue_shares_reversal (
+		payment_hash TEXT NOT NULL,
+		recipient TEXT NOT NULL,
+		reversal INTEGER NOT NULL DEFAULT 0,
+		zone TEXT NOT NULL,
+		eur_cents INTEGER NOT NULL,
+		sats INTEGER NOT NULL,
+		settled_at TIMESTAMP NOT NULL,
+		delivered INTEGER NOT NULL DEFAULT 0,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		batch INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (payment_hash, recipient, reversal)
+	);
+	INSERT INTO revenue_shares_reversal (payment_hash, recipient, zone, eur_cents, sats, settled_at, delivered, attempts, last_error, batch)
+		SELECT payment_hash, recipient, zone, eur_cents, sats, settled_at, delivered, attempts, last_error, batch FROM revenue_shares;
+	DROP TABLE revenue_shares;
+	ALTER TABLE revenue_shares_reversal RENAME TO revenue_shares;
+	CREATE INDEX revenue_shares_recipient_batch ON revenue_shares (recipient, batch)`,
+	`ALTER TABLE admin_users ADD COLUMN totp_step INTEGER NOT NULL DEFAULT 0`,
+	// orders paid before operator replies were followed up are not chased
+	`INSERT OR IGNORE INTO settings (key, value) VALUES ('reply_followup_since', strftime('%Y-%m-%dT%H:%M:%fZ', 'now'))`,
+}
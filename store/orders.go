@@ -0,0 +1,536 @@
+package store
+
+import (
+	"database/sql"
+	"ljightningparking/clock"
+	"strings"
+	"time"
+)
+
+type OrderState string
+
+const (
+	OrderPending   OrderState = "pending"
+	OrderPaid      OrderState = "paid"
+	OrderConfirmed OrderState = "confirmed"
+	OrderSmsFailed OrderState = "sms_failed"
+	OrderExpired   OrderState = "expired"
+	OrderRefunded  OrderState = "refunded"
+	// OrderRefundOwed means the settled payment is to be returned to the
+	// user, it becomes OrderRefunded once an admin records the refund.
+	OrderRefundOwed OrderState = "refund_owed"
+	// OrderRejected means SMS parking refused the purchase in its reply.
+	OrderRejected OrderState = "rejected"
+	// OrderAccepted means the user's payment is held by lnd but not settled
+	// until the parking SMS goes through.
+	OrderAccepted OrderState = "accepted"
+	// OrderCancelled means the held payment was returned to the user.
+	OrderCancelled OrderState = "cancelled"
+)
+
+var OrderStates = []OrderState{OrderPending, OrderAccepted, OrderPaid, OrderConfirmed, OrderSmsFailed, OrderExpired, OrderRefundOwed, OrderRefunded, OrderRejected, OrderCancelled}
+
+// Tags are set by admins working a support request about an order.
+const (
+	TagInvestigating = "investigating"
+	TagRefunded      = "refunded"
+	TagUserError     = "user-error"
+)
+
+var OrderTags = []string{TagInvestigating, TagRefunded, TagUserError}
+
+// Follow-ups of a parking SMS the operator did not reply to in time, first
+// asking for the balance to see the operator answers at all, then alerting
+// the admins.
+const (
+	FollowupInquired  = 1
+	FollowupEscalated = 2
+)
+
+// Order is a parking purchase, from invoice creation to the parking SMS.
+type Order struct {
+	PaymentHash    string
+	PaymentRequest string
+	Zone           string
+	Plate          string
+	Hours          float64
+	Sats           int64
+	Eur            float64
+	State          OrderState
+	Tag            string
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	// ExpiresAt is when the unpaid invoice expires, in unix seconds.
+	ExpiresAt int64
+	// Receipt is the signed purchase terms as json.
+	Receipt     string
+	SmsAttempts int
+	SmsError    string
+	// Reply is the kind of the operator's reply SMS, empty until it arrives.
+	Reply            string
+	ValidUntil       sql.NullTime
+	OperatorPriceEur float64
+	// Preimage is the hex preimage of a hold invoice, needed to settle it.
+	Preimage string
+	// Settled is set once a hold invoice's payment is claimed.
+	Settled bool
+	// Product is the catalogue product bought, empty for hourly parking in
+	// Zone.
+	Product string
+	// PaidAt is when the payment arrived, and SmsSentAt when the parking SMS
+	// first went out.
+	PaidAt    sql.NullTime
+	SmsSentAt sql.NullTime
+	// AmtPaidSat is what lnd reported paid, once it was checked against
+	// Sats. OverpaymentRefunded is set once an admin sent the excess back.
+	AmtPaidSat          int64
+	OverpaymentRefunded bool
+	// ReplyFollowup is how far a missing operator reply was followed up.
+	ReplyFollowup int
+}
+
+// Reference is the short reference users quote to support, the start of the
+// payment hash.
+func (o Order) Reference() string {
+	if len(o.PaymentHash) < 8 {
+		return strings.ToUpper(o.PaymentHash)
+	}
+	return strings.ToUpper(o.PaymentHash[:8])
+}
+
+// Overpaid is how many sats more than the invoice asked for were paid.
+func (o Order) Overpaid() int64 {
+	if o.AmtPaidSat <= o.Sats {
+		return 0
+	}
+	return o.AmtPaidSat - o.Sats
+}
+
+// Received is how many sats the payer paid for the order and did not get
+// back yet.
+func (o Order) Received() int64 {
+	if o.AmtPaidSat <= 0 {
+		return o.Sats
+	}
+	if o.OverpaymentRefunded {
+		return o.AmtPaidSat - o.Overpaid()
+	}
+	return o.AmtPaidSat
+}
+
+// InvoiceSettled reports whether the order's payment was claimed. Hold
+// invoices are only settled once the parking SMS went out.
+func (o Order) InvoiceSettled() bool {
+	switch o.State {
+	case OrderPending, OrderExpired, OrderAccepted, OrderCancelled:
+		return false
+	}
+	return len(o.Preimage) == 0 || o.Settled
+}
+
+type OrderNote struct {
+	Author    string
+	Body      string
+	CreatedAt time.Time
+}
+
+const orderColumns = "payment_hash, payment_request, zone, plate, hours, sats, eur, state, tag, created_at, updated_at, expires_at, receipt, sms_attempts, sms_error, reply, valid_until, operator_price_eur, preimage, settled, product, paid_at, sms_sent_at, amt_paid_sat, overpayment_refunded, reply_followup"
+
+// InsertOrder records a new order. It is a no-op without a database.
+func InsertOrder(o Order) error {
+	if DB == nil {
+		return nil
+	}
+
+	now := clock.Now()
+	_, err := Exec("INSERT INTO orders ("+orderColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		o.PaymentHash, o.PaymentRequest, o.Zone, strings.ToUpper(o.Plate), o.Hours, o.Sats, o.Eur, o.State, o.Tag, now, now,
+		o.ExpiresAt, o.Receipt, o.SmsAttempts, o.SmsError, o.Reply, o.ValidUntil, o.OperatorPriceEur, o.Preimage, o.Settled, o.Product,
+		o.PaidAt, o.SmsSentAt, o.AmtPaidSat, o.OverpaymentRefunded, o.ReplyFollowup)
+	return err
+}
+
+// SetOrderState moves an order to state, recording when it was paid the
+// first time it moves to OrderPaid or OrderAccepted.
+func SetOrderState(paymentHash string, state OrderState) error {
+	if DB == nil {
+		return nil
+	}
+
+	now := clock.Now()
+	if state == OrderPaid || state == OrderAccepted {
+		_, err := Exec("UPDATE orders SET state = ?, paid_at = COALESCE(paid_at, ?), updated_at = ? WHERE payment_hash = ?", state, now, now, paymentHash)
+		return err
+	}
+	_, err := Exec("UPDATE orders SET state = ?, updated_at = ? WHERE payment_hash = ?", state, now, paymentHash)
+	return err
+}
+
+// SetOrderRefunded moves an order owed a refund to refunded, reporting
+// whether it was owed one.
+func SetOrderRefunded(paymentHash string) (bool, error) {
+	result, err := Exec("UPDATE orders SET state = ?, updated_at = ? WHERE payment_hash = ? AND state = ?",
+		OrderRefunded, clock.Now(), paymentHash, OrderRefundOwed)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// SetOrderAmountPaid records what lnd reported paid for an order's invoice.
+func SetOrderAmountPaid(paymentHash string, amtPaidSat int64) error {
+	if DB == nil {
+		return nil
+	}
+
+	_, err := Exec("UPDATE orders SET amt_paid_sat = ?, updated_at = ? WHERE payment_hash = ?", amtPaidSat, clock.Now(), paymentHash)
+	return err
+}
+
+// SetOverpaymentRefunded records that an order's overpayment was returned,
+// reporting whether it wasn't already.
+func SetOverpaymentRefunded(paymentHash string) (bool, error) {
+	if DB == nil {
+		return false, nil
+	}
+
+	result, err := Exec("UPDATE orders SET overpayment_refunded = 1, updated_at = ? WHERE payment_hash = ? AND amt_paid_sat > sats AND overpayment_refunded = 0",
+		clock.Now(), paymentHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// SetOrderSettled records that a hold invoice was settled or cancelled. A
+// cancelled invoice also moves the order to OrderCancelled.
+func SetOrderSettled(paymentHash string, settled bool) error {
+	if DB == nil {
+		return nil
+	}
+
+	var err error
+	if settled {
+		_, err = Exec("UPDATE orders SET settled = 1, updated_at = ? WHERE payment_hash = ?", clock.Now(), paymentHash)
+	} else {
+		_, err = Exec("UPDATE orders SET state = ?, updated_at = ? WHERE payment_hash = ?", OrderCancelled, clock.Now(), paymentHash)
+	}
+	return err
+}
+
+func GetOrder(paymentHash string) (Order, error) {
+	return scanOrder(QueryRow("SELECT "+orderColumns+" FROM orders WHERE payment_hash = ?", paymentHash))
+}
+
+func GetOrderByPaymentRequest(paymentRequest string) (Order, error) {
+	return scanOrder(QueryRow("SELECT "+orderColumns+" FROM orders WHERE payment_request = ?", paymentRequest))
+}
+
+// OrdersByHashPrefix returns up to limit orders whose payment hash starts
+// with prefix, a lowercase hex string.
+func OrdersByHashPrefix(prefix string, limit int) ([]Order, error) {
+	// hashes starting with prefix sort before prefix followed by the letter
+	// after f, and this lets the primary key index find them
+	return queryOrders("SELECT "+orderColumns+" FROM orders WHERE payment_hash >= ? AND payment_hash < ? ORDER BY created_at DESC LIMIT ?",
+		prefix, prefix+"g", limit)
+}
+
+// ReplyMatchWindow is how long after sending the parking SMS a reply is
+// matched to it.
+const ReplyMatchWindow = 6 * time.Hour
+
+// OrderAwaitingReply finds the most recent order the operator has not replied
+// to yet. Replies with neither zone nor plate only match when a single order
+// is waiting, as there is no telling which of several they are about.
+func OrderAwaitingReply(zone, plate string, now time.Time) (Order, error) {
+	query := "SELECT " + orderColumns + " FROM orders WHERE state = ? AND reply = '' AND updated_at >= ?"
+	args := []interface{}{OrderConfirmed, now.Add(-ReplyMatchWindow)}
+	if len(zone) > 0 {
+		query += " AND zone = ? COLLATE NOCASE"
+		args = append(args, zone)
+	}
+	if len(plate) > 0 {
+		query += " AND plate = ?"
+		args = append(args, strings.ToUpper(plate))
+	}
+	if len(zone) == 0 && len(plate) == 0 {
+		orders, err := queryOrders(query+" LIMIT 2", args...)
+		if err != nil {
+			return Order{}, err
+		}
+		if len(orders) != 1 {
+			return Order{}, sql.ErrNoRows
+		}
+		return orders[0], nil
+	}
+	query += " ORDER BY updated_at DESC LIMIT 1"
+
+	return scanOrder(QueryRow(query, args...))
+}
+
+// UnansweredOrders returns the orders whose parking SMS went out in
+// [sentAfter, sentBefore) without an operator reply and followed up less than
+// followup. Orders sent before following up was introduced are left out, they
+// were never waited for.
+func UnansweredOrders(sentAfter, sentBefore time.Time, followup int) ([]Order, error) {
+	return queryOrders("SELECT "+orderColumns+" FROM orders WHERE state = ? AND reply = '' AND sms_sent_at >= ? AND sms_sent_at < ? AND reply_followup < ?"+
+		" AND sms_sent_at >= COALESCE((SELECT value FROM settings WHERE key = 'reply_followup_since'), '') ORDER BY sms_sent_at",
+		OrderConfirmed, sentAfter, sentBefore, followup)
+}
+
+// SetOrderFollowup records how far a missing operator reply was followed up.
+// It leaves updated_at alone, replies are matched to orders by it.
+func SetOrderFollowup(paymentHash string, followup int) error {
+	_, err := Exec("UPDATE orders SET reply_followup = ? WHERE payment_hash = ?", followup, paymentHash)
+	return err
+}
+
+// SetOrderReply records the operator's reply to the parking SMS.
+func SetOrderReply(paymentHash string, state OrderState, reply string, validUntil time.Time, priceEur float64) error {
+	valid := sql.NullTime{Time: validUntil, Valid: !validUntil.IsZero()}
+	_, err := Exec("UPDATE orders SET state = ?, reply = ?, valid_until = ?, operator_price_eur = ?, updated_at = ? WHERE payment_hash = ?",
+		state, reply, valid, priceEur, clock.Now(), paymentHash)
+	return err
+}
+
+// SetOrderPlate moves an order whose parking SMS was not sent yet to another
+// plate.
+func SetOrderPlate(paymentHash, plate string) error {
+	_, err := Exec("UPDATE orders SET plate = ?, updated_at = ? WHERE payment_hash = ?", strings.ToUpper(plate), clock.Now(), paymentHash)
+	return err
+}
+
+func SetOrderTag(paymentHash, tag string) error {
+	_, err := Exec("UPDATE orders SET tag = ?, updated_at = ? WHERE payment_hash = ?", tag, clock.Now(), paymentHash)
+	return err
+}
+
+func AddOrderNote(paymentHash, author, body string) error {
+	_, err := Exec("INSERT INTO order_notes (payment_hash, author, body, created_at) VALUES (?, ?, ?, ?)",
+		paymentHash, author, body, clock.Now())
+	return err
+}
+
+func OrderNotes(paymentHash string) ([]OrderNote, error) {
+	rows, err := Query("SELECT author, body, created_at FROM order_notes WHERE payment_hash = ? ORDER BY created_at", paymentHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notes []OrderNote
+	for rows.Next() {
+		var n OrderNote
+		err = rows.Scan(&n.Author, &n.Body, &n.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		notes = append(notes, n)
+	}
+	return notes, rows.Err()
+}
+
+// RecordSmsAttempt counts a parking SMS send attempt and sets the order state
+// from its outcome.
+func RecordSmsAttempt(paymentHash string, sendErr error) error {
+	if DB == nil {
+		return nil
+	}
+
+	now := clock.Now()
+	if sendErr != nil {
+		_, err := Exec("UPDATE orders SET state = ?, sms_attempts = sms_attempts + 1, sms_error = ?, updated_at = ? WHERE payment_hash = ?",
+			OrderSmsFailed, sendErr.Error(), now, paymentHash)
+		return err
+	}
+
+	_, err := Exec("UPDATE orders SET state = ?, sms_attempts = sms_attempts + 1, sms_error = '', sms_sent_at = COALESCE(sms_sent_at, ?), updated_at = ? WHERE payment_hash = ?",
+		OrderConfirmed, now, now, paymentHash)
+	return err
+}
+
+// PendingOrders returns unpaid orders whose invoice has not expired yet.
+func PendingOrders(now time.Time) ([]Order, error) {
+	return queryOrders("SELECT "+orderColumns+" FROM orders WHERE state = ? AND expires_at > ?", OrderPending, now.Unix())
+}
+
+// UndispatchedOrders returns orders paid since paidSince whose parking SMS
+// was never sent successfully.
+func UndispatchedOrders(paidSince time.Time) ([]Order, error) {
+	return queryOrders("SELECT "+orderColumns+" FROM orders WHERE state IN (?, ?) AND paid_at >= ? ORDER BY created_at",
+		OrderPaid, OrderSmsFailed, paidSince)
+}
+
+// HeldOrders returns orders whose hold invoice was paid but neither settled
+// nor cancelled yet.
+func HeldOrders() ([]Order, error) {
+	return queryOrders("SELECT "+orderColumns+" FROM orders WHERE preimage != '' AND settled = 0 AND state NOT IN (?, ?, ?) ORDER BY created_at",
+		OrderPending, OrderExpired, OrderCancelled)
+}
+
+// OrdersSince returns the orders created since a time, oldest first.
+func OrdersSince(since time.Time) ([]Order, error) {
+	return queryOrders("SELECT "+orderColumns+" FROM orders WHERE created_at >= ? ORDER BY created_at", since)
+}
+
+// HourlyPurchases is the orders of a product in a zone created within an
+// hour.
+type HourlyPurchases struct {
+	Hour      time.Time
+	Zone      string
+	Product   string
+	Purchases int
+	Eur       float64
+	Sats      int64
+}
+
+// PurchasesByHour sums the orders in states, hold invoices only once
+// settled, by the UTC hour they were created in, zone and product, oldest
+// first. Orders of zone exclude are left out.
+func PurchasesByHour(states []OrderState, exclude string) ([]HourlyPurchases, error) {
+	if len(states) == 0 {
+		return nil, nil
+	}
+
+	args := make([]interface{}, 0, len(states)+1)
+	for _, s := range states {
+		args = append(args, s)
+	}
+	args = append(args, exclude)
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(states)), ", ")
+	rows, err := Query(`SELECT strftime('%Y-%m-%dT%H:00:00Z', created_at) AS hour, zone, product, COUNT(*), SUM(eur), SUM(sats)
+		FROM orders WHERE state IN (`+placeholders+`) AND (preimage = '' OR settled) AND zone != ?
+		GROUP BY hour, zone, product ORDER BY hour, zone, product`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hours []HourlyPurchases
+	for rows.Next() {
+		var h HourlyPurchases
+		var hour string
+		err = rows.Scan(&hour, &h.Zone, &h.Product, &h.Purchases, &h.Eur, &h.Sats)
+		if err != nil {
+			return nil, err
+		}
+		h.Hour, err = time.Parse(time.RFC3339, hour)
+		if err != nil {
+			return nil, err
+		}
+		hours = append(hours, h)
+	}
+	return hours, rows.Err()
+}
+
+// UnconfirmedOrders returns the orders created in [from, to) that were paid
+// but never got their parking SMS through.
+func UnconfirmedOrders(from, to time.Time) ([]Order, error) {
+	return queryOrders("SELECT "+orderColumns+" FROM orders WHERE state IN (?, ?) AND created_at >= ? AND created_at < ? ORDER BY created_at",
+		OrderPaid, OrderSmsFailed, from, to)
+}
+
+func queryOrders(query string, args ...interface{}) ([]Order, error) {
+	rows, err := Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orders []Order
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	return orders, rows.Err()
+}
+
+// OrderFilter selects orders in the admin session browser. Empty fields
+// don't filter.
+type OrderFilter struct {
+	// Reference is the start of the payment hash, see Order.Reference.
+	Reference string
+	// Plate is any part of the plate, support often only has a fragment.
+	Plate string
+	Zone  string
+	State OrderState
+	Tag   string
+	From  time.Time
+	To    time.Time
+	Page  int
+}
+
+const OrdersPerPage = 50
+
+// SearchOrders returns one page of matching orders, newest first, and whether
+// there are more.
+func SearchOrders(f OrderFilter) ([]Order, bool, error) {
+	var where []string
+	var args []interface{}
+
+	if len(f.Reference) > 0 {
+		where = append(where, "substr(payment_hash, 1, ?) = ?")
+		args = append(args, len(f.Reference), strings.ToLower(f.Reference))
+	}
+	if len(f.Plate) > 0 {
+		// a fragment can't use orders_plate, the other filters and the
+		// page narrow the scan
+		where = append(where, "instr(plate, ?) > 0")
+		args = append(args, strings.ToUpper(f.Plate))
+	}
+	if len(f.Zone) > 0 {
+		where = append(where, "zone = ?")
+		args = append(args, f.Zone)
+	}
+	if len(f.State) > 0 {
+		where = append(where, "state = ?")
+		args = append(args, f.State)
+	}
+	if len(f.Tag) > 0 {
+		where = append(where, "tag = ?")
+		args = append(args, f.Tag)
+	}
+	if !f.From.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, f.From)
+	}
+	if !f.To.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, f.To)
+	}
+
+	query := "SELECT " + orderColumns + " FROM orders"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY created_at DESC LIMIT ? OFFSET ?"
+	args = append(args, OrdersPerPage+1, f.Page*OrdersPerPage)
+
+	orders, err := queryOrders(query, args...)
+	if err != nil {
+		return nil, false, err
+	}
+
+	more := len(orders) > OrdersPerPage
+	if more {
+		orders = orders[:OrdersPerPage]
+	}
+	return orders, more, nil
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanOrder(row scanner) (Order, error) {
+	var o Order
+	err := row.Scan(&o.PaymentHash, &o.PaymentRequest, &o.Zone, &o.Plate, &o.Hours, &o.Sats, &o.Eur, &o.State, &o.Tag, &o.CreatedAt, &o.UpdatedAt,
+		&o.ExpiresAt, &o.Receipt, &o.SmsAttempts, &o.SmsError, &o.Reply, &o.ValidUntil, &o.OperatorPriceEur, &o.Preimage, &o.Settled, &o.Product,
+		&o.PaidAt, &o.SmsSentAt, &o.AmtPaidSat, &o.OverpaymentRefunded, &o.ReplyFollowup)
+	return o, err
+}
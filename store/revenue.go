@@ -0,0 +1,218 @@
+package store
+
+import (
+	"errors"
+	"ljightningparking/clock"
+	"ljightningparking/money"
+	"strings"
+	"time"
+)
+
+// RevenueShare is what a revenue share recipient, like the owner of a private
+// lot, is owed for a settled payment.
+type RevenueShare struct {
+	PaymentHash string
+	Recipient   string
+	Zone        string
+	Eur         money.Cents
+	Sats        int64
+	SettledAt   time.Time
+	// Delivered is set once the recipient's webhook accepted the settlement.
+	Delivered bool
+	Attempts  int
+	LastError string
+	// Batch is the payout batch the share was paid in, 0 until then.
+	Batch int64
+	// Reversal takes back the share of a refunded payment, with negative
+	// amounts.
+	Reversal bool
+}
+
+const revenueShareColumns = "payment_hash, recipient, zone, eur_cents, sats, settled_at, delivered, attempts, last_error, batch, reversal"
+
+// InsertRevenueShare stores a share unless the payment's share for the
+// recipient was stored already.
+func InsertRevenueShare(s RevenueShare) error {
+	if DB == nil {
+		return nil
+	}
+
+	_, err := Exec("INSERT OR IGNORE INTO revenue_shares ("+revenueShareColumns+") VALUES (?, ?, ?, ?, ?, ?, 0, 0, '', 0, 0)",
+		s.PaymentHash, s.Recipient, s.Zone, int64(s.Eur), s.Sats, s.SettledAt)
+	return err
+}
+
+// UndeliveredShares returns the shares of recipients whose webhook has not
+// gone through after fewer than maxAttempts, oldest first.
+func UndeliveredShares(recipients []string, maxAttempts, limit int) ([]RevenueShare, error) {
+	if len(recipients) == 0 {
+		return nil, nil
+	}
+
+	args := make([]interface{}, 0, len(recipients)+2)
+	for _, r := range recipients {
+		args = append(args, r)
+	}
+	args = append(args, maxAttempts, limit)
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(recipients)), ", ")
+	return queryRevenueShares("SELECT "+revenueShareColumns+" FROM revenue_shares WHERE recipient IN ("+placeholders+") AND delivered = 0 AND attempts < ? ORDER BY settled_at LIMIT ?",
+		args...)
+}
+
+// ReverseRevenueShares takes back the shares of a refunded payment, adding a
+// negative share for each, and returns how many were reversed.
+func ReverseRevenueShares(paymentHash string) (int64, error) {
+	result, err := Exec(`INSERT OR IGNORE INTO revenue_shares (`+revenueShareColumns+`)
+		SELECT payment_hash, recipient, zone, -eur_cents, -sats, ?, 0, 0, '', 0, 1 FROM revenue_shares WHERE payment_hash = ? AND reversal = 0`,
+		clock.Now(), paymentHash)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// RecordShareDelivery records an attempt at delivering a share's webhook.
+func RecordShareDelivery(paymentHash, recipient string, reversal bool, deliveryErr error) error {
+	if deliveryErr != nil {
+		_, err := Exec("UPDATE revenue_shares SET attempts = attempts + 1, last_error = ? WHERE payment_hash = ? AND recipient = ? AND reversal = ?",
+			deliveryErr.Error(), paymentHash, recipient, reversal)
+		return err
+	}
+	_, err := Exec("UPDATE revenue_shares SET delivered = 1, attempts = attempts + 1, last_error = '' WHERE payment_hash = ? AND recipient = ? AND reversal = ?",
+		paymentHash, recipient, reversal)
+	return err
+}
+
+// BatchShares returns the shares paid in a payout batch.
+func BatchShares(batch int64) ([]RevenueShare, error) {
+	return queryRevenueShares("SELECT "+revenueShareColumns+" FROM revenue_shares WHERE batch = ? ORDER BY settled_at", batch)
+}
+
+func queryRevenueShares(query string, args ...interface{}) ([]RevenueShare, error) {
+	rows, err := Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var shares []RevenueShare
+	for rows.Next() {
+		var s RevenueShare
+		var cents int64
+		err = rows.Scan(&s.PaymentHash, &s.Recipient, &s.Zone, &cents, &s.Sats, &s.SettledAt, &s.Delivered, &s.Attempts, &s.LastError, &s.Batch, &s.Reversal)
+		if err != nil {
+			return nil, err
+		}
+		s.Eur = money.Cents(cents)
+		shares = append(shares, s)
+	}
+	return shares, rows.Err()
+}
+
+// PayoutBatch is what a recipient was paid at once for their shares.
+type PayoutBatch struct {
+	ID        int64
+	Recipient string
+	Eur       money.Cents
+	Sats      int64
+	Shares    int
+	CreatedBy string
+	CreatedAt time.Time
+}
+
+// UnpaidShares totals the shares of each recipient not paid in a batch yet.
+func UnpaidShares() ([]PayoutBatch, error) {
+	rows, err := Query("SELECT recipient, SUM(eur_cents), SUM(sats), COUNT(*) FROM revenue_shares WHERE batch = 0 GROUP BY recipient ORDER BY recipient")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var totals []PayoutBatch
+	for rows.Next() {
+		var t PayoutBatch
+		var cents int64
+		err = rows.Scan(&t.Recipient, &cents, &t.Sats, &t.Shares)
+		if err != nil {
+			return nil, err
+		}
+		t.Eur = money.Cents(cents)
+		totals = append(totals, t)
+	}
+	return totals, rows.Err()
+}
+
+// ErrNoShares is returned for a payout batch of a recipient owed nothing.
+var ErrNoShares = errors.New("the recipient has no unpaid shares")
+
+// CreatePayoutBatch puts a recipient's unpaid shares in a new batch.
+func CreatePayoutBatch(recipient, admin string) (PayoutBatch, error) {
+	var id int64
+	err := Transaction(func(tx *Tx) error {
+		var unpaid int
+		err := tx.QueryRow("SELECT COUNT(*) FROM revenue_shares WHERE recipient = ? AND batch = 0", recipient).Scan(&unpaid)
+		if err != nil {
+			return err
+		}
+		if unpaid == 0 {
+			return ErrNoShares
+		}
+
+		result, err := tx.Exec("INSERT INTO payout_batches (recipient, created_by, created_at) VALUES (?, ?, ?)", recipient, admin, clock.Now())
+		if err != nil {
+			return err
+		}
+		id, err = result.LastInsertId()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE revenue_shares SET batch = ? WHERE recipient = ? AND batch = 0", id, recipient)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE payout_batches SET
+			eur_cents = (SELECT COALESCE(SUM(eur_cents), 0) FROM revenue_shares WHERE batch = ?),
+			sats = (SELECT COALESCE(SUM(sats), 0) FROM revenue_shares WHERE batch = ?),
+			shares = (SELECT COUNT(*) FROM revenue_shares WHERE batch = ?)
+			WHERE id = ?`, id, id, id, id)
+		return err
+	})
+	if err != nil {
+		return PayoutBatch{}, err
+	}
+
+	batches, err := queryPayoutBatches("SELECT "+payoutBatchColumns+" FROM payout_batches WHERE id = ?", id)
+	if err != nil || len(batches) == 0 {
+		return PayoutBatch{ID: id, Recipient: recipient}, err
+	}
+	return batches[0], nil
+}
+
+const payoutBatchColumns = "id, recipient, eur_cents, sats, shares, created_by, created_at"
+
+// PayoutBatches returns the latest payout batches, newest first.
+func PayoutBatches(limit int) ([]PayoutBatch, error) {
+	return queryPayoutBatches("SELECT "+payoutBatchColumns+" FROM payout_batches ORDER BY id DESC LIMIT ?", limit)
+}
+
+func queryPayoutBatches(query string, args ...interface{}) ([]PayoutBatch, error) {
+	rows, err := Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var batches []PayoutBatch
+	for rows.Next() {
+		var b PayoutBatch
+		var cents int64
+		err = rows.Scan(&b.ID, &b.Recipient, &cents, &b.Sats, &b.Shares, &b.CreatedBy, &b.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		b.Eur = money.Cents(cents)
+		batches = append(batches, b)
+	}
+	return batches, rows.Err()
+}
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"database/sql"
+	"ljightningparking/clock"
+	"strings"
+	"time"
+)
+
+// ParkingSession is the continuous parking of a plate in a zone, possibly
+// bought with several orders extending each other.
+type ParkingSession struct {
+	Plate     string
+	Zone      string
+	StartedAt time.Time
+	PaidUntil time.Time
+	// Hours is the parking time bought since StartedAt.
+	Hours float64
+}
+
+// Active reports whether the session's parking has not run out at now.
+func (s ParkingSession) Active(now time.Time) bool {
+	return s.PaidUntil.After(now)
+}
+
+// Remaining is the parking time left at now.
+func (s ParkingSession) Remaining(now time.Time) time.Duration {
+	if !s.Active(now) {
+		return 0
+	}
+	return s.PaidUntil.Sub(now)
+}
+
+const sessionColumns = "plate, zone, started_at, paid_until, hours"
+
+func scanSession(row scanner) (ParkingSession, error) {
+	var s ParkingSession
+	var startedAt, paidUntil int64
+	err := row.Scan(&s.Plate, &s.Zone, &startedAt, &paidUntil, &s.Hours)
+	s.StartedAt = time.Unix(startedAt, 0)
+	s.PaidUntil = time.Unix(paidUntil, 0)
+	return s, err
+}
+
+// GetSession returns the last parking session of a plate in a zone, active or
+// not. It returns sql.ErrNoRows if the plate never parked there.
+func GetSession(plate, zone string) (ParkingSession, error) {
+	return scanSession(QueryRow("SELECT "+sessionColumns+" FROM parking_sessions WHERE plate = ? AND zone = ?",
+		strings.ToUpper(plate), zone))
+}
+
+// ActiveSessions returns the sessions of a plate still paid for at now, the
+// soonest to run out first.
+func ActiveSessions(plate string, now time.Time) ([]ParkingSession, error) {
+	rows, err := Query("SELECT "+sessionColumns+" FROM parking_sessions WHERE plate = ? AND paid_until > ? ORDER BY paid_until",
+		strings.ToUpper(plate), now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []ParkingSession
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// SaveSession creates or replaces the session of its plate and zone. It is a
+// no-op without a database.
+func SaveSession(s ParkingSession) error {
+	if DB == nil {
+		return nil
+	}
+
+	_, err := Exec("INSERT OR REPLACE INTO parking_sessions ("+sessionColumns+", updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+		strings.ToUpper(s.Plate), s.Zone, s.StartedAt.Unix(), s.PaidUntil.Unix(), s.Hours, clock.Now())
+	return err
+}
+
+// SetSessionPaidUntil corrects when an active session runs out from the
+// operator's confirmation, which is authoritative.
+func SetSessionPaidUntil(plate, zone string, paidUntil time.Time) error {
+	if DB == nil {
+		return nil
+	}
+
+	_, err := Exec("UPDATE parking_sessions SET paid_until = ?, updated_at = ? WHERE plate = ? AND zone = ? AND paid_until > ?",
+		paidUntil.Unix(), clock.Now(), strings.ToUpper(plate), zone, clock.Now().Unix())
+	return err
+}
+
+// PruneSessions drops sessions that ran out over a day ago.
+func PruneSessions(db *sql.DB, now time.Time) (int64, error) {
+	result, err := execLocked(db, "DELETE FROM parking_sessions WHERE paid_until < ?", now.Add(-24*time.Hour).Unix())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,30 @@
+package store
+
+import "database/sql"
+
+// GetSetting returns a persisted service setting, or def if it was never set
+// or there is no database.
+func GetSetting(key, def string) (string, error) {
+	if DB == nil {
+		return def, nil
+	}
+
+	var value string
+	err := QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return def, nil
+	}
+	if err != nil {
+		return def, err
+	}
+	return value, nil
+}
+
+func SetSetting(key, value string) error {
+	if DB == nil {
+		return nil
+	}
+
+	_, err := Exec("INSERT INTO settings (key, value) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET value = excluded.value", key, value)
+	return err
+}
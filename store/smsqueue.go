@@ -0,0 +1,107 @@
+package store
+
+import (
+	"database/sql"
+	"ljightningparking/clock"
+	"time"
+)
+
+const (
+	SmsQueued = "queued"
+	SmsSent   = "sent"
+	SmsFailed = "failed"
+	// SmsCancelled SMS were withdrawn before being sent, e.g. when their
+	// order moved to another plate.
+	SmsCancelled = "cancelled"
+)
+
+// QueuedSms is an SMS waiting to be sent, or the outcome of one.
+type QueuedSms struct {
+	ID int64
+	// Ref identifies what the SMS is for, the payment hash of parking SMS.
+	Ref string
+	// To is the number the SMS goes to, empty for the parking operator.
+	To        string
+	Message   string
+	State     string
+	Attempts  int
+	LastError string
+	// NextAttemptAt and Deadline are unix times, the SMS fails once a retry
+	// would come after its deadline.
+	NextAttemptAt int64
+	Deadline      int64
+}
+
+// InsertQueuedSms stores a new queued SMS and returns its id, 0 when there is
+// no database.
+func InsertQueuedSms(q QueuedSms) (int64, error) {
+	if DB == nil {
+		return 0, nil
+	}
+
+	now := clock.Now()
+	result, err := Exec("INSERT INTO sms_queue (ref, recipient, message, state, attempts, last_error, next_attempt_at, deadline, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		q.Ref, q.To, q.Message, q.State, q.Attempts, q.LastError, q.NextAttemptAt, q.Deadline, now, now)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func UpdateQueuedSms(q QueuedSms) error {
+	if DB == nil || q.ID == 0 {
+		return nil
+	}
+
+	_, err := Exec("UPDATE sms_queue SET state = ?, attempts = ?, last_error = ?, next_attempt_at = ?, updated_at = ? WHERE id = ?",
+		q.State, q.Attempts, q.LastError, q.NextAttemptAt, clock.Now(), q.ID)
+	return err
+}
+
+// SmsState returns the state of the latest SMS queued for ref, "" if there is
+// none.
+func SmsState(ref string) (string, error) {
+	if DB == nil {
+		return "", nil
+	}
+
+	var state string
+	err := QueryRow("SELECT state FROM sms_queue WHERE ref = ? ORDER BY id DESC LIMIT 1", ref).Scan(&state)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return state, err
+}
+
+// QueuedSmsList returns the SMS still waiting to be sent.
+func QueuedSmsList() ([]QueuedSms, error) {
+	if DB == nil {
+		return nil, nil
+	}
+
+	rows, err := Query("SELECT id, ref, recipient, message, state, attempts, last_error, next_attempt_at, deadline FROM sms_queue WHERE state = ? ORDER BY id", SmsQueued)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var queued []QueuedSms
+	for rows.Next() {
+		var q QueuedSms
+		err = rows.Scan(&q.ID, &q.Ref, &q.To, &q.Message, &q.State, &q.Attempts, &q.LastError, &q.NextAttemptAt, &q.Deadline)
+		if err != nil {
+			return nil, err
+		}
+		queued = append(queued, q)
+	}
+	return queued, rows.Err()
+}
+
+// PruneSmsQueue deletes SMS that were sent or failed over a month ago.
+func PruneSmsQueue(db *sql.DB, now time.Time) (int64, error) {
+	result, err := execLocked(db, "DELETE FROM sms_queue WHERE state != ? AND updated_at < ?", SmsQueued, now.AddDate(0, -1, 0))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,174 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// DB is the service's sqlite database, nil when no database is configured.
+var DB *sql.DB
+
+// Options are the sqlite connection settings.
+type Options struct {
+	// WAL lets reads go on while a write is in progress.
+	WAL bool
+	// BusyTimeout is how long a connection waits for a lock before failing
+	// with "database is locked".
+	BusyTimeout time.Duration
+}
+
+var DefaultOptions = Options{WAL: true, BusyTimeout: 5 * time.Second}
+
+// writer serializes writes, as sqlite allows one writer at a time and
+// concurrent ones would otherwise fail once the busy timeout runs out.
+var writer sync.Mutex
+
+// Open opens the sqlite database at path and brings its schema up to date.
+// Foreign keys are always enforced.
+func Open(path string, options Options) error {
+	params := url.Values{
+		"_foreign_keys": {"on"},
+		"_busy_timeout": {fmt.Sprint(options.BusyTimeout.Milliseconds())},
+		"_txlock":       {"immediate"},
+		// stored times are UTC, they are read back in local time
+		"_loc": {"auto"},
+	}
+	if options.WAL {
+		params.Set("_journal_mode", "WAL")
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return err
+	}
+
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	err = migrate(db)
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	DB = db
+	return nil
+}
+
+// Exec runs a statement that writes to the database, one at a time.
+func Exec(query string, args ...interface{}) (sql.Result, error) {
+	writer.Lock()
+	defer writer.Unlock()
+
+	return execLocked(DB, query, args...)
+}
+
+// Serialized runs fn while no other write is going on, for work that writes
+// through DB directly, like maintenance.
+func Serialized(fn func() error) error {
+	writer.Lock()
+	defer writer.Unlock()
+
+	return fn()
+}
+
+// Ping checks the database answers queries.
+func Ping() error {
+	var one int
+	return DB.QueryRow("SELECT 1").Scan(&one)
+}
+
+// Close checkpoints the write-ahead log into the database file and closes
+// it, waiting for a write in progress to finish. Later queries fail.
+func Close() error {
+	if DB == nil {
+		return nil
+	}
+
+	writer.Lock()
+	defer writer.Unlock()
+
+	_, err := DB.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	if err != nil {
+		DB.Close()
+		return fmt.Errorf("checkpoint: %s", err)
+	}
+	return DB.Close()
+}
+
+// LatestSchemaVersion is the schema version migrate brings databases to.
+func LatestSchemaVersion() int {
+	return len(migrations)
+}
+
+// SchemaVersion returns how many migrations the database at path has, without
+// applying any.
+func SchemaVersion(path string) (int, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var version int
+	err = db.QueryRow("PRAGMA user_version").Scan(&version)
+	return version, err
+}
+
+// CopyDatabase writes a consistent copy of the database at path to dest,
+// opening it read-only so its schema is left as it is, while the service may
+// be using it.
+func CopyDatabase(path, dest string) error {
+	params := url.Values{
+		"mode":          {"ro"},
+		"_busy_timeout": {fmt.Sprint(DefaultOptions.BusyTimeout.Milliseconds())},
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?"+params.Encode())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec("VACUUM INTO ?", dest)
+	return err
+}
+
+// migrate applies the migrations newer than the database's user_version.
+func migrate(db *sql.DB) error {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(migrations[i])
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %s", i+1, err)
+		}
+		_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"database/sql"
+	"ljightningparking/clock"
+	"time"
+)
+
+// Steps of a purchase in the test zone, recorded to tell how far an end to
+// end check of production got.
+const (
+	TestInvoiced  = "invoice_created"
+	TestPaid      = "paid"
+	TestSmsSent   = "sms_sent"
+	TestSmsFailed = "sms_failed"
+	TestReplied   = "reply_parsed"
+	TestSettled   = "settled"
+)
+
+// TestSteps is the order the steps of a successful test run happen in. Held
+// payments settle on the reply when settling on replies.
+var TestSteps = []string{TestInvoiced, TestPaid, TestSmsSent, TestReplied, TestSettled}
+
+type TestStep struct {
+	Step      string
+	Detail    string
+	CreatedAt time.Time
+}
+
+// TestRun is a purchase in the test zone and the steps it went through.
+type TestRun struct {
+	PaymentHash string
+	Steps       []TestStep
+}
+
+// Reached returns the time step was recorded, zero if it wasn't.
+func (r TestRun) Reached(step string) time.Time {
+	for _, s := range r.Steps {
+		if s.Step == step {
+			return s.CreatedAt
+		}
+	}
+	return time.Time{}
+}
+
+// Last is the latest step the run got to.
+func (r TestRun) Last() TestStep {
+	if len(r.Steps) == 0 {
+		return TestStep{}
+	}
+	return r.Steps[len(r.Steps)-1]
+}
+
+// Passed reports whether the run went through every step.
+func (r TestRun) Passed() bool {
+	for _, step := range TestSteps {
+		if r.Reached(step).IsZero() {
+			return false
+		}
+	}
+	return true
+}
+
+// RecordTestStep records a step of a test zone purchase. It is a no-op
+// without a database.
+func RecordTestStep(paymentHash, step, detail string) error {
+	if DB == nil {
+		return nil
+	}
+
+	_, err := Exec("INSERT INTO test_steps (payment_hash, step, detail, created_at) VALUES (?, ?, ?, ?)",
+		paymentHash, step, detail, clock.Now())
+	return err
+}
+
+// TestRuns returns the latest test zone purchases, newest first.
+func TestRuns(limit int) ([]TestRun, error) {
+	rows, err := Query(`SELECT payment_hash, step, detail, created_at FROM test_steps
+		WHERE payment_hash IN (SELECT payment_hash FROM test_steps GROUP BY payment_hash ORDER BY MIN(id) DESC LIMIT ?)
+		ORDER BY id`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []TestRun
+	index := make(map[string]int)
+	for rows.Next() {
+		var paymentHash string
+		var s TestStep
+		err = rows.Scan(&paymentHash, &s.Step, &s.Detail, &s.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		i, ok := index[paymentHash]
+		if !ok {
+			i = len(runs)
+			index[paymentHash] = i
+			runs = append(runs, TestRun{PaymentHash: paymentHash})
+		}
+		runs[i].Steps = append(runs[i].Steps, s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// newest first
+	for i, j := 0, len(runs)-1; i < j; i, j = i+1, j-1 {
+		runs[i], runs[j] = runs[j], runs[i]
+	}
+	return runs, nil
+}
+
+// PruneTestSteps drops test runs older than 90 days.
+func PruneTestSteps(db *sql.DB, now time.Time) (int64, error) {
+	result, err := execLocked(db, "DELETE FROM test_steps WHERE created_at < ?", now.AddDate(0, 0, -90))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,52 @@
+package store
+
+import (
+	"database/sql"
+	"time"
+)
+
+// timeLayout is how TIMESTAMP columns are stored: RFC 3339 in UTC with a
+// fixed number of digits, so they compare correctly as text in queries.
+const timeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// Timestamp formats t the way TIMESTAMP columns are stored.
+func Timestamp(t time.Time) string {
+	return t.UTC().Format(timeLayout)
+}
+
+// normalize converts time arguments to their stored form. The driver would
+// otherwise store them in their own time zone, which breaks comparing them.
+func normalize(args []interface{}) []interface{} {
+	normalized := args
+	for i, a := range args {
+		var value interface{}
+		switch a := a.(type) {
+		case time.Time:
+			value = Timestamp(a)
+		case sql.NullTime:
+			if a.Valid {
+				value = Timestamp(a.Time)
+			}
+		default:
+			continue
+		}
+
+		// the caller's slice is left alone
+		if &normalized[0] == &args[0] {
+			normalized = append([]interface{}(nil), args...)
+		}
+		normalized[i] = value
+	}
+	return normalized
+}
+
+// Query runs a query with its time arguments in their stored form.
+func Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return DB.Query(query, normalize(args)...)
+}
+
+// QueryRow runs a query returning one row with its time arguments in their
+// stored form.
+func QueryRow(query string, args ...interface{}) *sql.Row {
+	return DB.QueryRow(query, normalize(args)...)
+}
@@ -0,0 +1,96 @@
+package theme
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+type Link struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// Theme is the look of the public pages, so the service can be run under an
+// operator's own brand.
+type Theme struct {
+	// Name is the operator or service name shown in the header and titles.
+	Name    string `json:"name"`
+	LogoURL string `json:"logo_url,omitempty"`
+	// PrimaryColor is a #rrggbb color for buttons and links.
+	PrimaryColor string `json:"primary_color,omitempty"`
+	FooterLinks  []Link `json:"footer_links,omitempty"`
+}
+
+var Default = Theme{Name: "ljightning parking"}
+
+// hosts holds the themes of tenants served from their own host names.
+var hosts = map[string]Theme{}
+
+var colorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// Load reads the default theme and optional per host themes from a json file
+// like {"default": {...}, "hosts": {"parking.example.com": {...}}}.
+func Load(filename string) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	var config struct {
+		Default Theme            `json:"default"`
+		Hosts   map[string]Theme `json:"hosts"`
+	}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return err
+	}
+
+	err = config.Default.validate()
+	if err != nil {
+		return fmt.Errorf("default theme: %w", err)
+	}
+	loaded := make(map[string]Theme, len(config.Hosts))
+	for host, t := range config.Hosts {
+		err = t.validate()
+		if err != nil {
+			return fmt.Errorf("theme for %s: %w", host, err)
+		}
+		loaded[strings.ToLower(host)] = t
+	}
+
+	Default, hosts = config.Default, loaded
+	return nil
+}
+
+func (t Theme) validate() error {
+	if len(t.Name) == 0 {
+		return fmt.Errorf("missing name")
+	}
+	if len(t.PrimaryColor) > 0 && !colorPattern.MatchString(t.PrimaryColor) {
+		return fmt.Errorf("primary_color %q is not a #rrggbb color", t.PrimaryColor)
+	}
+	return nil
+}
+
+// For returns the theme of the host a request was made to.
+func For(r *http.Request) Theme {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if t, ok := hosts[strings.ToLower(host)]; ok {
+		return t
+	}
+	return Default
+}
+
+// Color returns the validated primary color for use in a stylesheet.
+func (t Theme) Color() template.CSS {
+	return template.CSS(t.PrimaryColor)
+}
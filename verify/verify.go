@@ -0,0 +1,160 @@
+package verify
+
+import (
+	"ljightningparking/clock"
+	"sync"
+	"time"
+)
+
+// Threshold is how many invoices one IP may create per hour before it has to
+// prove it is a real wallet user by paying a 1 sat invoice. Zero disables it.
+var Threshold = 0
+
+const (
+	window = time.Hour
+	// DepositSats is the verification amount, credited back on the next purchase.
+	DepositSats = 1
+)
+
+type client struct {
+	created  []time.Time
+	verified time.Time
+	credit   int64
+}
+
+// reservation is credit applied to an invoice that is not paid yet.
+type reservation struct {
+	ip      string
+	sats    int64
+	expires time.Time
+}
+
+var clients = struct {
+	byIP map[string]*client
+	// reserved is by the payment hash of the invoice the credit went to.
+	reserved map[string]reservation
+	sync.Mutex
+}{byIP: make(map[string]*client), reserved: make(map[string]reservation)}
+
+func get(ip string, now time.Time) *client {
+	c, ok := clients.byIP[ip]
+	if !ok {
+		c = &client{}
+		clients.byIP[ip] = c
+	}
+
+	recent := c.created[:0]
+	for _, t := range c.created {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	c.created = recent
+
+	return c
+}
+
+// Required reports whether ip has to pay the verification deposit before it
+// can create another invoice.
+func Required(ip string) bool {
+	if Threshold <= 0 {
+		return false
+	}
+
+	clients.Lock()
+	defer clients.Unlock()
+
+	now := clock.Now()
+	c := get(ip, now)
+	return len(c.created) >= Threshold && now.Sub(c.verified) >= window
+}
+
+// Created counts an invoice created for ip.
+func Created(ip string) {
+	if Threshold <= 0 {
+		return
+	}
+
+	clients.Lock()
+	defer clients.Unlock()
+
+	now := clock.Now()
+	c := get(ip, now)
+	c.created = append(c.created, now)
+
+	prune(now)
+}
+
+// Paid marks ip as verified for the next hour and credits the deposit.
+func Paid(ip string) {
+	clients.Lock()
+	defer clients.Unlock()
+
+	c := get(ip, clock.Now())
+	c.verified = clock.Now()
+	c.credit += DepositSats
+}
+
+// Credit returns the deposit ip has paid and not yet used, nor applied to
+// an invoice that can still be paid.
+func Credit(ip string) int64 {
+	clients.Lock()
+	defer clients.Unlock()
+
+	c, ok := clients.byIP[ip]
+	if !ok {
+		return 0
+	}
+	credit := c.credit
+	now := clock.Now()
+	for _, r := range clients.reserved {
+		if r.ip == ip && now.Before(r.expires) {
+			credit -= r.sats
+		}
+	}
+	if credit < 0 {
+		return 0
+	}
+	return credit
+}
+
+// Reserve applies sats of ip's credit to the invoice with paymentHash until
+// it expires. The credit is only used up once the invoice is paid, see
+// Spend.
+func Reserve(ip, paymentHash string, sats int64, expires time.Time) {
+	clients.Lock()
+	defer clients.Unlock()
+
+	clients.reserved[paymentHash] = reservation{ip, sats, expires}
+	prune(clock.Now())
+}
+
+// Spend uses up the credit reserved for an invoice that was paid.
+func Spend(paymentHash string) {
+	clients.Lock()
+	defer clients.Unlock()
+
+	r, ok := clients.reserved[paymentHash]
+	if !ok {
+		return
+	}
+	delete(clients.reserved, paymentHash)
+	if c, ok := clients.byIP[r.ip]; ok && c.credit >= r.sats {
+		c.credit -= r.sats
+	}
+}
+
+// prune forgets clients without recent activity or unused credit, and the
+// reservations of invoices that expired unpaid.
+func prune(now time.Time) {
+	for hash, r := range clients.reserved {
+		if !now.Before(r.expires) {
+			delete(clients.reserved, hash)
+		}
+	}
+	for ip, c := range clients.byIP {
+		if len(c.created) == 0 && c.credit == 0 && now.Sub(c.verified) >= window {
+			delete(clients.byIP, ip)
+		}
+	}
+}
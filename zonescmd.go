@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"ljightningparking/parking"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// runZones handles the zones subcommands.
+func runZones(args []string) {
+	if len(args) == 0 || args[0] != "import" {
+		log.Fatalf("usage: zones import -source <url or file> -zones <zones file>")
+	}
+	runZonesImport(args[1:])
+}
+
+// runZonesImport maps the city's parking zone open data to a zones file,
+// showing how it differs from the current zones before writing it.
+func runZonesImport(args []string) {
+	fs := flag.NewFlagSet("zones import", flag.ExitOnError)
+	source := fs.String("source", "", "url or path of the city's parking zone open data, as GeoJSON")
+	zonesPath := fs.String("zones", "zones.json", "zones file to write, compared against the built in zones when missing")
+	yes := fs.Bool("yes", false, "write the zones file without asking")
+	fs.Parse(args)
+
+	if len(*source) == 0 {
+		log.Fatalf("missing -source")
+	}
+
+	data, err := readSource(*source)
+	if err != nil {
+		log.Fatalf("error reading %s: %s", *source, err)
+	}
+
+	imported, err := parking.ImportOpenData(data)
+	if err != nil {
+		log.Fatalf("error mapping open data: %s", err)
+	}
+
+	if _, err := os.Stat(*zonesPath); err == nil {
+		parking.ZonesFile = *zonesPath
+		_, err = parking.ReloadZones()
+		if err != nil {
+			log.Fatalf("error loading current zones: %s", err)
+		}
+	}
+
+	diff, err := parking.DiffZones(imported)
+	if err != nil {
+		log.Fatalf("error comparing zones: %s", err)
+	}
+	if len(diff) == 0 {
+		fmt.Println("zones are up to date")
+		return
+	}
+	for _, line := range diff {
+		fmt.Println(line)
+	}
+
+	if !*yes {
+		fmt.Printf("Write %s? [y/N] ", *zonesPath)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+			return
+		}
+	}
+
+	err = ioutil.WriteFile(*zonesPath, append(imported, '\n'), 0644)
+	if err != nil {
+		log.Fatalf("error writing %s: %s", *zonesPath, err)
+	}
+	fmt.Printf("wrote %s, send SIGHUP to reload a running server\n", *zonesPath)
+}
+
+func readSource(source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return ioutil.ReadFile(source)
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}